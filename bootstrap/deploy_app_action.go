@@ -46,6 +46,9 @@ func interpolateRelease(s *State, r *ct.Release) {
 		for i, v := range proc.Cmd {
 			proc.Cmd[i] = interpolate(s, v)
 		}
+		for i, v := range proc.Args {
+			proc.Args[i] = interpolate(s, v)
+		}
 	}
 }
 
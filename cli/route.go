@@ -17,7 +17,7 @@ import (
 func init() {
 	register("route", runRoute, `
 usage: flynn route
-       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] <domain>
+       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] [-m <page>] <domain>
        flynn route add tcp [-s <service>]
        flynn route remove <id>
 
@@ -28,6 +28,7 @@ Options:
    -c, --tls-cert <tls-cert>  path to PEM encoded certificate for TLS, - for stdin (http only)
    -k, --tls-key <tls-key>    path to PEM encoded private key for TLS, - for stdin (http only)
    --sticky                   enable cookie-based sticky routing (http only)
+   -m, --maintenance-page <page>  HTML page served while the service has no instances (http only)
 
 Commands:
    With no arguments, shows a list of routes.
@@ -137,12 +138,23 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 		return errors.New("Both the TLS certificate AND private key need to be specified")
 	}
 
+	var maintenancePage []byte
+	if path := args.String["--maintenance-page"]; path != "" {
+		var err error
+		maintenancePage, err = ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read maintenance page: %s", err)
+		}
+	}
+
 	hr := &router.HTTPRoute{
 		Service: service,
 		Domain:  args.String["<domain>"],
 		TLSCert: string(tlsCert),
 		TLSKey:  string(tlsKey),
 		Sticky:  args.Bool["sticky"],
+
+		MaintenancePage: string(maintenancePage),
 	}
 	route := hr.ToRoute()
 	if err := client.CreateRoute(mustApp(), route); err != nil {
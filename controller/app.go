@@ -1,14 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"regexp"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/controller/name"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/random"
 	routerc "github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
@@ -29,9 +32,19 @@ var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
 
 func (r *AppRepo) Add(data interface{}) error {
 	app := data.(*ct.App)
+	if err := r.insert(r.db, app); err != nil {
+		return err
+	}
+	r.addDefaultRoute(app)
+	return nil
+}
+
+// insert validates and inserts a new app using db, which may be a
+// transaction.
+func (r *AppRepo) insert(db rowQueryer, app *ct.App) error {
 	if app.Name == "" {
 		var nameID uint32
-		if err := r.db.QueryRow("SELECT nextval('name_ids')").Scan(&nameID); err != nil {
+		if err := db.QueryRow("SELECT nextval('name_ids')").Scan(&nameID); err != nil {
 			return err
 		}
 		app.Name = name.Get(nameID)
@@ -39,6 +52,10 @@ func (r *AppRepo) Add(data interface{}) error {
 	if len(app.Name) > 100 || !appNamePattern.MatchString(app.Name) {
 		return ct.ValidationError{Field: "name", Message: "is invalid"}
 	}
+	retention, err := logRetentionJSON(app.LogRetention)
+	if err != nil {
+		return err
+	}
 	if app.ID == "" {
 		app.ID = random.UUID()
 	}
@@ -49,8 +66,12 @@ func (r *AppRepo) Add(data interface{}) error {
 			meta.Map[k] = sql.NullString{String: v, Valid: true}
 		}
 	}
-	err := r.db.QueryRow("INSERT INTO apps (app_id, name, protected, meta) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, meta).Scan(&app.CreatedAt, &app.UpdatedAt)
+	err = db.QueryRow("INSERT INTO apps (app_id, name, protected, meta, log_retention) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, meta, retention).Scan(&app.CreatedAt, &app.UpdatedAt)
 	app.ID = cleanUUID(app.ID)
+	return err
+}
+
+func (r *AppRepo) addDefaultRoute(app *ct.App) {
 	if !app.Protected && r.defaultDomain != "" {
 		route := (&router.HTTPRoute{
 			Domain:  fmt.Sprintf("%s.%s", app.Name, r.defaultDomain),
@@ -61,13 +82,74 @@ func (r *AppRepo) Add(data interface{}) error {
 			log.Printf("Error creating default route for %s: %s", app.Name, err)
 		}
 	}
-	return err
+}
+
+// Clone creates an app with the given name running a copy of the source
+// app's current release, with the same meta and log retention. The app and
+// the release are created in a single transaction, so a failure leaves no
+// partial clone. The formation, routes other than the default route, and
+// secrets are not copied.
+func (r *AppRepo) Clone(src *ct.App, name string) (*ct.App, error) {
+	app := &ct.App{Name: name, Meta: src.Meta, LogRetention: src.LogRetention}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.insert(tx, app); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var srcReleaseID *string
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1", src.ID).Scan(&srcReleaseID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// the source app may have no release, in which case there is nothing
+	// else to copy
+	if srcReleaseID != nil {
+		// the release data is copied as is so that every field of the
+		// release is kept
+		releaseID := random.UUID()
+		if _, err := tx.Exec("INSERT INTO releases (release_id, artifact_id, data) SELECT $1, artifact_id, data FROM releases WHERE release_id = $2", releaseID, *srcReleaseID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE apps SET release_id = $2 WHERE app_id = $1", app.ID, releaseID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.addDefaultRoute(app)
+	return app, nil
+}
+
+// logRetentionJSON validates and encodes an app's log retention policy,
+// returning nil if the app uses the host defaults.
+func logRetentionJSON(r *ct.LogRetention) (interface{}, error) {
+	if r == nil || (r.MaxBytes == 0 && r.MaxAge == 0) {
+		return nil, nil
+	}
+	if r.MaxBytes < 0 || r.MaxAge < 0 {
+		return nil, ct.ValidationError{Field: "log_retention", Message: "must not be negative"}
+	}
+	if r.MaxBytes > 0 && r.MaxBytes < host.MinLogRetentionBytes {
+		return nil, ct.ValidationError{Field: "log_retention", Message: fmt.Sprintf("max_bytes must be at least %d", host.MinLogRetentionBytes)}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
 }
 
 func scanApp(s Scanner) (*ct.App, error) {
 	app := &ct.App{}
 	var meta hstore.Hstore
-	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &app.CreatedAt, &app.UpdatedAt)
+	var retention sql.NullString
+	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &retention, &app.CreatedAt, &app.UpdatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -77,6 +159,12 @@ func scanApp(s Scanner) (*ct.App, error) {
 			app.Meta[k] = v.String
 		}
 	}
+	if retention.Valid {
+		app.LogRetention = &ct.LogRetention{}
+		if err := json.Unmarshal([]byte(retention.String), app.LogRetention); err != nil {
+			return nil, err
+		}
+	}
 	app.ID = cleanUUID(app.ID)
 	return app, err
 }
@@ -89,7 +177,7 @@ type rowQueryer interface {
 
 func selectApp(db rowQueryer, id string, update bool) (*ct.App, error) {
 	var row Scanner
-	query := "SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
+	query := "SELECT app_id, name, protected, meta, log_retention, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
 	var suffix string
 	if update {
 		suffix = " FOR UPDATE"
@@ -117,8 +205,42 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 		return nil, err
 	}
 
+	// the name the app had before being renamed
+	var oldName string
+	protected := app.Protected
+
 	for k, v := range data {
 		switch k {
+		case "name":
+			name, ok := v.(string)
+			if !ok {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: expected string, got %T", v)
+			}
+			if name == app.Name {
+				continue
+			}
+			if protected {
+				tx.Rollback()
+				return nil, ct.ValidationError{Field: "name", Message: "can't be changed for protected apps"}
+			}
+			if len(name) > 100 || !appNamePattern.MatchString(name) {
+				tx.Rollback()
+				return nil, ct.ValidationError{Field: "name", Message: "is invalid"}
+			}
+			// routes and formations refer to the app by ID, so only the
+			// default route, whose domain is the name, is moved once
+			// the rename is committed
+			_, err := tx.Exec("UPDATE apps SET name = $2, updated_at = now() WHERE app_id = $1", app.ID, name)
+			if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+				tx.Rollback()
+				return nil, ct.ValidationError{Field: "name", Message: "is already taken"}
+			} else if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			oldName = app.Name
+			app.Name = name
 		case "protected":
 			protected, ok := v.(bool)
 			if !ok {
@@ -154,10 +276,74 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				tx.Rollback()
 				return nil, err
 			}
+		case "log_retention":
+			// round trip through JSON to decode the policy, null resets
+			// the app to the host defaults
+			data, err := json.Marshal(v)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			var r *ct.LogRetention
+			if err := json.Unmarshal(data, &r); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: invalid log_retention: %s", err)
+			}
+			retention, err := logRetentionJSON(r)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if _, err := tx.Exec("UPDATE apps SET log_retention = $2, updated_at = now() WHERE app_id = $1", app.ID, retention); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.LogRetention = nil
+			if retention != nil {
+				app.LogRetention = r
+			}
 		}
 	}
 
-	return app, tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if oldName != "" {
+		r.moveDefaultRoute(app, oldName)
+	}
+	return app, nil
+}
+
+// moveDefaultRoute replaces the default route of an app which has been
+// renamed with one for its new name. The route keeps pointing at the same
+// service, as the app's releases keep registering the service they were
+// created with.
+func (r *AppRepo) moveDefaultRoute(app *ct.App, oldName string) {
+	if r.defaultDomain == "" {
+		return
+	}
+	routes, err := r.router.ListRoutes(routeParentRef(app))
+	if err != nil {
+		log.Printf("Error listing routes of renamed app %s: %s", app.Name, err)
+		return
+	}
+	oldDomain := fmt.Sprintf("%s.%s", oldName, r.defaultDomain)
+	for _, route := range routes {
+		if route.Type != "http" || route.HTTPRoute().Domain != oldDomain {
+			continue
+		}
+		httpRoute := route.HTTPRoute()
+		httpRoute.Route = &router.Route{ParentRef: route.ParentRef}
+		httpRoute.Domain = fmt.Sprintf("%s.%s", app.Name, r.defaultDomain)
+		if err := r.router.CreateRoute(httpRoute.ToRoute()); err != nil {
+			log.Printf("Error creating default route for renamed app %s: %s", app.Name, err)
+			return
+		}
+		if err := r.router.DeleteRoute(route.ID); err != nil {
+			log.Printf("Error deleting old default route of renamed app %s: %s", app.Name, err)
+		}
+		return
+	}
 }
 
 func (r *AppRepo) Remove(id string) error {
@@ -186,7 +372,7 @@ func (r *AppRepo) Remove(id string) error {
 }
 
 func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	rows, err := r.db.Query("SELECT app_id, name, protected, meta, log_retention, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	ct "github.com/flynn/flynn/controller/types"
@@ -17,7 +22,9 @@ func NewArtifactRepo(db *DB) *ArtifactRepo {
 
 func (r *ArtifactRepo) Add(data interface{}) error {
 	a := data.(*ct.Artifact)
-	// TODO: actually validate
+	if err := normalizeArtifact(a); err != nil {
+		return err
+	}
 	if a.ID == "" {
 		a.ID = random.UUID()
 	}
@@ -65,3 +72,93 @@ func (r *ArtifactRepo) List() (interface{}, error) {
 	}
 	return artifacts, nil
 }
+
+// artifactSchemes are the URI schemes supported by each artifact type.
+var artifactSchemes = map[string][]string{
+	"docker": {"https", "http", "docker"},
+	"file":   {"file", "https", "http"},
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+var (
+	imageNamePattern = regexp.MustCompile(`^[a-z0-9_.-]+(/[a-z0-9_.-]+)*$`)
+	imageRefPattern  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	imageIDPattern   = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+// normalizeArtifact checks that the URI of the artifact is valid for its
+// type, so that invalid artifacts are rejected when they are created rather
+// than when a job using them fails to start, and rewrites the URI in a
+// normalized form.
+func normalizeArtifact(a *ct.Artifact) error {
+	// releases which only set config use an empty artifact
+	if a.Type == "" && a.URI == "" {
+		return nil
+	}
+
+	schemes, ok := artifactSchemes[a.Type]
+	if !ok {
+		return ct.ValidationError{Field: "type", Message: "must be one of docker or file"}
+	}
+	u, err := url.Parse(a.URI)
+	if err != nil || !u.IsAbs() {
+		return ct.ValidationError{Field: "uri", Message: "must be an absolute URI"}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	supported := false
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return ct.ValidationError{Field: "uri", Message: fmt.Sprintf("scheme %q is not supported for %s artifacts", u.Scheme, a.Type)}
+	}
+	u.Host = strings.ToLower(u.Host)
+	if port, ok := defaultPorts[u.Scheme]; ok {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.Fragment = ""
+
+	switch a.Type {
+	case "docker":
+		if u.Host == "" {
+			return ct.ValidationError{Field: "uri", Message: "must include a registry host"}
+		}
+		name := strings.Trim(u.Path, "/")
+		if !imageNamePattern.MatchString(name) {
+			return ct.ValidationError{Field: "uri", Message: fmt.Sprintf("has an invalid image name %q", name)}
+		}
+		u.Path = "/" + name
+		q, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return ct.ValidationError{Field: "uri", Message: "has an invalid query"}
+		}
+		for k, v := range q {
+			if k != "id" && k != "tag" {
+				return ct.ValidationError{Field: "uri", Message: fmt.Sprintf("has an unsupported parameter %q", k)}
+			}
+			if len(v) != 1 || !imageRefPattern.MatchString(v[0]) {
+				return ct.ValidationError{Field: "uri", Message: fmt.Sprintf("has an invalid image %s", k)}
+			}
+		}
+		if id := q.Get("id"); imageIDPattern.MatchString(id) {
+			q.Set("id", strings.ToLower(id))
+		}
+		u.RawQuery = q.Encode()
+	case "file":
+		if u.Path == "" || u.Path == "/" {
+			return ct.ValidationError{Field: "uri", Message: "must include a path"}
+		}
+		if u.Scheme == "file" {
+			if u.Host != "" && u.Host != "localhost" {
+				return ct.ValidationError{Field: "uri", Message: "file URIs must not include a host"}
+			}
+			u.Host = ""
+		}
+	}
+	a.URI = u.String()
+	return nil
+}
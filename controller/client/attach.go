@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/attempt"
+)
+
+// reattachAttempts is the strategy used to re-attach to a job after the
+// attach connection breaks.
+var reattachAttempts = attempt.Strategy{
+	Total: 30 * time.Second,
+	Delay: 500 * time.Millisecond,
+}
+
+// reattachConn wraps an attach stream and transparently re-attaches to the
+// job if the connection breaks while the job is still running.
+//
+// Re-attaching resumes the job's output from the number of bytes already read
+// from each output stream, so output is neither duplicated nor lost. Frames
+// which were only partially received before the connection broke are dropped
+// and delivered in full when resuming. If the job's logs no longer retain the
+// output from there, reading fails with ErrLogsTruncated.
+type reattachConn struct {
+	reattach func(stdoutOffset, stderrOffset int64) (utils.ReadWriteCloser, error)
+
+	mtx    sync.Mutex
+	conn   utils.ReadWriteCloser
+	closed bool
+
+	r        *bufio.Reader
+	buf      bytes.Buffer // decoded frames waiting to be read
+	received [3]int64     // bytes read from each stream
+	eof      [3]bool
+	exited   bool
+}
+
+func newReattachConn(conn utils.ReadWriteCloser, reattach func(stdoutOffset, stderrOffset int64) (utils.ReadWriteCloser, error)) *reattachConn {
+	return &reattachConn{
+		reattach: reattach,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+	}
+}
+
+func (c *reattachConn) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 {
+		if err := c.readFrame(); err != nil {
+			if c.exited || c.isClosed() {
+				return 0, err
+			}
+			if rerr := c.reconnect(); rerr == ErrLogsTruncated {
+				return 0, rerr
+			} else if rerr != nil {
+				// the job is no longer running, so surface the original error
+				return 0, err
+			}
+		}
+	}
+	return c.buf.Read(p)
+}
+
+func (c *reattachConn) readFrame() error {
+	frameType, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch frameType {
+	case host.AttachData:
+		var header [5]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return err
+		}
+		stream := header[0]
+		if stream > 2 {
+			return fmt.Errorf("controller: unknown attach stream %d", stream)
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length == 0 {
+			if !c.eof[stream] {
+				c.eof[stream] = true
+				c.buf.WriteByte(frameType)
+				c.buf.Write(header[:])
+			}
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return err
+		}
+		c.buf.WriteByte(frameType)
+		c.buf.Write(header[:])
+		c.buf.Write(data)
+		c.received[stream] += int64(len(data))
+	case host.AttachExit:
+		var status [4]byte
+		if _, err := io.ReadFull(c.r, status[:]); err != nil {
+			return err
+		}
+		c.buf.WriteByte(frameType)
+		c.buf.Write(status[:])
+		c.exited = true
+	default:
+		return fmt.Errorf("controller: unknown attach frame type %d", frameType)
+	}
+	return nil
+}
+
+func (c *reattachConn) reconnect() error {
+	c.mtx.Lock()
+	c.conn.Close()
+	c.mtx.Unlock()
+
+	var conn utils.ReadWriteCloser
+	var err error
+	for a := reattachAttempts.Start(); a.Next(); {
+		if c.isClosed() {
+			return io.ErrClosedPipe
+		}
+		conn, err = c.reattach(c.received[1], c.received[2])
+		if err == nil || err == ErrNotFound || err == ErrLogsTruncated {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		conn.Close()
+		return io.ErrClosedPipe
+	}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	return nil
+}
+
+func (c *reattachConn) isClosed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closed
+}
+
+func (c *reattachConn) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn.Write(p)
+}
+
+func (c *reattachConn) CloseWrite() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn.CloseWrite()
+}
+
+func (c *reattachConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/attempt"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (S) SetUpSuite(c *C) {
+	reattachAttempts = attempt.Strategy{Total: time.Second, Delay: 10 * time.Millisecond}
+}
+
+func dataFrame(stream byte, data string) []byte {
+	frame := []byte{host.AttachData, stream, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func exitFrame(status uint32) []byte {
+	frame := []byte{host.AttachExit, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], status)
+	return frame
+}
+
+type fakeAttachServer struct {
+	// responses are the streams written for each successive attach, an
+	// empty stream results in a 404 unless truncated is set, in which case
+	// it results in a 416
+	responses [][]byte
+	truncated bool
+
+	mtx      sync.Mutex
+	attaches int
+	queries  []string
+}
+
+func (s *fakeAttachServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mtx.Lock()
+	if s.attaches >= len(s.responses) {
+		s.mtx.Unlock()
+		w.WriteHeader(404)
+		return
+	}
+	stream := s.responses[s.attaches]
+	s.attaches++
+	s.queries = append(s.queries, req.URL.RawQuery)
+	s.mtx.Unlock()
+
+	if req.URL.Path != "/apps/app/jobs" && req.URL.Path != "/apps/app/jobs/host0-job0/attach" {
+		w.WriteHeader(400)
+		return
+	}
+	if stream == nil {
+		if s.truncated {
+			w.WriteHeader(416)
+		} else {
+			w.WriteHeader(404)
+		}
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nFlynn-Job-ID: host0-job0\r\nContent-Type: application/vnd.flynn.attach\r\nContent-Length: 0\r\n\r\n"))
+	conn.Write(stream)
+}
+
+func newAttachTestClient(c *C, s *fakeAttachServer) (*Client, func()) {
+	srv := httptest.NewServer(s)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+	client.dial = net.Dial
+	return client, srv.Close
+}
+
+func (S) TestRunJobAttachedReconnect(c *C) {
+	var initial bytes.Buffer
+	initial.Write(dataFrame(1, "hello "))
+	initial.Write(dataFrame(2, "warn"))
+	// a frame which is cut off by the connection breaking
+	initial.Write(dataFrame(1, "world")[:8])
+
+	// the replay resumes from the output which was received in full
+	var replay bytes.Buffer
+	replay.Write(dataFrame(1, "wor"))
+	replay.Write(dataFrame(2, "ing"))
+	replay.Write(dataFrame(1, "ld!"))
+	replay.Write(dataFrame(1, ""))
+	replay.Write(dataFrame(2, ""))
+	replay.Write(exitFrame(3))
+
+	s := &fakeAttachServer{responses: [][]byte{initial.Bytes(), replay.Bytes()}}
+	client, cleanup := newAttachTestClient(c, s)
+	defer cleanup()
+
+	rwc, err := client.RunJobAttached("app", &ct.NewJob{})
+	c.Assert(err, IsNil)
+	defer rwc.Close()
+
+	var stdout, stderr bytes.Buffer
+	status, err := cluster.NewAttachClient(rwc).Receive(&stdout, &stderr)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 3)
+	c.Assert(stdout.String(), Equals, "hello world!")
+	c.Assert(stderr.String(), Equals, "warning")
+	c.Assert(s.attaches, Equals, 2)
+	c.Assert(s.queries[1], Equals, "stdout_offset=6&stderr_offset=4")
+}
+
+func (S) TestRunJobAttachedTruncated(c *C) {
+	initial := dataFrame(1, "hello")
+	// the output after the first frame has been rotated out of the logs
+	s := &fakeAttachServer{responses: [][]byte{initial, nil}, truncated: true}
+	client, cleanup := newAttachTestClient(c, s)
+	defer cleanup()
+
+	rwc, err := client.RunJobAttached("app", &ct.NewJob{})
+	c.Assert(err, IsNil)
+	defer rwc.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = cluster.NewAttachClient(rwc).Receive(&stdout, &stderr)
+	c.Assert(err, Equals, ErrLogsTruncated)
+	c.Assert(stdout.String(), Equals, "hello")
+	c.Assert(s.attaches, Equals, 2)
+	c.Assert(s.queries[1], Equals, "stdout_offset=5&stderr_offset=0")
+}
+
+func (S) TestRunJobAttachedJobDied(c *C) {
+	initial := dataFrame(1, "hello")
+	// the job is not running when re-attaching
+	s := &fakeAttachServer{responses: [][]byte{initial, nil}}
+	client, cleanup := newAttachTestClient(c, s)
+	defer cleanup()
+
+	rwc, err := client.RunJobAttached("app", &ct.NewJob{})
+	c.Assert(err, IsNil)
+	defer rwc.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = cluster.NewAttachClient(rwc).Receive(&stdout, &stderr)
+	c.Assert(err, NotNil)
+	c.Assert(stdout.String(), Equals, "hello")
+	c.Assert(s.attaches, Equals, 2)
+}
@@ -11,7 +11,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
@@ -32,10 +34,11 @@ func NewClient(uri, key string) (*Client, error) {
 		return nil, err
 	}
 	c := &Client{
-		url:  uri,
-		addr: u.Host,
-		http: http.DefaultClient,
-		key:  key,
+		url:     uri,
+		addr:    u.Host,
+		http:    http.DefaultClient,
+		key:     key,
+		Timeout: DefaultTimeout,
 	}
 	if u.Scheme == "discoverd+http" {
 		if err := discoverd.Connect(""); err != nil {
@@ -57,8 +60,9 @@ func NewClientWithPin(uri, key string, pin []byte) (*Client, error) {
 		return nil, err
 	}
 	c := &Client{
-		dial: (&pinned.Config{Pin: pin}).Dial,
-		key:  key,
+		dial:    (&pinned.Config{Pin: pin}).Dial,
+		key:     key,
+		Timeout: DefaultTimeout,
 	}
 	if _, port, _ := net.SplitHostPort(u.Host); port == "" {
 		u.Host += ":443"
@@ -70,6 +74,10 @@ func NewClientWithPin(uri, key string, pin []byte) (*Client, error) {
 	return c, nil
 }
 
+// DefaultTimeout is the Timeout of clients returned by NewClient and
+// NewClientWithPin.
+const DefaultTimeout = time.Minute
+
 type Client struct {
 	url  string
 	key  string
@@ -78,8 +86,48 @@ type Client struct {
 
 	dial      rpcplus.DialFunc
 	dialClose io.Closer
+
+	// Timeout is how long to wait for a request to complete before aborting
+	// it and returning a *TimeoutError, zero means no timeout.
+	Timeout time.Duration
+
+	// StreamTimeout is how long to wait for the response headers of a
+	// streaming request, such as StreamJobEvents, zero means no timeout.
+	// Once a stream is established it is not subject to a timeout.
+	StreamTimeout time.Duration
+}
+
+// WithTimeout returns a copy of the client which uses the given timeout for
+// non-streaming requests, for example:
+//
+//	client.WithTimeout(5 * time.Second).GetApp(appID)
+//
+// The copy shares the connection of the client, so only the original client
+// should be closed.
+func (c *Client) WithTimeout(timeout time.Duration) *Client {
+	client := *c
+	client.Timeout = timeout
+	return &client
+}
+
+// TimeoutError is returned when a request is aborted because it did not
+// complete within the client's timeout.
+type TimeoutError struct {
+	Method   string
+	URL      string
+	Duration time.Duration // the timeout which was exceeded
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("controller: %s %s timed out after %s", e.Method, e.URL, e.Duration)
 }
 
+// Timeout implements net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error.
+func (e *TimeoutError) Temporary() bool { return true }
+
 func (c *Client) Close() error {
 	if c.dialClose != nil {
 		c.dialClose.Close()
@@ -89,12 +137,33 @@ func (c *Client) Close() error {
 
 var ErrNotFound = errors.New("controller: not found")
 
+// ErrConflict is returned when a write is rejected because it was based on
+// stale state, the caller should re-read the current state and retry.
+var ErrConflict = errors.New("controller: conflict")
+
+// ErrLogsTruncated is returned when re-attaching to a job whose logs no longer
+// retain the output which has not yet been received.
+var ErrLogsTruncated = errors.New("controller: job logs truncated")
+
 func toJSON(v interface{}) (io.Reader, error) {
 	data, err := json.Marshal(v)
 	return bytes.NewBuffer(data), err
 }
 
 func (c *Client) rawReq(method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
+	return c.rawReqWithTimeout(method, path, header, in, out, c.Timeout)
+}
+
+// streamReq makes a request whose response body is streamed, using the
+// client's StreamTimeout.
+func (c *Client) streamReq(method, path string, header http.Header) (*http.Response, error) {
+	return c.rawReqWithTimeout(method, path, header, nil, nil, c.StreamTimeout)
+}
+
+// rawReqWithTimeout makes a request which is aborted if it has not completed
+// within timeout, where completed means the response has been decoded into
+// out, or just that the response headers have been read if out is nil.
+func (c *Client) rawReqWithTimeout(method, path string, header http.Header, in, out interface{}, timeout time.Duration) (res *http.Response, err error) {
 	var payload io.Reader
 	switch v := in.(type) {
 	case io.Reader:
@@ -120,7 +189,19 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 	}
 	req.Header = header
 	req.SetBasicAuth("", c.key)
-	res, err := c.http.Do(req)
+
+	if timeout > 0 {
+		cancel := make(chan struct{})
+		req.Cancel = cancel
+		timer := time.AfterFunc(timeout, func() { close(cancel) })
+		defer func() {
+			if !timer.Stop() && err != nil {
+				err = &TimeoutError{Method: method, URL: req.URL.String(), Duration: timeout}
+			}
+		}()
+	}
+
+	res, err = c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -128,6 +209,10 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 		res.Body.Close()
 		return res, ErrNotFound
 	}
+	if res.StatusCode == 409 {
+		res.Body.Close()
+		return res, ErrConflict
+	}
 	if res.StatusCode == 400 {
 		var body ct.ValidationError
 		defer res.Body.Close()
@@ -195,6 +280,20 @@ func (c *Client) StreamFormations(since *time.Time) (*FormationUpdates, *error)
 		s := time.Unix(0, 0)
 		since = &s
 	}
+	return c.streamFormations("Controller.StreamFormations", since)
+}
+
+// StreamAppFormations is like StreamFormations, but only streams the
+// formations of the app.
+func (c *Client) StreamAppFormations(appID string, since *time.Time) (*FormationUpdates, *error) {
+	req := &ct.StreamFormationsReq{AppID: appID, Since: time.Unix(0, 0)}
+	if since != nil {
+		req.Since = *since
+	}
+	return c.streamFormations("Controller.StreamAppFormations", req)
+}
+
+func (c *Client) streamFormations(method string, arg interface{}) (*FormationUpdates, *error) {
 	dial := c.dial
 	if dial == nil {
 		dial = net.Dial
@@ -212,7 +311,7 @@ func (c *Client) StreamFormations(since *time.Time) (*FormationUpdates, *error)
 		close(ch)
 		return &FormationUpdates{ch, conn}, &err
 	}
-	return &FormationUpdates{ch, conn}, &client.StreamGo("Controller.StreamFormations", since, ch).Error
+	return &FormationUpdates{ch, conn}, &client.StreamGo(method, arg, ch).Error
 }
 
 func (c *Client) CreateArtifact(artifact *ct.Artifact) error {
@@ -247,6 +346,9 @@ func (c *Client) PutResource(resource *ct.Resource) error {
 	return c.put(fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource, resource)
 }
 
+// PutFormation creates or updates a formation. If formation.Generation is
+// set (e.g. from GetFormation), ErrConflict is returned if the formation has
+// since been modified. On success, formation.Generation is updated.
 func (c *Client) PutFormation(formation *ct.Formation) error {
 	if formation.AppID == "" || formation.ReleaseID == "" {
 		return errors.New("controller: missing app id and/or release id")
@@ -265,10 +367,31 @@ func (c *Client) DeleteJob(appID, jobID string) error {
 	return c.delete(fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID))
 }
 
+// TestHealthCheck runs check once against the given running job, returning
+// the result without changing the state of the job.
+func (c *Client) TestHealthCheck(appID, jobID string, check *ct.HealthCheck) (*ct.HealthResult, error) {
+	res := &ct.HealthResult{}
+	return res, c.post(fmt.Sprintf("/apps/%s/jobs/%s/health_check", appID, jobID), check, res)
+}
+
 func (c *Client) SetAppRelease(appID, releaseID string) error {
 	return c.put(fmt.Sprintf("/apps/%s/release", appID), &ct.Release{ID: releaseID}, nil)
 }
 
+// SetReleaseAndFormation sets the app's release and, if the app has a single
+// formation, replaces it with a formation of the release with the given
+// process counts, in one step, so that the new release is never run at the old
+// counts. Protected apps cannot be scaled to zero this way.
+func (c *Client) SetReleaseAndFormation(appID, releaseID string, procs map[string]int) error {
+	if procs == nil {
+		procs = make(map[string]int)
+	}
+	return c.put(fmt.Sprintf("/apps/%s/release", appID), &struct {
+		ID        string         `json:"id"`
+		Formation map[string]int `json:"formation"`
+	}{releaseID, procs}, nil)
+}
+
 func (c *Client) GetAppRelease(appID string) (*ct.Release, error) {
 	release := &ct.Release{}
 	return release, c.get(fmt.Sprintf("/apps/%s/release", appID), release)
@@ -288,6 +411,12 @@ func (c *Client) CreateRoute(appID string, route *router.Route) error {
 	return c.post(fmt.Sprintf("/apps/%s/routes", appID), route, route)
 }
 
+// UpdateRoute replaces the config of an existing route of the app, for example
+// to point it at a different service.
+func (c *Client) UpdateRoute(appID string, routeID string, route *router.Route) error {
+	return c.put(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID), route, route)
+}
+
 func (c *Client) DeleteRoute(appID string, routeID string) error {
 	return c.delete(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID))
 }
@@ -297,6 +426,26 @@ func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
 	return formation, c.get(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), formation)
 }
 
+func (c *Client) DeleteFormation(appID, releaseID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID))
+}
+
+// SnapshotFormations returns the formations of every app in the cluster, so
+// they can be restored with RestoreFormations, for example after scaling
+// everything down for maintenance.
+func (c *Client) SnapshotFormations() (*ct.FormationSnapshot, error) {
+	snapshot := &ct.FormationSnapshot{}
+	return snapshot, c.get("/formations/snapshot", snapshot)
+}
+
+// RestoreFormations sets every formation in the snapshot back to the process
+// counts and hosts it had when the snapshot was taken. Other formations of
+// the apps in the snapshot, such as those of releases created since, are
+// scaled down to zero, and apps which are not in the snapshot are not changed.
+func (c *Client) RestoreFormations(snapshot *ct.FormationSnapshot) error {
+	return c.put("/formations/snapshot", snapshot, nil)
+}
+
 func (c *Client) GetRelease(releaseID string) (*ct.Release, error) {
 	release := &ct.Release{}
 	return release, c.get(fmt.Sprintf("/releases/%s", releaseID), release)
@@ -312,6 +461,25 @@ func (c *Client) GetApp(appID string) (*ct.App, error) {
 	return app, c.get(fmt.Sprintf("/apps/%s", appID), app)
 }
 
+// UpdateApp changes the name and/or metadata of an app, returning the updated
+// app. A renamed app keeps its ID, routes and formations, and is looked up by
+// its new name rather than the old one.
+func (c *Client) UpdateApp(appID string, updates *ct.AppUpdate) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post(fmt.Sprintf("/apps/%s", appID), updates, app)
+}
+
+// CloneApp creates an app with the given name running a copy of the source
+// app's current release, with the same artifact, processes and env. The clone
+// is done by the controller in a single transaction. The formation and routes
+// are not copied, so the clone starts scaled to zero, and secrets are not
+// copied, so any the release references must be set on the clone before it is
+// scaled up.
+func (c *Client) CloneApp(srcAppID, newName string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post(fmt.Sprintf("/apps/%s/clone", srcAppID), &ct.CloneAppReq{Name: newName}, app)
+}
+
 type sseDecoder struct {
 	*bufio.Reader
 }
@@ -333,18 +501,121 @@ func (dec *sseDecoder) Decode(v interface{}) error {
 type JobEventStream struct {
 	Events chan *ct.JobEvent
 	body   io.ReadCloser
+
+	// done is closed by Close so that events are no longer sent to a
+	// consumer which has stopped receiving them, it is shared with any
+	// stream filtering this one
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newJobEventStream(body io.ReadCloser, buffer int) *JobEventStream {
+	return &JobEventStream{
+		Events:    make(chan *ct.JobEvent, buffer),
+		body:      body,
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+// filter returns a stream of the events which the caller sends on its Events
+// channel, closing it also closes s.
+func (s *JobEventStream) filter() *JobEventStream {
+	return &JobEventStream{
+		Events:    make(chan *ct.JobEvent),
+		body:      s.body,
+		done:      s.done,
+		closeOnce: s.closeOnce,
+	}
 }
 
 func (s *JobEventStream) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
 	s.body.Close()
 }
 
+// send sends e on the Events channel, returning false if the stream has been
+// closed.
+func (s *JobEventStream) send(e *ct.JobEvent) bool {
+	select {
+	case s.Events <- e:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// StreamJobEventsOptions configures how job events are buffered when the
+// consumer of a job event stream is slow.
+type StreamJobEventsOptions struct {
+	// BufferSize is the capacity of the Events channel.
+	BufferSize int
+
+	// ServerBuffer is the number of events the controller queues for the
+	// stream before applying Policy, zero uses the controller default.
+	ServerBuffer int
+
+	// Policy is either "block" (the default), which stops reading new events
+	// until the consumer catches up, or "drop", which drops the oldest queued
+	// events and sends an event with the ct.JobEventGap state and the number
+	// of dropped events so the consumer can reconcile using JobList.
+	Policy string
+
+	// LastEventID replays the events after the event with the given ID
+	// before streaming live events, for resuming a stream from the ID of
+	// the last event it received.
+	LastEventID int64
+
+	// ReplayChunk and ReplayInterval pace the replay, which is sent in
+	// chunks of at most ReplayChunk events with a pause of ReplayInterval
+	// between them. Zero values use the controller defaults. If either is
+	// set, an event with the ct.JobEventCaughtUp state is sent once the
+	// replay is done.
+	ReplayChunk    int
+	ReplayInterval time.Duration
+
+	// JobIDs restricts the stream to the events of the given jobs, all of
+	// the app's job events are streamed if it is empty.
+	JobIDs []string
+}
+
 func (c *Client) StreamJobEvents(appID string) (*JobEventStream, error) {
-	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/jobs", appID), http.Header{"Accept": []string{"text/event-stream"}}, nil, nil)
+	return c.StreamJobEventsWithOptions(appID, nil)
+}
+
+func (c *Client) StreamJobEventsWithOptions(appID string, opts *StreamJobEventsOptions) (*JobEventStream, error) {
+	if opts == nil {
+		opts = &StreamJobEventsOptions{}
+	}
+	query := url.Values{}
+	if opts.ServerBuffer > 0 {
+		query.Set("buffer", strconv.Itoa(opts.ServerBuffer))
+	}
+	if opts.Policy != "" {
+		query.Set("policy", opts.Policy)
+	}
+	if opts.ReplayChunk > 0 {
+		query.Set("replay_chunk", strconv.Itoa(opts.ReplayChunk))
+	}
+	if opts.ReplayInterval > 0 {
+		query.Set("replay_interval", opts.ReplayInterval.String())
+	}
+	for _, id := range opts.JobIDs {
+		query.Add("job_id", id)
+	}
+	path := fmt.Sprintf("/apps/%s/jobs", appID)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	if opts.LastEventID > 0 {
+		header.Set("Last-Event-Id", strconv.FormatInt(opts.LastEventID, 10))
+	}
+	res, err := c.streamReq("GET", path, header)
 	if err != nil {
 		return nil, err
 	}
-	stream := &JobEventStream{Events: make(chan *ct.JobEvent), body: res.Body}
+	stream := newJobEventStream(res.Body, opts.BufferSize)
 	go func() {
 		defer close(stream.Events)
 		dec := &sseDecoder{bufio.NewReader(stream.body)}
@@ -353,7 +624,9 @@ func (c *Client) StreamJobEvents(appID string) (*JobEventStream, error) {
 			if err := dec.Decode(event); err != nil {
 				return
 			}
-			stream.Events <- event
+			if !stream.send(event) {
+				return
+			}
 		}
 	}()
 	return stream, nil
@@ -364,19 +637,77 @@ func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error
 	if tail {
 		path += "?tail=true"
 	}
-	res, err := c.rawReq("GET", path, nil, nil, nil)
+	res, err := c.streamReq("GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
 	return res.Body, nil
 }
 
+// RunJobAttached runs a job and attaches to it. If the attach connection
+// breaks while the job is still running, the returned stream transparently
+// re-attaches and resumes without duplicating or losing output.
 func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCloser, error) {
-	data, err := toJSON(job)
+	res, rwc, err := c.hijack(fmt.Sprintf("/apps/%s/jobs", appID), job)
+	if err != nil {
+		return nil, err
+	}
+	if jobID := res.Header.Get("Flynn-Job-ID"); jobID != "" {
+		return newReattachConn(rwc, func(stdoutOffset, stderrOffset int64) (utils.ReadWriteCloser, error) {
+			return c.attachJob(appID, jobID, stdoutOffset, stderrOffset)
+		}), nil
+	}
+	return rwc, nil
+}
+
+// RunJobLike runs a one-off job with the release, environment, resources and
+// volume mounts of the given running job and attaches to it. The command,
+// TTY settings and any additional environment are taken from job, its
+// ReleaseID is ignored.
+func (c *Client) RunJobLike(appID, jobID string, job *ct.NewJob) (utils.ReadWriteCloser, error) {
+	res, rwc, err := c.hijack(fmt.Sprintf("/apps/%s/jobs/%s/clone", appID, jobID), job)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/apps/%s/jobs", c.url, appID), data)
+	if id := res.Header.Get("Flynn-Job-ID"); id != "" {
+		return newReattachConn(rwc, func(stdoutOffset, stderrOffset int64) (utils.ReadWriteCloser, error) {
+			return c.attachJob(appID, id, stdoutOffset, stderrOffset)
+		}), nil
+	}
+	return rwc, nil
+}
+
+// AttachJob attaches to a running job, replaying its retained output from the
+// start. It returns ErrNotFound if the job is not running.
+func (c *Client) AttachJob(appID, jobID string) (utils.ReadWriteCloser, error) {
+	return c.attachJob(appID, jobID, 0, 0)
+}
+
+// attachJob attaches to a running job, replaying its output from the given
+// number of bytes of stdout and stderr. It returns ErrLogsTruncated if the
+// job's logs no longer retain the output from there.
+func (c *Client) attachJob(appID, jobID string, stdoutOffset, stderrOffset int64) (utils.ReadWriteCloser, error) {
+	path := fmt.Sprintf("/apps/%s/jobs/%s/attach", appID, jobID)
+	if stdoutOffset > 0 || stderrOffset > 0 {
+		path += fmt.Sprintf("?stdout_offset=%d&stderr_offset=%d", stdoutOffset, stderrOffset)
+	}
+	_, rwc, err := c.hijack(path, nil)
+	return rwc, err
+}
+
+func (c *Client) hijack(path string, in interface{}) (*http.Response, utils.ReadWriteCloser, error) {
+	var data io.Reader
+	if in != nil {
+		var err error
+		data, err = toJSON(in)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", c.url+path, data)
+	if err != nil {
+		return nil, nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/vnd.flynn.attach")
 	req.SetBasicAuth("", c.key)
@@ -386,10 +717,18 @@ func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCl
 	}
 	res, rwc, err := utils.HijackRequest(req, dial)
 	if err != nil {
-		res.Body.Close()
-		return nil, err
+		if res != nil {
+			res.Body.Close()
+			switch res.StatusCode {
+			case 404:
+				err = ErrNotFound
+			case 416:
+				err = ErrLogsTruncated
+			}
+		}
+		return nil, nil, err
 	}
-	return rwc, nil
+	return res, rwc, nil
 }
 
 func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
@@ -397,11 +736,225 @@ func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
 	return job, c.post(fmt.Sprintf("/apps/%s/jobs", appID), req, job)
 }
 
+// StopJobsMatching stops the app's running one-off jobs whose meta contains
+// every key and value in selector, returning the IDs of the stopped jobs.
+// Jobs which belong to the app's formations are never stopped. If only some
+// of the jobs could be stopped, the IDs of those which were are returned
+// along with the error.
+func (c *Client) StopJobsMatching(appID string, selector map[string]string) ([]string, error) {
+	res := &ct.StopJobsRes{}
+	if err := c.post(fmt.Sprintf("/apps/%s/jobs/stop", appID), &ct.StopJobsReq{Selector: selector}, res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return res.Stopped, errors.New(res.Error)
+	}
+	return res.Stopped, nil
+}
+
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	var jobs []*ct.Job
 	return jobs, c.get(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
 }
 
+// JobEventsSince returns the app's job events which occurred at or after
+// since, oldest first.
+func (c *Client) JobEventsSince(appID string, since time.Time) ([]*ct.JobEvent, error) {
+	var events []*ct.JobEvent
+	query := url.Values{"since": []string{since.UTC().Format(time.RFC3339Nano)}}
+	return events, c.get(fmt.Sprintf("/apps/%s/job_events?%s", appID, query.Encode()), &events)
+}
+
+// PendingJobs returns the jobs which the scheduler wants to run for the app
+// but has not yet been able to place, along with the reason why.
+func (c *Client) PendingJobs(appID string) ([]*ct.PendingJob, error) {
+	var jobs []*ct.PendingJob
+	return jobs, c.get(fmt.Sprintf("/apps/%s/pending_jobs", appID), &jobs)
+}
+
+// PutPendingJobs replaces the pending jobs of the app, it is called by the
+// scheduler whenever its pending queue changes.
+func (c *Client) PutPendingJobs(appID string, jobs []*ct.PendingJob) error {
+	if jobs == nil {
+		jobs = []*ct.PendingJob{}
+	}
+	return c.put(fmt.Sprintf("/apps/%s/pending_jobs", appID), jobs, nil)
+}
+
+// SetSecret creates or replaces a secret of the app, which release and job env
+// values can reference with ct.SecretRefPrefix.
+func (c *Client) SetSecret(appID, name, value string) error {
+	return c.put(fmt.Sprintf("/apps/%s/secrets/%s", appID, name), &ct.Secret{Value: value}, nil)
+}
+
+// GetSecret returns the value of a secret of the app.
+func (c *Client) GetSecret(appID, name string) (string, error) {
+	secret := &ct.Secret{}
+	if err := c.get(fmt.Sprintf("/apps/%s/secrets/%s", appID, name), secret); err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
+
+// SecretList returns the secrets of the app, without their values.
+func (c *Client) SecretList(appID string) ([]*ct.Secret, error) {
+	var secrets []*ct.Secret
+	return secrets, c.get(fmt.Sprintf("/apps/%s/secrets", appID), &secrets)
+}
+
+func (c *Client) DeleteSecret(appID, name string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/secrets/%s", appID, name))
+}
+
+// Reconcile stops the app's jobs which no formation accounts for, other than
+// one-off jobs, and asks the scheduler to start the jobs its formations
+// expect but which are not running, returning a report of the actions taken.
+func (c *Client) Reconcile(appID string) (*ct.ReconcileReport, error) {
+	report := &ct.ReconcileReport{}
+	return report, c.post(fmt.Sprintf("/apps/%s/reconcile", appID), nil, report)
+}
+
+// GetJobEvent returns the most recent event of the app's job with the given
+// state, such as the "crashed" event recording why a job stopped. The latest
+// event of any state is returned if state is empty.
+func (c *Client) GetJobEvent(appID, jobID, state string) (*ct.JobEvent, error) {
+	event := &ct.JobEvent{}
+	path := fmt.Sprintf("/apps/%s/jobs/%s/events", appID, jobID)
+	if state != "" {
+		path += "?state=" + url.QueryEscape(state)
+	}
+	return event, c.get(path, event)
+}
+
+// SchedulerDump returns a snapshot of the scheduler leader's view of the
+// cluster, for debugging.
+func (c *Client) SchedulerDump() (*ct.SchedulerState, error) {
+	state := &ct.SchedulerState{}
+	return state, c.get("/scheduler/dump", state)
+}
+
+// SchedulerMetrics returns how long the scheduler leader has taken to
+// converge formations to their desired process counts.
+func (c *Client) SchedulerMetrics() (*ct.SchedulerMetrics, error) {
+	metrics := &ct.SchedulerMetrics{}
+	return metrics, c.get("/scheduler/metrics", metrics)
+}
+
+// ClusterConfig returns the active configuration of the cluster, including
+// the scheduler's policies and which features are enabled.
+func (c *Client) ClusterConfig() (*ct.ClusterConfig, error) {
+	conf := &ct.ClusterConfig{}
+	return conf, c.get("/cluster/config", conf)
+}
+
+// AddClusterEvent adds a host or scheduler event to the cluster event stream,
+// setting its ID.
+func (c *Client) AddClusterEvent(e *ct.ClusterEvent) error {
+	return c.post("/cluster/events", e, e)
+}
+
+type ClusterEventStream struct {
+	Events chan *ct.ClusterEvent
+	body   io.ReadCloser
+}
+
+func (s *ClusterEventStream) Close() {
+	s.body.Close()
+}
+
+// StreamClusterEvents streams the host, job, deploy, formation and scheduler
+// events of the whole cluster in the order they happened, starting with those
+// with an ID greater than sinceID. Events is closed when the stream ends.
+func (c *Client) StreamClusterEvents(sinceID int64) (*ClusterEventStream, error) {
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	res, err := c.streamReq("GET", fmt.Sprintf("/cluster/events?since_id=%d", sinceID), header)
+	if err != nil {
+		return nil, err
+	}
+	stream := &ClusterEventStream{Events: make(chan *ct.ClusterEvent), body: res.Body}
+	go func() {
+		defer close(stream.Events)
+		dec := &sseDecoder{bufio.NewReader(stream.body)}
+		for {
+			event := &ct.ClusterEvent{}
+			if err := dec.Decode(event); err != nil {
+				return
+			}
+			stream.Events <- event
+		}
+	}()
+	return stream, nil
+}
+
+// SchedulerConfig returns the stored maintenance mode and default
+// anti-affinity of the scheduler, which it applies when it becomes leader.
+func (c *Client) SchedulerConfig() (*ct.SchedulerConfig, error) {
+	conf := &ct.SchedulerConfig{}
+	return conf, c.get("/scheduler/config", conf)
+}
+
+// UpdateSchedulerConfig changes the scheduler's maintenance mode and default
+// anti-affinity, leaving those which are not set in u as they are, and
+// returns its resulting config.
+func (c *Client) UpdateSchedulerConfig(u *ct.SchedulerConfigUpdate) (*ct.SchedulerConfig, error) {
+	out := &ct.SchedulerConfig{}
+	return out, c.put("/scheduler/config", u, out)
+}
+
+// DrainHost migrates the jobs on a host to other hosts and stops new jobs
+// being placed on it. One-off jobs are given oneOffGrace to finish before
+// being stopped, and the IDs of those which had to be stopped are returned. A
+// negative grace leaves one-off jobs running.
+func (c *Client) DrainHost(hostID string, oneOffGrace time.Duration) ([]string, error) {
+	drain := &ct.HostDrain{HostID: hostID, OneOffGrace: oneOffGrace}
+	if err := c.post("/scheduler/drain", drain, drain); err != nil {
+		return nil, err
+	}
+	return drain.Killed, nil
+}
+
+// UndrainHost allows new jobs to be placed on a drained host again.
+func (c *Client) UndrainHost(hostID string) error {
+	return c.delete("/scheduler/drain/" + hostID)
+}
+
+// ClearQuarantine replaces the jobs of a formation which the scheduler
+// quarantined for crashing repeatedly with new jobs, optionally only those of
+// the process type typ, returning the number of jobs which were cleared.
+func (c *Client) ClearQuarantine(appID, releaseID, typ string) (int, error) {
+	path := fmt.Sprintf("/apps/%s/formations/%s/quarantine", appID, releaseID)
+	if typ != "" {
+		path += "?type=" + url.QueryEscape(typ)
+	}
+	res := &ct.QuarantineClear{}
+	if err := c.send("DELETE", path, nil, res); err != nil {
+		return 0, err
+	}
+	return res.Cleared, nil
+}
+
+// CreateJobSchedule registers a schedule which launches a one-off job at the
+// times given by schedule.Schedule.
+func (c *Client) CreateJobSchedule(appID string, schedule *ct.JobSchedule) error {
+	return c.post(fmt.Sprintf("/apps/%s/schedules", appID), schedule, schedule)
+}
+
+func (c *Client) GetJobSchedule(appID, scheduleID string) (*ct.JobSchedule, error) {
+	schedule := &ct.JobSchedule{}
+	return schedule, c.get(fmt.Sprintf("/apps/%s/schedules/%s", appID, scheduleID), schedule)
+}
+
+func (c *Client) JobScheduleList(appID string) ([]*ct.JobSchedule, error) {
+	var schedules []*ct.JobSchedule
+	return schedules, c.get(fmt.Sprintf("/apps/%s/schedules", appID), &schedules)
+}
+
+// DeleteJobSchedule stops the schedule from launching further jobs, jobs which
+// are already running are left to finish.
+func (c *Client) DeleteJobSchedule(appID, scheduleID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/schedules/%s", appID, scheduleID))
+}
+
 func (c *Client) AppList() ([]*ct.App, error) {
 	var apps []*ct.App
 	return apps, c.get("/apps", &apps)
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (S) TestStreamJobEventsOptions(c *C) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		fmt.Fprint(w, "id: 1\nevent: up\ndata: {\"id\":1,\"job_id\":\"host0-job0\",\"state\":\"up\"}\n\n")
+		fmt.Fprintf(w, "event: gap\ndata: {\"state\":%q,\"dropped\":5}\n\n", ct.JobEventGap)
+		fmt.Fprint(w, "id: 7\nevent: down\ndata: {\"id\":7,\"job_id\":\"host0-job0\",\"state\":\"down\"}\n\n")
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamJobEventsWithOptions("app", &StreamJobEventsOptions{
+		BufferSize:   10,
+		ServerBuffer: 2,
+		Policy:       "drop",
+	})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Assert(cap(stream.Events), Equals, 10)
+
+	var events []*ct.JobEvent
+	for e := range stream.Events {
+		events = append(events, e)
+	}
+	c.Assert(query, Equals, "buffer=2&policy=drop")
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].State, Equals, "up")
+	c.Assert(events[1].State, Equals, ct.JobEventGap)
+	c.Assert(events[1].Dropped, Equals, 5)
+	c.Assert(events[2].ID, Equals, int64(7))
+}
+
+func (S) TestRequestTimeout(c *C) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+	c.Assert(client.Timeout, Equals, DefaultTimeout)
+
+	client.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err = client.GetApp("app")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(err, FitsTypeOf, &TimeoutError{})
+	c.Assert(err.(*TimeoutError).Duration, Equals, 50*time.Millisecond)
+
+	// a per-call timeout overrides the client's timeout
+	client.Timeout = time.Hour
+	start = time.Now()
+	_, err = client.WithTimeout(50 * time.Millisecond).GetApp("app")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(err, FitsTypeOf, &TimeoutError{})
+	c.Assert(client.Timeout, Equals, time.Hour)
+}
+
+func (S) TestStreamNotSubjectToTimeout(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "id: 1\nevent: up\ndata: {\"id\":1,\"job_id\":\"host0-job0\",\"state\":\"up\"}\n\n")
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+	client.Timeout = 50 * time.Millisecond
+
+	stream, err := client.StreamJobEvents("app")
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	select {
+	case e, ok := <-stream.Events:
+		c.Assert(ok, Equals, true)
+		c.Assert(e.ID, Equals, int64(1))
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for job event")
+	}
+}
+
+func (S) TestStopJobsMatchingPartialFailure(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"stopped":["host0-job0"],"error":"stop failed"}`)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stopped, err := client.StopJobsMatching("app", map[string]string{"purpose": "debug"})
+	c.Assert(err, ErrorMatches, "stop failed")
+	c.Assert(stopped, DeepEquals, []string{"host0-job0"})
+}
@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// CrashStat summarises the crashes of the jobs of a process type over a
+// window of time.
+type CrashStat struct {
+	// Crashes is the number of jobs of the type which crashed.
+	Crashes int
+
+	// Restarts is the number of jobs of the type which were started on the
+	// same host as a crashed job of the type to replace it.
+	Restarts int
+
+	// MTBF is the mean of the intervals between consecutive crashes, zero if
+	// there were fewer than two crashes.
+	MTBF time.Duration
+}
+
+// CrashStats returns crash statistics for each process type of the app which
+// had job events in the last window, computed from the app's job event
+// history. One-off jobs are ignored.
+func (c *Client) CrashStats(appID string, window time.Duration) (map[string]CrashStat, error) {
+	if window <= 0 {
+		return nil, errors.New("controller: crash stats window must be positive")
+	}
+	events, err := c.JobEventsSince(appID, time.Now().Add(-window))
+	if err != nil {
+		return nil, err
+	}
+
+	// crashed jobs are restarted on the same host, so restarts are matched
+	// to crashes by type and host
+	type typeHost struct{ typ, host string }
+
+	stats := make(map[string]CrashStat)
+	// first and last are the times of the first and last crashes of each
+	// type, the mean interval between consecutive crashes being the time
+	// between them divided by the number of intervals
+	first := make(map[string]time.Time)
+	last := make(map[string]time.Time)
+	// replacing is the number of crashed jobs of each type on each host
+	// which have not yet been replaced by a new job
+	replacing := make(map[typeHost]int)
+	for _, e := range events {
+		if e.Type == "" {
+			continue
+		}
+		key := typeHost{e.Type, strings.SplitN(e.JobID, "-", 2)[0]}
+		stat := stats[e.Type]
+		switch e.State {
+		case "crashed":
+			stat.Crashes++
+			replacing[key]++
+			if e.CreatedAt != nil {
+				if t, ok := first[e.Type]; !ok || e.CreatedAt.Before(t) {
+					first[e.Type] = *e.CreatedAt
+				}
+				if e.CreatedAt.After(last[e.Type]) {
+					last[e.Type] = *e.CreatedAt
+				}
+			}
+		case "starting":
+			if replacing[key] > 0 {
+				stat.Restarts++
+				replacing[key]--
+			}
+		}
+		stats[e.Type] = stat
+	}
+	for typ, stat := range stats {
+		if stat.Crashes > 1 {
+			stat.MTBF = last[typ].Sub(first[typ]) / time.Duration(stat.Crashes-1)
+			stats[typ] = stat
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (S) TestCrashStats(c *C) {
+	var events []*ct.JobEvent
+	// each event is a minute after the last
+	now := time.Now().Add(-30 * time.Minute)
+	addEvent := func(id, typ, state string) {
+		now = now.Add(time.Minute)
+		createdAt := now
+		events = append(events, &ct.JobEvent{Job: ct.Job{AppID: "app", ReleaseID: "release", Type: typ, State: state, CreatedAt: &createdAt}, JobID: id})
+	}
+	addEvent("host0-web0", "web", "up")
+	addEvent("host0-worker0", "worker", "up")
+	// the web jobs keep crashing and being replaced
+	for i := 0; i < 3; i++ {
+		addEvent(fmt.Sprintf("host0-web%d", i), "web", "crashed")
+		addEvent(fmt.Sprintf("host0-web%d", i+1), "web", "starting")
+		addEvent(fmt.Sprintf("host0-web%d", i+1), "web", "up")
+	}
+	addEvent("host0-web3", "web", "crashed")
+	// a single crash has no interval
+	addEvent("host0-clock0", "clock", "crashed")
+	// a job started on another host or of another type doesn't replace it
+	addEvent("host1-web4", "web", "starting")
+	addEvent("host0-worker1", "worker", "starting")
+	// one-off jobs are ignored
+	addEvent("host0-oneoff", "", "crashed")
+
+	var since time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/apps/app/job_events" {
+			w.WriteHeader(404)
+			return
+		}
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, req.FormValue("since"))
+		c.Assert(err, IsNil)
+		json.NewEncoder(w).Encode(events)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	window := time.Hour
+	stats, err := client.CrashStats("app", window)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(since) >= window, Equals, true)
+	c.Assert(time.Since(since) < window+time.Minute, Equals, true)
+
+	c.Assert(stats, HasLen, 3)
+	c.Assert(stats["web"].Crashes, Equals, 4)
+	c.Assert(stats["web"].Restarts, Equals, 3)
+	// the web jobs crashed every three minutes
+	c.Assert(stats["web"].MTBF, Equals, 3*time.Minute)
+	c.Assert(stats["clock"], DeepEquals, CrashStat{Crashes: 1})
+	c.Assert(stats["worker"], DeepEquals, CrashStat{})
+
+	_, err = client.CrashStats("app", 0)
+	c.Assert(err, NotNil)
+}
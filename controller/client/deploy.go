@@ -0,0 +1,574 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	// DeployRolling replaces the jobs of the current release one at a time,
+	// waiting for each new job to come up before stopping an old one.
+	DeployRolling = "rolling"
+
+	// DeployAllAtOnceCanary starts a single canary job of the new release
+	// which must stay up for DeployOptions.CanarySoak, and then replaces all
+	// of the remaining jobs in a single wave. If the canary fails, the new
+	// release is removed without stopping any of the old jobs.
+	DeployAllAtOnceCanary = "all-at-once-canary"
+
+	// DeployBlueGreen starts all of the jobs of the new release alongside
+	// the old ones and, once they are all up, switches the app's routes from
+	// the services of the old release to those of the new release before
+	// removing the old release. If a new job fails before the switch, or a
+	// route can't be switched, any switched routes are switched back and the
+	// new release is removed.
+	//
+	// The process types of the new release register services using SD_NAME
+	// in their environment. Those which register the same service as they
+	// did in the old release, as releases created by the git receiver do,
+	// are deployed using a copy of the new release in which they register
+	// the alternate service, so that the app alternates between service and
+	// service-green. The app must have at least one route to switch.
+	DeployBlueGreen = "blue-green"
+)
+
+const (
+	DefaultCanarySoak    = 30 * time.Second
+	DefaultDeployTimeout = 2 * time.Minute
+)
+
+// deployPollInterval is how often a deploy which is waiting for jobs reports
+// its progress, so that the controller knows it is still running and it sees
+// if it has been stopped even if no jobs change state.
+var deployPollInterval = 30 * time.Second
+
+type DeployOptions struct {
+	// Strategy is one of DeployRolling (the default), DeployAllAtOnceCanary
+	// or DeployBlueGreen.
+	Strategy string
+
+	// CanarySoak is how long the canary job must stay up before the rest of
+	// the jobs are replaced, zero uses DefaultCanarySoak.
+	CanarySoak time.Duration
+
+	// Timeout is how long to wait for new jobs to come up, zero uses
+	// DefaultDeployTimeout.
+	Timeout time.Duration
+}
+
+// ErrCanaryFailed is returned by DeployAppRelease when the canary job of a
+// DeployAllAtOnceCanary deploy stops during its soak period.
+var ErrCanaryFailed = errors.New("controller: canary job failed")
+
+// DeployAppRelease deploys the release to the app, moving the jobs of the
+// app's current formation to the release using the strategy in opts, and
+// then sets it as the app's release.
+func (c *Client) DeployAppRelease(appID, releaseID string, opts *DeployOptions) error {
+	if opts == nil {
+		opts = &DeployOptions{}
+	}
+	if opts.CanarySoak == 0 {
+		opts.CanarySoak = DefaultCanarySoak
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultDeployTimeout
+	}
+	switch opts.Strategy {
+	case "":
+		opts.Strategy = DeployRolling
+	case DeployRolling, DeployAllAtOnceCanary, DeployBlueGreen:
+	default:
+		return fmt.Errorf("controller: unknown deploy strategy %q", opts.Strategy)
+	}
+
+	release, err := c.GetAppRelease(appID)
+	if err == ErrNotFound {
+		// nothing is running, so there is nothing to move
+		return c.SetAppRelease(appID, releaseID)
+	} else if err != nil {
+		return err
+	}
+	if release.ID == releaseID {
+		return nil
+	}
+	old, err := c.GetFormation(appID, release.ID)
+	if err == ErrNotFound {
+		return c.SetAppRelease(appID, releaseID)
+	} else if err != nil {
+		return err
+	}
+
+	if opts.Strategy == DeployBlueGreen {
+		if releaseID, err = c.blueGreenRelease(old.ReleaseID, releaseID); err != nil {
+			return err
+		}
+	}
+
+	stream, err := c.StreamJobEvents(appID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	record := &ct.Deploy{
+		OldReleaseID: old.ReleaseID,
+		NewReleaseID: releaseID,
+		Strategy:     opts.Strategy,
+	}
+	for _, n := range old.Processes {
+		if n > 0 {
+			record.JobsExpected += n
+		}
+	}
+	if err := c.post(fmt.Sprintf("/apps/%s/deploys", appID), record, record); err != nil {
+		return err
+	}
+
+	d := &deployment{
+		client: c,
+		opts:   opts,
+		events: stream.Events,
+		record: record,
+		old:    old,
+		new:    &ct.Formation{AppID: appID, ReleaseID: releaseID, Processes: make(map[string]int, len(old.Processes))},
+		up:     make(map[string]struct{}),
+	}
+	err = d.deploy()
+	d.finish(err)
+	return err
+}
+
+// DeployList returns the running deploys of all apps, along with those which
+// finished in the last day, most recent first.
+func (c *Client) DeployList() ([]*ct.Deploy, error) {
+	var deploys []*ct.Deploy
+	return deploys, c.get("/deploys", &deploys)
+}
+
+// StopDeploy stops the app's running deploy, which returns ErrDeployStopped
+// once it next sees a job of the new release come up. Canary and blue/green
+// deploys then remove the new release, while a rolling deploy leaves the jobs
+// it has already moved running. ErrNotFound is returned if the app has no
+// running deploy.
+func (c *Client) StopDeploy(appID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/deploy", appID))
+}
+
+// ErrDeployStopped is returned by DeployAppRelease when the deploy is stopped
+// using StopDeploy.
+var ErrDeployStopped = errors.New("controller: deploy stopped")
+
+// errDeployExpired is returned when the controller has failed the deploy for
+// not reporting progress in time.
+var errDeployExpired = errors.New("controller: deploy timed out waiting for progress")
+
+type deployment struct {
+	client *Client
+	opts   *DeployOptions
+	events <-chan *ct.JobEvent
+	record *ct.Deploy
+	old    *ct.Formation
+	new    *ct.Formation
+
+	// up is the set of jobs of the new release which are up
+	up map[string]struct{}
+}
+
+func (d *deployment) deploy() error {
+	var err error
+	switch d.opts.Strategy {
+	case DeployAllAtOnceCanary:
+		err = d.canary()
+	case DeployBlueGreen:
+		err = d.blueGreen()
+	default:
+		err = d.rolling()
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.client.DeleteFormation(d.new.AppID, d.old.ReleaseID); err != nil {
+		return err
+	}
+	return d.client.SetAppRelease(d.new.AppID, d.new.ReleaseID)
+}
+
+func (d *deployment) recordPath() string {
+	return fmt.Sprintf("/apps/%s/deploys/%s", d.new.AppID, d.record.ID)
+}
+
+// progress records the number of new jobs which are up, returning
+// ErrDeployStopped if the deploy has been stopped, or errDeployExpired if the
+// controller has failed it.
+func (d *deployment) progress() error {
+	d.record.JobsUp = len(d.up)
+	updated := &ct.Deploy{}
+	if err := d.client.put(d.recordPath(), d.record, updated); err != nil {
+		// the record is informational, so failing to update it doesn't
+		// fail the deploy
+		return nil
+	}
+	switch updated.Status {
+	case ct.DeployStatusStopped:
+		return ErrDeployStopped
+	case ct.DeployStatusFailed:
+		return errDeployExpired
+	}
+	return nil
+}
+
+// finish records the outcome of the deploy, a stopped or expired deploy was
+// already recorded as such by the controller.
+func (d *deployment) finish(err error) {
+	if err == ErrDeployStopped || err == errDeployExpired {
+		return
+	}
+	d.record.JobsUp = len(d.up)
+	d.record.Status = ct.DeployStatusComplete
+	if err != nil {
+		d.record.Status = ct.DeployStatusFailed
+		d.record.Error = err.Error()
+	}
+	d.client.put(d.recordPath(), d.record, d.record)
+}
+
+func (d *deployment) types() []string {
+	types := make([]string, 0, len(d.old.Processes))
+	for typ, n := range d.old.Processes {
+		if n > 0 {
+			types = append(types, typ)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (d *deployment) rolling() error {
+	for _, typ := range d.types() {
+		for d.old.Processes[typ] > 0 {
+			d.new.Processes[typ]++
+			if err := d.client.PutFormation(d.new); err != nil {
+				return err
+			}
+			if err := d.waitUp(map[string]int{typ: 1}, time.After(d.opts.Timeout)); err != nil {
+				return err
+			}
+			d.old.Processes[typ]--
+			if err := d.client.PutFormation(d.old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *deployment) canary() (err error) {
+	types := d.types()
+	if len(types) == 0 {
+		return nil
+	}
+	// remove the new release if anything fails before the old jobs are
+	// touched, leaving the app as it was
+	defer func() {
+		if err != nil {
+			d.client.DeleteFormation(d.new.AppID, d.new.ReleaseID)
+		}
+	}()
+
+	canaryType := types[0]
+	d.new.Processes[canaryType] = 1
+	if err := d.client.PutFormation(d.new); err != nil {
+		return err
+	}
+	if err := d.waitUp(map[string]int{canaryType: 1}, time.After(d.opts.Timeout)); err != nil {
+		if err == errJobStopped {
+			return ErrCanaryFailed
+		}
+		return err
+	}
+	if err := d.soak(time.After(d.opts.CanarySoak)); err != nil {
+		return err
+	}
+
+	expected := make(map[string]int, len(types))
+	for _, typ := range types {
+		d.new.Processes[typ] = d.old.Processes[typ]
+		expected[typ] = d.old.Processes[typ]
+	}
+	expected[canaryType]--
+	if err := d.client.PutFormation(d.new); err != nil {
+		return err
+	}
+	return d.waitUp(expected, time.After(d.opts.Timeout))
+}
+
+// routeCutover is a route which a blue/green deploy switches from a service
+// of the old release to the corresponding service of the new release.
+type routeCutover struct {
+	route *router.Route
+	from  string
+	to    string
+}
+
+func (d *deployment) blueGreen() (err error) {
+	types := d.types()
+	if len(types) == 0 {
+		return nil
+	}
+	cutovers, err := d.routeCutovers()
+	if err != nil {
+		return err
+	}
+	if len(cutovers) == 0 {
+		return fmt.Errorf("controller: app %s has no routes to the services of release %s to switch", d.new.AppID, d.old.ReleaseID)
+	}
+	// remove the new release if anything fails, the routes only point at it
+	// once all of its jobs are up
+	defer func() {
+		if err != nil {
+			d.client.DeleteFormation(d.new.AppID, d.new.ReleaseID)
+		}
+	}()
+
+	expected := make(map[string]int, len(types))
+	for _, typ := range types {
+		d.new.Processes[typ] = d.old.Processes[typ]
+		expected[typ] = d.old.Processes[typ]
+	}
+	if err := d.client.PutFormation(d.new); err != nil {
+		return err
+	}
+	if err := d.waitUp(expected, time.After(d.opts.Timeout)); err != nil {
+		return err
+	}
+
+	for i, cutover := range cutovers {
+		if err := d.client.UpdateRoute(d.new.AppID, cutover.route.ID, routeWithService(cutover.route, cutover.to)); err != nil {
+			// switch back the routes which were already switched
+			for _, switched := range cutovers[:i] {
+				d.client.UpdateRoute(d.new.AppID, switched.route.ID, routeWithService(switched.route, switched.from))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// routeCutovers returns the app's routes to the services of the old release,
+// along with the services of the new release they are switched to.
+func (d *deployment) routeCutovers() ([]*routeCutover, error) {
+	oldRelease, err := d.client.GetRelease(d.old.ReleaseID)
+	if err != nil {
+		return nil, err
+	}
+	newRelease, err := d.client.GetRelease(d.new.ReleaseID)
+	if err != nil {
+		return nil, err
+	}
+	oldServices := releaseServices(oldRelease)
+	newServices := releaseServices(newRelease)
+
+	routes, err := d.client.RouteList(d.new.AppID)
+	if err != nil {
+		return nil, err
+	}
+	var cutovers []*routeCutover
+	for _, route := range routes {
+		from := routeService(route)
+		for typ, service := range oldServices {
+			if service != from {
+				continue
+			}
+			to := newServices[typ]
+			if to == "" || to == from {
+				return nil, fmt.Errorf("controller: process type %q of release %s must register a service other than %q to be deployed blue/green", typ, d.new.ReleaseID, from)
+			}
+			cutovers = append(cutovers, &routeCutover{route: route, from: from, to: to})
+			break
+		}
+	}
+	return cutovers, nil
+}
+
+// blueGreenRelease returns the ID of the release to deploy blue/green in place
+// of the new release, which is a copy of it if any of its process types
+// register the same service as they did in the old release, with those
+// process types registering the alternate service instead.
+func (c *Client) blueGreenRelease(oldID, newID string) (string, error) {
+	oldRelease, err := c.GetRelease(oldID)
+	if err != nil {
+		return "", err
+	}
+	newRelease, err := c.GetRelease(newID)
+	if err != nil {
+		return "", err
+	}
+	oldServices := releaseServices(oldRelease)
+	var release *ct.Release
+	for typ, service := range releaseServices(newRelease) {
+		if oldServices[typ] != service {
+			continue
+		}
+		if release == nil {
+			release = copyRelease(newRelease)
+		}
+		release.Processes[typ].Env["SD_NAME"] = alternateService(service)
+	}
+	if release == nil {
+		return newID, nil
+	}
+	if err := c.CreateRelease(release); err != nil {
+		return "", err
+	}
+	return release.ID, nil
+}
+
+// copyRelease returns a copy of release to be created as a new release, with
+// each process type having its own environment.
+func copyRelease(release *ct.Release) *ct.Release {
+	r := *release
+	r.ID = ""
+	r.CreatedAt = nil
+	r.Processes = make(map[string]ct.ProcessType, len(release.Processes))
+	for typ, proc := range release.Processes {
+		env := make(map[string]string, len(proc.Env)+1)
+		for k, v := range proc.Env {
+			env[k] = v
+		}
+		proc.Env = env
+		r.Processes[typ] = proc
+	}
+	return &r
+}
+
+// alternateService returns the service which routes to service are switched
+// to by a blue/green deploy of a release which registers service again.
+func alternateService(service string) string {
+	if strings.HasSuffix(service, "-green") {
+		return strings.TrimSuffix(service, "-green")
+	}
+	return service + "-green"
+}
+
+// releaseServices returns the services registered by the process types of
+// the release, which are set using SD_NAME.
+func releaseServices(release *ct.Release) map[string]string {
+	services := make(map[string]string, len(release.Processes))
+	for typ, proc := range release.Processes {
+		service := proc.Env["SD_NAME"]
+		if service == "" {
+			service = release.Env["SD_NAME"]
+		}
+		if service != "" {
+			services[typ] = service
+		}
+	}
+	return services
+}
+
+func routeService(route *router.Route) string {
+	switch route.Type {
+	case "http":
+		return route.HTTPRoute().Service
+	case "tcp":
+		return route.TCPRoute().Service
+	}
+	return ""
+}
+
+// routeWithService returns a copy of route which points at service.
+func routeWithService(route *router.Route, service string) *router.Route {
+	switch route.Type {
+	case "http":
+		r := route.HTTPRoute()
+		r.Service = service
+		return r.ToRoute()
+	case "tcp":
+		r := route.TCPRoute()
+		r.Service = service
+		return r.ToRoute()
+	}
+	return route
+}
+
+var errJobStopped = errors.New("controller: job of new release stopped")
+
+// newJob returns whether the event is for a job of the new release.
+func (d *deployment) newJob(e *ct.JobEvent) bool {
+	return e.ReleaseID == d.new.ReleaseID && e.Type != ""
+}
+
+func jobStopped(state string) bool {
+	return state == "down" || state == "crashed" || state == "failed"
+}
+
+// waitUp waits for the given number of new jobs of each type to come up,
+// returning errJobStopped if a new job stops.
+func (d *deployment) waitUp(expected map[string]int, timeout <-chan time.Time) error {
+	poll := time.NewTicker(deployPollInterval)
+	defer poll.Stop()
+	for {
+		var remaining int
+		for _, n := range expected {
+			remaining += n
+		}
+		if remaining <= 0 {
+			return nil
+		}
+		select {
+		case e, ok := <-d.events:
+			if !ok {
+				return errors.New("controller: job event stream closed unexpectedly")
+			}
+			if !d.newJob(e) {
+				continue
+			}
+			if jobStopped(e.State) {
+				return errJobStopped
+			}
+			if _, ok := d.up[e.JobID]; e.State == "up" && !ok {
+				d.up[e.JobID] = struct{}{}
+				expected[e.Type]--
+				if err := d.progress(); err != nil {
+					return err
+				}
+			}
+		case <-poll.C:
+			if err := d.progress(); err != nil {
+				return err
+			}
+		case <-timeout:
+			return fmt.Errorf("controller: timed out waiting for %d jobs of release %s to start", remaining, d.new.ReleaseID)
+		}
+	}
+}
+
+// soak returns ErrCanaryFailed if a new job stops before the soak period
+// ends.
+func (d *deployment) soak(done <-chan time.Time) error {
+	poll := time.NewTicker(deployPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case e, ok := <-d.events:
+			if !ok {
+				return errors.New("controller: job event stream closed unexpectedly")
+			}
+			if d.newJob(e) && jobStopped(e.State) {
+				return ErrCanaryFailed
+			}
+		case <-poll.C:
+			if err := d.progress(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+// fakeDeployController serves the parts of the controller API used by
+// DeployAppRelease and WaitForRelease, calling onPut whenever a formation is
+// put so that tests can send job events in response, and onRoute whenever a
+// route is updated.
+type fakeDeployController struct {
+	mtx        sync.Mutex
+	release    string
+	releases   map[string]*ct.Release
+	formations map[string]*ct.Formation
+	jobs       []*ct.Job
+	routes     map[string]*router.Route
+	puts       map[string]int
+	deploys    []*ct.Deploy
+	events     chan *ct.JobEvent
+	onPut      func(f *ct.Formation)
+	onRoute    func(r *router.Route)
+}
+
+func newFakeDeployController(release string, procs map[string]int) *fakeDeployController {
+	return &fakeDeployController{
+		release:    release,
+		releases:   make(map[string]*ct.Release),
+		formations: map[string]*ct.Formation{release: {AppID: "app", ReleaseID: release, Processes: procs}},
+		routes:     make(map[string]*router.Route),
+		puts:       make(map[string]int),
+		events:     make(chan *ct.JobEvent, 100),
+	}
+}
+
+func (f *fakeDeployController) sendJob(id, release, typ, state string) {
+	f.events <- &ct.JobEvent{Job: ct.Job{AppID: "app", ReleaseID: release, Type: typ, State: state}, JobID: id}
+}
+
+func (f *fakeDeployController) deploy(id string) *ct.Deploy {
+	for _, d := range f.deploys {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *fakeDeployController) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/apps/app/jobs" && strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Write([]byte(":\n"))
+		w.(http.Flusher).Flush()
+		for e := range f.events {
+			fmt.Fprintf(w, "event: %s\ndata: ", e.State)
+			json.NewEncoder(w).Encode(e)
+			w.Write([]byte("\n"))
+			w.(http.Flusher).Flush()
+		}
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch {
+	case req.URL.Path == "/apps/app/jobs":
+		json.NewEncoder(w).Encode(f.jobs)
+	case req.URL.Path == "/deploys":
+		json.NewEncoder(w).Encode(f.deploys)
+	case req.URL.Path == "/apps/app/deploys" && req.Method == "POST":
+		d := &ct.Deploy{}
+		json.NewDecoder(req.Body).Decode(d)
+		d.ID = fmt.Sprintf("deploy%d", len(f.deploys))
+		d.AppID = "app"
+		d.Status = ct.DeployStatusRunning
+		f.deploys = append(f.deploys, d)
+		json.NewEncoder(w).Encode(d)
+	case strings.HasPrefix(req.URL.Path, "/apps/app/deploys/") && req.Method == "PUT":
+		update := &ct.Deploy{}
+		json.NewDecoder(req.Body).Decode(update)
+		d := f.deploy(strings.TrimPrefix(req.URL.Path, "/apps/app/deploys/"))
+		if d == nil {
+			w.WriteHeader(404)
+			return
+		}
+		if d.Status == ct.DeployStatusRunning {
+			d.Status, d.JobsUp, d.Error = update.Status, update.JobsUp, update.Error
+		}
+		json.NewEncoder(w).Encode(d)
+	case req.URL.Path == "/apps/app/deploy" && req.Method == "DELETE":
+		for _, d := range f.deploys {
+			if d.Status == ct.DeployStatusRunning {
+				d.Status = ct.DeployStatusStopped
+				json.NewEncoder(w).Encode(d)
+				return
+			}
+		}
+		w.WriteHeader(404)
+	case req.URL.Path == "/releases" && req.Method == "POST":
+		release := &ct.Release{}
+		json.NewDecoder(req.Body).Decode(release)
+		release.ID = fmt.Sprintf("release%d", len(f.releases))
+		f.releases[release.ID] = release
+		json.NewEncoder(w).Encode(release)
+	case strings.HasPrefix(req.URL.Path, "/releases/"):
+		release, ok := f.releases[strings.TrimPrefix(req.URL.Path, "/releases/")]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(release)
+	case req.URL.Path == "/apps/app/routes":
+		routes := make([]*router.Route, 0, len(f.routes))
+		for _, route := range f.routes {
+			routes = append(routes, route)
+		}
+		json.NewEncoder(w).Encode(routes)
+	case strings.HasPrefix(req.URL.Path, "/apps/app/routes/") && req.Method == "PUT":
+		route := &router.Route{}
+		json.NewDecoder(req.Body).Decode(route)
+		route.ID = strings.TrimPrefix(req.URL.Path, "/apps/app/routes/")
+		f.routes[route.ID] = route
+		if f.onRoute != nil {
+			f.onRoute(route)
+		}
+		json.NewEncoder(w).Encode(route)
+	case req.URL.Path == "/apps/app/release" && req.Method == "GET":
+		json.NewEncoder(w).Encode(&ct.Release{ID: f.release})
+	case req.URL.Path == "/apps/app/release" && req.Method == "PUT":
+		release := &ct.Release{}
+		json.NewDecoder(req.Body).Decode(release)
+		f.release = release.ID
+		w.WriteHeader(200)
+	case strings.HasPrefix(req.URL.Path, "/apps/app/formations/"):
+		id := strings.TrimPrefix(req.URL.Path, "/apps/app/formations/")
+		switch req.Method {
+		case "GET":
+			formation, ok := f.formations[id]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(w).Encode(formation)
+		case "PUT":
+			formation := &ct.Formation{}
+			json.NewDecoder(req.Body).Decode(formation)
+			f.formations[id] = formation
+			f.puts[id]++
+			if f.onPut != nil {
+				f.onPut(formation)
+			}
+			json.NewEncoder(w).Encode(formation)
+		case "DELETE":
+			delete(f.formations, id)
+			w.WriteHeader(200)
+		}
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (S) TestDeployCanaryCrash(c *C) {
+	f := newFakeDeployController("old", map[string]int{"web": 3, "worker": 2})
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID == "new" {
+			// the canary comes up and then crashes during the soak
+			f.sendJob("host0-canary", "new", "web", "up")
+			f.sendJob("host0-canary", "new", "web", "crashed")
+		}
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	err = client.DeployAppRelease("app", "new", &DeployOptions{
+		Strategy:   DeployAllAtOnceCanary,
+		CanarySoak: 10 * time.Second,
+	})
+	c.Assert(err, Equals, ErrCanaryFailed)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.release, Equals, "old")
+	c.Assert(f.puts["old"], Equals, 0)
+	c.Assert(f.puts["new"], Equals, 1)
+	c.Assert(f.formations, HasLen, 1)
+	c.Assert(f.formations["old"].Processes, DeepEquals, map[string]int{"web": 3, "worker": 2})
+}
+
+func (S) TestDeployCanary(c *C) {
+	f := newFakeDeployController("old", map[string]int{"web": 3, "worker": 2})
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID != "new" {
+			return
+		}
+		for typ, n := range formation.Processes {
+			for i := 0; i < n; i++ {
+				f.sendJob(fmt.Sprintf("host0-%s%d", typ, i), "new", typ, "up")
+			}
+		}
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	err = client.DeployAppRelease("app", "new", &DeployOptions{
+		Strategy:   DeployAllAtOnceCanary,
+		CanarySoak: 100 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.release, Equals, "new")
+	// the canary and then the rest in a single wave
+	c.Assert(f.puts["new"], Equals, 2)
+	c.Assert(f.formations, HasLen, 1)
+	c.Assert(f.formations["new"].Processes, DeepEquals, map[string]int{"web": 3, "worker": 2})
+}
+
+// newFakeBlueGreenController returns a fake controller for blue/green deploys
+// from the old to the new release of an app with three web jobs, where each
+// release registers its own service which is routed to by a single route.
+func newFakeBlueGreenController() *fakeDeployController {
+	f := newFakeDeployController("old", map[string]int{"web": 3})
+	for _, id := range []string{"old", "new"} {
+		f.releases[id] = &ct.Release{ID: id, Processes: map[string]ct.ProcessType{
+			"web": {Env: map[string]string{"SD_NAME": "app-web-" + id}},
+		}}
+	}
+	route := (&router.HTTPRoute{Domain: "app.example.com", Service: "app-web-old"}).ToRoute()
+	route.ID = "http/app"
+	f.routes[route.ID] = route
+	return f
+}
+
+func (S) TestDeployBlueGreen(c *C) {
+	f := newFakeBlueGreenController()
+
+	// the number of up jobs of each release, jobs of the old release go
+	// away when its formation is deleted
+	up := map[string]int{"old": 3}
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID != "new" {
+			return
+		}
+		go func() {
+			for i := 0; i < formation.Processes["web"]; i++ {
+				id := fmt.Sprintf("host0-web%d", i)
+				f.sendJob(id, "new", "web", "starting")
+				time.Sleep(10 * time.Millisecond)
+				f.mtx.Lock()
+				up["new"]++
+				f.mtx.Unlock()
+				f.sendJob(id, "new", "web", "up")
+			}
+		}()
+	}
+	var upAtCutover int
+	f.onRoute = func(route *router.Route) {
+		upAtCutover = up["new"]
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// send requests through the route throughout the deploy, counting those
+	// whose service has no jobs to serve them
+	var requests, dropped int
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			f.mtx.Lock()
+			release := strings.TrimPrefix(f.routes["http/app"].HTTPRoute().Service, "app-web-")
+			if _, ok := f.formations[release]; !ok || up[release] == 0 {
+				dropped++
+			}
+			requests++
+			f.mtx.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	err = client.DeployAppRelease("app", "new", &DeployOptions{Strategy: DeployBlueGreen})
+	close(stop)
+	<-done
+	c.Assert(err, IsNil)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(requests > 0, Equals, true)
+	c.Assert(dropped, Equals, 0)
+	// the route was only switched once all of the new jobs were up
+	c.Assert(upAtCutover, Equals, 3)
+	c.Assert(f.routes["http/app"].HTTPRoute().Service, Equals, "app-web-new")
+	c.Assert(f.routes["http/app"].HTTPRoute().Domain, Equals, "app.example.com")
+	c.Assert(f.release, Equals, "new")
+	// the full new formation was started in one step
+	c.Assert(f.puts["new"], Equals, 1)
+	c.Assert(f.puts["old"], Equals, 0)
+	c.Assert(f.formations, HasLen, 1)
+	c.Assert(f.formations["new"].Processes, DeepEquals, map[string]int{"web": 3})
+}
+
+func (S) TestDeployBlueGreenRollback(c *C) {
+	f := newFakeBlueGreenController()
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID == "new" {
+			f.sendJob("host0-web0", "new", "web", "up")
+			f.sendJob("host0-web1", "new", "web", "crashed")
+		}
+	}
+	routeUpdated := false
+	f.onRoute = func(*router.Route) { routeUpdated = true }
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	err = client.DeployAppRelease("app", "new", &DeployOptions{Strategy: DeployBlueGreen})
+	c.Assert(err, NotNil)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	// the new release is removed, and the old one is left serving the route
+	c.Assert(routeUpdated, Equals, false)
+	c.Assert(f.routes["http/app"].HTTPRoute().Service, Equals, "app-web-old")
+	c.Assert(f.release, Equals, "old")
+	c.Assert(f.formations, HasLen, 1)
+	c.Assert(f.formations["old"].Processes, DeepEquals, map[string]int{"web": 3})
+}
+
+func (S) TestDeployBlueGreenSameService(c *C) {
+	// the new release registers the same service as the old one, as
+	// releases created by the git receiver do
+	f := newFakeBlueGreenController()
+	f.releases["new"].Processes["web"].Env["SD_NAME"] = "app-web-old"
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID == "old" {
+			return
+		}
+		for i := 0; i < formation.Processes["web"]; i++ {
+			f.sendJob(fmt.Sprintf("host0-web%d", i), formation.ReleaseID, "web", "up")
+		}
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// a copy of the new release which registers the alternate service is
+	// deployed, and the route switched to it
+	err = client.DeployAppRelease("app", "new", &DeployOptions{Strategy: DeployBlueGreen})
+	c.Assert(err, IsNil)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.release, Not(Equals), "new")
+	c.Assert(f.release, Not(Equals), "old")
+	c.Assert(f.releases[f.release].Processes["web"].Env["SD_NAME"], Equals, "app-web-old-green")
+	c.Assert(f.releases["new"].Processes["web"].Env["SD_NAME"], Equals, "app-web-old")
+	c.Assert(f.routes["http/app"].HTTPRoute().Service, Equals, "app-web-old-green")
+	c.Assert(f.puts["new"], Equals, 0)
+	c.Assert(f.deploys[0].NewReleaseID, Equals, f.release)
+
+	// deploying the same service again switches back
+	c.Assert(alternateService("app-web-old-green"), Equals, "app-web-old")
+}
+
+func (S) TestDeployBlueGreenNoRoutes(c *C) {
+	f := newFakeBlueGreenController()
+	delete(f.routes, "http/app")
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// there is no route to switch, so nothing is started
+	err = client.DeployAppRelease("app", "new", &DeployOptions{Strategy: DeployBlueGreen})
+	c.Assert(err, NotNil)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.puts["new"], Equals, 0)
+	c.Assert(f.release, Equals, "old")
+}
+
+func (S) TestDeployList(c *C) {
+	f := newFakeDeployController("old", map[string]int{"web": 2})
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// list the deploys before each new job comes up
+	listed := make(chan []*ct.Deploy, 2)
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID != "new" {
+			return
+		}
+		id := fmt.Sprintf("host0-web%d", formation.Processes["web"])
+		go func() {
+			list, err := client.DeployList()
+			c.Check(err, IsNil)
+			listed <- list
+			f.sendJob(id, "new", "web", "up")
+		}()
+	}
+
+	err = client.DeployAppRelease("app", "new", nil)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		list := <-listed
+		c.Assert(list, HasLen, 1)
+		c.Assert(list[0].AppID, Equals, "app")
+		c.Assert(list[0].OldReleaseID, Equals, "old")
+		c.Assert(list[0].NewReleaseID, Equals, "new")
+		c.Assert(list[0].Strategy, Equals, DeployRolling)
+		c.Assert(list[0].Status, Equals, ct.DeployStatusRunning)
+		c.Assert(list[0].JobsUp, Equals, i)
+		c.Assert(list[0].JobsExpected, Equals, 2)
+	}
+
+	list, err := client.DeployList()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Status, Equals, ct.DeployStatusComplete)
+	c.Assert(list[0].JobsUp, Equals, 2)
+	c.Assert(list[0].Error, Equals, "")
+}
+
+func (S) TestStopDeploy(c *C) {
+	f := newFakeDeployController("old", map[string]int{"web": 3})
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// stop the deploy once the canary has been started
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID != "new" {
+			return
+		}
+		go func() {
+			c.Check(client.StopDeploy("app"), IsNil)
+			f.sendJob("host0-canary", "new", "web", "up")
+		}()
+	}
+
+	err = client.DeployAppRelease("app", "new", &DeployOptions{Strategy: DeployAllAtOnceCanary})
+	c.Assert(err, Equals, ErrDeployStopped)
+	c.Assert(client.StopDeploy("app"), Equals, ErrNotFound)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.deploys, HasLen, 1)
+	c.Assert(f.deploys[0].Status, Equals, ct.DeployStatusStopped)
+	c.Assert(f.release, Equals, "old")
+	c.Assert(f.formations, HasLen, 1)
+	c.Assert(f.formations["old"].Processes, DeepEquals, map[string]int{"web": 3})
+}
+
+func (S) TestStopDeployWithoutJobEvents(c *C) {
+	defer func(d time.Duration) { deployPollInterval = d }(deployPollInterval)
+	deployPollInterval = 10 * time.Millisecond
+
+	f := newFakeDeployController("old", map[string]int{"web": 3})
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// stop the deploy once the first new job has been requested, which
+	// never comes up
+	f.onPut = func(formation *ct.Formation) {
+		if formation.ReleaseID == "new" {
+			go func() { c.Check(client.StopDeploy("app"), IsNil) }()
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- client.DeployAppRelease("app", "new", nil) }()
+	select {
+	case err := <-done:
+		c.Assert(err, Equals, ErrDeployStopped)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the deploy to stop")
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.deploys[0].Status, Equals, ct.DeployStatusStopped)
+	c.Assert(f.release, Equals, "old")
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+// JobOutput is an item received from a job run with RunJob. Every item but
+// the last is a chunk of output from Stream, the last has Done set along with
+// either the job's exit status or the error which ended the stream.
+type JobOutput struct {
+	Stream string // "stdout" or "stderr"
+	Data   []byte
+
+	Done       bool
+	ExitStatus int
+	Err        error
+}
+
+// RunJob runs a one-off job attached, sending its output and then its exit
+// status on the returned channel, which is closed after the last item. The
+// job's stdin is closed straight away, and the channel must be drained.
+func (c *Client) RunJob(appID string, job *ct.NewJob) (<-chan JobOutput, error) {
+	rwc, err := c.RunJobAttached(appID, job)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan JobOutput)
+	go func() {
+		defer close(ch)
+		defer rwc.Close()
+		client := cluster.NewAttachClient(rwc)
+		client.CloseWrite()
+		status, err := client.Receive(jobOutputWriter{ch, "stdout"}, jobOutputWriter{ch, "stderr"})
+		ch <- JobOutput{Done: true, ExitStatus: status, Err: err}
+	}()
+	return ch, nil
+}
+
+// jobOutputWriter sends each write as a JobOutput from the stream.
+type jobOutputWriter struct {
+	ch     chan<- JobOutput
+	stream string
+}
+
+func (w jobOutputWriter) Write(p []byte) (int, error) {
+	// the buffer is reused by the caller, so copy the data
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.ch <- JobOutput{Stream: w.stream, Data: data}
+	return len(p), nil
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"bytes"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (S) TestRunJob(c *C) {
+	var stream bytes.Buffer
+	stream.Write(dataFrame(1, "hello\n"))
+	stream.Write(dataFrame(2, "failed"))
+	stream.Write(dataFrame(1, ""))
+	stream.Write(dataFrame(2, ""))
+	stream.Write(exitFrame(1))
+	client, cleanup := newAttachTestClient(c, &fakeAttachServer{responses: [][]byte{stream.Bytes()}})
+	defer cleanup()
+
+	ch, err := client.RunJob("app", &ct.NewJob{Cmd: []string{"sh", "-c", "echo hello; echo failed >&2; exit 1"}})
+	c.Assert(err, IsNil)
+	var out []JobOutput
+	for o := range ch {
+		out = append(out, o)
+	}
+	c.Assert(out, DeepEquals, []JobOutput{
+		{Stream: "stdout", Data: []byte("hello\n")},
+		{Stream: "stderr", Data: []byte("failed")},
+		{Done: true, ExitStatus: 1},
+	})
+}
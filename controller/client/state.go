@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"fmt"
+)
+
+// StreamJobsState streams the state changes of the given jobs of the app,
+// which are job IDs as returned by JobList. Only events which change the
+// state of one of the jobs are sent, and the Events channel is closed once
+// all of the jobs have reached a terminal state (down, crashed or failed),
+// including jobs which already had when the stream was started. An error is
+// returned if any of the jobs is not one of the app's jobs.
+func (c *Client) StreamJobsState(appID string, jobIDs []string) (*JobEventStream, error) {
+	// subscribe to job events before listing the jobs so that no changes are
+	// missed in between
+	stream, err := c.StreamJobEventsWithOptions(appID, &StreamJobEventsOptions{JobIDs: jobIDs})
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.JobList(appID)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	// states is the last known state of each job, jobs are removed once they
+	// reach a terminal state
+	states := make(map[string]string, len(jobIDs))
+	for _, id := range jobIDs {
+		states[id] = ""
+	}
+	known := make(map[string]struct{}, len(jobIDs))
+	for _, job := range list {
+		if _, ok := states[job.ID]; !ok {
+			continue
+		}
+		known[job.ID] = struct{}{}
+		if jobStopped(job.State) {
+			delete(states, job.ID)
+		} else {
+			states[job.ID] = job.State
+		}
+	}
+	for _, id := range jobIDs {
+		// an unknown job would never reach a terminal state, so the
+		// stream would never finish
+		if _, ok := known[id]; !ok {
+			stream.Close()
+			return nil, fmt.Errorf("controller: unknown job %s", id)
+		}
+	}
+
+	filtered := stream.filter()
+	go func() {
+		defer close(filtered.Events)
+		if len(states) == 0 {
+			stream.Close()
+		}
+		for e := range stream.Events {
+			state, ok := states[e.JobID]
+			if !ok || e.State == state {
+				continue
+			}
+			if jobStopped(e.State) {
+				delete(states, e.JobID)
+			} else {
+				states[e.JobID] = e.State
+			}
+			if !filtered.send(e) {
+				return
+			}
+			if len(states) == 0 {
+				// drain the events which were already read until the
+				// underlying stream closes
+				stream.Close()
+			}
+		}
+	}()
+	return filtered, nil
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (S) TestStreamJobsState(c *C) {
+	f := newFakeDeployController("release", map[string]int{"web": 3})
+	f.jobs = []*ct.Job{
+		{ID: "host0-web0", AppID: "app", ReleaseID: "release", Type: "web", State: "starting"},
+		{ID: "host0-web1", AppID: "app", ReleaseID: "release", Type: "web", State: "starting"},
+		{ID: "host0-web2", AppID: "app", ReleaseID: "release", Type: "web", State: "up"},
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamJobsState("app", []string{"host0-web0", "host0-web1"})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	f.sendJob("host0-web0", "release", "web", "starting") // not a change
+	f.sendJob("host0-web2", "release", "web", "down")     // not watched
+	f.sendJob("host0-web0", "release", "web", "up")
+	f.sendJob("host0-other", "release", "web", "starting") // not watched
+	f.sendJob("host0-web1", "release", "web", "up")
+	f.sendJob("host0-web0", "release", "web", "down")
+	f.sendJob("host0-web1", "release", "web", "crashed")
+	f.sendJob("host0-web2", "release", "web", "starting") // after the stream ends
+
+	type update struct{ id, state string }
+	var updates []update
+	timeout := time.After(5 * time.Second)
+loop:
+	for {
+		select {
+		case e, ok := <-stream.Events:
+			if !ok {
+				break loop
+			}
+			updates = append(updates, update{e.JobID, e.State})
+		case <-timeout:
+			c.Fatal("timed out waiting for the stream to close")
+		}
+	}
+	c.Assert(updates, DeepEquals, []update{
+		{"host0-web0", "up"},
+		{"host0-web1", "up"},
+		{"host0-web0", "down"},
+		{"host0-web1", "crashed"},
+	})
+}
+
+func (S) TestStreamJobsStateAlreadyStopped(c *C) {
+	f := newFakeDeployController("release", map[string]int{"web": 1})
+	f.jobs = []*ct.Job{{ID: "host0-web0", AppID: "app", ReleaseID: "release", Type: "web", State: "down"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamJobsState("app", []string{"host0-web0"})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	select {
+	case e, ok := <-stream.Events:
+		c.Assert(ok, Equals, false, Commentf("unexpected event %+v", e))
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the stream to close")
+	}
+}
+
+func (S) TestStreamJobsStateUnknownJob(c *C) {
+	f := newFakeDeployController("release", map[string]int{"web": 1})
+	f.jobs = []*ct.Job{{ID: "host0-web0", AppID: "app", ReleaseID: "release", Type: "web", State: "up"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	// a job which is not in the job list would never finish the stream
+	_, err = client.StreamJobsState("app", []string{"host0-web0", "host0-other"})
+	c.Assert(err, ErrorMatches, "controller: unknown job host0-other")
+}
+
+func (S) TestStreamJobsStateClose(c *C) {
+	f := newFakeDeployController("release", map[string]int{"web": 1})
+	f.jobs = []*ct.Job{{ID: "host0-web0", AppID: "app", ReleaseID: "release", Type: "web", State: "starting"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamJobsState("app", []string{"host0-web0"})
+	c.Assert(err, IsNil)
+
+	// closing a stream whose events are not being received stops it
+	// without sending them
+	f.sendJob("host0-web0", "release", "web", "up")
+	time.Sleep(100 * time.Millisecond)
+	stream.Close()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case e, ok := <-stream.Events:
+		c.Assert(ok, Equals, false, Commentf("unexpected event %+v", e))
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the stream to stop")
+	}
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// FormationStatusStream is a stream of the status of an app's formations,
+// see StreamFormationStatus.
+type FormationStatusStream struct {
+	Updates chan *ct.FormationStatus
+
+	formations    *FormationUpdates
+	formationsErr *error
+	jobs          *JobEventStream
+	err           error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close stops the stream, Updates is closed once it has stopped.
+func (s *FormationStatusStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.formations.Close()
+		s.jobs.Close()
+	})
+}
+
+// Err returns the error which caused the stream to stop, it should only be
+// called once Updates has been closed.
+func (s *FormationStatusStream) Err() error {
+	return s.err
+}
+
+// StreamFormationStatus streams the number of jobs of each process type which
+// the formations of the app want running and the number which are up. The
+// current status is sent once it is known, and then an update is sent
+// whenever either number changes, for example when a job comes up or crashes
+// or a formation is scaled.
+func (c *Client) StreamFormationStatus(appID string) (*FormationStatusStream, error) {
+	// subscribe to job events before listing the jobs so that no changes are
+	// missed in between
+	jobs, err := c.StreamJobEvents(appID)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.JobList(appID)
+	if err != nil {
+		jobs.Close()
+		return nil, err
+	}
+	formations, formationsErr := c.StreamAppFormations(appID, nil)
+	stream := &FormationStatusStream{
+		Updates:       make(chan *ct.FormationStatus),
+		formations:    formations,
+		formationsErr: formationsErr,
+		jobs:          jobs,
+		done:          make(chan struct{}),
+	}
+	go stream.run(c, appID, list)
+	return stream, nil
+}
+
+func (s *FormationStatusStream) run(c *Client, appID string, list []*ct.Job) {
+	defer close(s.Updates)
+	defer s.Close()
+
+	// desired is the processes of each of the app's formations, keyed by
+	// release ID
+	desired := make(map[string]map[string]int)
+	// up is the type of each job of the app which is up, keyed by job ID
+	up := make(map[string]string)
+	setJobs := func(list []*ct.Job) {
+		up = make(map[string]string, len(list))
+		for _, job := range list {
+			if job.Type != "" && job.State == "up" {
+				up[job.ID] = job.Type
+			}
+		}
+	}
+	setJobs(list)
+
+	// the initial status is not known until the existing formations have
+	// all been received, which is indicated by a sentinel
+	var synced bool
+	var last *ct.FormationStatus
+	for {
+		select {
+		case <-s.done:
+			return
+		case f, ok := <-s.formations.Chan:
+			if !ok {
+				if s.err = *s.formationsErr; s.err == nil {
+					s.err = errors.New("controller: formation stream closed unexpectedly")
+				}
+				return
+			}
+			if f.App == nil {
+				synced = true
+			} else if len(f.Processes) == 0 {
+				delete(desired, f.Release.ID)
+			} else {
+				desired[f.Release.ID] = f.Processes
+			}
+		case e, ok := <-s.jobs.Events:
+			if !ok {
+				s.err = errors.New("controller: job event stream closed unexpectedly")
+				return
+			}
+			switch {
+			case e.State == ct.JobEventGap:
+				// events were dropped, so start again from the job list
+				list, err := c.JobList(appID)
+				if err != nil {
+					s.err = err
+					return
+				}
+				setJobs(list)
+			case e.Type == "":
+				continue
+			case e.State == "up":
+				up[e.JobID] = e.Type
+			case jobStopped(e.State):
+				delete(up, e.JobID)
+			}
+		}
+		if !synced {
+			continue
+		}
+
+		status := &ct.FormationStatus{
+			AppID:   appID,
+			Desired: make(map[string]int),
+			Running: make(map[string]int),
+		}
+		for _, procs := range desired {
+			for typ, n := range procs {
+				if n > 0 {
+					status.Desired[typ] += n
+				}
+			}
+		}
+		for _, typ := range up {
+			status.Running[typ]++
+		}
+		if last != nil && reflect.DeepEqual(status, last) {
+			continue
+		}
+		select {
+		case s.Updates <- status:
+		case <-s.done:
+			return
+		}
+		last = status
+	}
+}
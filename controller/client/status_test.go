@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+	"github.com/flynn/flynn/pkg/rpcplus/comborpc"
+)
+
+// fakeFormationsRPC streams the given formations of the requested app
+// followed by the sentinel, and then any formations sent on updates.
+type fakeFormationsRPC struct {
+	formations []*ct.ExpandedFormation
+	updates    chan *ct.ExpandedFormation
+}
+
+func (f *fakeFormationsRPC) StreamAppFormations(req ct.StreamFormationsReq, stream rpcplus.Stream) error {
+	for _, formation := range append(f.formations, &ct.ExpandedFormation{}) {
+		if formation.App != nil && formation.App.ID != req.AppID {
+			continue
+		}
+		select {
+		case stream.Send <- formation:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	for {
+		select {
+		case formation := <-f.updates:
+			select {
+			case stream.Send <- formation:
+			case <-stream.Error:
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+func (S) TestStreamFormationStatus(c *C) {
+	app := &ct.App{ID: "app"}
+	release := &ct.Release{ID: "release"}
+	formations := &fakeFormationsRPC{
+		formations: []*ct.ExpandedFormation{
+			{App: app, Release: release, Processes: map[string]int{"web": 1}},
+			{App: &ct.App{ID: "other"}, Release: &ct.Release{ID: "other"}, Processes: map[string]int{"web": 5}},
+		},
+		updates: make(chan *ct.ExpandedFormation),
+	}
+	rpcServer := rpcplus.NewServer()
+	c.Assert(rpcServer.RegisterName("Controller", formations), IsNil)
+	rpcHandler := comborpc.New(rpcServer)
+
+	events := make(chan *ct.JobEvent)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == rpcplus.DefaultRPCPath:
+			rpcHandler.ServeHTTP(w, req)
+		case req.URL.Path == "/apps/app/jobs" && strings.Contains(req.Header.Get("Accept"), "text/event-stream"):
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			w.Write([]byte(":\n"))
+			w.(http.Flusher).Flush()
+			for e := range events {
+				fmt.Fprintf(w, "event: %s\ndata: ", e.State)
+				json.NewEncoder(w).Encode(e)
+				w.Write([]byte("\n"))
+				w.(http.Flusher).Flush()
+			}
+		case req.URL.Path == "/apps/app/jobs":
+			json.NewEncoder(w).Encode([]*ct.Job{
+				{ID: "host0-web0", AppID: "app", ReleaseID: "release", Type: "web", State: "up"},
+				{ID: "host0-oneoff", AppID: "app", ReleaseID: "release", State: "up"},
+			})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	defer close(events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamFormationStatus("app")
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	assertStatus := func(desired, running int) {
+		select {
+		case status, ok := <-stream.Updates:
+			if !ok {
+				c.Fatalf("stream closed unexpectedly: %s", stream.Err())
+			}
+			c.Assert(status.AppID, Equals, "app")
+			c.Assert(status.Desired["web"], Equals, desired)
+			c.Assert(status.Running["web"], Equals, running)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for status %d/%d", running, desired)
+		}
+	}
+	sendJob := func(id, state string) {
+		events <- &ct.JobEvent{Job: ct.Job{AppID: "app", ReleaseID: "release", Type: "web", State: state}, JobID: id}
+	}
+
+	assertStatus(1, 1)
+
+	// scale up and check the running count climbs to the target
+	formations.updates <- &ct.ExpandedFormation{App: app, Release: release, Processes: map[string]int{"web": 3}}
+	assertStatus(3, 1)
+	sendJob("host0-web1", "starting")
+	sendJob("host0-web1", "up")
+	assertStatus(3, 2)
+	// a repeated event does not change the status
+	sendJob("host0-web1", "up")
+	sendJob("host0-web2", "up")
+	assertStatus(3, 3)
+
+	// a crash widens the gap again
+	sendJob("host0-web0", "crashed")
+	assertStatus(3, 2)
+	sendJob("host0-web3", "up")
+	assertStatus(3, 3)
+
+	// scale down
+	formations.updates <- &ct.ExpandedFormation{App: app, Release: release, Processes: map[string]int{"web": 1}}
+	assertStatus(1, 3)
+	sendJob("host0-web2", "down")
+	sendJob("host0-web3", "down")
+	assertStatus(1, 2)
+	assertStatus(1, 1)
+}
+
+func (S) TestStreamFormationStatusClose(c *C) {
+	formations := &fakeFormationsRPC{
+		formations: []*ct.ExpandedFormation{
+			{App: &ct.App{ID: "app"}, Release: &ct.Release{ID: "release"}, Processes: map[string]int{"web": 1}},
+		},
+		updates: make(chan *ct.ExpandedFormation),
+	}
+	rpcServer := rpcplus.NewServer()
+	c.Assert(rpcServer.RegisterName("Controller", formations), IsNil)
+	rpcHandler := comborpc.New(rpcServer)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == rpcplus.DefaultRPCPath:
+			rpcHandler.ServeHTTP(w, req)
+		case req.URL.Path == "/apps/app/jobs" && strings.Contains(req.Header.Get("Accept"), "text/event-stream"):
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			w.Write([]byte(":\n"))
+			w.(http.Flusher).Flush()
+			<-w.(http.CloseNotifier).CloseNotify()
+		case req.URL.Path == "/apps/app/jobs":
+			json.NewEncoder(w).Encode([]*ct.Job{})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	stream, err := client.StreamFormationStatus("app")
+	c.Assert(err, IsNil)
+
+	// closing a stream whose update is not being received stops it without
+	// sending the update
+	time.Sleep(100 * time.Millisecond)
+	stream.Close()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case status, ok := <-stream.Updates:
+		if ok {
+			c.Fatalf("expected the stream to have stopped, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the stream to stop")
+	}
+}
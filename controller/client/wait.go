@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type WaitOpts struct {
+	// Timeout is how long to wait for the release to be rolled out, zero
+	// uses DefaultDeployTimeout.
+	Timeout time.Duration
+
+	// RollbackRelease is the release to set back as the app's release if
+	// the rollout fails, empty leaves the new release in place.
+	RollbackRelease string
+}
+
+// WaitForRelease waits until the formation of the release has the desired
+// number of jobs of each process type up, which for process types with a
+// health check means that they are passing it. It is typically called after
+// SetAppRelease.
+//
+// An error is returned if a job of the release crashes or fails to start, or
+// if the timeout is reached, in which case the app is rolled back to
+// opts.RollbackRelease if it is set.
+func (c *Client) WaitForRelease(appID, releaseID string, opts WaitOpts) (err error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultDeployTimeout
+	}
+	if opts.RollbackRelease != "" {
+		defer func() {
+			if err == nil {
+				return
+			}
+			if rerr := c.SetAppRelease(appID, opts.RollbackRelease); rerr != nil {
+				err = fmt.Errorf("%s (rollback to release %s also failed: %s)", err, opts.RollbackRelease, rerr)
+			}
+		}()
+	}
+
+	// subscribe to job events before listing the jobs so that no changes are
+	// missed in between
+	stream, err := c.StreamJobEvents(appID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	formation, err := c.GetFormation(appID, releaseID)
+	if err == ErrNotFound {
+		// the release has nothing to run
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// up is the type of each job of the release which is up, keyed by job
+	// ID
+	var up map[string]string
+	listJobs := func() error {
+		list, err := c.JobList(appID)
+		if err != nil {
+			return err
+		}
+		up = make(map[string]string, len(list))
+		for _, job := range list {
+			if job.ReleaseID == releaseID && job.Type != "" && job.State == "up" {
+				up[job.ID] = job.Type
+			}
+		}
+		return nil
+	}
+	if err := listJobs(); err != nil {
+		return err
+	}
+
+	timeout := time.After(opts.Timeout)
+	for {
+		running := make(map[string]int, len(formation.Processes))
+		for _, typ := range up {
+			running[typ]++
+		}
+		var remaining int
+		for typ, n := range formation.Processes {
+			if n > running[typ] {
+				remaining += n - running[typ]
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case e, ok := <-stream.Events:
+			if !ok {
+				return errors.New("controller: job event stream closed unexpectedly")
+			}
+			switch {
+			case e.State == ct.JobEventGap:
+				// events were dropped, so start again from the job list
+				if err := listJobs(); err != nil {
+					return err
+				}
+			case e.ReleaseID != releaseID || e.Type == "":
+				continue
+			case e.State == "crashed" || e.State == "failed":
+				return fmt.Errorf("controller: job %s of release %s %s", e.JobID, releaseID, e.State)
+			case e.State == "up":
+				up[e.JobID] = e.Type
+			case e.State == "down":
+				delete(up, e.JobID)
+			}
+		case <-timeout:
+			return fmt.Errorf("controller: timed out waiting for %d jobs of release %s to start", remaining, releaseID)
+		}
+	}
+}
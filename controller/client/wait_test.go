@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (S) TestWaitForRelease(c *C) {
+	f := newFakeDeployController("new", map[string]int{"web": 2, "worker": 1})
+	f.jobs = []*ct.Job{
+		{ID: "host0-web0", AppID: "app", ReleaseID: "old", Type: "web", State: "up"},
+		{ID: "host0-web1", AppID: "app", ReleaseID: "old", Type: "web", State: "up"},
+		{ID: "host0-worker0", AppID: "app", ReleaseID: "old", Type: "worker", State: "up"},
+		// already up before waiting
+		{ID: "host0-web2", AppID: "app", ReleaseID: "new", Type: "web", State: "up"},
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() { done <- client.WaitForRelease("app", "new", WaitOpts{Timeout: 10 * time.Second}) }()
+	assertWaiting := func() {
+		select {
+		case err := <-done:
+			c.Fatalf("WaitForRelease returned early: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// jobs which are starting, or of the old release, don't count
+	f.sendJob("host0-web3", "new", "web", "starting")
+	f.sendJob("host0-worker1", "old", "worker", "up")
+	assertWaiting()
+	// a job which comes up and goes down again no longer counts
+	f.sendJob("host0-worker1", "new", "worker", "up")
+	f.sendJob("host0-worker1", "new", "worker", "down")
+	assertWaiting()
+	f.sendJob("host0-worker2", "new", "worker", "up")
+	assertWaiting()
+	f.sendJob("host0-web3", "new", "web", "up")
+
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for WaitForRelease to return")
+	}
+}
+
+func (S) TestWaitForReleaseRollback(c *C) {
+	f := newFakeDeployController("new", map[string]int{"web": 2})
+	f.formations["old"] = &ct.Formation{AppID: "app", ReleaseID: "old", Processes: map[string]int{"web": 2}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	f.sendJob("host0-web0", "new", "web", "up")
+	f.sendJob("host0-web1", "new", "web", "crashed")
+	err = client.WaitForRelease("app", "new", WaitOpts{Timeout: 10 * time.Second, RollbackRelease: "old"})
+	c.Assert(err, ErrorMatches, "controller: job host0-web1 of release new crashed")
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.release, Equals, "old")
+}
+
+func (S) TestWaitForReleaseTimeout(c *C) {
+	f := newFakeDeployController("new", map[string]int{"web": 1})
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	defer close(f.events)
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	err = client.WaitForRelease("app", "new", WaitOpts{Timeout: 100 * time.Millisecond})
+	c.Assert(err, ErrorMatches, "controller: timed out waiting for 1 jobs of release new to start")
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.release, Equals, "new")
+}
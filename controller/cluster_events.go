@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type ClusterEventRepo struct {
+	db *DB
+}
+
+func NewClusterEventRepo(db *DB) *ClusterEventRepo {
+	return &ClusterEventRepo{db}
+}
+
+const clusterEventColumns = "event_id, type, app_id, object_id, data, created_at"
+
+// Events are kept for clusterEventRetention, and old events are pruned once
+// every clusterEventPruneInterval events.
+var (
+	clusterEventRetention           = 7 * 24 * time.Hour
+	clusterEventPruneInterval int64 = 1000
+)
+
+func scanClusterEvent(s Scanner) (*ct.ClusterEvent, error) {
+	e := &ct.ClusterEvent{}
+	var typ, data string
+	var appID sql.NullString
+	if err := s.Scan(&e.ID, &typ, &appID, &e.ObjectID, &data, &e.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	e.Type = ct.ClusterEventType(typ)
+	if appID.Valid {
+		e.AppID = cleanUUID(appID.String)
+	}
+	if data != "" {
+		e.Data = json.RawMessage(data)
+	}
+	return e, nil
+}
+
+// Add inserts an event, holding a lock on the table until the event is
+// committed so that events are committed in ID order. Otherwise a stream which
+// has sent an event could skip one with a lower ID which commits later.
+// Events older than clusterEventRetention are pruned as events are added.
+func (r *ClusterEventRepo) Add(e *ct.ClusterEvent) error {
+	var appID interface{}
+	if e.AppID != "" {
+		appID = e.AppID
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// EXCLUSIVE mode conflicts with itself but not with reads
+	if _, err := tx.Exec("LOCK TABLE cluster_events IN EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow("INSERT INTO cluster_events (type, app_id, object_id, data) VALUES ($1, $2, $3, $4) RETURNING event_id, created_at",
+		string(e.Type), appID, e.ObjectID, string(e.Data)).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if e.ID%clusterEventPruneInterval == 0 {
+		if _, err := tx.Exec("DELETE FROM cluster_events WHERE created_at < $1", time.Now().Add(-clusterEventRetention)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// listAfter returns at most n events with an ID greater than sinceID, oldest
+// first.
+func (r *ClusterEventRepo) listAfter(sinceID int64, n int) ([]*ct.ClusterEvent, error) {
+	rows, err := r.db.Query("SELECT "+clusterEventColumns+" FROM cluster_events WHERE event_id > $1 ORDER BY event_id LIMIT $2", sinceID, n)
+	if err != nil {
+		return nil, err
+	}
+	var events []*ct.ClusterEvent
+	for rows.Next() {
+		e, err := scanClusterEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// recordClusterEvent adds an event about the given object to the cluster
+// event stream. The object has already been stored by the time its event is
+// recorded, so errors are logged rather than failing the request.
+func recordClusterEvent(db *DB, typ ct.ClusterEventType, appID, objectID string, data interface{}) {
+	e := &ct.ClusterEvent{Type: typ, AppID: appID, ObjectID: objectID}
+	var err error
+	if data != nil {
+		e.Data, err = json.Marshal(data)
+	}
+	if err == nil {
+		err = NewClusterEventRepo(db).Add(e)
+	}
+	if err != nil {
+		log.Printf("error recording %s cluster event for %q: %s", typ, objectID, err)
+	}
+}
+
+// createClusterEvent records an event observed outside of the controller,
+// the controller records the events of the jobs, deploys and formations it
+// stores itself.
+func createClusterEvent(e ct.ClusterEvent, repo *ClusterEventRepo, r ResponseHelper) {
+	switch e.Type {
+	case ct.ClusterEventHost, ct.ClusterEventScheduler:
+	default:
+		r.Error(ct.ValidationError{Field: "type", Message: "must be either host or scheduler"})
+		return
+	}
+	e.ID = 0
+	e.CreatedAt = nil
+	if err := repo.Add(&e); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &e)
+}
+
+func streamClusterEvents(req *http.Request, w http.ResponseWriter, repo *ClusterEventRepo, r ResponseHelper) {
+	if err := serveClusterEvents(req, w, repo); err != nil {
+		r.Error(err)
+	}
+}
+
+// serveClusterEvents streams the events with an ID greater than the since_id
+// parameter or the Last-Event-Id header, followed by new events as they are
+// added.
+func serveClusterEvents(req *http.Request, w http.ResponseWriter, repo *ClusterEventRepo) (err error) {
+	var sinceID int64
+	since := req.FormValue("since_id")
+	if since == "" {
+		since = req.Header.Get("Last-Event-Id")
+	}
+	if since != "" {
+		sinceID, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || sinceID < 0 {
+			return ct.ValidationError{Field: "since_id", Message: "is invalid"}
+		}
+	}
+
+	connected := make(chan struct{})
+	done := make(chan struct{})
+	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
+		switch ev {
+		case pq.ListenerEventConnected:
+			close(connected)
+		case pq.ListenerEventDisconnected:
+			close(done)
+		case pq.ListenerEventConnectionAttemptFailed:
+			err = listenErr
+			close(done)
+		}
+	}
+	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, listenEvent)
+	defer listener.Close()
+	listener.Listen("cluster_events")
+
+	// wait until listening before reading past events so that none which
+	// are added in between are missed
+	select {
+	case <-done:
+		return
+	case <-connected:
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+
+	sendKeepAlive := func() error {
+		if _, err := w.Write([]byte(":\n")); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+	if err = sendKeepAlive(); err != nil {
+		return nil
+	}
+
+	// sendSince sends all events after the last one sent, so events are
+	// always sent in sequence order regardless of how notifications arrive
+	sendSince := func() error {
+		for {
+			events, err := repo.listAfter(sinceID, defaultReplayChunk)
+			if err != nil {
+				return err
+			}
+			for _, e := range events {
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: ", e.ID, e.Type); err != nil {
+					return err
+				}
+				if err := json.NewEncoder(w).Encode(e); err != nil {
+					return err
+				}
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return err
+				}
+				w.(http.Flusher).Flush()
+				sinceID = e.ID
+			}
+			if len(events) < defaultReplayChunk {
+				return nil
+			}
+		}
+	}
+	if err := sendSince(); err != nil {
+		return nil
+	}
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case <-done:
+			return
+		case <-closed:
+			return nil
+		case <-time.After(30 * time.Second):
+			if err := sendKeepAlive(); err != nil {
+				return nil
+			}
+		case n := <-listener.Notify:
+			if n != nil {
+				if id, err := strconv.ParseInt(n.Extra, 10, 64); err == nil && id <= sinceID {
+					continue
+				}
+			}
+			if err := sendSince(); err != nil {
+				return nil
+			}
+		}
+	}
+}
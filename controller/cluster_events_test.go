@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestStreamClusterEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "cluster-events"})
+	release := s.createTestRelease(c, &ct.Release{})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	// a host being added and a formation being scaled are both in the stream
+	hostData, _ := json.Marshal(&ct.ClusterHostEvent{HostID: "host1", Event: "up"})
+	hostEvent := &ct.ClusterEvent{Type: ct.ClusterEventHost, ObjectID: "host1", Data: hostData}
+	c.Assert(client.AddClusterEvent(hostEvent), IsNil)
+	c.Assert(hostEvent.ID > 0, Equals, true)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}}), IsNil)
+
+	stream, err := client.StreamClusterEvents(hostEvent.ID - 1)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	nextEvent := func() *ct.ClusterEvent {
+		select {
+		case e, ok := <-stream.Events:
+			if !ok {
+				c.Fatal("unexpected close of cluster event stream")
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for cluster event")
+		}
+		return nil
+	}
+
+	e := nextEvent()
+	c.Assert(e.ID, Equals, hostEvent.ID)
+	c.Assert(e.Type, Equals, ct.ClusterEventHost)
+	c.Assert(e.ObjectID, Equals, "host1")
+	host := &ct.ClusterHostEvent{}
+	c.Assert(json.Unmarshal(e.Data, host), IsNil)
+	c.Assert(host.Event, Equals, "up")
+
+	e = nextEvent()
+	c.Assert(e.ID > hostEvent.ID, Equals, true)
+	c.Assert(e.Type, Equals, ct.ClusterEventFormation)
+	c.Assert(e.AppID, Equals, app.ID)
+	c.Assert(e.ObjectID, Equals, release.ID)
+	formation := &ct.Formation{}
+	c.Assert(json.Unmarshal(e.Data, formation), IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	lastID := e.ID
+
+	// events added once streaming are sent live
+	c.Assert(client.PutJob(&ct.Job{ID: "host1-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"}), IsNil)
+	e = nextEvent()
+	c.Assert(e.ID > lastID, Equals, true)
+	c.Assert(e.Type, Equals, ct.ClusterEventJob)
+	c.Assert(e.ObjectID, Equals, "host1-job0")
+	job := &ct.Job{}
+	c.Assert(json.Unmarshal(e.Data, job), IsNil)
+	c.Assert(job.State, Equals, "starting")
+
+	// job events can only be added by the controller itself
+	err = client.AddClusterEvent(&ct.ClusterEvent{Type: ct.ClusterEventJob})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestPruneClusterEvents(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	addEvent := func() *ct.ClusterEvent {
+		e := &ct.ClusterEvent{Type: ct.ClusterEventHost, ObjectID: "host1", Data: []byte(`{}`)}
+		c.Assert(client.AddClusterEvent(e), IsNil)
+		return e
+	}
+	old := addEvent()
+	time.Sleep(200 * time.Millisecond)
+
+	// prune on every event, keeping those from the last 100ms
+	defer func(r time.Duration, i int64) { clusterEventRetention, clusterEventPruneInterval = r, i }(clusterEventRetention, clusterEventPruneInterval)
+	clusterEventRetention = 100 * time.Millisecond
+	clusterEventPruneInterval = 1
+	recent := addEvent()
+
+	stream, err := client.StreamClusterEvents(old.ID - 1)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	select {
+	case e, ok := <-stream.Events:
+		c.Assert(ok, Equals, true)
+		c.Assert(e.ID, Equals, recent.ID)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for cluster event")
+	}
+}
@@ -31,6 +31,9 @@ import (
 
 var ErrNotFound = errors.New("controller: resource not found")
 
+// ErrConflict is returned when a write is based on stale state.
+var ErrConflict = errors.New("controller: conflict")
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -69,10 +72,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	leaderWait, err := discoverd.RegisterAndStandby("flynn-controller-schedules", addr, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go runSchedules(db, cc, sc, leaderWait)
+
 	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY")})
 	log.Fatal(http.ListenAndServe(addr, handler))
 }
 
+// runSchedules runs job schedules once this controller is the leader, which
+// is signalled by leaderWait, so that scheduled jobs are not launched by every
+// controller instance.
+func runSchedules(db dbWrapper, cc clusterClient, sc routerc.Client, leaderWait <-chan *discoverd.Service) {
+	<-leaderWait
+
+	d := NewDB(db)
+	appRepo := NewAppRepo(d, os.Getenv("DEFAULT_ROUTE_DOMAIN"), sc)
+	newScheduleRunner(NewJobScheduleRepo(d), NewJobRepo(d), appRepo, NewReleaseRepo(d), NewArtifactRepo(d), NewSecretRepo(d), cc).Run()
+}
+
 type dbWrapper interface {
 	Database() *sql.DB
 	DSN() string
@@ -109,6 +129,10 @@ func (r *responseHelper) Error(err error) {
 			r.WriteHeader(404)
 			return
 		}
+		if err == ErrConflict {
+			r.WriteHeader(409)
+			return
+		}
 		log.Println(err)
 		r.JSON(500, struct{}{})
 	}
@@ -136,17 +160,30 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	artifactRepo := NewArtifactRepo(d)
 	releaseRepo := NewReleaseRepo(d)
 	jobRepo := NewJobRepo(d)
+	pendingJobRepo := NewPendingJobRepo(d)
+	jobScheduleRepo := NewJobScheduleRepo(d)
+	secretRepo := NewSecretRepo(d)
+	deployRepo := NewDeployRepo(d)
+	clusterEventRepo := NewClusterEventRepo(d)
 	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo)
+	schedulerConfigRepo := NewSchedulerConfigRepo(d)
 	m.Map(resourceRepo)
 	m.Map(appRepo)
 	m.Map(artifactRepo)
 	m.Map(releaseRepo)
 	m.Map(jobRepo)
+	m.Map(pendingJobRepo)
+	m.Map(jobScheduleRepo)
+	m.Map(secretRepo)
+	m.Map(deployRepo)
+	m.Map(clusterEventRepo)
 	m.Map(formationRepo)
+	m.Map(schedulerConfigRepo)
 	m.Map(c.dc)
 	m.MapTo(c.cc, (*clusterClient)(nil))
 	m.MapTo(c.sc, (*routerc.Client)(nil))
 	m.MapTo(c.dc, (*resource.DiscoverdClient)(nil))
+	m.Map(newSchedulerClient(c.dc, c.key))
 
 	getAppMiddleware := crud("apps", ct.App{}, appRepo, r)
 	getReleaseMiddleware := crud("releases", ct.Release{}, releaseRepo, r)
@@ -158,15 +195,41 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	r.Get("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, getFormation)
 	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, deleteFormation)
 	r.Get("/apps/:apps_id/formations", getAppMiddleware, listFormations)
+	r.Delete("/apps/:apps_id/formations/:releases_id/quarantine", getAppMiddleware, getReleaseMiddleware, clearQuarantine)
+	r.Get("/formations/snapshot", snapshotFormations)
+	r.Put("/formations/snapshot", binding.Bind(ct.FormationSnapshot{}), restoreFormations)
 
 	r.Post("/apps/:apps_id/jobs", getAppMiddleware, binding.Bind(ct.NewJob{}), runJob)
 	r.Put("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, binding.Bind(ct.Job{}), putJob)
 	r.Get("/apps/:apps_id/jobs", getAppMiddleware, listJobs)
 	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, killJob)
+	r.Post("/apps/:apps_id/jobs/stop", getAppMiddleware, binding.Bind(ct.StopJobsReq{}), stopJobs)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/events", getAppMiddleware, getJobEvent)
 	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobLog)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/clone", getAppMiddleware, binding.Bind(ct.NewJob{}), runJobLike)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/health_check", getAppMiddleware, connectHostMiddleware, binding.Bind(ct.HealthCheck{}), testHealthCheck)
+	r.Get("/apps/:apps_id/job_events", getAppMiddleware, listJobEvents)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/attach", getAppMiddleware, connectHostMiddleware, attachJob)
+	r.Put("/apps/:apps_id/pending_jobs", getAppMiddleware, putPendingJobs)
+	r.Get("/apps/:apps_id/pending_jobs", getAppMiddleware, listPendingJobs)
+	r.Post("/apps/:apps_id/reconcile", getAppMiddleware, reconcileApp)
+	r.Put("/apps/:apps_id/secrets/:secrets_name", getAppMiddleware, binding.Bind(ct.Secret{}), putSecret)
+	r.Get("/apps/:apps_id/secrets", getAppMiddleware, listSecrets)
+	r.Get("/apps/:apps_id/secrets/:secrets_name", getAppMiddleware, getSecret)
+	r.Delete("/apps/:apps_id/secrets/:secrets_name", getAppMiddleware, deleteSecret)
+	r.Post("/apps/:apps_id/schedules", getAppMiddleware, binding.Bind(ct.JobSchedule{}), createJobSchedule)
+	r.Get("/apps/:apps_id/schedules", getAppMiddleware, listJobSchedules)
+	r.Get("/apps/:apps_id/schedules/:schedules_id", getAppMiddleware, getJobSchedule)
+	r.Delete("/apps/:apps_id/schedules/:schedules_id", getAppMiddleware, deleteJobSchedule)
+
+	r.Post("/apps/:apps_id/deploys", getAppMiddleware, binding.Bind(ct.Deploy{}), createDeploy)
+	r.Put("/apps/:apps_id/deploys/:deploys_id", getAppMiddleware, binding.Bind(ct.Deploy{}), updateDeploy)
+	r.Delete("/apps/:apps_id/deploy", getAppMiddleware, stopDeploy)
+	r.Get("/deploys", listDeploys)
 
 	r.Put("/apps/:apps_id/release", getAppMiddleware, binding.Bind(releaseID{}), setAppRelease)
 	r.Get("/apps/:apps_id/release", getAppMiddleware, getAppRelease)
+	r.Post("/apps/:apps_id/clone", getAppMiddleware, binding.Bind(ct.CloneAppReq{}), cloneApp)
 
 	r.Post("/providers/:providers_id/resources", getProviderMiddleware, binding.Bind(ct.ResourceReq{}), resourceServerMiddleware, provisionResource)
 	r.Get("/providers/:providers_id/resources", getProviderMiddleware, getProviderResources)
@@ -174,9 +237,20 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	r.Put("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, binding.Bind(ct.Resource{}), putResource)
 	r.Get("/apps/:apps_id/resources", getAppMiddleware, getAppResources)
 
+	r.Get("/scheduler/dump", getSchedulerDump)
+	r.Get("/scheduler/metrics", getSchedulerMetrics)
+	r.Get("/scheduler/config", getSchedulerConfig)
+	r.Put("/scheduler/config", binding.Bind(ct.SchedulerConfigUpdate{}), putSchedulerConfig)
+	r.Post("/scheduler/drain", binding.Bind(ct.HostDrain{}), drainHost)
+	r.Delete("/scheduler/drain/:host_id", undrainHost)
+	r.Get("/cluster/config", getClusterConfig)
+	r.Post("/cluster/events", binding.Bind(ct.ClusterEvent{}), createClusterEvent)
+	r.Get("/cluster/events", streamClusterEvents)
+
 	r.Post("/apps/:apps_id/routes", getAppMiddleware, binding.Bind(router.Route{}), createRoute)
 	r.Get("/apps/:apps_id/routes", getAppMiddleware, getRouteList)
 	r.Get("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, getRoute)
+	r.Put("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, binding.Bind(router.Route{}), updateRoute)
 	r.Delete("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, deleteRoute)
 
 	return rpcMuxHandler(m, rpcHandler(formationRepo), c.key), m
@@ -217,13 +291,9 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r ResponseHelper) {
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
-	if app.Protected {
-		for typ := range release.Processes {
-			if formation.Processes[typ] == 0 {
-				r.Error(ct.ValidationError{Message: "unable to scale to zero, app is protected"})
-				return
-			}
-		}
+	if err := checkProtected(app, release, formation.Processes); err != nil {
+		r.Error(err)
+		return
 	}
 	if err := repo.Add(&formation); err != nil {
 		r.Error(err)
@@ -232,6 +302,20 @@ func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo
 	r.JSON(200, &formation)
 }
 
+// checkProtected returns a validation error if app is protected and procs
+// would scale any of the process types of release to zero.
+func checkProtected(app *ct.App, release *ct.Release, procs map[string]int) error {
+	if !app.Protected {
+		return nil
+	}
+	for typ := range release.Processes {
+		if procs[typ] == 0 {
+			return ct.ValidationError{Message: "unable to scale to zero, app is protected"}
+		}
+	}
+	return nil
+}
+
 func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *FormationRepo, r ResponseHelper) {
 	formation, err := repo.Get(app.ID, params["releases_id"])
 	if err != nil {
@@ -263,8 +347,40 @@ func listFormations(app *ct.App, repo *FormationRepo, r ResponseHelper) {
 	r.JSON(200, list)
 }
 
+func snapshotFormations(repo *FormationRepo, r ResponseHelper) {
+	snapshot, err := repo.Snapshot()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, snapshot)
+}
+
+func restoreFormations(snapshot ct.FormationSnapshot, repo *FormationRepo, r ResponseHelper) {
+	for _, f := range snapshot.Formations {
+		if f == nil || f.AppID == "" || f.ReleaseID == "" {
+			r.Error(ct.ValidationError{Field: "formations", Message: "must all have an app and release"})
+			return
+		}
+		if !idPattern.MatchString(f.AppID) || !idPattern.MatchString(f.ReleaseID) {
+			r.Error(ct.ValidationError{Field: "formations", Message: fmt.Sprintf("formation %s/%s has an invalid app or release ID", f.AppID, f.ReleaseID)})
+			return
+		}
+	}
+	if err := repo.Restore(&snapshot); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
 type releaseID struct {
 	ID string `json:"id"`
+
+	// Formation, if set, replaces the app's formations with a formation of
+	// the release with these process counts, in the same transaction as
+	// setting the release.
+	Formation map[string]int `json:"formation"`
 }
 
 func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, r ResponseHelper) {
@@ -279,7 +395,6 @@ func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseR
 		return
 	}
 	release := rel.(*ct.Release)
-	apps.SetRelease(app.ID, release.ID)
 
 	// TODO: use transaction/lock
 	fs, err := formations.List(app.ID)
@@ -287,11 +402,32 @@ func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseR
 		r.Error(err)
 		return
 	}
+	if rid.Formation != nil {
+		if err := checkProtected(app, release, rid.Formation); err != nil {
+			r.Error(err)
+			return
+		}
+		f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: rid.Formation}
+		var replaces string
+		if len(fs) == 1 {
+			f.Hosts = fs[0].Hosts
+			replaces = fs[0].ReleaseID
+		}
+		if err := formations.SetReleaseAndFormation(f, replaces); err != nil {
+			r.Error(err)
+			return
+		}
+		r.JSON(200, release)
+		return
+	}
+
+	apps.SetRelease(app.ID, release.ID)
 	if len(fs) == 1 && fs[0].ReleaseID != release.ID {
 		if err := formations.Add(&ct.Formation{
 			AppID:     app.ID,
 			ReleaseID: release.ID,
 			Processes: fs[0].Processes,
+			Hosts:     fs[0].Hosts,
 		}); err != nil {
 			r.Error(err)
 			return
@@ -314,6 +450,15 @@ func getAppRelease(app *ct.App, apps *AppRepo, r ResponseHelper) {
 	r.JSON(200, release)
 }
 
+func cloneApp(req ct.CloneAppReq, app *ct.App, apps *AppRepo, r ResponseHelper) {
+	clone, err := apps.Clone(app, req.Name)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, clone)
+}
+
 func resourceServerMiddleware(c martini.Context, p *ct.Provider, dc resource.DiscoverdClient, r ResponseHelper) {
 	server, err := resource.NewServerWithDiscoverd(p.URL, dc)
 	if err != nil {
@@ -10,15 +10,19 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/rpcplus"
+	"github.com/flynn/flynn/router/types"
 )
 
 // Hook gocheck up to the "go test" runner
@@ -221,6 +225,138 @@ func (s *S) TestUpdateApp(c *C) {
 	c.Assert(gotApp.Meta, DeepEquals, meta)
 }
 
+func (s *S) TestRenameApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "rename-app", Meta: map[string]string{"foo": "bar"}})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "rename-app-tcp"}).ToRoute())
+	s.createTestApp(c, &ct.App{Name: "rename-app-taken"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	updated, err := client.UpdateApp(app.Name, &ct.AppUpdate{Name: "rename-app-new"})
+	c.Assert(err, IsNil)
+	c.Assert(updated.ID, Equals, app.ID)
+	c.Assert(updated.Name, Equals, "rename-app-new")
+	c.Assert(updated.Meta, DeepEquals, app.Meta)
+
+	got, err := client.GetApp("rename-app-new")
+	c.Assert(err, IsNil)
+	c.Assert(got.ID, Equals, app.ID)
+	_, err = client.GetApp("rename-app")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// the formation and routes are still there
+	formation, err := client.GetFormation("rename-app-new", release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 1})
+	routes, err := client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	found := false
+	for _, r := range routes {
+		if r.ID == route.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	// names must be unique and valid
+	_, err = client.UpdateApp(app.ID, &ct.AppUpdate{Name: "rename-app-taken"})
+	c.Assert(err, NotNil)
+	_, err = client.UpdateApp(app.ID, &ct.AppUpdate{Name: "Invalid Name"})
+	c.Assert(err, NotNil)
+
+	updated, err = client.UpdateApp(app.ID, &ct.AppUpdate{Meta: map[string]string{"foo": "baz"}})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Name, Equals, "rename-app-new")
+	c.Assert(updated.Meta, DeepEquals, map[string]string{"foo": "baz"})
+}
+
+func (s *S) TestRenameProtectedApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "rename-protected", Protected: true})
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	_, err = client.UpdateApp(app.ID, &ct.AppUpdate{Name: "rename-protected-new"})
+	c.Assert(err, NotNil)
+	got, err := client.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Name, Equals, "rename-protected")
+}
+
+func (s *S) TestRenameAppDefaultRoute(c *C) {
+	rc := newFakeRouter()
+	repo := NewAppRepo(nil, "example.com", rc)
+	app := &ct.App{ID: random.UUID(), Name: "renamed"}
+	defaultRoute := (&router.HTTPRoute{Domain: "old-name.example.com", Service: "old-name-web", Sticky: true}).ToRoute()
+	defaultRoute.ParentRef = routeParentRef(app)
+	c.Assert(rc.CreateRoute(defaultRoute), IsNil)
+	tcpRoute := (&router.TCPRoute{Service: "old-name-tcp"}).ToRoute()
+	tcpRoute.ParentRef = routeParentRef(app)
+	c.Assert(rc.CreateRoute(tcpRoute), IsNil)
+
+	repo.moveDefaultRoute(app, "old-name")
+
+	// the default route is for the new name but keeps its service, and
+	// other routes are left alone
+	routes, err := rc.ListRoutes(routeParentRef(app))
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+	var moved *router.HTTPRoute
+	for _, route := range routes {
+		switch route.Type {
+		case "http":
+			moved = route.HTTPRoute()
+		case "tcp":
+			c.Assert(route.ID, Equals, tcpRoute.ID)
+		}
+	}
+	c.Assert(moved, NotNil)
+	c.Assert(moved.ID, Not(Equals), defaultRoute.ID)
+	c.Assert(moved.Domain, Equals, "renamed.example.com")
+	c.Assert(moved.Service, Equals, "old-name-web")
+	c.Assert(moved.Sticky, Equals, true)
+	c.Assert(moved.ParentRef, Equals, routeParentRef(app))
+}
+
+func (s *S) TestAppLogRetention(c *C) {
+	retention := &ct.LogRetention{MaxBytes: 10 * 1024 * 1024, MaxAge: 48 * time.Hour}
+	app := s.createTestApp(c, &ct.App{Name: "log-retention-app", LogRetention: retention})
+	c.Assert(app.LogRetention, DeepEquals, retention)
+
+	gotApp := &ct.App{}
+	res, err := s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.LogRetention, DeepEquals, retention)
+
+	// too small to hold a full log line in each half of the log
+	res, err = s.Post("/apps/"+app.ID, map[string]interface{}{"log_retention": &ct.LogRetention{MaxBytes: 1024}}, nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	retention = &ct.LogRetention{MaxBytes: host.MinLogRetentionBytes}
+	res, err = s.Post("/apps/"+app.ID, map[string]interface{}{"log_retention": retention}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.LogRetention, DeepEquals, retention)
+
+	// null resets to the host defaults
+	res, err = s.Post("/apps/"+app.ID, map[string]interface{}{"log_retention": nil}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.LogRetention, IsNil)
+
+	res, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.LogRetention, IsNil)
+}
+
 func (s *S) TestDeleteApp(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "delete-app"})
 
@@ -287,7 +423,7 @@ func (s *S) TestCreateArtifact(c *C) {
 	for i, id := range []string{"", random.UUID()} {
 		in := &ct.Artifact{
 			ID:   id,
-			Type: "docker-image",
+			Type: "docker",
 			URI:  fmt.Sprintf("docker://flynn/host?id=adsf%d", i),
 		}
 		out := s.createTestArtifact(c, in)
@@ -309,6 +445,218 @@ func (s *S) TestCreateArtifact(c *C) {
 	}
 }
 
+func (s *S) TestCreateArtifactValidation(c *C) {
+	res, err := s.Post("/artifacts", &ct.Artifact{Type: "docker", URI: "ftp://example.com/flynn/busybox"}, &ct.Artifact{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	out := s.createTestArtifact(c, &ct.Artifact{
+		Type: "docker",
+		URI:  "HTTPS://Registry.Hub.Docker.com:443/flynn/busybox/?id=184AF8860F22E7A87F1416BB12A32B20D0D2C142F719653D87809A6122B04663",
+	})
+	c.Assert(out.URI, Equals, "https://registry.hub.docker.com/flynn/busybox?id=184af8860f22e7a87f1416bb12a32b20d0d2c142f719653d87809a6122b04663")
+}
+
+// ArtifactSuite tests artifact validation without needing a database
+type ArtifactSuite struct{}
+
+var _ = Suite(&ArtifactSuite{})
+
+func (ArtifactSuite) TestNormalizeArtifact(c *C) {
+	busybox := "https://registry.hub.docker.com/flynn/busybox?id=184af8860f22e7a87f1416bb12a32b20d0d2c142f719653d87809a6122b04663"
+	for _, t := range []struct {
+		typ, uri, normalized string
+	}{
+		{"docker", busybox, busybox},
+		{"docker", "https://registry.hub.docker.com:443/flynn/busybox?id=184AF8860F22E7A87F1416BB12A32B20D0D2C142F719653D87809A6122B04663#latest", busybox},
+		{"docker", "docker://flynn/host?id=adsf0", "docker://flynn/host?id=adsf0"},
+		{"docker", "http://localhost:5000/flynn/busybox?tag=latest", "http://localhost:5000/flynn/busybox?tag=latest"},
+		{"docker", "https://registry.hub.docker.com/flynn/busybox", "https://registry.hub.docker.com/flynn/busybox"},
+		{"file", "file:///var/lib/flynn/slug.tgz", "file:///var/lib/flynn/slug.tgz"},
+		{"file", "file://localhost/var/lib/flynn/slug.tgz", "file:///var/lib/flynn/slug.tgz"},
+		{"file", "https://example.com/slug.tgz", "https://example.com/slug.tgz"},
+		{"", "", ""},
+	} {
+		a := &ct.Artifact{Type: t.typ, URI: t.uri}
+		c.Assert(normalizeArtifact(a), IsNil, Commentf("uri: %s", t.uri))
+		c.Assert(a.URI, Equals, t.normalized)
+	}
+
+	for _, t := range []struct {
+		typ, uri, field string
+	}{
+		{"docker-image", "docker://flynn/host", "type"},
+		{"", "docker://flynn/host", "type"},
+		{"docker", "", "uri"},
+		{"docker", "flynn/busybox", "uri"},
+		{"docker", "ftp://example.com/flynn/busybox", "uri"},
+		{"docker", "file:///flynn/busybox", "uri"},
+		{"docker", "https:///flynn/busybox", "uri"},
+		{"docker", "https://registry.hub.docker.com/", "uri"},
+		{"docker", "https://registry.hub.docker.com/Flynn/Busybox", "uri"},
+		{"docker", "https://registry.hub.docker.com/flynn/busybox?id=", "uri"},
+		{"docker", "https://registry.hub.docker.com/flynn/busybox?id=a&id=b", "uri"},
+		{"docker", "https://registry.hub.docker.com/flynn/busybox?id=a;b", "uri"},
+		{"docker", "https://registry.hub.docker.com/flynn/busybox?digest=a", "uri"},
+		{"file", "docker://flynn/busybox", "uri"},
+		{"file", "file://example.com/slug.tgz", "uri"},
+		{"file", "https://example.com", "uri"},
+	} {
+		err := normalizeArtifact(&ct.Artifact{Type: t.typ, URI: t.uri})
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("uri: %s", t.uri))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("uri: %s", t.uri))
+	}
+}
+
+// ReleaseSuite tests release validation without needing a database
+type ReleaseSuite struct{}
+
+var _ = Suite(&ReleaseSuite{})
+
+func (ReleaseSuite) TestValidateReleaseProcessTypes(c *C) {
+	valid := map[string]ct.ProcessType{"web": {}, "Web": {}, "-web": {}, "worker-2": {}, "db_replica": {}, strings.Repeat("a", 63): {}}
+	c.Assert(validateReleaseProcessTypes(&ct.Release{Processes: valid}), IsNil)
+
+	for _, t := range []struct {
+		typ     string
+		message string
+	}{
+		{"", "process type name must not be empty, it is reserved for one-off jobs"},
+		{"web server", `process type name "web server" is invalid`},
+		{"../web", `process type name "../web" is invalid`},
+		{"web.1", `process type name "web.1" is invalid`},
+		{strings.Repeat("a", 64), fmt.Sprintf("process type name %q is invalid", strings.Repeat("a", 64))},
+	} {
+		err := validateReleaseProcessTypes(&ct.Release{Processes: map[string]ct.ProcessType{t.typ: {}}})
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("type: %q", t.typ))
+		c.Assert(err.(ct.ValidationError).Field, Equals, "processes")
+		c.Assert(err.(ct.ValidationError).Message, Equals, t.message)
+	}
+}
+
+func (ReleaseSuite) TestValidateReleasePorts(c *C) {
+	for _, procs := range []map[string]ct.ProcessType{
+		nil,
+		{"web": {Ports: []ct.Port{{Proto: "tcp"}}}, "worker": {Ports: []ct.Port{{Proto: "tcp"}}}},
+		{"web": {Ports: []ct.Port{{Port: 80, Proto: "tcp"}}}, "dns": {Ports: []ct.Port{{Port: 80, Proto: "udp"}}}},
+		{"web": {Ports: []ct.Port{{Port: 8000, Proto: "tcp", RangeEnd: 8009}}}, "worker": {Ports: []ct.Port{{Port: 8010, Proto: "tcp"}}}},
+	} {
+		c.Assert(validateReleasePorts(&ct.Release{Processes: procs}), IsNil, Commentf("processes: %v", procs))
+	}
+
+	for _, t := range []struct {
+		procs   map[string]ct.ProcessType
+		message string
+	}{
+		{
+			map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 80, Proto: "tcp"}}}, "worker": {Ports: []ct.Port{{Port: 80, Proto: "tcp"}}}},
+			`tcp port 80 of "worker" conflicts with "web"`,
+		},
+		{
+			map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 80}, {Port: 80, Proto: "tcp"}}}},
+			`tcp port 80 of "web" conflicts with "web"`,
+		},
+		{
+			map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 8000, Proto: "tcp", RangeEnd: 8009}}}, "worker": {Ports: []ct.Port{{Port: 8005, Proto: "tcp"}}}},
+			`tcp port 8005 of "worker" conflicts with "web"`,
+		},
+	} {
+		err := validateReleasePorts(&ct.Release{Processes: t.procs})
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Field, Equals, "processes")
+		c.Assert(err.(ct.ValidationError).Message, Equals, t.message)
+	}
+}
+
+func (ReleaseSuite) TestValidateReleaseVolumes(c *C) {
+	valid := map[string]ct.ProcessType{"db": {Volumes: []ct.VolumeMount{{Name: "pg-data", Path: "/var/lib/postgresql"}}}}
+	c.Assert(validateReleaseVolumes(&ct.Release{Processes: valid}), IsNil)
+
+	for _, t := range []struct {
+		volume  ct.VolumeMount
+		message string
+	}{
+		{ct.VolumeMount{Name: "../data", Path: "/data"}, `volume name "../data" of "db" is invalid`},
+		{ct.VolumeMount{Path: "/data"}, `volume name "" of "db" is invalid`},
+		{ct.VolumeMount{Name: "data", Path: "data"}, `volume path "data" of "db" is not absolute`},
+	} {
+		err := validateReleaseVolumes(&ct.Release{Processes: map[string]ct.ProcessType{"db": {Volumes: []ct.VolumeMount{t.volume}}}})
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Message, Equals, t.message)
+	}
+}
+
+func (ReleaseSuite) TestValidateReleaseDNS(c *C) {
+	valid := map[string]ct.ProcessType{"web": {DNS: []string{"10.0.0.2", "::1"}, Hostname: "web-1.example.com"}}
+	c.Assert(validateReleaseDNS(&ct.Release{Processes: valid}), IsNil)
+
+	// hostnames longer than 64 bytes can't be set in a container
+	long := strings.Repeat("a", 61) + ".com"
+	for _, t := range []struct {
+		proc    ct.ProcessType
+		message string
+	}{
+		{ct.ProcessType{DNS: []string{"ns.example.com"}}, `nameserver "ns.example.com" of "web" is not an IP address`},
+		{ct.ProcessType{Hostname: "web_1"}, `hostname "web_1" of "web" is invalid`},
+		{ct.ProcessType{Hostname: "-web"}, `hostname "-web" of "web" is invalid`},
+		{ct.ProcessType{Hostname: "web..example.com"}, `hostname "web..example.com" of "web" is invalid`},
+		{ct.ProcessType{Hostname: long}, fmt.Sprintf(`hostname %q of "web" is invalid`, long)},
+	} {
+		err := validateReleaseDNS(&ct.Release{Processes: map[string]ct.ProcessType{"web": t.proc}})
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Message, Equals, t.message)
+	}
+}
+
+func (s *S) TestCreateReleasePortConflict(c *C) {
+	res, err := s.Post("/releases", &ct.Release{
+		ArtifactID: s.createTestArtifact(c, &ct.Artifact{}).ID,
+		Processes: map[string]ct.ProcessType{
+			"web":    {Ports: []ct.Port{{Port: 8080, Proto: "tcp"}}},
+			"worker": {Ports: []ct.Port{{Port: 8080, Proto: "tcp"}}},
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	var verr ct.ValidationError
+	c.Assert(json.NewDecoder(res.Body).Decode(&verr), IsNil)
+	c.Assert(verr.Message, Equals, `tcp port 8080 of "worker" conflicts with "web"`)
+}
+
+func (s *S) TestCreateReleaseInvalidProcessType(c *C) {
+	res, err := s.Post("/releases", &ct.Release{
+		ArtifactID: s.createTestArtifact(c, &ct.Artifact{}).ID,
+		Processes:  map[string]ct.ProcessType{"": {Cmd: []string{"start"}}},
+	}, nil)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	var verr ct.ValidationError
+	c.Assert(json.NewDecoder(res.Body).Decode(&verr), IsNil)
+	c.Assert(verr.Field, Equals, "processes")
+}
+
+func (s *S) TestCreateReleaseMissingArtifact(c *C) {
+	missing := random.UUID()
+	res, err := s.Post("/releases", &ct.Release{
+		ArtifactID: s.createTestArtifact(c, &ct.Artifact{}).ID,
+		Processes:  map[string]ct.ProcessType{"web": {}, "logger": {Artifact: missing}},
+	}, nil)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	var verr ct.ValidationError
+	c.Assert(json.NewDecoder(res.Body).Decode(&verr), IsNil)
+	c.Assert(verr.Message, Equals, fmt.Sprintf("artifact %q does not exist", missing))
+
+	// a process type can run from another existing artifact
+	sidecar := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://flynn/sidecar"})
+	s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "logger": {Artifact: sidecar.ID}},
+	})
+}
+
 func (s *S) createTestRelease(c *C, in *ct.Release) *ct.Release {
 	if in.ArtifactID == "" {
 		in.ArtifactID = s.createTestArtifact(c, &ct.Artifact{}).ID
@@ -414,6 +762,56 @@ func (s *S) TestDeleteFormation(c *C) {
 	}
 }
 
+func (s *S) TestFormationGenerationConflict(c *C) {
+	release := s.createTestRelease(c, &ct.Release{})
+	app := s.createTestApp(c, &ct.App{Name: "formation-generation"})
+	created := s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID, Processes: map[string]int{"web": 1}})
+	c.Assert(created.Generation, Equals, int64(1))
+
+	client1, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	client2, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	// both clients read the same generation
+	f1, err := client1.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	f2, err := client2.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f1.Generation, Equals, f2.Generation)
+
+	// the first write wins
+	f1.Processes = map[string]int{"web": 2}
+	c.Assert(client1.PutFormation(f1), IsNil)
+	c.Assert(f1.Generation, Equals, int64(2))
+
+	// the stale write conflicts and doesn't clobber the first write
+	f2.Processes = map[string]int{"web": 3}
+	c.Assert(client2.PutFormation(f2), Equals, controller.ErrConflict)
+	current, err := client2.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// retrying with fresh state succeeds
+	current.Processes["web"]++
+	c.Assert(client2.PutFormation(current), IsNil)
+	c.Assert(current.Generation, Equals, int64(3))
+	f, err := client1.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 3})
+
+	// writes without a generation are unconditional
+	c.Assert(client1.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}), IsNil)
+
+	// a write with a generation doesn't recreate a deleted formation
+	f, err = client1.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(client2.DeleteFormation(app.ID, release.ID), IsNil)
+	c.Assert(client1.PutFormation(f), Equals, controller.ErrNotFound)
+	_, err = client1.GetFormation(app.ID, release.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
 func (s *S) TestCreateKey(c *C) {
 	in := &ct.Key{Key: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC5r1JfsAYIFi86KBa7C5nqKo+BLMJk29+5GsjelgBnCmn4J/QxOrVtovNcntoRLUCRwoHEMHzs3Tc6+PdswIxpX1l3YC78kgdJe6LVb962xUgP6xuxauBNRO7tnh9aPGyLbjl9j7qZAcn2/ansG1GBVoX1GSB58iBsVDH18DdVzlGwrR4OeNLmRQj8kuJEuKOoKEkW55CektcXjV08K3QSQID7aRNHgDpGGgp6XDi0GhIMsuDUGHAdPGZnqYZlxuUFaCW2hK6i1UkwnQCCEv/9IUFl2/aqVep2iX/ynrIaIsNKm16o0ooZ1gCHJEuUKRPUXhZUXqkRXqqHd3a4CUhH jonathan@titanous.com"}
 	out := s.createTestKey(c, in)
@@ -559,6 +957,138 @@ func (s *S) TestFormationList(c *C) {
 	c.Assert(list, HasLen, 0)
 }
 
+func (s *S) TestFormationSnapshot(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	expected := make(map[string]map[string]int)
+	for i, procs := range []map[string]int{{"web": 2, "worker": 1}, {"web": 3}} {
+		release := s.createTestRelease(c, &ct.Release{})
+		app := s.createTestApp(c, &ct.App{Name: fmt.Sprintf("formation-snapshot-%d", i)})
+		s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID, Processes: procs})
+		expected[app.ID] = procs
+	}
+
+	snapshot, err := client.SnapshotFormations()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.CreatedAt, NotNil)
+	var found int
+	for _, f := range snapshot.Formations {
+		if procs, ok := expected[f.AppID]; ok {
+			c.Assert(f.Processes, DeepEquals, procs)
+			found++
+		}
+	}
+	c.Assert(found, Equals, len(expected))
+
+	// scale everything down
+	for _, f := range snapshot.Formations {
+		c.Assert(client.PutFormation(&ct.Formation{AppID: f.AppID, ReleaseID: f.ReleaseID, Processes: map[string]int{}}), IsNil)
+	}
+	for _, f := range snapshot.Formations {
+		current, err := client.GetFormation(f.AppID, f.ReleaseID)
+		c.Assert(err, IsNil)
+		c.Assert(current.Processes, HasLen, 0)
+	}
+
+	// every formation is back at its prior counts after restoring
+	c.Assert(client.RestoreFormations(snapshot), IsNil)
+	for _, f := range snapshot.Formations {
+		current, err := client.GetFormation(f.AppID, f.ReleaseID)
+		c.Assert(err, IsNil)
+		c.Assert(current.Processes, DeepEquals, f.Processes)
+	}
+	for appID, procs := range expected {
+		var list []ct.Formation
+		res, err := s.Get("/apps/"+appID+"/formations", &list)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(list, HasLen, 1)
+		c.Assert(list[0].Processes, DeepEquals, procs)
+	}
+
+	// a formation of a release created since the snapshot is scaled down
+	// when its app is restored
+	var appID string
+	for id := range expected {
+		appID = id
+		break
+	}
+	newRelease := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: newRelease.ID, AppID: appID, Processes: map[string]int{"web": 1}})
+	c.Assert(client.RestoreFormations(snapshot), IsNil)
+	current, err := client.GetFormation(appID, newRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.Processes, HasLen, 0)
+	for _, f := range snapshot.Formations {
+		if f.AppID == appID {
+			current, err = client.GetFormation(f.AppID, f.ReleaseID)
+			c.Assert(err, IsNil)
+			c.Assert(current.Processes, DeepEquals, expected[appID])
+		}
+	}
+
+	// a snapshot of a release which doesn't exist is rejected
+	res, err := s.Put("/formations/snapshot", &ct.FormationSnapshot{Formations: []*ct.Formation{
+		{AppID: appID, ReleaseID: random.UUID(), Processes: map[string]int{"web": 1}},
+	}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// as is a snapshot with an invalid app or release ID
+	for _, f := range []*ct.Formation{
+		{AppID: "invalid", ReleaseID: newRelease.ID, Processes: map[string]int{"web": 1}},
+		{AppID: appID, ReleaseID: "invalid", Processes: map[string]int{"web": 1}},
+	} {
+		res, err = s.Put("/formations/snapshot", &ct.FormationSnapshot{Formations: []*ct.Formation{f}}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestFormationSnapshotProtected(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-snapshot-protected", Protected: true})
+	oldRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}})
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 1}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	for _, snapshot := range []*ct.FormationSnapshot{
+		// scaling a running formation to zero is rejected
+		{Formations: []*ct.Formation{
+			{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}},
+			{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{}},
+		}},
+		// as is scaling down a running formation which isn't in the snapshot
+		{Formations: []*ct.Formation{
+			{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}},
+		}},
+	} {
+		err := client.RestoreFormations(snapshot)
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Message, Equals, "unable to scale to zero, app is protected")
+	}
+
+	// nothing changed
+	for _, id := range []string{oldRelease.ID, newRelease.ID} {
+		current, err := client.GetFormation(app.ID, id)
+		c.Assert(err, IsNil)
+		c.Assert(current.Processes, DeepEquals, map[string]int{"web": 1})
+	}
+
+	// a snapshot which keeps every process type running is restored
+	c.Assert(client.RestoreFormations(&ct.FormationSnapshot{Formations: []*ct.Formation{
+		{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}},
+		{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 3}},
+	}}), IsNil)
+	current, err := client.GetFormation(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.Processes, DeepEquals, map[string]int{"web": 3})
+}
+
 func (s *S) setAppRelease(c *C, appID, id string) *ct.Release {
 	out := &ct.Release{}
 	res, err := s.Put("/apps/"+appID+"/release", &ct.Release{ID: id}, out)
@@ -602,6 +1132,156 @@ func (s *S) TestSetAppRelease(c *C) {
 	c.Assert(formations[0].ReleaseID, Equals, newRelease.ID)
 }
 
+func (s *S) TestSetReleaseAndFormation(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "set-release-and-formation"})
+	oldRelease := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, oldRelease.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1, "worker": 1}})
+	newRelease := s.createTestRelease(c, &ct.Release{})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	since := time.Now()
+	updates, streamErr := client.StreamFormations(&since)
+	for f := range updates.Chan {
+		// wait for the end of the existing formations
+		if f.App == nil {
+			break
+		}
+	}
+	c.Assert(*streamErr, IsNil)
+
+	procs := map[string]int{"web": 3}
+	c.Assert(client.SetReleaseAndFormation(app.ID, newRelease.ID, procs), IsNil)
+
+	// the scheduler sees the new release at the new counts, and the removal
+	// of the old formation, without the new release ever being at the old
+	// counts
+	var newSeen, oldRemoved bool
+	for !newSeen || !oldRemoved {
+		select {
+		case f := <-updates.Chan:
+			if f.App.ID != app.ID {
+				continue
+			}
+			switch f.Release.ID {
+			case newRelease.ID:
+				c.Assert(f.Processes, DeepEquals, procs)
+				newSeen = true
+			case oldRelease.ID:
+				c.Assert(f.Processes, IsNil)
+				oldRemoved = true
+			}
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for formation updates")
+		}
+	}
+
+	release, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, newRelease.ID)
+	var formations []ct.Formation
+	res, err := s.Get("/apps/"+app.ID+"/formations", &formations)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, newRelease.ID)
+	c.Assert(formations[0].Processes, DeepEquals, procs)
+}
+
+func (s *S) TestSetReleaseAndFormationProtected(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "set-release-and-formation-protected", Protected: true})
+	oldRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.setAppRelease(c, app.ID, oldRelease.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}})
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	for _, procs := range []map[string]int{nil, {"web": 1}, {"web": 1, "worker": 0}} {
+		err := client.SetReleaseAndFormation(app.ID, newRelease.ID, procs)
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Message, Equals, "unable to scale to zero, app is protected")
+	}
+
+	// nothing changed
+	release, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, oldRelease.ID)
+	var formations []ct.Formation
+	res, err := s.Get("/apps/"+app.ID+"/formations", &formations)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, oldRelease.ID)
+
+	procs := map[string]int{"web": 2, "worker": 1}
+	c.Assert(client.SetReleaseAndFormation(app.ID, newRelease.ID, procs), IsNil)
+	res, err = s.Get("/apps/"+app.ID+"/formations", &formations)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 1)
+	c.Assert(formations[0].ReleaseID, Equals, newRelease.ID)
+	c.Assert(formations[0].Processes, DeepEquals, procs)
+}
+
+func (s *S) TestCloneApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "clone-src", Meta: map[string]string{"foo": "bar"}})
+	release := s.createTestRelease(c, &ct.Release{
+		Env:       map[string]string{"FOO": "bar"},
+		Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}, Ports: []ct.Port{{Proto: "tcp"}}}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	res, err := s.Put("/apps/"+app.ID+"/jobs/host0-job0", &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"}, nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	clone, err := client.CloneApp(app.ID, "clone-dst")
+	c.Assert(err, IsNil)
+	c.Assert(clone.ID, Not(Equals), app.ID)
+	c.Assert(clone.Name, Equals, "clone-dst")
+	c.Assert(clone.Meta, DeepEquals, app.Meta)
+
+	// the clone has a copy of the release
+	cloneRelease, err := client.GetAppRelease(clone.ID)
+	c.Assert(err, IsNil)
+	c.Assert(cloneRelease.ID, Not(Equals), release.ID)
+	c.Assert(cloneRelease.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(cloneRelease.Env, DeepEquals, release.Env)
+	c.Assert(cloneRelease.Processes, DeepEquals, release.Processes)
+
+	// but is scaled to zero
+	_, err = client.GetFormation(clone.ID, cloneRelease.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	jobs, err := client.JobList(clone.ID)
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 0)
+
+	// and the source is unchanged
+	formation, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// an app without a release is cloned without one
+	bare := s.createTestApp(c, &ct.App{Name: "clone-bare"})
+	clone, err = client.CloneApp(bare.ID, "clone-bare-dst")
+	c.Assert(err, IsNil)
+	_, err = client.GetAppRelease(clone.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// nothing is created if the clone fails
+	_, err = client.CloneApp(app.ID, "clone_invalid")
+	c.Assert(err, NotNil)
+	_, err = client.GetApp("clone_invalid")
+	c.Assert(err, Equals, controller.ErrNotFound)
+	client.Close()
+}
+
 func (s *S) createTestProvider(c *C, provider *ct.Provider) *ct.Provider {
 	out := &ct.Provider{}
 	res, err := s.Post("/providers", provider, out)
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// recentDeploys is how long finished deploys are listed for.
+const recentDeploys = 24 * time.Hour
+
+// deployTimeout is how long a running deploy can go without its client
+// reporting progress before it is considered to have failed, for example
+// because the client went away. Clients report progress at least every 30
+// seconds while waiting for jobs.
+var deployTimeout = 5 * time.Minute
+
+type DeployRepo struct {
+	db *DB
+}
+
+func NewDeployRepo(db *DB) *DeployRepo {
+	return &DeployRepo{db}
+}
+
+const deployColumns = "deploy_id, app_id, old_release_id, new_release_id, strategy, status, jobs_up, jobs_expected, error, created_at, updated_at, finished_at"
+
+func scanDeploy(s Scanner) (*ct.Deploy, error) {
+	d := &ct.Deploy{}
+	err := s.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &d.Status, &d.JobsUp, &d.JobsExpected, &d.Error, &d.CreatedAt, &d.UpdatedAt, &d.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.AppID = cleanUUID(d.AppID)
+	d.OldReleaseID = cleanUUID(d.OldReleaseID)
+	d.NewReleaseID = cleanUUID(d.NewReleaseID)
+	return d, nil
+}
+
+func (r *DeployRepo) Add(d *ct.Deploy) error {
+	if d.Strategy == "" {
+		return ct.ValidationError{Field: "strategy", Message: "must be set"}
+	}
+	if d.ID == "" {
+		d.ID = random.UUID()
+	}
+	d.Status = ct.DeployStatusRunning
+	err := r.db.QueryRow("INSERT INTO deploys (deploy_id, app_id, old_release_id, new_release_id, strategy, status, jobs_up, jobs_expected) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at, updated_at",
+		d.ID, d.AppID, d.OldReleaseID, d.NewReleaseID, d.Strategy, d.Status, d.JobsUp, d.JobsExpected).Scan(&d.CreatedAt, &d.UpdatedAt)
+	d.ID = cleanUUID(d.ID)
+	if err != nil {
+		return err
+	}
+	recordClusterEvent(r.db, ct.ClusterEventDeploy, d.AppID, d.ID, d)
+	return nil
+}
+
+func (r *DeployRepo) Get(appID, id string) (*ct.Deploy, error) {
+	return scanDeploy(r.db.QueryRow("SELECT "+deployColumns+" FROM deploys WHERE app_id = $1 AND deploy_id = $2", appID, id))
+}
+
+// Update records the progress or outcome of a running deploy, and returns the
+// deploy as stored so that the client performing it sees if it was stopped.
+// Deploys which have finished are not changed.
+func (r *DeployRepo) Update(d *ct.Deploy) (*ct.Deploy, error) {
+	switch d.Status {
+	case ct.DeployStatusRunning, ct.DeployStatusComplete, ct.DeployStatusFailed:
+	default:
+		return nil, ct.ValidationError{Field: "status", Message: "must be one of running, complete or failed"}
+	}
+	err := r.db.Exec("UPDATE deploys SET status = $3, jobs_up = $4, error = $5, updated_at = now(), finished_at = CASE WHEN $3 = 'running' THEN NULL ELSE now() END WHERE app_id = $1 AND deploy_id = $2 AND status = 'running'",
+		d.AppID, d.ID, d.Status, d.JobsUp, d.Error)
+	if err != nil {
+		return nil, err
+	}
+	return r.getAndRecord(d.AppID, d.ID)
+}
+
+// Stop marks the app's most recent running deploy as stopped, the client
+// performing it stops the next time it reports progress.
+func (r *DeployRepo) Stop(appID string) (*ct.Deploy, error) {
+	if err := r.expire(); err != nil {
+		return nil, err
+	}
+	var id string
+	err := r.db.QueryRow("UPDATE deploys SET status = $2, updated_at = now(), finished_at = now() WHERE deploy_id = (SELECT deploy_id FROM deploys WHERE app_id = $1 AND status = 'running' ORDER BY created_at DESC LIMIT 1) AND status = 'running' RETURNING deploy_id", appID, ct.DeployStatusStopped).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return r.getAndRecord(appID, id)
+}
+
+// expire fails the running deploys whose clients have not reported progress
+// within deployTimeout.
+func (r *DeployRepo) expire() error {
+	rows, err := r.db.Query("UPDATE deploys SET status = $1, error = $2, updated_at = now(), finished_at = now() WHERE status = 'running' AND updated_at < $3 RETURNING app_id, deploy_id",
+		ct.DeployStatusFailed, "deploy timed out waiting for progress", time.Now().Add(-deployTimeout))
+	if err != nil {
+		return err
+	}
+	var expired [][2]string
+	for rows.Next() {
+		var appID, id string
+		if err := rows.Scan(&appID, &id); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, [2]string{appID, id})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range expired {
+		if _, err := r.getAndRecord(d[0], d[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAndRecord gets a deploy which has just changed, and records its new
+// state in the cluster event stream.
+func (r *DeployRepo) getAndRecord(appID, id string) (*ct.Deploy, error) {
+	d, err := r.Get(appID, id)
+	if err != nil {
+		return nil, err
+	}
+	recordClusterEvent(r.db, ct.ClusterEventDeploy, d.AppID, d.ID, d)
+	return d, nil
+}
+
+// List returns the running deploys of all apps along with those which
+// finished in the last day, most recent first.
+func (r *DeployRepo) List() ([]*ct.Deploy, error) {
+	if err := r.expire(); err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query("SELECT "+deployColumns+" FROM deploys WHERE status = 'running' OR finished_at > $1 ORDER BY created_at DESC", time.Now().Add(-recentDeploys))
+	if err != nil {
+		return nil, err
+	}
+	deploys := []*ct.Deploy{}
+	for rows.Next() {
+		d, err := scanDeploy(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deploys = append(deploys, d)
+	}
+	return deploys, rows.Err()
+}
+
+func createDeploy(d ct.Deploy, app *ct.App, repo *DeployRepo, releases *ReleaseRepo, r ResponseHelper) {
+	d.AppID = app.ID
+	for field, id := range map[string]string{"old_release": d.OldReleaseID, "new_release": d.NewReleaseID} {
+		if _, err := releases.Get(id); err == ErrNotFound {
+			r.Error(ct.ValidationError{Field: field, Message: "does not exist"})
+			return
+		} else if err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if err := repo.Add(&d); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &d)
+}
+
+func updateDeploy(d ct.Deploy, app *ct.App, params martini.Params, repo *DeployRepo, r ResponseHelper) {
+	d.AppID = app.ID
+	d.ID = params["deploys_id"]
+	updated, err := repo.Update(&d)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, updated)
+}
+
+func stopDeploy(app *ct.App, repo *DeployRepo, r ResponseHelper) {
+	d, err := repo.Stop(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, d)
+}
+
+func listDeploys(repo *DeployRepo, r ResponseHelper) {
+	list, err := repo.List()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
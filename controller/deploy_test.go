@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestDeploys(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deploy-test"})
+	oldRelease := s.createTestRelease(c, &ct.Release{})
+	newRelease := s.createTestRelease(c, &ct.Release{})
+
+	out := &ct.Deploy{}
+	res, err := s.Post("/apps/"+app.ID+"/deploys", &ct.Deploy{
+		OldReleaseID: oldRelease.ID,
+		NewReleaseID: newRelease.ID,
+		Strategy:     "rolling",
+		JobsExpected: 2,
+	}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.ID, Not(Equals), "")
+	c.Assert(out.Status, Equals, ct.DeployStatusRunning)
+
+	findDeploy := func() *ct.Deploy {
+		var list []*ct.Deploy
+		_, err := s.Get("/deploys", &list)
+		c.Assert(err, IsNil)
+		for _, d := range list {
+			if d.ID == out.ID {
+				return d
+			}
+		}
+		return nil
+	}
+	d := findDeploy()
+	c.Assert(d, NotNil)
+	c.Assert(d.AppID, Equals, app.ID)
+	c.Assert(d.Status, Equals, ct.DeployStatusRunning)
+	c.Assert(d.FinishedAt, IsNil)
+
+	path := "/apps/" + app.ID + "/deploys/" + out.ID
+	res, err = s.Put(path, &ct.Deploy{Status: ct.DeployStatusRunning, JobsUp: 1}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.JobsUp, Equals, 1)
+
+	// stopping the deploy is seen by the next update, which doesn't change it
+	res, err = s.Delete("/apps/" + app.ID + "/deploy")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Put(path, &ct.Deploy{Status: ct.DeployStatusRunning, JobsUp: 2}, out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Status, Equals, ct.DeployStatusStopped)
+	c.Assert(out.JobsUp, Equals, 1)
+	c.Assert(out.FinishedAt, NotNil)
+
+	// there is nothing left to stop
+	res, err = s.Delete("/apps/" + app.ID + "/deploy")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	res, err = s.Post("/apps/"+app.ID+"/deploys", &ct.Deploy{OldReleaseID: oldRelease.ID, NewReleaseID: newRelease.ID}, &ct.Deploy{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestStopDeployMostRecent(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deploy-stop-recent-test"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	var deploys []*ct.Deploy
+	for i := 0; i < 2; i++ {
+		out := &ct.Deploy{}
+		res, err := s.Post("/apps/"+app.ID+"/deploys", &ct.Deploy{OldReleaseID: release.ID, NewReleaseID: release.ID, Strategy: "rolling"}, out)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		deploys = append(deploys, out)
+	}
+
+	// only the most recent running deploy is stopped each time
+	for i := len(deploys) - 1; i >= 0; i-- {
+		out := &ct.Deploy{}
+		res, err := s.send("DELETE", "/apps/"+app.ID+"/deploy", nil, out)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(out.ID, Equals, deploys[i].ID)
+		c.Assert(out.Status, Equals, ct.DeployStatusStopped)
+	}
+}
+
+func (s *S) TestDeployExpired(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deploy-expired-test"})
+	release := s.createTestRelease(c, &ct.Release{})
+	out := &ct.Deploy{}
+	res, err := s.Post("/apps/"+app.ID+"/deploys", &ct.Deploy{OldReleaseID: release.ID, NewReleaseID: release.ID, Strategy: "rolling"}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// a deploy whose client stops reporting progress is failed
+	defer func(d time.Duration) { deployTimeout = d }(deployTimeout)
+	deployTimeout = 0
+	var list []*ct.Deploy
+	_, err = s.Get("/deploys", &list)
+	c.Assert(err, IsNil)
+	var d *ct.Deploy
+	for _, deploy := range list {
+		if deploy.ID == out.ID {
+			d = deploy
+		}
+	}
+	c.Assert(d, NotNil)
+	c.Assert(d.Status, Equals, ct.DeployStatusFailed)
+	c.Assert(d.Error, Not(Equals), "")
+	c.Assert(d.FinishedAt, NotNil)
+
+	// the client sees it has failed when it next reports progress
+	res, err = s.Put("/apps/"+app.ID+"/deploys/"+out.ID, &ct.Deploy{Status: ct.DeployStatusRunning, JobsUp: 1}, out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Status, Equals, ct.DeployStatusFailed)
+}
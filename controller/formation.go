@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -23,7 +24,9 @@ type FormationRepo struct {
 	releases  *ReleaseRepo
 	artifacts *ArtifactRepo
 
-	subscriptions map[chan<- *ct.ExpandedFormation]struct{}
+	// subscriptions maps the channel of each subscriber to the ID of the
+	// app it is subscribed to, or to "" for all apps
+	subscriptions map[chan<- *ct.ExpandedFormation]string
 	stopListener  chan struct{}
 	subMtx        sync.RWMutex
 }
@@ -34,7 +37,7 @@ func NewFormationRepo(db *DB, appRepo *AppRepo, releaseRepo *ReleaseRepo, artifa
 		apps:          appRepo,
 		releases:      releaseRepo,
 		artifacts:     artifactRepo,
-		subscriptions: make(map[chan<- *ct.ExpandedFormation]struct{}),
+		subscriptions: make(map[chan<- *ct.ExpandedFormation]string),
 		stopListener:  make(chan struct{}),
 	}
 }
@@ -48,31 +51,123 @@ func procsHstore(m map[string]int) hstore.Hstore {
 
 }
 
+// Add creates or updates a formation. If f.Generation is set, the formation
+// is only updated if its stored generation matches, otherwise ErrConflict is
+// returned so the caller can retry with fresh state, or ErrNotFound if the
+// formation does not exist.
 func (r *FormationRepo) Add(f *ct.Formation) error {
 	// TODO: actually validate
 	procs := procsHstore(f.Processes)
-	err := r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
-		f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	hosts, err := hostsJSON(f.Hosts)
+	if err != nil {
+		return err
+	}
+	if f.Generation != 0 {
+		// a generation is only known for a formation which exists, so a
+		// deleted formation is not recreated
+		err := r.db.QueryRow("UPDATE formations SET processes = $3, hosts = $5, generation = generation + 1, updated_at = now() WHERE app_id = $1 AND release_id = $2 AND generation = $4 AND deleted_at IS NULL RETURNING created_at, updated_at, generation",
+			f.AppID, f.ReleaseID, procs, f.Generation, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+		if err == sql.ErrNoRows {
+			if _, err := r.Get(f.AppID, f.ReleaseID); err != nil {
+				return err
+			}
+			return ErrConflict
+		} else if err != nil {
+			return err
+		}
+		r.record(f)
+		return nil
+	}
+	err = r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes, hosts) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at, generation",
+		f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
-			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+		err = r.db.QueryRow("UPDATE formations SET processes = $3, hosts = $4, generation = generation + 1, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at, generation",
+			f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+	}
+	if err != nil {
+		return err
+	}
+	r.record(f)
+	return nil
+}
+
+// record adds a formation which has just been scaled to the cluster event
+// stream.
+func (r *FormationRepo) record(f *ct.Formation) {
+	recordClusterEvent(r.db, ct.ClusterEventFormation, f.AppID, f.ReleaseID, f)
+}
+
+// SetReleaseAndFormation sets the release of f as the release of its app and
+// replaces the formation of the replaces release, if any, with f in a single
+// transaction, so that the scheduler moves straight to running the release at
+// the counts of f rather than first running it at the counts of the old
+// formation. The app's other formations are left untouched.
+func (r *FormationRepo) SetReleaseAndFormation(f *ct.Formation, replaces string) error {
+	procs := procsHstore(f.Processes)
+	hosts, err := hostsJSON(f.Hosts)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", f.AppID, f.ReleaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if replaces != "" && replaces != f.ReleaseID {
+		if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, hosts = NULL, generation = generation + 1, updated_at = now() WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", f.AppID, replaces); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.QueryRow("UPDATE formations SET processes = $3, hosts = $4, generation = generation + 1, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at, generation",
+		f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO formations (app_id, release_id, processes, hosts) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at, generation",
+			f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
 	}
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.record(f)
 	return nil
 }
 
+// hostsJSON encodes the host IDs a formation is pinned to, returning nil if it
+// is not pinned.
+func hostsJSON(hosts []string) (interface{}, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
 func scanFormation(s Scanner) (*ct.Formation, error) {
 	f := &ct.Formation{}
 	var procs hstore.Hstore
-	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &f.CreatedAt, &f.UpdatedAt)
+	var hosts sql.NullString
+	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &hosts, &f.Generation, &f.CreatedAt, &f.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if hosts.Valid {
+		if err := json.Unmarshal([]byte(hosts.String), &f.Hosts); err != nil {
+			return nil, err
+		}
+	}
 	f.Processes = make(map[string]int, len(procs.Map))
 	for k, v := range procs.Map {
 		n, _ := strconv.Atoi(v.String)
@@ -86,12 +181,12 @@ func scanFormation(s Scanner) (*ct.Formation, error) {
 }
 
 func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
-	row := r.db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+	row := r.db.QueryRow("SELECT app_id, release_id, processes, hosts, generation, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
 	return scanFormation(row)
 }
 
 func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	rows, err := r.db.Query("SELECT app_id, release_id, processes, hosts, generation, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -107,8 +202,166 @@ func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
 	return formations, nil
 }
 
+// Snapshot returns the formations of all apps which have not been deleted.
+func (r *FormationRepo) Snapshot() (*ct.FormationSnapshot, error) {
+	snapshot := &ct.FormationSnapshot{Formations: []*ct.Formation{}}
+	if err := r.db.QueryRow("SELECT now()").Scan(&snapshot.CreatedAt); err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query("SELECT f.app_id, f.release_id, f.processes, f.hosts, f.generation, f.created_at, f.updated_at FROM formations f JOIN apps a USING (app_id) WHERE f.deleted_at IS NULL AND a.deleted_at IS NULL ORDER BY f.app_id, f.release_id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		formation, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshot.Formations = append(snapshot.Formations, formation)
+	}
+	return snapshot, rows.Err()
+}
+
+// Restore sets the processes and hosts of each formation in the snapshot in
+// a single transaction, recreating formations which have since been deleted.
+// The formations of each app in the snapshot are restored as a whole, so any
+// other formations of the app, such as those of releases deployed since the
+// snapshot was taken, are scaled down to zero. Formations of apps which have
+// since been deleted are skipped, and apps which are not in the snapshot are
+// left as they are. The snapshot is rejected if it would scale any process
+// type of a running formation of a protected app to zero.
+func (r *FormationRepo) Restore(snapshot *ct.FormationSnapshot) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var restored []*ct.Formation
+	apps := make(map[string]*ct.App)
+	snapshotReleases := make(map[string]map[string]struct{})
+	for _, f := range snapshot.Formations {
+		app := &ct.App{ID: cleanUUID(f.AppID)}
+		var deleted bool
+		err := tx.QueryRow("SELECT deleted_at IS NOT NULL, protected FROM apps WHERE app_id = $1", f.AppID).Scan(&deleted, &app.Protected)
+		if err == sql.ErrNoRows || err == nil && deleted {
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return err
+		}
+		release, err := scanRelease(tx.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", f.ReleaseID))
+		if err == ErrNotFound {
+			tx.Rollback()
+			return ct.ValidationError{Field: "formations", Message: fmt.Sprintf("release %q does not exist", f.ReleaseID)}
+		} else if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if app.Protected {
+			// only formations which are running jobs can be scaled down
+			current, err := scanFormation(tx.QueryRow("SELECT app_id, release_id, processes, hosts, generation, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", f.AppID, f.ReleaseID))
+			if err == nil && len(current.Processes) > 0 {
+				err = checkProtected(app, release, f.Processes)
+			} else if err == ErrNotFound {
+				err = nil
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		apps[app.ID] = app
+		if snapshotReleases[app.ID] == nil {
+			snapshotReleases[app.ID] = make(map[string]struct{})
+		}
+		snapshotReleases[app.ID][release.ID] = struct{}{}
+		procs := procsHstore(f.Processes)
+		hosts, err := hostsJSON(f.Hosts)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.QueryRow("UPDATE formations SET processes = $3, hosts = $4, generation = generation + 1, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at, generation",
+			f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow("INSERT INTO formations (app_id, release_id, processes, hosts) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at, generation",
+				f.AppID, f.ReleaseID, procs, hosts).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		restored = append(restored, f)
+	}
+	for appID, releases := range snapshotReleases {
+		scaledDown, err := scaleDownFormations(tx, apps[appID], releases)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		restored = append(restored, scaledDown...)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, f := range restored {
+		r.record(f)
+	}
+	return nil
+}
+
+// scaleDownFormations scales the formations of the app to zero, other than
+// those of the given releases. Running formations of a protected app can't be
+// scaled down.
+func scaleDownFormations(tx *dbTx, app *ct.App, keep map[string]struct{}) ([]*ct.Formation, error) {
+	rows, err := tx.Query("SELECT app_id, release_id, processes, hosts, generation, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL", app.ID)
+	if err != nil {
+		return nil, err
+	}
+	var formations []*ct.Formation
+	for rows.Next() {
+		f, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := keep[f.ReleaseID]; !ok {
+			formations = append(formations, f)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, f := range formations {
+		// scanFormation omits process types which are already scaled to zero
+		if app.Protected && len(f.Processes) > 0 {
+			release, err := scanRelease(tx.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1", f.ReleaseID))
+			if err != nil {
+				return nil, err
+			}
+			if err := checkProtected(app, release, nil); err != nil {
+				return nil, err
+			}
+		}
+		f.Processes = map[string]int{}
+		f.Hosts = nil
+		err := tx.QueryRow("UPDATE formations SET processes = $3, generation = generation + 1, updated_at = now() WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at, generation",
+			app.ID, f.ReleaseID, procsHstore(f.Processes)).Scan(&f.CreatedAt, &f.UpdatedAt, &f.Generation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return formations, nil
+}
+
+// Rectify notifies the scheduler of the formation without changing it, so
+// that it starts any of the formation's jobs which are missing.
+func (r *FormationRepo) Rectify(appID, releaseID string) error {
+	return r.db.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+}
+
 func (r *FormationRepo) Remove(appID, releaseID string) error {
-	err := r.db.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID)
+	err := r.db.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, hosts = NULL, generation = generation + 1, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID)
 	if err != nil {
 		return err
 	}
@@ -134,8 +387,10 @@ func (r *FormationRepo) publish(appID, releaseID string) {
 	r.subMtx.RLock()
 	defer r.subMtx.RUnlock()
 
-	for ch := range r.subscriptions {
-		ch <- f
+	for ch, app := range r.subscriptions {
+		if app == "" || app == appID {
+			ch <- f
+		}
 	}
 }
 
@@ -153,11 +408,23 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 		return nil, err
 	}
 	f := &ct.ExpandedFormation{
-		App:       app.(*ct.App),
-		Release:   release.(*ct.Release),
-		Artifact:  artifact.(*ct.Artifact),
-		Processes: formation.Processes,
-		UpdatedAt: *formation.UpdatedAt,
+		App:        app.(*ct.App),
+		Release:    release.(*ct.Release),
+		Artifact:   artifact.(*ct.Artifact),
+		Processes:  formation.Processes,
+		Hosts:      formation.Hosts,
+		Generation: formation.Generation,
+		UpdatedAt:  *formation.UpdatedAt,
+	}
+	for _, id := range f.Release.ArtifactIDs()[1:] {
+		a, err := r.artifacts.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if f.Artifacts == nil {
+			f.Artifacts = make(map[string]*ct.Artifact)
+		}
+		f.Artifacts[id] = a.(*ct.Artifact)
 	}
 	return f, nil
 }
@@ -189,24 +456,33 @@ func (r *FormationRepo) startListener() error {
 	return nil
 }
 
-func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, since time.Time) error {
+// Subscribe sends the formations of the app which have been updated since
+// since to ch followed by an empty sentinel, and then formations as they are
+// updated. If appID is empty the formations of all apps are sent.
+func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, appID string, since time.Time) error {
 	var startListener bool
 	r.subMtx.Lock()
 	if len(r.subscriptions) == 0 {
 		startListener = true
 	}
-	r.subscriptions[ch] = struct{}{}
+	r.subscriptions[ch] = appID
 	r.subMtx.Unlock()
 	if startListener {
 		if err := r.startListener(); err != nil {
 			return err
 		}
 	}
-	return r.sendUpdatedSince(ch, since)
+	return r.sendUpdatedSince(ch, appID, since)
 }
 
-func (r *FormationRepo) sendUpdatedSince(ch chan<- *ct.ExpandedFormation, since time.Time) error {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
+func (r *FormationRepo) sendUpdatedSince(ch chan<- *ct.ExpandedFormation, appID string, since time.Time) error {
+	query := "SELECT app_id, release_id, processes, hosts, generation, created_at, updated_at FROM formations WHERE updated_at >= $1"
+	args := []interface{}{since}
+	if appID != "" {
+		query += " AND app_id = $2"
+		args = append(args, appID)
+	}
+	rows, err := r.db.Query(query+" ORDER BY updated_at DESC", args...)
 	if err != nil {
 		return err
 	}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,8 +15,10 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 )
@@ -35,34 +38,50 @@ func (r *JobRepo) Add(job *ct.Job) error {
 		return ErrNotFound
 	}
 	// TODO: actually validate
-	err := r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at",
-		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+	err := r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state, meta, generation) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at, updated_at",
+		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State, envHstore(job.Meta), job.Generation).Scan(&job.CreatedAt, &job.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "foreign_key_violation" && e.Constraint == "job_cache_release_id_fkey" {
+		return ct.ValidationError{Field: "release", Message: fmt.Sprintf("release %q does not exist", job.ReleaseID)}
+	}
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE job_cache SET state = $3, updated_at = now() WHERE job_id = $1 AND host_id = $2 RETURNING created_at, updated_at",
-			jobID, hostID, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+		// the generation of a job is only ever the one it was started with
+		err = r.db.QueryRow("UPDATE job_cache SET state = $3, updated_at = now() WHERE job_id = $1 AND host_id = $2 RETURNING created_at, updated_at, generation",
+			jobID, hostID, job.State).Scan(&job.CreatedAt, &job.UpdatedAt, &job.Generation)
+	}
+	if err != nil {
+		return err
 	}
+	err = r.db.Exec("INSERT INTO job_events (job_id, host_id, app_id, state, exit_status) VALUES ($1, $2, $3, $4, $5)", jobID, hostID, job.AppID, job.State, job.ExitStatus)
 	if err != nil {
 		return err
 	}
-	return r.db.Exec("INSERT INTO job_events (job_id, host_id, app_id, state) VALUES ($1, $2, $3, $4)", jobID, hostID, job.AppID, job.State)
+	recordClusterEvent(r.db, ct.ClusterEventJob, job.AppID, job.ID, job)
+	return nil
 }
 
 func scanJob(s Scanner) (*ct.Job, error) {
 	job := &ct.Job{}
-	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &job.CreatedAt, &job.UpdatedAt)
+	var meta hstore.Hstore
+	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &meta, &job.Generation, &job.CreatedAt, &job.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if len(meta.Map) > 0 {
+		job.Meta = make(map[string]string, len(meta.Map))
+		for k, v := range meta.Map {
+			job.Meta[k] = v.String
+		}
+	}
 	job.AppID = cleanUUID(job.AppID)
 	job.ReleaseID = cleanUUID(job.ReleaseID)
 	return job, nil
 }
 
 func (r *JobRepo) List(appID string) ([]*ct.Job, error) {
-	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, created_at, updated_at FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC", appID)
+	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, meta, generation, created_at, updated_at FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -78,8 +97,27 @@ func (r *JobRepo) List(appID string) ([]*ct.Job, error) {
 	return jobs, nil
 }
 
+// ListScheduled returns the jobs launched by the job schedule which were
+// last known to be starting or up.
+func (r *JobRepo) ListScheduled(scheduleID string) ([]*ct.Job, error) {
+	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, meta, generation, created_at, updated_at FROM job_cache WHERE meta -> $1 = $2 AND state IN ('starting', 'up') ORDER BY created_at", ct.JobMetaSchedule, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*ct.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
 func (r *JobRepo) listEvents(appID string, sinceID int64, count int) ([]*ct.JobEvent, error) {
-	query := "SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_events.state, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND event_id > $2 ORDER BY event_id DESC"
+	query := "SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_cache.generation, job_events.state, job_events.exit_status, job_events.host_id, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND event_id > $2 ORDER BY event_id DESC"
 	args := []interface{}{appID, sinceID}
 	if count > 0 {
 		query += " LIMIT $3"
@@ -101,20 +139,74 @@ func (r *JobRepo) listEvents(appID string, sinceID int64, count int) ([]*ct.JobE
 	return events, nil
 }
 
+// listEventsSince returns the app's job events created at or after since, in
+// the order they occurred.
+func (r *JobRepo) listEventsSince(appID string, since time.Time) ([]*ct.JobEvent, error) {
+	rows, err := r.db.Query("SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_cache.generation, job_events.state, job_events.exit_status, job_events.host_id, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND job_events.created_at >= $2 ORDER BY event_id", appID, since)
+	if err != nil {
+		return nil, err
+	}
+	events := []*ct.JobEvent{}
+	for rows.Next() {
+		event, err := scanJobEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// listEventsAfter returns at most n of the app's job events with an ID
+// greater than sinceID, in ID order.
+func (r *JobRepo) listEventsAfter(appID string, sinceID int64, n int) ([]*ct.JobEvent, error) {
+	rows, err := r.db.Query("SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_cache.generation, job_events.state, job_events.exit_status, job_events.host_id, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND event_id > $2 ORDER BY event_id LIMIT $3", appID, sinceID, n)
+	if err != nil {
+		return nil, err
+	}
+	var events []*ct.JobEvent
+	for rows.Next() {
+		event, err := scanJobEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
 func (r *JobRepo) getEvent(eventID int64) (*ct.JobEvent, error) {
-	row := r.db.QueryRow("SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_events.state, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.event_id = $1", eventID)
+	row := r.db.QueryRow("SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_cache.generation, job_events.state, job_events.exit_status, job_events.host_id, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.event_id = $1", eventID)
+	return scanJobEvent(row)
+}
+
+// latestEvent returns the most recent event of the app's job with the given
+// state, or of any state if state is empty.
+func (r *JobRepo) latestEvent(appID, id, state string) (*ct.JobEvent, error) {
+	hostID, jobID := parseJobID(id)
+	if hostID == "" {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_cache.generation, job_events.state, job_events.exit_status, job_events.host_id, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND job_events.job_id = $2 AND job_events.host_id = $3 AND ($4 = '' OR job_events.state::text = $4) ORDER BY event_id DESC LIMIT 1", appID, jobID, hostID, state)
 	return scanJobEvent(row)
 }
 
 func scanJobEvent(s Scanner) (*ct.JobEvent, error) {
 	event := &ct.JobEvent{}
-	err := s.Scan(&event.ID, &event.JobID, &event.AppID, &event.ReleaseID, &event.Type, &event.State, &event.CreatedAt)
+	var exitStatus sql.NullInt64
+	err := s.Scan(&event.ID, &event.JobID, &event.AppID, &event.ReleaseID, &event.Type, &event.Generation, &event.State, &exitStatus, &event.HostID, &event.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if exitStatus.Valid {
+		status := int(exitStatus.Int64)
+		event.ExitStatus = &status
+	}
 	event.AppID = cleanUUID(event.AppID)
 	event.ReleaseID = cleanUUID(event.ReleaseID)
 	return event, nil
@@ -141,6 +233,38 @@ func listJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRe
 	r.JSON(200, list)
 }
 
+// listJobEvents lists the app's job events since the time given in the since
+// parameter, which is required so that the whole history is never loaded at
+// once.
+func listJobEvents(req *http.Request, app *ct.App, repo *JobRepo, r ResponseHelper) {
+	if req.FormValue("since") == "" {
+		r.Error(ct.ValidationError{Field: "since", Message: "must be set"})
+		return
+	}
+	since, err := time.Parse(time.RFC3339Nano, req.FormValue("since"))
+	if err != nil {
+		r.Error(ct.ValidationError{Field: "since", Message: "is invalid"})
+		return
+	}
+	list, err := repo.listEventsSince(app.ID, since)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+// getJobEvent returns the most recent event of a job with the state given by
+// the state parameter, or of any state if it is not set.
+func getJobEvent(req *http.Request, app *ct.App, params martini.Params, repo *JobRepo, r ResponseHelper) {
+	event, err := repo.latestEvent(app.ID, params["jobs_id"], req.FormValue("state"))
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, event)
+}
+
 func putJob(job ct.Job, app *ct.App, repo *JobRepo, r ResponseHelper) {
 	job.AppID = app.ID
 	if err := repo.Add(&job); err != nil {
@@ -209,6 +333,46 @@ func jobLog(req *http.Request, app *ct.App, params martini.Params, hc cluster.Ho
 	}
 }
 
+// defaultJobEventBuffer is the number of job events which are queued for a
+// slow consumer before the stream either blocks or drops events.
+const defaultJobEventBuffer = 100
+
+const (
+	// defaultReplayChunk is the number of past job events which are sent at
+	// once when a stream replays events on connect.
+	defaultReplayChunk = 100
+
+	// defaultReplayInterval is the pause between chunks of replayed events.
+	defaultReplayInterval = 50 * time.Millisecond
+)
+
+// Allow pausing between replayed chunks to be mocked in tests
+var replaySleep = time.Sleep
+
+// replayJobEvents sends the events returned by list with an ID greater than
+// sinceID in chunks of at most chunk events, pausing for interval between
+// chunks so that a consumer which reconnects after a long gap is not sent the
+// whole backlog at once, and then calls caughtUp. It returns the ID of the
+// last event sent.
+func replayJobEvents(sinceID int64, chunk int, interval time.Duration, list func(sinceID int64, n int) ([]*ct.JobEvent, error), send func(*ct.JobEvent) error, caughtUp func() error) (int64, error) {
+	for {
+		events, err := list(sinceID, chunk)
+		if err != nil {
+			return sinceID, err
+		}
+		for _, e := range events {
+			if err := send(e); err != nil {
+				return sinceID, err
+			}
+			sinceID = e.ID
+		}
+		if len(events) < chunk {
+			return sinceID, caughtUp()
+		}
+		replaySleep(interval)
+	}
+}
+
 func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRepo) (err error) {
 	var lastID int64
 	if req.Header.Get("Last-Event-Id") != "" {
@@ -224,6 +388,46 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 			return ct.ValidationError{Field: "count", Message: "is invalid"}
 		}
 	}
+	bufferSize := defaultJobEventBuffer
+	if req.FormValue("buffer") != "" {
+		bufferSize, err = strconv.Atoi(req.FormValue("buffer"))
+		if err != nil || bufferSize < 1 {
+			return ct.ValidationError{Field: "buffer", Message: "is invalid"}
+		}
+	}
+	// the caught up marker is only sent to clients which request pacing, as
+	// other clients don't expect it
+	paced := req.FormValue("replay_chunk") != "" || req.FormValue("replay_interval") != ""
+	replayChunk := defaultReplayChunk
+	if req.FormValue("replay_chunk") != "" {
+		replayChunk, err = strconv.Atoi(req.FormValue("replay_chunk"))
+		if err != nil || replayChunk < 1 {
+			return ct.ValidationError{Field: "replay_chunk", Message: "is invalid"}
+		}
+	}
+	replayInterval := defaultReplayInterval
+	if req.FormValue("replay_interval") != "" {
+		replayInterval, err = time.ParseDuration(req.FormValue("replay_interval"))
+		if err != nil || replayInterval < 0 {
+			return ct.ValidationError{Field: "replay_interval", Message: "is invalid"}
+		}
+	}
+	var drop bool
+	switch req.FormValue("policy") {
+	case "", "block":
+	case "drop":
+		drop = true
+	default:
+		return ct.ValidationError{Field: "policy", Message: "must be either block or drop"}
+	}
+	// job_id restricts the stream to the events of the given jobs
+	var jobIDs map[string]struct{}
+	if ids := req.Form["job_id"]; len(ids) > 0 {
+		jobIDs = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			jobIDs[id] = struct{}{}
+		}
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 
@@ -239,6 +443,9 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 	}
 
 	sendJobEvent := func(e *ct.JobEvent) error {
+		if _, ok := jobIDs[e.JobID]; jobIDs != nil && !ok {
+			return nil
+		}
 		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: ", e.ID, e.State); err != nil {
 			return err
 		}
@@ -251,6 +458,19 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 		w.(http.Flusher).Flush()
 		return nil
 	}
+	sendGap := func(dropped int) error {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: ", ct.JobEventGap); err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(&ct.JobEvent{Job: ct.Job{AppID: app.ID, State: ct.JobEventGap}, Dropped: dropped}); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
 
 	connected := make(chan struct{})
 	done := make(chan struct{})
@@ -269,19 +489,41 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 	defer listener.Close()
 	listener.Listen("job_events:" + formatUUID(app.ID))
 
-	var currID int64
-	if lastID > 0 || count > 0 {
-		events, err := repo.listEvents(app.ID, lastID, count)
-		if err != nil {
+	sendCaughtUp := func() error {
+		if !paced {
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: ", ct.JobEventCaughtUp); err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(&ct.JobEvent{Job: ct.Job{AppID: app.ID, State: ct.JobEventCaughtUp}}); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
 			return err
 		}
-		// events are in ID DESC order, so iterate in reverse
-		for i := len(events) - 1; i >= 0; i-- {
-			e := events[i]
-			if err := sendJobEvent(e); err != nil {
+		w.(http.Flusher).Flush()
+		return nil
+	}
+
+	var currID int64
+	if lastID > 0 || count > 0 {
+		if count > 0 {
+			// replay from the oldest of the last count events, which are
+			// in ID DESC order
+			events, err := repo.listEvents(app.ID, lastID, count)
+			if err != nil {
 				return err
 			}
-			currID = e.ID
+			if len(events) > 0 {
+				lastID = events[len(events)-1].ID - 1
+			}
+		}
+		currID, err = replayJobEvents(lastID, replayChunk, replayInterval, func(sinceID int64, n int) ([]*ct.JobEvent, error) {
+			return repo.listEventsAfter(app.ID, sinceID, n)
+		}, sendJobEvent, sendCaughtUp)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -291,6 +533,50 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 	case <-connected:
 	}
 
+	// events are queued so that a slow consumer either blocks the listener
+	// or has events dropped, depending on the requested policy
+	queue := newJobEventQueue(bufferSize, drop)
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	// the writer must have stopped using w before the handler returns
+	defer func() {
+		close(stop)
+		<-writerDone
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(30 * time.Second):
+				if err := sendKeepAlive(); err != nil {
+					writeErr <- err
+					return
+				}
+			case <-queue.Ready():
+				ids, dropped := queue.Pop()
+				if dropped > 0 {
+					if err := sendGap(dropped); err != nil {
+						writeErr <- err
+						return
+					}
+				}
+				for _, id := range ids {
+					e, err := repo.getEvent(id)
+					if err == nil {
+						err = sendJobEvent(e)
+					}
+					if err != nil {
+						writeErr <- err
+						return
+					}
+				}
+			}
+		}
+	}()
+
 	closed := w.(http.CloseNotifier).CloseNotify()
 	for {
 		select {
@@ -298,10 +584,8 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 			return
 		case <-closed:
 			return
-		case <-time.After(30 * time.Second):
-			if err := sendKeepAlive(); err != nil {
-				return err
-			}
+		case err := <-writeErr:
+			return err
 		case n := <-listener.Notify:
 			id, err := strconv.ParseInt(n.Extra, 10, 64)
 			if err != nil {
@@ -310,17 +594,84 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 			if id <= currID {
 				continue
 			}
-			e, err := repo.getEvent(id)
-			if err != nil {
-				return err
+			if !queue.Push(id, closed) {
+				return nil
 			}
-			if err = sendJobEvent(e); err != nil {
-				return err
+		}
+	}
+}
+
+func newJobEventQueue(size int, drop bool) *jobEventQueue {
+	return &jobEventQueue{
+		size:  size,
+		drop:  drop,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+// jobEventQueue is a bounded queue of job event IDs. When the queue is full,
+// Push either blocks until there is space or drops the oldest event,
+// recording the number of dropped events so a gap can be signalled.
+type jobEventQueue struct {
+	size int
+	drop bool
+
+	mtx     sync.Mutex
+	ids     []int64
+	dropped int
+
+	ready chan struct{}
+	space chan struct{}
+}
+
+// Push adds an event ID to the queue, returning false if stop was closed
+// while blocked waiting for space.
+func (q *jobEventQueue) Push(id int64, stop <-chan bool) bool {
+	for {
+		q.mtx.Lock()
+		if len(q.ids) < q.size || q.drop {
+			if len(q.ids) >= q.size {
+				q.ids = q.ids[1:]
+				q.dropped++
 			}
+			q.ids = append(q.ids, id)
+			q.mtx.Unlock()
+			signal(q.ready)
+			return true
+		}
+		q.mtx.Unlock()
+		select {
+		case <-q.space:
+		case <-stop:
+			return false
 		}
 	}
 }
 
+// Ready returns a channel which receives when there are events to Pop.
+func (q *jobEventQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Pop removes and returns all queued event IDs along with the number of
+// events dropped before them.
+func (q *jobEventQueue) Pop() ([]int64, int) {
+	q.mtx.Lock()
+	ids, dropped := q.ids, q.dropped
+	q.ids, q.dropped = nil, 0
+	q.mtx.Unlock()
+	signal(q.space)
+	return ids, dropped
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
 type SSELogWriter interface {
 	Stream(string) io.Writer
 }
@@ -424,7 +775,130 @@ func killJob(app *ct.App, params martini.Params, client cluster.Host, r Response
 	}
 }
 
-func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+// testHealthCheck runs the given health check once against a running job of
+// the app, without affecting the state of the job.
+func testHealthCheck(app *ct.App, params martini.Params, check ct.HealthCheck, client cluster.Host, releases *ReleaseRepo, r ResponseHelper) {
+	if check.Type != "tcp" && check.Type != "http" {
+		r.Error(ct.ValidationError{Field: "type", Message: `must be "tcp" or "http"`})
+		return
+	}
+	job, err := client.GetJob(params["jobs_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if job.Job == nil || job.Job.Metadata["flynn-controller.app"] != app.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+
+	// the process type provides the default port of the check
+	var proc ct.ProcessType
+	if releaseID := job.Job.Metadata["flynn-controller.release"]; releaseID != "" {
+		data, err := releases.Get(releaseID)
+		if err != nil && err != ErrNotFound {
+			r.Error(err)
+			return
+		} else if err == nil {
+			proc = data.(*ct.Release).Processes[job.Job.Metadata["flynn-controller.type"]]
+		}
+	}
+
+	res := &ct.HealthResult{}
+	addr, err := utils.HealthCheckAddr(&check, proc, job)
+	if err == nil {
+		start := time.Now()
+		res.Detail, err = utils.ProbeHealth(&check, addr)
+		res.Latency = time.Since(start)
+	}
+	if err != nil {
+		res.Detail = err.Error()
+	} else {
+		res.Healthy = true
+	}
+	r.JSON(200, res)
+}
+
+// stopJobsMatching stops the app's running one-off jobs whose metadata
+// matches selector, returning the IDs of the stopped jobs, including those
+// stopped before an error. Jobs which belong to a formation are never stopped,
+// so that the app is not scaled down, and the selector may not use the
+// controller's own keys.
+func stopJobsMatching(appID string, selector map[string]string, cl clusterClient) ([]string, error) {
+	if len(selector) == 0 {
+		return nil, ct.ValidationError{Field: "selector", Message: "must not be empty"}
+	}
+	if err := validateMeta("selector", selector); err != nil {
+		return nil, err
+	}
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	stopped := []string{}
+	for hostID, h := range hosts {
+		var client cluster.Host
+		for _, job := range h.Jobs {
+			if job.Metadata["flynn-controller.app"] != appID || job.Metadata["flynn-controller.type"] != "" || !metaMatches(job.Metadata, selector) {
+				continue
+			}
+			if client == nil {
+				if client, err = cl.DialHost(hostID); err != nil {
+					return stopped, err
+				}
+				defer client.Close()
+			}
+			if err := client.StopJob(job.ID); err != nil {
+				return stopped, err
+			}
+			stopped = append(stopped, hostID+"-"+job.ID)
+		}
+	}
+	sort.Strings(stopped)
+	return stopped, nil
+}
+
+// validateMeta returns a validation error for field if meta uses any of the
+// controller's own keys.
+func validateMeta(field string, meta map[string]string) error {
+	for k := range meta {
+		if strings.HasPrefix(k, "flynn-controller.") {
+			return ct.ValidationError{Field: field, Message: fmt.Sprintf("%q is a reserved key", k)}
+		}
+	}
+	return nil
+}
+
+// metaMatches returns whether meta contains every key and value in selector.
+func metaMatches(meta, selector map[string]string) bool {
+	for k, v := range selector {
+		if value, ok := meta[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// stopJobs responds with the IDs of the stopped jobs, along with the error if
+// only some of the matching jobs could be stopped.
+func stopJobs(app *ct.App, req ct.StopJobsReq, cl clusterClient, r ResponseHelper) {
+	stopped, err := stopJobsMatching(app.ID, req.Selector, cl)
+	if err != nil && len(stopped) == 0 {
+		r.Error(err)
+		return
+	}
+	res := &ct.StopJobsRes{Stopped: stopped}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.JSON(200, res)
+}
+
+func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, secrets *SecretRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	if err := validateMeta("meta", newJob.Meta); err != nil {
+		r.Error(err)
+		return
+	}
 	data, err := releases.Get(newJob.ReleaseID)
 	if err != nil {
 		r.Error(err)
@@ -439,50 +913,25 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 	artifact := data.(*ct.Artifact)
 	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
 
-	env := make(map[string]string, len(release.Env)+len(newJob.Env))
-	for k, v := range release.Env {
-		env[k] = v
-	}
-	for k, v := range newJob.Env {
-		env[k] = v
-	}
-	job := &host.Job{
-		ID: cluster.RandomJobID(""),
-		Metadata: map[string]string{
-			"flynn-controller.app":      app.ID,
-			"flynn-controller.app_name": app.Name,
-			"flynn-controller.release":  release.ID,
-		},
-		Artifact: host.Artifact{
-			Type: artifact.Type,
-			URI:  artifact.URI,
-		},
-		Config: host.ContainerConfig{
-			Cmd:   newJob.Cmd,
-			Env:   env,
-			TTY:   newJob.TTY,
-			Stdin: attach,
-		},
-	}
-	if len(newJob.Entrypoint) > 0 {
-		job.Config.Entrypoint = newJob.Entrypoint
+	job := oneOffJobConfig(app, release, artifact, &newJob)
+	job.Config.Stdin = attach
+	if err := resolveSecrets(app.ID, job.Config.Env, secrets); err != nil {
+		r.Error(err)
+		return
 	}
 
-	hosts, err := cl.ListHosts()
+	hostID, err := randomHost(cl)
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	// pick a random host
-	var hostID string
-	for hostID = range hosts {
-		break
-	}
-	if hostID == "" {
-		r.Error(errors.New("no hosts found"))
-		return
-	}
 
+	startOneOffJob(cl, hostID, job, &newJob, attach, w, r)
+}
+
+// startOneOffJob starts job on the given host, either proxying an attach
+// connection to it or responding with the started job.
+func startOneOffJob(cl clusterClient, hostID string, job *host.Job, newJob *ct.NewJob, attach bool, w http.ResponseWriter, r ResponseHelper) {
 	var attachClient cluster.AttachClient
 	if attach {
 		attachReq := &host.AttachReq{
@@ -505,8 +954,7 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		defer attachClient.Close()
 	}
 
-	_, err = cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}})
-	if err != nil {
+	if _, err := cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}}); err != nil {
 		r.Error(fmt.Errorf("schedule failed: %s", err.Error()))
 		return
 	}
@@ -516,31 +964,214 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 			r.Error(fmt.Errorf("attach wait failed: %s", err.Error()))
 			return
 		}
-		w.Header().Set("Content-Type", "application/vnd.flynn.attach")
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusSwitchingProtocols)
-		conn, _, err := w.(http.Hijacker).Hijack()
-		if err != nil {
-			panic(err)
-		}
-		defer conn.Close()
-
-		done := make(chan struct{}, 2)
-		cp := func(to io.Writer, from io.Reader) {
-			io.Copy(to, from)
-			done <- struct{}{}
-		}
-		go cp(conn, attachClient.Conn())
-		go cp(attachClient.Conn(), conn)
-		<-done
-		<-done
-
+		w.Header().Set("Flynn-Job-ID", hostID+"-"+job.ID)
+		proxyAttach(w, attachClient)
 		return
 	} else {
 		r.JSON(200, &ct.Job{
 			ID:        hostID + "-" + job.ID,
-			ReleaseID: newJob.ReleaseID,
+			ReleaseID: job.Metadata["flynn-controller.release"],
 			Cmd:       newJob.Cmd,
+			Meta:      newJob.Meta,
 		})
 	}
 }
+
+// runJobLike runs a one-off job with the release, environment, resources
+// and mounts of a running job of the app, but with the command of newJob.
+// The job runs on the same host as the running job so that its volumes are
+// available.
+func runJobLike(app *ct.App, params martini.Params, newJob ct.NewJob, secrets *SecretRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	if err := validateMeta("meta", newJob.Meta); err != nil {
+		r.Error(err)
+		return
+	}
+	hostID, jobID := parseJobID(params["jobs_id"])
+	if hostID == "" {
+		r.Error(ErrNotFound)
+		return
+	}
+	client, err := cl.DialHost(hostID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	defer client.Close()
+	active, err := client.GetJob(jobID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if active.Job == nil || active.Job.Metadata["flynn-controller.app"] != app.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+	target := active.Job
+	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+
+	if err := resolveSecrets(app.ID, newJob.Env, secrets); err != nil {
+		r.Error(err)
+		return
+	}
+	env := make(map[string]string, len(target.Config.Env)+len(newJob.Env))
+	for k, v := range target.Config.Env {
+		env[k] = v
+	}
+	for k, v := range newJob.Env {
+		env[k] = v
+	}
+	meta := make(map[string]string, len(newJob.Meta)+3)
+	for k, v := range newJob.Meta {
+		meta[k] = v
+	}
+	for _, k := range []string{"flynn-controller.app", "flynn-controller.app_name", "flynn-controller.release"} {
+		meta[k] = target.Metadata[k]
+	}
+	job := &host.Job{
+		ID:           cluster.RandomJobID(""),
+		Metadata:     meta,
+		Artifact:     target.Artifact,
+		Resources:    target.Resources,
+		LogRetention: target.LogRetention,
+		Config: host.ContainerConfig{
+			Cmd:        newJob.Cmd,
+			Env:        env,
+			TTY:        newJob.TTY,
+			Stdin:      attach,
+			Mounts:     target.Config.Mounts,
+			WorkingDir: target.Config.WorkingDir,
+			Uid:        target.Config.Uid,
+			User:       target.Config.User,
+		},
+	}
+	if len(newJob.Entrypoint) > 0 {
+		job.Config.Entrypoint = newJob.Entrypoint
+	} else {
+		job.Config.Entrypoint = target.Config.Entrypoint
+	}
+
+	startOneOffJob(cl, hostID, job, &newJob, attach, w, r)
+}
+
+// oneOffJobConfig returns the host job config to run newJob using the given
+// release.
+func oneOffJobConfig(app *ct.App, release *ct.Release, artifact *ct.Artifact, newJob *ct.NewJob) *host.Job {
+	env := make(map[string]string, len(release.Env)+len(newJob.Env))
+	for k, v := range release.Env {
+		env[k] = v
+	}
+	for k, v := range newJob.Env {
+		env[k] = v
+	}
+	meta := make(map[string]string, len(newJob.Meta)+3)
+	for k, v := range newJob.Meta {
+		meta[k] = v
+	}
+	meta["flynn-controller.app"] = app.ID
+	meta["flynn-controller.app_name"] = app.Name
+	meta["flynn-controller.release"] = release.ID
+	job := &host.Job{
+		ID:       cluster.RandomJobID(""),
+		Metadata: meta,
+		Artifact: host.Artifact{
+			Type: artifact.Type,
+			URI:  artifact.URI,
+		},
+		Config: host.ContainerConfig{
+			Cmd: newJob.Cmd,
+			Env: env,
+			TTY: newJob.TTY,
+		},
+	}
+	if len(newJob.Entrypoint) > 0 {
+		job.Config.Entrypoint = newJob.Entrypoint
+	}
+	if r := app.LogRetention; r != nil {
+		job.LogRetention = host.LogRetention{MaxBytes: r.MaxBytes, MaxAge: r.MaxAge}
+	}
+	return job
+}
+
+// randomHost returns the ID of a random host in the cluster.
+func randomHost(cl clusterClient) (string, error) {
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		return "", err
+	}
+	var hostID string
+	for hostID = range hosts {
+		break
+	}
+	if hostID == "" {
+		return "", errors.New("no hosts found")
+	}
+	return hostID, nil
+}
+
+// attachJob re-attaches to a running job, replaying its output from the start
+// so that a client which lost its connection can resume the session.
+// attachJob attaches to a running job, replaying its logs. The stdout_offset
+// and stderr_offset query parameters resume the replay from the given number of
+// bytes of each stream, responding with a 416 if the logs no longer retain the
+// output from there.
+func attachJob(app *ct.App, params martini.Params, client cluster.Host, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	var offsets [2]int64
+	for i, name := range []string{"stdout_offset", "stderr_offset"} {
+		if s := req.URL.Query().Get(name); s != "" {
+			offset, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || offset < 0 {
+				r.Error(ct.ValidationError{Field: name, Message: "must be a non-negative integer"})
+				return
+			}
+			offsets[i] = offset
+		}
+	}
+	job, err := client.GetJob(params["jobs_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if job.Job == nil || job.Status != host.StatusRunning {
+		r.Error(ErrNotFound)
+		return
+	}
+	attachReq := &host.AttachReq{
+		JobID: params["jobs_id"],
+		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStdin | host.AttachFlagLogs | host.AttachFlagStream,
+
+		StdoutOffset: offsets[0],
+		StderrOffset: offsets[1],
+	}
+	attachClient, err := client.Attach(attachReq, false)
+	if err == cluster.ErrLogsTruncated {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		r.Error(fmt.Errorf("attach failed: %s", err.Error()))
+		return
+	}
+	defer attachClient.Close()
+	proxyAttach(w, attachClient)
+}
+
+func proxyAttach(w http.ResponseWriter, attachClient cluster.AttachClient) {
+	w.Header().Set("Content-Type", "application/vnd.flynn.attach")
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	cp := func(to io.Writer, from io.Reader) {
+		io.Copy(to, from)
+		done <- struct{}{}
+	}
+	go cp(conn, attachClient.Conn())
+	go cp(attachClient.Conn(), conn)
+	<-done
+	<-done
+}
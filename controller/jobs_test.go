@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
@@ -44,6 +50,195 @@ func (s *S) TestJobList(c *C) {
 	c.Assert(job.ReleaseID, Equals, release.ID)
 }
 
+func (s *S) TestJobGeneration(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-generation"})
+	release := s.createTestRelease(c, &ct.Release{})
+	formation := s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting", Generation: formation.Generation})
+
+	// later updates keep the generation the job was started with
+	job := s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up", Generation: formation.Generation + 1})
+	c.Assert(job.Generation, Equals, formation.Generation)
+
+	var list []ct.Job
+	_, err := s.Get("/apps/"+app.ID+"/jobs", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Generation, Equals, formation.Generation)
+}
+
+func (s *S) TestJobMissingRelease(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-missing-release"})
+	res, err := s.Put("/apps/"+app.ID+"/jobs/host0-job0", &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: random.UUID(), State: "starting"}, &ct.Job{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestJobEventsSince(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "job-events-since"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	events, err := client.JobEventsSince(app.ID, time.Now().Add(-time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].State, Equals, "starting")
+	c.Assert(events[1].State, Equals, "up")
+	for _, e := range events {
+		c.Assert(e.JobID, Equals, "host0-job0")
+		c.Assert(e.Type, Equals, "web")
+	}
+
+	events, err = client.JobEventsSince(app.ID, time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+
+	// since is required
+	res, err := s.Get("/apps/"+app.ID+"/job_events", &events)
+	c.Assert(err, NotNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestStreamJobEventsJobIDs(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stream-job-ids"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	before := time.Now().Add(-time.Minute)
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job1", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job2", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job1", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job2", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	events, err := client.JobEventsSince(app.ID, before)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 5)
+
+	// replay the events after the first, only the events of the selected
+	// job are sent
+	stream, err := client.StreamJobEventsWithOptions(app.ID, &controller.StreamJobEventsOptions{
+		LastEventID: events[0].ID,
+		JobIDs:      []string{"host0-job1"},
+	})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	var states []string
+	for len(states) < 2 {
+		select {
+		case e, ok := <-stream.Events:
+			c.Assert(ok, Equals, true)
+			c.Assert(e.JobID, Equals, "host0-job1")
+			states = append(states, e.State)
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for job events")
+		}
+	}
+	c.Assert(states, DeepEquals, []string{"starting", "up"})
+}
+
+func (s *S) TestStreamJobEventsReconnect(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stream-reconnect"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	before := time.Now().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		s.createTestJob(c, &ct.Job{ID: fmt.Sprintf("host0-job%d", i), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	}
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	events, err := client.JobEventsSince(app.ID, before)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 5)
+
+	next := func(stream *controller.JobEventStream) *ct.JobEvent {
+		select {
+		case e, ok := <-stream.Events:
+			c.Assert(ok, Equals, true)
+			return e
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for job event")
+		}
+		return nil
+	}
+
+	// a client reconnecting with the ID of the second event and asking for
+	// a paced replay is sent the rest of the events one at a time, then the
+	// caught up marker, then live events
+	stream, err := client.StreamJobEventsWithOptions(app.ID, &controller.StreamJobEventsOptions{
+		LastEventID:    events[1].ID,
+		ReplayChunk:    1,
+		ReplayInterval: time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	for _, expected := range events[2:] {
+		e := next(stream)
+		c.Assert(e.ID, Equals, expected.ID)
+		c.Assert(e.JobID, Equals, expected.JobID)
+	}
+	c.Assert(next(stream).State, Equals, ct.JobEventCaughtUp)
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	e := next(stream)
+	c.Assert(e.JobID, Equals, "host0-job0")
+	c.Assert(e.State, Equals, "up")
+
+	// a client which doesn't ask for pacing is not sent the marker
+	unpaced, err := client.StreamJobEventsWithOptions(app.ID, &controller.StreamJobEventsOptions{
+		LastEventID: events[3].ID,
+	})
+	c.Assert(err, IsNil)
+	defer unpaced.Close()
+	c.Assert(next(unpaced).ID, Equals, events[4].ID)
+	e = next(unpaced)
+	c.Assert(e.JobID, Equals, "host0-job0")
+	c.Assert(e.State, Equals, "up")
+}
+
+func (s *S) TestGetJobEvent(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "get-job-event"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	exitStatus := 2
+	s.createTestJob(c, &ct.Job{ID: "host0-job0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "crashed", ExitStatus: &exitStatus})
+	// a later event of another job does not match
+	s.createTestJob(c, &ct.Job{ID: "host0-job1", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "crashed"})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	event, err := client.GetJobEvent(app.ID, "host0-job0", "crashed")
+	c.Assert(err, IsNil)
+	c.Assert(event.JobID, Equals, "host0-job0")
+	c.Assert(event.HostID, Equals, "host0")
+	c.Assert(event.State, Equals, "crashed")
+	c.Assert(event.Type, Equals, "web")
+	c.Assert(event.ReleaseID, Equals, release.ID)
+	c.Assert(event.ExitStatus, NotNil)
+	c.Assert(*event.ExitStatus, Equals, 2)
+	c.Assert(event.CreatedAt, NotNil)
+
+	event, err = client.GetJobEvent(app.ID, "host0-job0", "up")
+	c.Assert(err, IsNil)
+	c.Assert(event.State, Equals, "up")
+	c.Assert(event.ExitStatus, IsNil)
+
+	// the latest event of any state is returned without a state
+	event, err = client.GetJobEvent(app.ID, "host0-job0", "")
+	c.Assert(err, IsNil)
+	c.Assert(event.State, Equals, "crashed")
+
+	_, err = client.GetJobEvent(app.ID, "host0-job0", "down")
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
 func newFakeLog(r io.Reader) *fakeLog {
 	return &fakeLog{r}
 }
@@ -69,6 +264,57 @@ func (s *S) TestKillJob(c *C) {
 	c.Assert(hc.IsStopped(jobID), Equals, true)
 }
 
+func (s *S) TestTestHealthCheck(c *C) {
+	// a job serving TCP on its process type's port and failing HTTP requests
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	tcpPort, _ := strconv.Atoi(strings.Split(l.Addr().String(), ":")[1])
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+	httpPort, _ := strconv.Atoi(strings.Split(srv.Listener.Addr().String(), ":")[1])
+
+	app := s.createTestApp(c, &ct.App{Name: "test-health-check"})
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: tcpPort, Proto: "tcp"}}}},
+	})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetInternalIP(jobID, "127.0.0.1")
+	s.cc.AddHost(hostID, host.Host{ID: hostID})
+	s.cc.SetHostClient(hostID, hc)
+	_, err = s.cc.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {{
+		ID: jobID,
+		Metadata: map[string]string{
+			"flynn-controller.app":     app.ID,
+			"flynn-controller.release": release.ID,
+			"flynn-controller.type":    "web",
+		},
+	}}}})
+	c.Assert(err, IsNil)
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	// the TCP check defaults to the port of the process type
+	res, err := client.TestHealthCheck(app.ID, hostID+"-"+jobID, &ct.HealthCheck{Type: "tcp"})
+	c.Assert(err, IsNil)
+	c.Assert(res.Healthy, Equals, true)
+	c.Assert(res.Latency > 0, Equals, true)
+	c.Assert(res.Detail, Equals, "connected to "+l.Addr().String())
+
+	res, err = client.TestHealthCheck(app.ID, hostID+"-"+jobID, &ct.HealthCheck{Type: "http", Port: httpPort, Path: "/status"})
+	c.Assert(err, IsNil)
+	c.Assert(res.Healthy, Equals, false)
+	c.Assert(res.Detail, Equals, "health check: unexpected status 500 Internal Server Error")
+
+	// the job is not stopped or otherwise changed
+	c.Assert(hc.IsStopped(jobID), Equals, false)
+	c.Assert(s.cc.GetHost(hostID).Jobs, HasLen, 1)
+}
+
 func (s *S) createLogTestApp(c *C, name string, stream io.Reader) (*ct.App, string, string) {
 	app := s.createTestApp(c, &ct.App{Name: name})
 	hostID, jobID := random.UUID(), random.UUID()
@@ -225,6 +471,13 @@ func (s *S) TestRunJobDetached(c *C) {
 	c.Assert(job.Config.Cmd, DeepEquals, []string{"foo", "bar"})
 	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "baz", "JOB": "true", "RELEASE": "true"})
 	c.Assert(job.Config.Stdin, Equals, false)
+
+	// the controller's own meta keys are reserved
+	req.Meta = map[string]string{"flynn-controller.type": "web"}
+	r, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), req, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 400)
+	c.Assert(s.cc.GetHost(hostID).Jobs, HasLen, 1)
 }
 
 func (s *S) TestRunJobAttached(c *C) {
@@ -301,3 +554,355 @@ func (s *S) TestRunJobAttached(c *C) {
 	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "baz", "JOB": "true", "RELEASE": "true"})
 	c.Assert(job.Config.Stdin, Equals, true)
 }
+
+func (s *S) TestRunJobLike(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-like"})
+	hostID := random.UUID()
+	target := &host.Job{
+		ID: "target",
+		Metadata: map[string]string{
+			"flynn-controller.app":      app.ID,
+			"flynn-controller.app_name": app.Name,
+			"flynn-controller.release":  "release-id",
+			"flynn-controller.type":     "echoer",
+		},
+		Artifact:  host.Artifact{Type: "docker", URI: "docker://foo/bar"},
+		Resources: host.JobResources{Memory: 1024},
+		Config: host.ContainerConfig{
+			Cmd:    []string{"echoer"},
+			Env:    map[string]string{"RELEASE": "true", "FOO": "bar"},
+			Mounts: []host.Mount{{Volume: "data", Location: "/data", Writeable: true}},
+		},
+	}
+	s.cc.SetHosts(map[string]host.Host{hostID: {Jobs: []*host.Job{target}}})
+	s.cc.SetHostClient(hostID, tu.NewFakeHostClient(hostID))
+
+	req := &ct.NewJob{
+		Cmd: []string{"sh", "-c", "env"},
+		Env: map[string]string{"JOB": "true", "FOO": "baz"},
+	}
+	res := &ct.Job{}
+	_, err := s.Post(fmt.Sprintf("/apps/%s/jobs/%s-target/clone", app.ID, hostID), req, res)
+	c.Assert(err, IsNil)
+	c.Assert(res.ReleaseID, Equals, "release-id")
+	c.Assert(res.Type, Equals, "")
+
+	jobs := s.cc.GetHost(hostID).Jobs
+	c.Assert(jobs, HasLen, 2)
+	job := jobs[1]
+	c.Assert(res.ID, Equals, hostID+"-"+job.ID)
+	c.Assert(job.ID, Not(Equals), target.ID)
+	c.Assert(job.Metadata, DeepEquals, map[string]string{
+		"flynn-controller.app":      app.ID,
+		"flynn-controller.app_name": app.Name,
+		"flynn-controller.release":  "release-id",
+	})
+	c.Assert(job.Artifact, DeepEquals, target.Artifact)
+	c.Assert(job.Resources, DeepEquals, target.Resources)
+	c.Assert(job.Config.Cmd, DeepEquals, []string{"sh", "-c", "env"})
+	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "baz", "JOB": "true", "RELEASE": "true"})
+	c.Assert(job.Config.Mounts, DeepEquals, target.Config.Mounts)
+
+	// the controller's own meta keys are reserved
+	reserved := &ct.NewJob{Cmd: req.Cmd, Meta: map[string]string{"flynn-controller.app": "other"}}
+	r, err := s.Post(fmt.Sprintf("/apps/%s/jobs/%s-target/clone", app.ID, hostID), reserved, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 400)
+	c.Assert(s.cc.GetHost(hostID).Jobs, HasLen, 2)
+
+	// jobs of other apps cannot be cloned
+	other := s.createTestApp(c, &ct.App{Name: "run-like-other"})
+	r, err = s.Post(fmt.Sprintf("/apps/%s/jobs/%s-target/clone", other.ID, hostID), req, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 404)
+}
+
+func (s *S) TestRunJobSecrets(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-secrets"})
+
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+
+	secret := &ct.Secret{}
+	res, err := s.Put("/apps/"+app.ID+"/secrets/db-password", &ct.Secret{Value: "s3cret"}, secret)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(secret.Name, Equals, "db-password")
+	c.Assert(secret.Value, Equals, "")
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"DB_PASSWORD": ct.SecretRefPrefix + "db-password"},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	_, err = s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"migrate"}}, &ct.Job{})
+	c.Assert(err, IsNil)
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Config.Env["DB_PASSWORD"], Equals, "s3cret")
+
+	// the secret value is not included in the release or the secret list
+	gotRelease := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", gotRelease)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.Env["DB_PASSWORD"], Equals, ct.SecretRefPrefix+"db-password")
+	var list []*ct.Secret
+	_, err = s.Get("/apps/"+app.ID+"/secrets", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Name, Equals, "db-password")
+	c.Assert(list[0].Value, Equals, "")
+
+	// jobs referencing missing secrets are not started
+	release = s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"API_KEY": ct.SecretRefPrefix + "api-key"},
+	})
+	res, err = s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID}, &ct.Job{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	c.Assert(s.cc.GetHost(hostID).Jobs, HasLen, 1)
+}
+
+// JobEventQueueSuite tests the job event queue without needing a database
+type JobEventQueueSuite struct{}
+
+var _ = Suite(&JobEventQueueSuite{})
+
+func (JobEventQueueSuite) TestDropPolicy(c *C) {
+	q := newJobEventQueue(2, true)
+	for i := int64(1); i <= 5; i++ {
+		c.Assert(q.Push(i, nil), Equals, true)
+	}
+	select {
+	case <-q.Ready():
+	default:
+		c.Fatal("queue not ready")
+	}
+	ids, dropped := q.Pop()
+	c.Assert(ids, DeepEquals, []int64{4, 5})
+	c.Assert(dropped, Equals, 3)
+
+	c.Assert(q.Push(6, nil), Equals, true)
+	ids, dropped = q.Pop()
+	c.Assert(ids, DeepEquals, []int64{6})
+	c.Assert(dropped, Equals, 0)
+}
+
+func (JobEventQueueSuite) TestBlockPolicy(c *C) {
+	q := newJobEventQueue(2, false)
+	c.Assert(q.Push(1, nil), Equals, true)
+	c.Assert(q.Push(2, nil), Equals, true)
+
+	// a slow consumer blocks the producer until events are popped
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(3, nil) }()
+	select {
+	case <-pushed:
+		c.Fatal("expected push to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ids, dropped := q.Pop()
+	c.Assert(ids, DeepEquals, []int64{1, 2})
+	c.Assert(dropped, Equals, 0)
+	select {
+	case ok := <-pushed:
+		c.Assert(ok, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for push")
+	}
+	ids, _ = q.Pop()
+	c.Assert(ids, DeepEquals, []int64{3})
+
+	// closing stop unblocks the producer
+	c.Assert(q.Push(4, nil), Equals, true)
+	c.Assert(q.Push(5, nil), Equals, true)
+	stop := make(chan bool)
+	go func() { pushed <- q.Push(6, stop) }()
+	close(stop)
+	select {
+	case ok := <-pushed:
+		c.Assert(ok, Equals, false)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for push")
+	}
+}
+
+// StopJobsSuite tests stopping one-off jobs by their meta against a fake
+// cluster without needing a database
+type StopJobsSuite struct {
+	cl      *tu.FakeCluster
+	hc      *tu.FakeHostClient
+	app     *ct.App
+	release *ct.Release
+}
+
+var _ = Suite(&StopJobsSuite{})
+
+func (s *StopJobsSuite) SetUpTest(c *C) {
+	s.cl = tu.NewFakeCluster()
+	s.cl.SetHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.hc = tu.NewFakeHostClient("host0")
+	s.cl.SetHostClient("host0", s.hc)
+	s.app = &ct.App{ID: "app", Name: "app"}
+	s.release = &ct.Release{ID: "release", ArtifactID: "artifact"}
+}
+
+// runJob adds a detached one-off job with the given meta to the cluster
+func (s *StopJobsSuite) runJob(meta map[string]string) string {
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	job := oneOffJobConfig(s.app, s.release, artifact, &ct.NewJob{ReleaseID: s.release.ID, Meta: meta})
+	s.cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{"host0": {job}}})
+	return job.ID
+}
+
+func (s *StopJobsSuite) TestStopMatching(c *C) {
+	debug1 := s.runJob(map[string]string{"purpose": "debug", "user": "a"})
+	debug2 := s.runJob(map[string]string{"purpose": "debug", "user": "b"})
+	migrate := s.runJob(map[string]string{"purpose": "migrate"})
+	untagged := s.runJob(nil)
+	// a formation job with matching metadata is never stopped
+	s.cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{"host0": {{
+		ID: "web",
+		Metadata: map[string]string{
+			"flynn-controller.app":     s.app.ID,
+			"flynn-controller.release": s.release.ID,
+			"flynn-controller.type":    "web",
+			"purpose":                  "debug",
+		},
+	}}}})
+
+	stopped, err := stopJobsMatching(s.app.ID, map[string]string{"purpose": "debug"}, s.cl)
+	c.Assert(err, IsNil)
+	expected := []string{"host0-" + debug1, "host0-" + debug2}
+	if expected[0] > expected[1] {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	c.Assert(stopped, DeepEquals, expected)
+	for _, id := range []string{debug1, debug2} {
+		c.Assert(s.hc.IsStopped(id), Equals, true)
+	}
+	for _, id := range []string{migrate, untagged, "web"} {
+		c.Assert(s.hc.IsStopped(id), Equals, false)
+	}
+
+	// every key of the selector must match
+	stopped, err = stopJobsMatching(s.app.ID, map[string]string{"purpose": "migrate", "user": "a"}, s.cl)
+	c.Assert(err, IsNil)
+	c.Assert(stopped, HasLen, 0)
+
+	_, err = stopJobsMatching(s.app.ID, nil, s.cl)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	// the controller's own keys can't be used to select jobs
+	_, err = stopJobsMatching(s.app.ID, map[string]string{"flynn-controller.release": s.release.ID}, s.cl)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(s.hc.IsStopped(migrate), Equals, false)
+}
+
+// stopFailCluster is a fake cluster whose hosts fail to stop the job failID
+type stopFailCluster struct {
+	*tu.FakeCluster
+	failID string
+}
+
+func (c *stopFailCluster) DialHost(id string) (cluster.Host, error) {
+	h, err := c.FakeCluster.DialHost(id)
+	if err != nil {
+		return nil, err
+	}
+	return &stopFailHost{Host: h, failID: c.failID}, nil
+}
+
+type stopFailHost struct {
+	cluster.Host
+	failID string
+}
+
+func (h *stopFailHost) StopJob(id string) error {
+	if id == h.failID {
+		return errors.New("stop failed")
+	}
+	return h.Host.StopJob(id)
+}
+
+func (s *StopJobsSuite) TestStopMatchingPartialFailure(c *C) {
+	first := s.runJob(map[string]string{"purpose": "debug"})
+	failed := s.runJob(map[string]string{"purpose": "debug"})
+	s.runJob(map[string]string{"purpose": "debug"})
+
+	// the jobs stopped before the failure are returned with the error
+	stopped, err := stopJobsMatching(s.app.ID, map[string]string{"purpose": "debug"}, &stopFailCluster{FakeCluster: s.cl, failID: failed})
+	c.Assert(err, ErrorMatches, "stop failed")
+	c.Assert(stopped, DeepEquals, []string{"host0-" + first})
+}
+
+// JobEventReplaySuite tests replaying past job events without needing a
+// database
+type JobEventReplaySuite struct{}
+
+var _ = Suite(&JobEventReplaySuite{})
+
+func (JobEventReplaySuite) TestReplayPaced(c *C) {
+	// a backlog of events since the client's old cursor
+	backlog := make([]*ct.JobEvent, 1050)
+	for i := range backlog {
+		backlog[i] = &ct.JobEvent{ID: int64(i + 1), JobID: fmt.Sprintf("host0-job%d", i)}
+	}
+	list := func(sinceID int64, n int) ([]*ct.JobEvent, error) {
+		events := backlog[sinceID:]
+		if len(events) > n {
+			events = events[:n]
+		}
+		return events, nil
+	}
+
+	defer func() { replaySleep = time.Sleep }()
+	var sleeps []time.Duration
+	var sent []int64
+	var sentAtSleep []int
+	replaySleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		sentAtSleep = append(sentAtSleep, len(sent))
+	}
+	var caughtUp int
+	send := func(e *ct.JobEvent) error {
+		c.Assert(caughtUp, Equals, 0, Commentf("event %d sent after the caught up marker", e.ID))
+		sent = append(sent, e.ID)
+		return nil
+	}
+
+	lastID, err := replayJobEvents(50, 100, 10*time.Millisecond, list, send, func() error {
+		caughtUp++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(lastID, Equals, int64(1050))
+
+	// everything after the cursor is sent in order, followed by the marker
+	c.Assert(sent, HasLen, 1000)
+	for i, id := range sent {
+		c.Assert(id, Equals, int64(i+51))
+	}
+	c.Assert(caughtUp, Equals, 1)
+
+	// with a pause after each full chunk
+	c.Assert(sleeps, HasLen, 10)
+	for i, d := range sleeps {
+		c.Assert(d, Equals, 10*time.Millisecond)
+		c.Assert(sentAtSleep[i], Equals, (i+1)*100)
+	}
+
+	// a client which is already current is just sent the marker
+	sent, caughtUp, sleeps = nil, 0, nil
+	lastID, err = replayJobEvents(1050, 100, 10*time.Millisecond, list, send, func() error {
+		caughtUp++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(lastID, Equals, int64(1050))
+	c.Assert(sent, HasLen, 0)
+	c.Assert(sleeps, HasLen, 0)
+	c.Assert(caughtUp, Equals, 1)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type PendingJobRepo struct {
+	db *DB
+}
+
+func NewPendingJobRepo(db *DB) *PendingJobRepo {
+	return &PendingJobRepo{db}
+}
+
+// Set replaces the pending jobs of the given app.
+func (r *PendingJobRepo) Set(appID string, jobs []*ct.PendingJob) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM pending_jobs WHERE app_id = $1", appID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, job := range jobs {
+		job.AppID = appID
+		if job.CreatedAt == nil {
+			err = tx.QueryRow("INSERT INTO pending_jobs (app_id, release_id, process_type, reason, message) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+				appID, job.ReleaseID, job.Type, string(job.Reason), job.Message).Scan(&job.CreatedAt)
+		} else {
+			_, err = tx.Exec("INSERT INTO pending_jobs (app_id, release_id, process_type, reason, message, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+				appID, job.ReleaseID, job.Type, string(job.Reason), job.Message, job.CreatedAt)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *PendingJobRepo) List(appID string) ([]*ct.PendingJob, error) {
+	rows, err := r.db.Query("SELECT app_id, release_id, process_type, reason, message, created_at FROM pending_jobs WHERE app_id = $1 ORDER BY created_at", appID)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*ct.PendingJob{}
+	for rows.Next() {
+		job := &ct.PendingJob{}
+		var reason string
+		if err := rows.Scan(&job.AppID, &job.ReleaseID, &job.Type, &reason, &job.Message, &job.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		job.AppID = cleanUUID(job.AppID)
+		job.ReleaseID = cleanUUID(job.ReleaseID)
+		job.Reason = ct.PlacementReason(reason)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func putPendingJobs(req *http.Request, app *ct.App, repo *PendingJobRepo, r ResponseHelper) {
+	var jobs []*ct.PendingJob
+	if err := json.NewDecoder(req.Body).Decode(&jobs); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := repo.Set(app.ID, jobs); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, jobs)
+}
+
+func listPendingJobs(app *ct.App, repo *PendingJobRepo, r ResponseHelper) {
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
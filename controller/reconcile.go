@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+type formationLister interface {
+	List(appID string) ([]*ct.Formation, error)
+}
+
+type jobLister interface {
+	List(appID string) ([]*ct.Job, error)
+}
+
+// formationRectifier asks the scheduler to rectify a formation, starting any
+// of its jobs which are missing.
+type formationRectifier interface {
+	Rectify(appID, releaseID string) error
+}
+
+// reconciler compares the jobs of an app running in the cluster with its
+// formations, stopping the jobs which no formation accounts for and asking
+// the scheduler to start the jobs which are missing. It is a manual safety
+// valve for when the scheduler's view of the cluster has diverged from
+// reality. Jobs are never started by the controller itself, as the scheduler
+// would not know about them.
+type reconciler struct {
+	formations formationLister
+	rectifier  formationRectifier
+	jobs       jobLister
+	releases   getter
+	artifacts  getter
+	cl         clusterClient
+}
+
+type reconcileKey struct {
+	releaseID, typ, hostID string
+}
+
+type reconcileJob struct {
+	hostID  string
+	job     *host.Job
+	tracked bool
+}
+
+// byTracked sorts the jobs the controller knows about first, so that they are
+// kept in preference to jobs it has never seen.
+type byTracked []reconcileJob
+
+func (j byTracked) Len() int           { return len(j) }
+func (j byTracked) Swap(i, k int)      { j[i], j[k] = j[k], j[i] }
+func (j byTracked) Less(i, k int) bool { return j[i].tracked && !j[k].tracked }
+
+func (r *reconciler) Reconcile(app *ct.App) (*ct.ReconcileReport, error) {
+	formations, err := r.formations.List(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	expanded := make(map[string]*ct.ExpandedFormation, len(formations))
+	for _, f := range formations {
+		ef, err := r.expand(app, f)
+		if err != nil {
+			return nil, err
+		}
+		expanded[f.ReleaseID] = ef
+	}
+
+	known, err := r.jobs.List(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]struct{}, len(known))
+	for _, job := range known {
+		tracked[job.ID] = struct{}{}
+	}
+
+	hosts, err := r.cl.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	hostIDs := make([]string, 0, len(hosts))
+	for id := range hosts {
+		hostIDs = append(hostIDs, id)
+	}
+	sort.Strings(hostIDs)
+
+	var jobs []reconcileJob
+	for _, id := range hostIDs {
+		for _, job := range hosts[id].Jobs {
+			// one-off jobs have no type and are never orphans
+			if job.Metadata["flynn-controller.app"] != app.ID || job.Metadata["flynn-controller.type"] == "" {
+				continue
+			}
+			_, ok := tracked[id+"-"+job.ID]
+			jobs = append(jobs, reconcileJob{hostID: id, job: job, tracked: ok})
+		}
+	}
+	sort.Stable(byTracked(jobs))
+
+	report := &ct.ReconcileReport{AppID: app.ID, Stopped: []*ct.ReconciledJob{}, Missing: []*ct.ReconciledJob{}}
+	counts := make(map[reconcileKey]int)
+	for _, j := range jobs {
+		releaseID := j.job.Metadata["flynn-controller.release"]
+		typ := j.job.Metadata["flynn-controller.type"]
+		key := reconcileKey{releaseID, typ, ""}
+		var expected int
+		if ef, ok := expanded[releaseID]; ok {
+			expected = ef.Processes[typ]
+			if ef.Release.Processes[typ].Omni {
+				key.hostID = j.hostID
+			}
+		}
+		if counts[key] < expected {
+			counts[key]++
+			continue
+		}
+		job := &ct.ReconciledJob{ID: j.hostID + "-" + j.job.ID, HostID: j.hostID, ReleaseID: releaseID, Type: typ}
+		if err := r.stop(j.hostID, j.job.ID); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("error stopping job %s: %s", job.ID, err))
+			continue
+		}
+		report.Stopped = append(report.Stopped, job)
+	}
+
+	releaseIDs := make([]string, 0, len(expanded))
+	for id := range expanded {
+		releaseIDs = append(releaseIDs, id)
+	}
+	sort.Strings(releaseIDs)
+	for _, releaseID := range releaseIDs {
+		ef := expanded[releaseID]
+		var rectify bool
+		types := make([]string, 0, len(ef.Processes))
+		for typ := range ef.Processes {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		for _, typ := range types {
+			var missing []reconcileKey
+			if ef.Release.Processes[typ].Omni {
+				for _, id := range hostIDs {
+					if !allowsHost(ef, id) {
+						continue
+					}
+					key := reconcileKey{releaseID, typ, id}
+					for i := counts[key]; i < ef.Processes[typ]; i++ {
+						missing = append(missing, key)
+					}
+				}
+			} else {
+				key := reconcileKey{releaseID, typ, ""}
+				for i := counts[key]; i < ef.Processes[typ]; i++ {
+					missing = append(missing, key)
+				}
+			}
+			for _, key := range missing {
+				report.Missing = append(report.Missing, &ct.ReconciledJob{HostID: key.hostID, ReleaseID: releaseID, Type: typ})
+			}
+			if len(missing) > 0 {
+				rectify = true
+			}
+		}
+		if !rectify {
+			continue
+		}
+		if err := r.rectifier.Rectify(app.ID, releaseID); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("error rectifying formation of release %s: %s", releaseID, err))
+		}
+	}
+	return report, nil
+}
+
+func (r *reconciler) expand(app *ct.App, f *ct.Formation) (*ct.ExpandedFormation, error) {
+	data, err := r.releases.Get(f.ReleaseID)
+	if err != nil {
+		return nil, err
+	}
+	release := data.(*ct.Release)
+	ef := &ct.ExpandedFormation{App: app, Release: release, Processes: f.Processes, Hosts: f.Hosts}
+	for i, id := range release.ArtifactIDs() {
+		data, err := r.artifacts.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ef.Artifact = data.(*ct.Artifact)
+			continue
+		}
+		if ef.Artifacts == nil {
+			ef.Artifacts = make(map[string]*ct.Artifact)
+		}
+		ef.Artifacts[id] = data.(*ct.Artifact)
+	}
+	return ef, nil
+}
+
+func (r *reconciler) stop(hostID, jobID string) error {
+	client, err := r.cl.DialHost(hostID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.StopJob(jobID)
+}
+
+// allowsHost returns whether the formation's jobs may run on the host.
+func allowsHost(ef *ct.ExpandedFormation, hostID string) bool {
+	if len(ef.Hosts) == 0 {
+		return true
+	}
+	for _, id := range ef.Hosts {
+		if id == hostID {
+			return true
+		}
+	}
+	return false
+}
+
+func reconcileApp(app *ct.App, formations *FormationRepo, jobs *JobRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, r ResponseHelper) {
+	rec := &reconciler{formations: formations, rectifier: formations, jobs: jobs, releases: releases, artifacts: artifacts, cl: cl}
+	report, err := rec.Reconcile(app)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, report)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+// ReconcileSuite tests reconciling an app's jobs against a fake cluster
+// without needing a database
+type ReconcileSuite struct {
+	cl         *tu.FakeCluster
+	hc         *tu.FakeHostClient
+	app        *ct.App
+	release    *ct.Release
+	formations fakeFormationLister
+	jobs       fakeJobLister
+	rectified  fakeRectifier
+	reconciler *reconciler
+}
+
+var _ = Suite(&ReconcileSuite{})
+
+type fakeFormationLister []*ct.Formation
+
+func (l fakeFormationLister) List(appID string) ([]*ct.Formation, error) {
+	return l, nil
+}
+
+type fakeJobLister []*ct.Job
+
+func (l fakeJobLister) List(appID string) ([]*ct.Job, error) {
+	return l, nil
+}
+
+type fakeRectifier []formationKey
+
+func (r *fakeRectifier) Rectify(appID, releaseID string) error {
+	*r = append(*r, formationKey{appID, releaseID})
+	return nil
+}
+
+func (s *ReconcileSuite) SetUpTest(c *C) {
+	s.cl = tu.NewFakeCluster()
+	s.cl.SetHosts(map[string]host.Host{"host0": {ID: "host0"}})
+	s.hc = tu.NewFakeHostClient("host0")
+	s.cl.SetHostClient("host0", s.hc)
+
+	s.app = &ct.App{ID: "app", Name: "app"}
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	s.release = &ct.Release{
+		ID:         "release",
+		ArtifactID: artifact.ID,
+		Processes:  map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}}},
+	}
+	s.formations = fakeFormationLister{{AppID: s.app.ID, ReleaseID: s.release.ID, Processes: map[string]int{"web": 1}}}
+	s.jobs = nil
+	s.rectified = nil
+	s.reconciler = &reconciler{
+		formations: s.formations,
+		rectifier:  &s.rectified,
+		releases:   fakeGetter{s.release.ID: s.release},
+		artifacts:  fakeGetter{artifact.ID: artifact},
+		cl:         s.cl,
+	}
+}
+
+func (s *ReconcileSuite) addJob(id, typ string) {
+	s.cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{"host0": {{
+		ID: id,
+		Metadata: map[string]string{
+			"flynn-controller.app":     s.app.ID,
+			"flynn-controller.release": s.release.ID,
+			"flynn-controller.type":    typ,
+		},
+	}}}})
+}
+
+func (s *ReconcileSuite) reconcile(c *C) *ct.ReconcileReport {
+	s.reconciler.jobs = s.jobs
+	report, err := s.reconciler.Reconcile(s.app)
+	c.Assert(err, IsNil)
+	c.Assert(report.Errors, HasLen, 0)
+	return report
+}
+
+func (s *ReconcileSuite) TestStopOrphan(c *C) {
+	// a job of the formation's type which was started manually
+	s.addJob("orphan", "web")
+	// a job started by the scheduler, which the controller knows about
+	s.addJob("tracked", "web")
+	s.jobs = fakeJobLister{{ID: "host0-tracked", AppID: s.app.ID, ReleaseID: s.release.ID, Type: "web", State: "up"}}
+	// a one-off job, which is left alone
+	s.addJob("oneoff", "")
+
+	report := s.reconcile(c)
+	c.Assert(report.AppID, Equals, s.app.ID)
+	c.Assert(report.Stopped, DeepEquals, []*ct.ReconciledJob{{ID: "host0-orphan", HostID: "host0", ReleaseID: s.release.ID, Type: "web"}})
+	c.Assert(report.Missing, HasLen, 0)
+	c.Assert(s.hc.IsStopped("orphan"), Equals, true)
+	c.Assert(s.hc.IsStopped("tracked"), Equals, false)
+	c.Assert(s.hc.IsStopped("oneoff"), Equals, false)
+
+	// reconciling again is a no-op
+	report = s.reconcile(c)
+	c.Assert(report.Stopped, HasLen, 0)
+	c.Assert(report.Missing, HasLen, 0)
+}
+
+func (s *ReconcileSuite) TestStopRemovedType(c *C) {
+	s.addJob("worker", "worker")
+	report := s.reconcile(c)
+	c.Assert(report.Stopped, HasLen, 1)
+	c.Assert(report.Stopped[0].Type, Equals, "worker")
+	c.Assert(s.hc.IsStopped("worker"), Equals, true)
+}
+
+func (s *ReconcileSuite) TestRectifyMissing(c *C) {
+	s.formations[0].Processes["web"] = 2
+	s.addJob("web", "web")
+
+	report := s.reconcile(c)
+	c.Assert(report.Stopped, HasLen, 0)
+	c.Assert(report.Missing, DeepEquals, []*ct.ReconciledJob{{ReleaseID: s.release.ID, Type: "web"}})
+
+	// the scheduler is asked to start the missing job rather than the
+	// controller starting it
+	c.Assert(s.rectified, DeepEquals, fakeRectifier{{s.app.ID, s.release.ID}})
+	c.Assert(s.cl.GetHost("host0").Jobs, HasLen, 1)
+}
+
+func (s *ReconcileSuite) TestRectifyMissingOmniPinned(c *C) {
+	s.cl.AddHost("host1", host.Host{ID: "host1"})
+	s.cl.SetHostClient("host1", tu.NewFakeHostClient("host1"))
+	s.release.Processes["web"] = ct.ProcessType{Cmd: []string{"start", "web"}, Omni: true}
+	s.formations[0].Hosts = []string{"host1"}
+
+	report := s.reconcile(c)
+	c.Assert(report.Missing, DeepEquals, []*ct.ReconciledJob{{HostID: "host1", ReleaseID: s.release.ID, Type: "web"}})
+	c.Assert(s.rectified, HasLen, 1)
+	c.Assert(s.cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(s.cl.GetHost("host1").Jobs, HasLen, 0)
+}
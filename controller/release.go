@@ -2,6 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	ct "github.com/flynn/flynn/controller/types"
@@ -34,6 +40,21 @@ func scanRelease(s Scanner) (*ct.Release, error) {
 
 func (r *ReleaseRepo) Add(data interface{}) error {
 	release := data.(*ct.Release)
+	if err := validateReleaseProcessTypes(release); err != nil {
+		return err
+	}
+	if err := validateReleasePorts(release); err != nil {
+		return err
+	}
+	if err := validateReleaseVolumes(release); err != nil {
+		return err
+	}
+	if err := validateReleaseDNS(release); err != nil {
+		return err
+	}
+	if err := r.validateArtifacts(release); err != nil {
+		return err
+	}
 	releaseCopy := *release
 
 	releaseCopy.ID = ""
@@ -54,6 +75,22 @@ func (r *ReleaseRepo) Add(data interface{}) error {
 	return err
 }
 
+// validateArtifacts checks that the artifacts which the release's process
+// types run from exist, as they are otherwise only looked up when the release
+// is deployed.
+func (r *ReleaseRepo) validateArtifacts(release *ct.Release) error {
+	for _, id := range release.ArtifactIDs()[1:] {
+		var artifactID string
+		err := r.db.QueryRow("SELECT artifact_id FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id).Scan(&artifactID)
+		if err == sql.ErrNoRows {
+			return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("artifact %q does not exist", id)}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *ReleaseRepo) Get(id string) (interface{}, error) {
 	row := r.db.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
 	return scanRelease(row)
@@ -75,3 +112,131 @@ func (r *ReleaseRepo) List() (interface{}, error) {
 	}
 	return releases, rows.Err()
 }
+
+// staticPort is a port which a process type binds on the host.
+type staticPort struct {
+	typ        string
+	proto      string
+	start, end int
+}
+
+func (p staticPort) overlaps(proto string, start, end int) bool {
+	return p.proto == proto && p.start <= end && start <= p.end
+}
+
+// releaseStaticPorts returns the static ports of the release's process types.
+func releaseStaticPorts(release *ct.Release) []staticPort {
+	types := make([]string, 0, len(release.Processes))
+	for typ := range release.Processes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var ports []staticPort
+	for _, typ := range types {
+		for _, p := range release.Processes[typ].Ports {
+			if p.Port == 0 {
+				// allocated by the host, so never conflicts
+				continue
+			}
+			port := staticPort{typ: typ, proto: p.Proto, start: p.Port, end: p.RangeEnd}
+			if port.proto == "" {
+				port.proto = "tcp"
+			}
+			if port.end < port.start {
+				port.end = port.start
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// validateReleaseProcessTypes checks that the names of the release's process
+// types are valid, and in particular that none use the type of one-off jobs,
+// and that their spread policies are known.
+func validateReleaseProcessTypes(release *ct.Release) error {
+	for typ, proc := range release.Processes {
+		if typ == ct.OneOffType {
+			return ct.ValidationError{Field: "processes", Message: "process type name must not be empty, it is reserved for one-off jobs"}
+		}
+		if !ct.ValidProcessType(typ) {
+			return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("process type name %q is invalid", typ)}
+		}
+		switch proc.Spread {
+		case "", ct.SpreadHosts, ct.SpreadZones:
+		default:
+			return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("spread policy %q of %q must be hosts or zones", proc.Spread, typ)}
+		}
+		if c := proc.HealthCheck; c != nil && (c.HealthyThreshold < 0 || c.UnhealthyThreshold < 0) {
+			return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("health check thresholds of %q must not be negative", typ)}
+		}
+	}
+	return nil
+}
+
+// validateReleasePorts checks that no two ports of the release's process
+// types use the same static port. Static ports are bound on the host, so
+// conflicting jobs would crash when they are placed on the same host.
+func validateReleasePorts(release *ct.Release) error {
+	ports := releaseStaticPorts(release)
+	for i, p := range ports {
+		for _, other := range ports[:i] {
+			if !other.overlaps(p.proto, p.start, p.end) {
+				continue
+			}
+			port := p.start
+			if other.start > port {
+				port = other.start
+			}
+			return ct.ValidationError{
+				Field:   "processes",
+				Message: fmt.Sprintf("%s port %d of %q conflicts with %q", p.proto, port, p.typ, other.typ),
+			}
+		}
+	}
+	return nil
+}
+
+// validateReleaseVolumes checks that the volumes of the release's process
+// types have valid names and are mounted at absolute paths.
+func validateReleaseVolumes(release *ct.Release) error {
+	for typ, proc := range release.Processes {
+		for _, v := range proc.Volumes {
+			if len(v.Name) > 100 || !appNamePattern.MatchString(v.Name) {
+				return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("volume name %q of %q is invalid", v.Name, typ)}
+			}
+			if !path.IsAbs(v.Path) {
+				return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("volume path %q of %q is not absolute", v.Path, typ)}
+			}
+		}
+	}
+	return nil
+}
+
+var hostnameLabelPattern = regexp.MustCompile(`^[a-zA-Z\d]([a-zA-Z\d-]{0,61}[a-zA-Z\d])?$`)
+
+// validateReleaseDNS checks that the nameservers of the release's process
+// types are IP addresses and that their hostnames are valid and short enough
+// to be set in a container.
+func validateReleaseDNS(release *ct.Release) error {
+	for typ, proc := range release.Processes {
+		for _, ns := range proc.DNS {
+			if net.ParseIP(ns) == nil {
+				return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("nameserver %q of %q is not an IP address", ns, typ)}
+			}
+		}
+		if proc.Hostname == "" {
+			continue
+		}
+		// the kernel limits hostnames to 64 bytes
+		valid := len(proc.Hostname) <= 64
+		for _, label := range strings.Split(proc.Hostname, ".") {
+			valid = valid && hostnameLabelPattern.MatchString(label)
+		}
+		if !valid {
+			return ct.ValidationError{Field: "processes", Message: fmt.Sprintf("hostname %q of %q is invalid", proc.Hostname, typ)}
+		}
+	}
+	return nil
+}
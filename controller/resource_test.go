@@ -22,7 +22,12 @@ type fakeServiceSet struct {
 
 func (s *fakeServiceSet) SelfAddr() string { return "" }
 
-func (s *fakeServiceSet) Leader() *discoverd.Service { return nil }
+func (s *fakeServiceSet) Leader() *discoverd.Service {
+	if services := s.fn(); len(services) > 0 {
+		return services[0]
+	}
+	return nil
+}
 
 func (s *fakeServiceSet) Leaders() chan *discoverd.Service { return nil }
 
@@ -38,6 +43,8 @@ func (s *fakeServiceSet) Watch(bringCurrent bool) chan *agent.ServiceUpdate { re
 
 func (s *fakeServiceSet) Unwatch(chan *agent.ServiceUpdate) {}
 
+func (s *fakeServiceSet) Resync() error { return nil }
+
 func (s *fakeServiceSet) Close() error { return nil }
 
 type resourceDiscoverd struct {
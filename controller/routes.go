@@ -1,13 +1,19 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	ct "github.com/flynn/flynn/controller/types"
 	routerc "github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
 )
 
-func createRoute(app *ct.App, router routerc.Client, route router.Route, r ResponseHelper) {
+func createRoute(app *ct.App, apps *AppRepo, router routerc.Client, route router.Route, r ResponseHelper) {
+	if err := validateRoutePort(app, apps, &route); err != nil {
+		r.Error(err)
+		return
+	}
 	route.ParentRef = routeParentRef(app)
 	if err := router.CreateRoute(&route); err != nil {
 		r.Error(err)
@@ -16,6 +22,31 @@ func createRoute(app *ct.App, router routerc.Client, route router.Route, r Respo
 	r.JSON(200, &route)
 }
 
+// validateRoutePort checks that the port of a TCP route is not a static port
+// of the app's release, as the router listens on the same hosts that the
+// app's jobs bind their static ports on.
+func validateRoutePort(app *ct.App, apps *AppRepo, route *router.Route) error {
+	if route.Type != "tcp" || route.Config == nil {
+		return nil
+	}
+	port := route.TCPRoute().Port
+	if port == 0 {
+		return nil
+	}
+	release, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, p := range releaseStaticPorts(release) {
+		if p.overlaps("tcp", port, port) {
+			return ct.ValidationError{Field: "port", Message: fmt.Sprintf("%d conflicts with process type %q", port, p.typ)}
+		}
+	}
+	return nil
+}
+
 func routeID(params martini.Params) string {
 	return params["routes_type"] + "/" + params["routes_id"]
 }
@@ -40,6 +71,44 @@ func getRoute(route *router.Route, r ResponseHelper) {
 	r.JSON(200, route)
 }
 
+// updateRoute replaces the config of an existing route, for example to point
+// it at a different service. The domain or port of a route can't be changed,
+// as they identify it.
+func updateRoute(app *ct.App, apps *AppRepo, existing *router.Route, route router.Route, router routerc.Client, r ResponseHelper) {
+	if route.Type != existing.Type {
+		r.Error(ct.ValidationError{Field: "type", Message: "can't be changed"})
+		return
+	}
+	if route.Config == nil {
+		r.Error(ct.ValidationError{Field: "config", Message: "must be set"})
+		return
+	}
+	switch route.Type {
+	case "http":
+		if route.HTTPRoute().Domain != existing.HTTPRoute().Domain {
+			r.Error(ct.ValidationError{Field: "domain", Message: "can't be changed"})
+			return
+		}
+	case "tcp":
+		if route.TCPRoute().Port != existing.TCPRoute().Port {
+			r.Error(ct.ValidationError{Field: "port", Message: "can't be changed"})
+			return
+		}
+	}
+	if err := validateRoutePort(app, apps, &route); err != nil {
+		r.Error(err)
+		return
+	}
+	route.ID = existing.ID
+	route.ParentRef = routeParentRef(app)
+	route.CreatedAt = existing.CreatedAt
+	if err := router.SetRoute(&route); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &route)
+}
+
 func getRouteList(app *ct.App, router routerc.Client, r ResponseHelper) {
 	routes, err := router.ListRoutes(routeParentRef(app))
 	if err != nil {
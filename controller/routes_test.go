@@ -54,7 +54,17 @@ func (r *fakeRouter) GetRoute(id string) (*router.Route, error) {
 	return route, nil
 }
 
-func (r *fakeRouter) SetRoute(*router.Route) error { return nil }
+func (r *fakeRouter) SetRoute(route *router.Route) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	if route.CreatedAt == nil {
+		route.CreatedAt = &now
+	}
+	route.UpdatedAt = &now
+	r.routes[route.ID] = route
+	return nil
+}
 
 type sortedRoutes []*router.Route
 
@@ -99,6 +109,22 @@ func (s *S) TestCreateRoute(c *C) {
 	c.Assert(gotRoute, DeepEquals, route)
 }
 
+func (s *S) TestCreateRoutePortConflict(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "route-port-conflict"})
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 2222, Proto: "tcp"}}}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	res, err := s.Post(fmt.Sprintf("/apps/%s/routes", app.ID), (&router.TCPRoute{Service: "foo", Port: 2222}).ToRoute(), nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "foo", Port: 2223}).ToRoute())
+	c.Assert(route.ID, Not(Equals), "")
+}
+
 func (s *S) TestDeleteRoute(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "delete-route"})
 	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "foo"}).ToRoute())
@@ -112,6 +138,30 @@ func (s *S) TestDeleteRoute(c *C) {
 	c.Assert(res.StatusCode, Equals, 404)
 }
 
+func (s *S) TestUpdateRoute(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "update-route"})
+	route := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "update-route.example.com", Service: "foo"}).ToRoute())
+	path := fmt.Sprintf("/apps/%s/routes/%s", app.ID, route.ID)
+
+	updated := (&router.HTTPRoute{Domain: "update-route.example.com", Service: "bar"}).ToRoute()
+	res, err := s.Put(path, updated, updated)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(updated.ID, Equals, route.ID)
+
+	gotRoute := &router.Route{}
+	_, err = s.Get(path, gotRoute)
+	c.Assert(err, IsNil)
+	c.Assert(gotRoute.HTTPRoute().Service, Equals, "bar")
+	c.Assert(gotRoute.ParentRef, Equals, route.ParentRef)
+
+	// the domain identifies the route, so can't be changed
+	res, err = s.Put(path, (&router.HTTPRoute{Domain: "other.example.com", Service: "bar"}).ToRoute(), nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) TestListRoutes(c *C) {
 	app0 := s.createTestApp(c, &ct.App{Name: "delete-route1"})
 	app1 := s.createTestApp(c, &ct.App{Name: "delete-route2"})
@@ -19,6 +19,19 @@ type ControllerRPC struct {
 }
 
 func (s *ControllerRPC) StreamFormations(since time.Time, stream rpcplus.Stream) error {
+	return s.streamFormations("", since, stream)
+}
+
+// StreamAppFormations is like StreamFormations, but only streams the
+// formations of req.AppID.
+func (s *ControllerRPC) StreamAppFormations(req ct.StreamFormationsReq, stream rpcplus.Stream) error {
+	if req.AppID == "" {
+		return ct.ValidationError{Field: "app_id", Message: "must not be blank"}
+	}
+	return s.streamFormations(req.AppID, req.Since, stream)
+}
+
+func (s *ControllerRPC) streamFormations(appID string, since time.Time, stream rpcplus.Stream) error {
 	ch := make(chan *ct.ExpandedFormation)
 	done := make(chan struct{})
 	go func() {
@@ -38,7 +51,7 @@ func (s *ControllerRPC) StreamFormations(since time.Time, stream rpcplus.Stream)
 		close(done)
 	}()
 
-	if err := s.formations.Subscribe(ch, since); err != nil {
+	if err := s.formations.Subscribe(ch, appID, since); err != nil {
 		return err
 	}
 	defer func() {
@@ -64,3 +64,41 @@ func (s *S) TestFormationStreaming(c *C) {
 
 	client.Close()
 }
+
+func (s *S) TestAppFormationStreaming(c *C) {
+	before := time.Now()
+	release := s.createTestRelease(c, &ct.Release{})
+	app := s.createTestApp(c, &ct.App{Name: "streamtest-app"})
+	other := s.createTestApp(c, &ct.App{Name: "streamtest-other"})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: other.ID})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	updates, streamErr := client.StreamAppFormations(app.ID, &before)
+	defer updates.Close()
+
+	// only the formations of the app are sent
+	var existing int
+	for f := range updates.Chan {
+		if f.App == nil {
+			break
+		}
+		c.Assert(f.App.ID, Equals, app.ID)
+		existing++
+	}
+	c.Assert(existing, Equals, 1)
+	c.Assert(*streamErr, IsNil)
+
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: other.ID, Processes: map[string]int{"foo": 1}})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID, Processes: map[string]int{"foo": 2}})
+	select {
+	case out := <-updates.Chan:
+		c.Assert(out.App.ID, Equals, app.ID)
+		c.Assert(out.Processes, DeepEquals, map[string]int{"foo": 2})
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for update")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/resource"
+)
+
+// schedulerTimeout is how long requests to the scheduler leader may take,
+// drain requests may additionally take the grace period of one-off jobs.
+const schedulerTimeout = time.Minute
+
+var schedulerHTTPClient = &http.Client{Timeout: schedulerTimeout}
+
+// schedulerClient makes requests to the scheduler leader, which it finds
+// using a discoverd service set shared between requests.
+type schedulerClient struct {
+	dc  resource.DiscoverdClient
+	key string
+
+	mtx sync.Mutex
+	set discoverd.ServiceSet
+}
+
+// newSchedulerClient returns a client which authenticates to the scheduler
+// with key, which is the controller's own auth key.
+func newSchedulerClient(dc resource.DiscoverdClient, key string) *schedulerClient {
+	return &schedulerClient{dc: dc, key: key}
+}
+
+func (s *schedulerClient) leader() (*discoverd.Service, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.set == nil {
+		set, err := s.dc.NewServiceSet("flynn-controller-scheduler")
+		if err != nil {
+			return nil, err
+		}
+		s.set = set
+	}
+	leader := s.set.Leader()
+	if leader == nil {
+		return nil, errors.New("controller: no scheduler leader")
+	}
+	return leader, nil
+}
+
+// request makes a request to the scheduler leader, decoding the response
+// into out.
+func (s *schedulerClient) request(method, path string, in, out interface{}) error {
+	return s.requestWithClient(schedulerHTTPClient, method, path, in, out)
+}
+
+// requestWithClient is like request but uses client, which allows requests
+// that are expected to take longer to have a longer timeout.
+//
+// A 400 from the scheduler is returned as a ct.ValidationError and a 404 as
+// ErrNotFound, so that they are passed on to the controller's client.
+func (s *schedulerClient) requestWithClient(client *http.Client, method, path string, in, out interface{}) error {
+	leader, err := s.leader()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+leader.Addr+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", s.key)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 400:
+		msg, _ := ioutil.ReadAll(res.Body)
+		return ct.ValidationError{Message: strings.TrimSpace(string(msg))}
+	case 404:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("controller: unexpected status %d from scheduler", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		// not a client error, so don't return the decode error directly
+		return fmt.Errorf("controller: error decoding scheduler response: %s", err)
+	}
+	return nil
+}
+
+// getSchedulerDump fetches the state of the scheduler from the scheduler
+// leader.
+func getSchedulerDump(sched *schedulerClient, r ResponseHelper) {
+	state := &ct.SchedulerState{}
+	if err := sched.request("GET", "/dump", nil, state); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, state)
+}
+
+// getSchedulerMetrics fetches the convergence metrics of the scheduler
+// leader.
+func getSchedulerMetrics(sched *schedulerClient, r ResponseHelper) {
+	metrics := &ct.SchedulerMetrics{}
+	if err := sched.request("GET", "/metrics", nil, metrics); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, metrics)
+}
+
+// getSchedulerConfig returns the stored runtime configurable parts of the
+// scheduler's policy.
+func getSchedulerConfig(repo *SchedulerConfigRepo, r ResponseHelper) {
+	conf, err := repo.Get()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, conf)
+}
+
+// putSchedulerConfig merges u into the stored runtime configurable parts of
+// the scheduler's policy and applies the result to the scheduler leader,
+// returning its resulting config. The stored config is applied by the next
+// leader even if applying it to the current one fails.
+func putSchedulerConfig(u ct.SchedulerConfigUpdate, repo *SchedulerConfigRepo, sched *schedulerClient, r ResponseHelper) {
+	switch u.DefaultAntiAffinity {
+	case "", ct.AntiAffinitySoft, ct.AntiAffinityHard:
+	default:
+		r.Error(ct.ValidationError{Field: "default_anti_affinity", Message: "must be soft or hard"})
+		return
+	}
+	conf, err := repo.Update(&u)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	out := &ct.SchedulerConfig{}
+	if err := sched.request("PUT", "/config", conf, out); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, out)
+}
+
+// drainHost asks the scheduler leader to drain a host, migrating its jobs to
+// other hosts, returning the one-off jobs which had to be stopped.
+func drainHost(drain ct.HostDrain, sched *schedulerClient, r ResponseHelper) {
+	if drain.HostID == "" {
+		r.Error(ct.ValidationError{Field: "host_id", Message: "must not be blank"})
+		return
+	}
+	out := &ct.HostDrain{}
+	client := &http.Client{Timeout: schedulerTimeout + drain.OneOffGrace}
+	if err := sched.requestWithClient(client, "POST", "/drain", &drain, out); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, out)
+}
+
+// undrainHost asks the scheduler leader to place new jobs on a drained host
+// again.
+func undrainHost(params martini.Params, sched *schedulerClient, r ResponseHelper) {
+	out := &ct.HostDrain{}
+	if err := sched.request("DELETE", "/drain?host="+url.QueryEscape(params["host_id"]), nil, out); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, out)
+}
+
+// clearQuarantine asks the scheduler leader to replace the quarantined jobs
+// of a formation, optionally only those of the process type given by the type
+// query parameter.
+func clearQuarantine(app *ct.App, release *ct.Release, req *http.Request, sched *schedulerClient, r ResponseHelper) {
+	q := url.Values{"app": {app.ID}, "release": {release.ID}}
+	if typ := req.URL.Query().Get("type"); typ != "" {
+		q.Set("type", typ)
+	}
+	out := &ct.QuarantineClear{}
+	if err := sched.request("DELETE", "/quarantine?"+q.Encode(), nil, out); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, out)
+}
+
+// getClusterConfig returns the active policies of the scheduler leader along
+// with the controller's own config, and the feature flags derived from them.
+func getClusterConfig(apps *AppRepo, sched *schedulerClient, r ResponseHelper) {
+	conf := &ct.ClusterConfig{
+		Scheduler:          &ct.SchedulerConfig{},
+		DefaultRouteDomain: apps.defaultDomain,
+	}
+	if err := sched.request("GET", "/config", nil, conf.Scheduler); err != nil {
+		r.Error(err)
+		return
+	}
+	conf.Features = map[string]bool{
+		ct.FeatureDefaultRoutes: conf.DefaultRouteDomain != "",
+		ct.FeatureMaintenance:   conf.Scheduler.Maintenance,
+		ct.FeatureQuarantine:    conf.Scheduler.MaxCrashes > 0,
+	}
+	r.JSON(200, conf)
+}
+
+// SchedulerConfigRepo stores the runtime configurable parts of the
+// scheduler's policy, so that they survive the scheduler leader changing.
+type SchedulerConfigRepo struct {
+	db *DB
+}
+
+func NewSchedulerConfigRepo(db *DB) *SchedulerConfigRepo {
+	return &SchedulerConfigRepo{db}
+}
+
+func (r *SchedulerConfigRepo) Get() (*ct.SchedulerConfig, error) {
+	conf := &ct.SchedulerConfig{}
+	var antiAffinity string
+	if err := r.db.QueryRow("SELECT maintenance, default_anti_affinity FROM scheduler_config").Scan(&conf.Maintenance, &antiAffinity); err != nil {
+		return nil, err
+	}
+	conf.DefaultAntiAffinity = ct.AntiAffinity(antiAffinity)
+	return conf, nil
+}
+
+// Update sets the fields which are set in u, returning the resulting config.
+func (r *SchedulerConfigRepo) Update(u *ct.SchedulerConfigUpdate) (*ct.SchedulerConfig, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	conf := &ct.SchedulerConfig{}
+	var antiAffinity string
+	if err := tx.QueryRow("SELECT maintenance, default_anti_affinity FROM scheduler_config FOR UPDATE").Scan(&conf.Maintenance, &antiAffinity); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	conf.DefaultAntiAffinity = ct.AntiAffinity(antiAffinity)
+	if u.Maintenance != nil {
+		conf.Maintenance = *u.Maintenance
+	}
+	if u.DefaultAntiAffinity != "" {
+		conf.DefaultAntiAffinity = u.DefaultAntiAffinity
+	}
+	if _, err := tx.Exec("UPDATE scheduler_config SET maintenance = $1, default_anti_affinity = $2, updated_at = now()", conf.Maintenance, string(conf.DefaultAntiAffinity)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return conf, tx.Commit()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/attempt"
+)
+
+// configAttempts is how long a new leader retries loading the stored config,
+// which fails while the controller is unavailable, for example when it is
+// being deployed.
+var configAttempts = attempt.Strategy{
+	Total: 5 * time.Minute,
+	Delay: time.Second,
+}
+
+// Config returns the scheduler's active placement and restart policy.
+func (c *context) Config() *ct.SchedulerConfig {
+	c.configMtx.RLock()
+	defer c.configMtx.RUnlock()
+	return &ct.SchedulerConfig{
+		Maintenance:         c.maintenance,
+		DefaultAntiAffinity: c.defaultAntiAffinity,
+		BackoffPeriod:       c.backoffPeriod,
+		RescheduleTimeout:   rescheduleTimeout,
+		MaxCrashes:          defaultMaxCrashes,
+		CrashWindow:         defaultCrashWindow,
+	}
+}
+
+// SetConfig changes the parts of the policy which can be changed at runtime,
+// the other fields of conf are ignored. Formations are rectified when
+// maintenance mode is turned off, starting any jobs which were held back.
+func (c *context) SetConfig(conf *ct.SchedulerConfig) error {
+	switch conf.DefaultAntiAffinity {
+	case ct.AntiAffinitySoft, ct.AntiAffinityHard:
+	case "":
+		conf.DefaultAntiAffinity = ct.AntiAffinitySoft
+	default:
+		return fmt.Errorf("scheduler: unknown anti-affinity %q", conf.DefaultAntiAffinity)
+	}
+
+	c.configMtx.Lock()
+	resume := c.maintenance && !conf.Maintenance
+	c.maintenance = conf.Maintenance
+	c.defaultAntiAffinity = conf.DefaultAntiAffinity
+	c.configMtx.Unlock()
+
+	if resume {
+		c.formations.mtx.RLock()
+		for _, f := range c.formations.formations {
+			go f.Rectify()
+		}
+		c.formations.mtx.RUnlock()
+	}
+	return nil
+}
+
+// loadConfig applies the config stored by the controller, so that a new
+// leader carries on with the maintenance mode and default anti-affinity of
+// the previous one.
+// It retries using configAttempts so that a controller which is briefly
+// unavailable does not stop the scheduler.
+func (c *context) loadConfig() error {
+	var conf *ct.SchedulerConfig
+	err := configAttempts.Run(func() (err error) {
+		conf, err = c.controllerClient.SchedulerConfig()
+		if err != nil {
+			grohl.Log(grohl.Data{"fn": "loadConfig", "at": "error", "err": err.Error()})
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	return c.SetConfig(conf)
+}
+
+// inMaintenance returns whether the scheduler is holding back starting jobs.
+func (c *context) inMaintenance() bool {
+	c.configMtx.RLock()
+	defer c.configMtx.RUnlock()
+	return c.maintenance
+}
+
+// antiAffinity returns the anti-affinity of the process type, which is the
+// default if it doesn't set one.
+func (c *context) antiAffinity(proc ct.ProcessType) ct.AntiAffinity {
+	if proc.AntiAffinity != "" {
+		return proc.AntiAffinity
+	}
+	c.configMtx.RLock()
+	defer c.configMtx.RUnlock()
+	return c.defaultAntiAffinity
+}
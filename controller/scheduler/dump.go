@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// Dump returns a snapshot of the scheduler's view of the cluster: the hosts
+// it is watching, the formations with their desired process counts, the jobs
+// it is tracking and the jobs it has been unable to place.
+func (c *context) Dump() *ct.SchedulerState {
+	state := &ct.SchedulerState{
+		Hosts:      []*ct.SchedulerHost{},
+		Formations: []*ct.SchedulerFormation{},
+		Jobs:       []*ct.SchedulerJob{},
+		Pending:    []*ct.PendingJob{},
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	c.hosts.mtx.RLock()
+	for id := range c.hosts.hosts {
+		state.Hosts = append(state.Hosts, &ct.SchedulerHost{ID: id, Draining: c.isDraining(id)})
+	}
+	c.hosts.mtx.RUnlock()
+	sort.Sort(schedulerHostsByID(state.Hosts))
+
+	c.formations.mtx.RLock()
+	formations := make([]*Formation, 0, len(c.formations.formations))
+	for _, f := range c.formations.formations {
+		formations = append(formations, f)
+	}
+	c.formations.mtx.RUnlock()
+	for _, f := range formations {
+		f.mtx.Lock()
+		processes := make(map[string]int, len(f.Processes))
+		for typ, n := range f.Processes {
+			processes[typ] = n
+		}
+		state.Formations = append(state.Formations, &ct.SchedulerFormation{
+			AppID:     f.AppID,
+			ReleaseID: f.Release.ID,
+			Processes: processes,
+		})
+		for typ, jobs := range f.jobs {
+			for _, job := range jobs {
+				state.Jobs = append(state.Jobs, &ct.SchedulerJob{
+					ID:        job.ID,
+					HostID:    job.HostID,
+					AppID:     f.AppID,
+					ReleaseID: f.Release.ID,
+					Type:      typ,
+					State:     job.state(),
+					Restarts:  job.restarts,
+					Reason:    job.failed,
+				})
+			}
+		}
+		f.mtx.Unlock()
+	}
+	sort.Sort(schedulerFormationsByKey(state.Formations))
+	sort.Sort(schedulerJobsByID(state.Jobs))
+
+	c.pendingMtx.Lock()
+	for _, types := range c.pending {
+		for _, jobs := range types {
+			state.Pending = append(state.Pending, jobs...)
+		}
+	}
+	c.pendingMtx.Unlock()
+
+	return state
+}
+
+// state returns the state of the job as seen by the scheduler.
+func (j *Job) state() string {
+	if j.failed != "" {
+		return "failed"
+	}
+	if j.timer != nil {
+		return "restarting"
+	}
+	if j.isUp() {
+		return "up"
+	}
+	return "starting"
+}
+
+// ServeHTTP serves the scheduler's debugging endpoints, its convergence
+// metrics at /metrics, its config at /config, draining a host with POST
+// /drain and undraining it with DELETE /drain?host=ID, and clearing the quarantine of a formation's failed jobs with
+// DELETE /quarantine?app=ID&release=ID[&type=TYPE].
+func (c *context) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/dump":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Dump())
+	case req.Method == "GET" && req.URL.Path == "/metrics":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Metrics())
+	case req.Method == "GET" && req.URL.Path == "/config":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Config())
+	case req.Method == "PUT" && req.URL.Path == "/config":
+		conf := &ct.SchedulerConfig{}
+		if err := json.NewDecoder(req.Body).Decode(conf); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := c.SetConfig(conf); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Config())
+	case req.Method == "POST" && req.URL.Path == "/drain":
+		drain := &ct.HostDrain{}
+		if err := json.NewDecoder(req.Body).Decode(drain); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if c.hosts.Get(drain.HostID) == nil {
+			http.NotFound(w, req)
+			return
+		}
+		killed, err := c.DrainHost(drain.HostID, drain.OneOffGrace)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		drain.Killed = killed
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drain)
+	case req.Method == "DELETE" && req.URL.Path == "/drain":
+		hostID := req.URL.Query().Get("host")
+		if !c.UndrainHost(hostID) {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&ct.HostDrain{HostID: hostID})
+	case req.Method == "DELETE" && req.URL.Path == "/quarantine":
+		q := req.URL.Query()
+		f := c.formations.Get(q.Get("app"), q.Get("release"))
+		if f == nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&ct.QuarantineClear{Cleared: f.ClearQuarantine(q.Get("type"))})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authHandler only passes requests to h which authenticate with key as their
+// basic auth password, the key being shared with the controller. All requests
+// are rejected if key is empty.
+func authHandler(key string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, password, _ := req.BasicAuth()
+		if key == "" || len(password) != len(key) || subtle.ConstantTimeCompare([]byte(password), []byte(key)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+type schedulerHostsByID []*ct.SchedulerHost
+
+func (h schedulerHostsByID) Len() int           { return len(h) }
+func (h schedulerHostsByID) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h schedulerHostsByID) Less(i, j int) bool { return h[i].ID < h[j].ID }
+
+type schedulerFormationsByKey []*ct.SchedulerFormation
+
+func (f schedulerFormationsByKey) Len() int      { return len(f) }
+func (f schedulerFormationsByKey) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f schedulerFormationsByKey) Less(i, j int) bool {
+	if f[i].AppID != f[j].AppID {
+		return f[i].AppID < f[j].AppID
+	}
+	return f[i].ReleaseID < f[j].ReleaseID
+}
+
+type schedulerJobsByID []*ct.SchedulerJob
+
+func (s schedulerJobsByID) Len() int      { return len(s) }
+func (s schedulerJobsByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s schedulerJobsByID) Less(i, j int) bool {
+	if s[i].HostID != s[j].HostID {
+		return s[i].HostID < s[j].HostID
+	}
+	return s[i].ID < s[j].ID
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+)
+
+const (
+	// healthCheckStartInterval is the time between the first probes of a
+	// job, which doubles after each failed probe up to the interval of the
+	// check.
+	healthCheckStartInterval = 100 * time.Millisecond
+
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// Allow mocking health check probes, time.After and time.Now in tests
+var healthCheckProbe = probeHealth
+var timeAfter = time.After
+var timeNow = time.Now
+
+func (j *Job) healthCheck() *ct.HealthCheck {
+	return j.Formation.Release.Processes[j.Type].HealthCheck
+}
+
+// healthCheckTarget returns the address to probe the health check of the job
+// at and the interval between probes once it is up.
+func healthCheckTarget(job *Job, activeJob *host.ActiveJob) (string, time.Duration, error) {
+	check := job.healthCheck()
+	addr, err := utils.HealthCheckAddr(check, job.Formation.Release.Processes[job.Type], activeJob)
+	if err != nil {
+		return "", 0, err
+	}
+	interval := check.Interval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	return addr, interval, nil
+}
+
+// healthyThreshold returns the number of probes in a row which must pass for
+// a job to be considered healthy.
+func healthyThreshold(check *ct.HealthCheck) int {
+	if check.HealthyThreshold < 1 {
+		return 1
+	}
+	return check.HealthyThreshold
+}
+
+// waitForHealthy probes the started job until its health check passes the
+// healthy threshold of the check in a row, then marks it as up. It gives up if
+// the job is stopped before it becomes healthy, and stops the job if it is
+// still unhealthy after the startup grace of its type. The grace is measured
+// from when probing starts, so it includes the time spent in slow probes.
+func (c *context) waitForHealthy(job *Job, activeJob *host.ActiveJob) {
+	g := grohl.NewContext(grohl.Data{"fn": "waitForHealthy", "app.id": job.Formation.AppID, "host.id": job.HostID, "job.id": job.ID})
+
+	check := job.healthCheck()
+	addr, interval, err := healthCheckTarget(job, activeJob)
+	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return
+	}
+	threshold := healthyThreshold(check)
+
+	grace := job.Formation.Release.Processes[job.Type].StartupGrace
+	start := timeNow()
+	var passed int
+	delay := healthCheckStartInterval
+	for {
+		if c.jobs.Get(job.HostID, job.ID) == nil {
+			g.Log(grohl.Data{"at": "stopped"})
+			return
+		}
+		err := healthCheckProbe(check, addr)
+		if err == nil {
+			if passed++; passed >= threshold {
+				break
+			}
+		} else {
+			passed = 0
+			if grace > 0 && timeNow().Sub(start) >= grace {
+				g.Log(grohl.Data{"at": "startup_failed", "addr": addr, "err": err, "grace": grace.String()})
+				c.failStartup(job)
+				return
+			}
+			g.Log(grohl.Data{"at": "unhealthy", "addr": addr, "err": err, "delay": delay.String()})
+		}
+		<-timeAfter(delay)
+		if delay *= 2; delay > interval {
+			delay = interval
+		}
+	}
+
+	g.Log(grohl.Data{"at": "healthy"})
+	j := &ct.Job{ID: job.HostID + "-" + job.ID, AppID: job.Formation.AppID, ReleaseID: job.Formation.Release.ID, Type: job.Type, State: "up", Generation: job.Generation}
+	if err := c.PutJob(j); err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+	}
+	job.setUp()
+
+	if check.UnhealthyThreshold > 0 {
+		c.monitorHealth(job, addr, interval)
+	}
+}
+
+// monitorHealth probes an up job every interval until it stops, stopping it
+// once the unhealthy threshold of its check is reached. Only consecutive
+// failures count towards the threshold, and once a probe has failed the job
+// only recovers after passing the healthy threshold of the check in a row, so
+// a job whose check passes just often enough to break up the failures is
+// still stopped. The job is then restarted as if it had crashed.
+func (c *context) monitorHealth(job *Job, addr string, interval time.Duration) {
+	g := grohl.NewContext(grohl.Data{"fn": "monitorHealth", "app.id": job.Formation.AppID, "host.id": job.HostID, "job.id": job.ID})
+	check := job.healthCheck()
+	threshold := healthyThreshold(check)
+
+	var failed, passed int
+	for {
+		select {
+		case <-job.stopped:
+			return
+		case <-timeAfter(interval):
+		}
+		if c.jobs.Get(job.HostID, job.ID) == nil {
+			return
+		}
+		err := healthCheckProbe(check, addr)
+		if err == nil {
+			if failed > 0 {
+				if passed++; passed >= threshold {
+					g.Log(grohl.Data{"at": "recovered", "addr": addr, "failed": failed})
+					failed = 0
+				}
+			}
+			continue
+		}
+		passed = 0
+		failed++
+		g.Log(grohl.Data{"at": "probe_failed", "addr": addr, "err": err, "failed": failed})
+		if failed >= check.UnhealthyThreshold {
+			g.Log(grohl.Data{"at": "unhealthy", "addr": addr, "threshold": check.UnhealthyThreshold})
+			c.failHealth(job)
+			return
+		}
+	}
+}
+
+// adoptHealth monitors the health of an up job which was running before the
+// scheduler started, as it is not probed until healthy like the jobs the
+// scheduler starts.
+func (c *context) adoptHealth(job *Job) {
+	check := job.healthCheck()
+	if check == nil || check.UnhealthyThreshold == 0 {
+		return
+	}
+	g := grohl.NewContext(grohl.Data{"fn": "adoptHealth", "app.id": job.Formation.AppID, "host.id": job.HostID, "job.id": job.ID})
+	h, err := c.DialHost(job.HostID)
+	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return
+	}
+	activeJob, err := h.GetJob(job.ID)
+	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return
+	}
+	addr, interval, err := healthCheckTarget(job, activeJob)
+	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return
+	}
+	c.monitorHealth(job, addr, interval)
+}
+
+// failStartup stops a job which did not become healthy within its startup
+// grace, the job is then restarted as if it had crashed.
+func (c *context) failStartup(job *Job) {
+	job.setStartupFailed()
+	if err := c.hosts.Get(job.HostID).StopJob(job.ID); err != nil {
+		grohl.Log(grohl.Data{"fn": "failStartup", "host.id": job.HostID, "job.id": job.ID, "at": "error", "err": err})
+	}
+}
+
+// failHealth stops an up job which reached the unhealthy threshold of its
+// health check, the job is then restarted as if it had crashed.
+func (c *context) failHealth(job *Job) {
+	job.setUnhealthy()
+	// an adopted job may be probed before its host is being watched
+	h := c.hosts.Get(job.HostID)
+	if h == nil {
+		var err error
+		if h, err = c.DialHost(job.HostID); err != nil {
+			grohl.Log(grohl.Data{"fn": "failHealth", "host.id": job.HostID, "job.id": job.ID, "at": "error", "err": err})
+			return
+		}
+	}
+	if err := h.StopJob(job.ID); err != nil {
+		grohl.Log(grohl.Data{"fn": "failHealth", "host.id": job.HostID, "job.id": job.ID, "at": "error", "err": err})
+	}
+}
+
+// probeHealth runs the check against addr once, returning an error if it
+// fails.
+func probeHealth(check *ct.HealthCheck, addr string) error {
+	_, err := utils.ProbeHealth(check, addr)
+	return err
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,9 +25,32 @@ import (
 
 var backoffPeriod = 10 * time.Minute
 
+// The quarantine policy of process types which don't set their own, a job
+// which crashes defaultMaxCrashes times within defaultCrashWindow (counting
+// the crashes of the jobs it replaced) is no longer restarted.
+var (
+	defaultMaxCrashes  = 5
+	defaultCrashWindow = 6 * time.Hour
+)
+
+// rescheduleTimeout is how long to wait for a rescheduled job to start before
+// giving up and leaving the original job running.
+var rescheduleTimeout = 30 * time.Second
+
 // Allow mocking time.AfterFunc in tests
 var timeAfterFunc = time.AfterFunc
 
+// Allow mocking the random start delay of omni jobs in tests
+var randomJitter = func(max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// Allow mocking the hosts registered as draining in tests
+var drainingHosts = discoverd.DrainingHosts
+
+// Allow mocking the hosts of discoverd services in tests
+var serviceHosts = discoverd.ServiceHosts
+
 func main() {
 	grohl.AddContext("app", "controller-scheduler")
 	grohl.Log(grohl.Data{"at": "start"})
@@ -43,11 +73,30 @@ func main() {
 	<-leaderWait
 	grohl.Log(grohl.Data{"at": "leader"})
 
+	if err := c.loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	c.loadDraining()
+
+	// serve the scheduler state for debugging, to the controller only
+	go func() { log.Fatal(http.ListenAndServe(":"+os.Getenv("PORT"), authHandler(os.Getenv("AUTH_KEY"), c))) }()
+
 	// TODO: periodic full cluster sync for anti-entropy
 	c.watchFormations(nil, nil)
 }
 
+// backoffPerioder is implemented by clusters which set the restart backoff
+// period, such as test clusters which shorten it so that backoff can be
+// exercised in real time.
+type backoffPerioder interface {
+	BackoffPeriod() time.Duration
+}
+
 func newContext(cc controllerClient, cl clusterClient) *context {
+	period := backoffPeriod
+	if b, ok := cl.(backoffPerioder); ok && b.BackoffPeriod() > 0 {
+		period = b.BackoffPeriod()
+	}
 	return &context{
 		controllerClient: cc,
 		clusterClient:    cl,
@@ -55,6 +104,13 @@ func newContext(cc controllerClient, cl clusterClient) *context {
 		hosts:            newHostClients(),
 		jobs:             newJobMap(),
 		omni:             make(map[*Formation]struct{}),
+		draining:         make(map[string]struct{}),
+		volumes:          make(map[string]string),
+		pending:          make(map[formationKey]map[string][]*ct.PendingJob),
+		metrics:          newMetrics(),
+
+		defaultAntiAffinity: ct.AntiAffinitySoft,
+		backoffPeriod:       period,
 	}
 }
 
@@ -68,6 +124,28 @@ type context struct {
 	hosts *hostClients
 	jobs  *jobMap
 	mtx   sync.RWMutex
+
+	draining map[string]struct{}
+	drainMtx sync.RWMutex
+
+	// volumes is the ID of the host holding each named volume
+	volumes    map[string]string
+	volumesMtx sync.RWMutex
+
+	// pending jobs which could not be placed, keyed by formation and type
+	pending    map[formationKey]map[string][]*ct.PendingJob
+	pendingMtx sync.Mutex
+
+	metrics *metrics
+
+	// the runtime configurable parts of the scheduler's policy
+	maintenance         bool
+	defaultAntiAffinity ct.AntiAffinity
+	configMtx           sync.RWMutex
+
+	// backoffPeriod is the delay before restarting a job which exits soon
+	// after starting, doubling with each further restart
+	backoffPeriod time.Duration
 }
 
 type clusterClient interface {
@@ -83,6 +161,11 @@ type controllerClient interface {
 	GetFormation(appID, releaseID string) (*ct.Formation, error)
 	StreamFormations(since *time.Time) (*controller.FormationUpdates, *error)
 	PutJob(job *ct.Job) error
+	JobList(appID string) ([]*ct.Job, error)
+	PutPendingJobs(appID string, jobs []*ct.PendingJob) error
+	AddClusterEvent(e *ct.ClusterEvent) error
+	GetSecret(appID, name string) (string, error)
+	SchedulerConfig() (*ct.SchedulerConfig, error)
 }
 
 func (c *context) syncCluster(events chan<- *host.Event) {
@@ -91,6 +174,7 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 	artifacts := make(map[string]*ct.Artifact)
 	releases := make(map[string]*ct.Release)
 	rectify := make(map[*Formation]struct{})
+	var adopted []*Job
 
 	go c.watchHosts(events)
 
@@ -126,14 +210,27 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 					releases[release.ID] = release
 				}
 
-				artifact := artifacts[release.ArtifactID]
-				if artifact == nil {
-					artifact, err = c.GetArtifact(release.ArtifactID)
-					if err != nil {
-						gg.Log(grohl.Data{"at": "getArtifact", "status": "error", "err": err})
-						continue
+				releaseArtifacts := make(map[string]*ct.Artifact)
+				var artifactErr error
+				for _, id := range release.ArtifactIDs() {
+					artifact := artifacts[id]
+					if artifact == nil {
+						artifact, artifactErr = c.GetArtifact(id)
+						if artifactErr != nil {
+							gg.Log(grohl.Data{"at": "getArtifact", "status": "error", "err": artifactErr, "artifact.id": id})
+							break
+						}
+						artifacts[artifact.ID] = artifact
 					}
-					artifacts[artifact.ID] = artifact
+					releaseArtifacts[id] = artifact
+				}
+				if artifactErr != nil {
+					continue
+				}
+				artifact := releaseArtifacts[release.ArtifactID]
+				delete(releaseArtifacts, release.ArtifactID)
+				if len(releaseArtifacts) == 0 {
+					releaseArtifacts = nil
 				}
 
 				formation, err := c.GetFormation(appID, releaseID)
@@ -143,31 +240,43 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 				}
 
 				f = NewFormation(c, &ct.ExpandedFormation{
-					App:       &ct.App{ID: appID},
-					Release:   release,
-					Artifact:  artifact,
-					Processes: formation.Processes,
+					App:        &ct.App{ID: appID},
+					Release:    release,
+					Artifact:   artifact,
+					Artifacts:  releaseArtifacts,
+					Processes:  formation.Processes,
+					Hosts:      formation.Hosts,
+					Generation: formation.Generation,
 				})
 				gg.Log(grohl.Data{"at": "addFormation"})
 				f = c.formations.Add(f)
+				f.restoreQuarantine()
 			}
 
 			gg.Log(grohl.Data{"at": "addJob"})
+			generation, _ := strconv.ParseInt(job.Metadata[ct.JobMetaGeneration], 10, 64)
 			go c.PutJob(&ct.Job{
-				ID:        h.ID + "-" + job.ID,
-				AppID:     appID,
-				ReleaseID: releaseID,
-				Type:      jobType,
-				State:     "up",
+				ID:         h.ID + "-" + job.ID,
+				AppID:      appID,
+				ReleaseID:  releaseID,
+				Type:       jobType,
+				State:      "up",
+				Generation: generation,
 			})
 			j := f.jobs.Add(jobType, h.ID, job.ID)
 			j.Formation = f
+			j.Generation = generation
+			j.setUp()
 			c.jobs.Add(j)
+			adopted = append(adopted, j)
 			rectify[f] = struct{}{}
 		}
 	}
 	c.mtx.Unlock()
 
+	for _, j := range adopted {
+		go c.adoptHealth(j)
+	}
 	for f := range rectify {
 		go f.Rectify()
 	}
@@ -204,11 +313,14 @@ func (c *context) watchFormations(events chan<- *FormationEvent, hostEvents chan
 			f := c.formations.Get(ef.App.ID, ef.Release.ID)
 			if f != nil {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "update"})
+				f.SetGeneration(ef.Generation)
 				f.SetProcesses(ef.Processes)
+				f.SetHosts(ef.Hosts)
 			} else {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "new"})
 				f = NewFormation(c, ef)
 				c.formations.Add(f)
+				f.restoreQuarantine()
 			}
 			// check for omnipresence
 			for _, proctype := range f.Release.Processes {
@@ -240,10 +352,20 @@ func (c *context) watchHosts(events chan<- *host.Event) {
 		// TODO: log/handle error
 	}
 
+	// subscribe before watching the existing hosts so that hosts added
+	// once they are being watched are not missed
+	ch := make(chan *host.HostEvent)
+	c.StreamHostEvents(ch)
 	go func() { // watch for new hosts
-		ch := make(chan *host.HostEvent)
-		c.StreamHostEvents(ch)
 		for event := range ch {
+			if event.Event == "remove" {
+				// a host which rejoins the cluster is no longer draining,
+				// its draining registration having gone with it
+				c.drainMtx.Lock()
+				delete(c.draining, event.HostID)
+				c.drainMtx.Unlock()
+				continue
+			}
 			if event.Event != "add" {
 				continue
 			}
@@ -278,6 +400,7 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 	c.hosts.Set(id, h)
 
 	g.Log(grohl.Data{"at": "start"})
+	c.addClusterEvent(ct.ClusterEventHost, "", id, &ct.ClusterHostEvent{HostID: id, Event: "up"})
 
 	ch := make(chan *host.Event)
 	h.StreamEvents("all", ch)
@@ -293,7 +416,18 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 			continue
 		}
 
-		j := &ct.Job{ID: id + "-" + event.JobID, AppID: job.Formation.AppID, ReleaseID: job.Formation.Release.ID, Type: job.Type}
+		if event.Event == "start" && job.healthCheck() != nil {
+			// the job is marked as up once its health check passes
+			g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
+			job.startedAt = event.Job.StartedAt
+			go c.waitForHealthy(job, event.Job)
+			if events != nil {
+				events <- event
+			}
+			continue
+		}
+
+		j := &ct.Job{ID: id + "-" + event.JobID, AppID: job.Formation.AppID, ReleaseID: job.Formation.Release.ID, Type: job.Type, Generation: job.Generation}
 		switch event.Event {
 		case "create":
 			j.State = "starting"
@@ -302,14 +436,35 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 			job.startedAt = event.Job.StartedAt
 		case "stop":
 			j.State = "down"
+			if job.isStartupFailed() || job.isUnhealthy() {
+				j.State = "crashed"
+			}
+			if event.Job != nil {
+				exitStatus := event.Job.ExitStatus
+				j.ExitStatus = &exitStatus
+				// a job which exits nonzero crashed, unless it was
+				// stopped for not being wanted
+				if exitStatus != 0 && !job.isStopping() {
+					j.State = "crashed"
+				}
+			}
 		case "error":
 			j.State = "crashed"
+			if event.Job != nil && event.Job.InitFailed {
+				j.State = "failed"
+			}
 		}
 		g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
 		if err = c.PutJob(j); err != nil {
 			g.Log(grohl.Data{"at": "error", "job.id": event.JobID, "event": event.Event, "err": err})
 			// TODO: handle error
 		}
+		if event.Event == "start" {
+			job.setUp()
+			if job.Formation != nil {
+				go job.Formation.checkConverged()
+			}
+		}
 
 		if event.Event != "error" && event.Event != "stop" {
 			if events != nil {
@@ -320,18 +475,51 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 		g.Log(grohl.Data{"at": "remove", "job.id": event.JobID, "event": event.Event})
 
 		c.jobs.Remove(id, event.JobID)
+		job.setStopped()
 		go func(event *host.Event) {
 			c.mtx.RLock()
-			job.Formation.RestartJob(job.Type, id, event.JobID)
+			if event.Event == "error" && event.Job != nil && event.Job.InitFailed {
+				job.Formation.FailJob(job.Type, id, event.JobID, *event.Job.Error)
+			} else {
+				crashed := event.Event == "error" || job.isStartupFailed() || job.isUnhealthy() || event.Job != nil && event.Job.ExitStatus != 0
+				job.Formation.RestartJob(job.Type, id, event.JobID, crashed)
+			}
 			c.mtx.RUnlock()
 			if events != nil {
 				events <- event
 			}
 		}(event)
 	}
+	c.addClusterEvent(ct.ClusterEventHost, "", id, &ct.ClusterHostEvent{HostID: id, Event: "down"})
 	// TODO: check error/reconnect
 }
 
+// addClusterEvent records an event in the controller's cluster event stream,
+// logging rather than returning errors as the stream is only informational.
+func (c *context) addClusterEvent(typ ct.ClusterEventType, appID, objectID string, data interface{}) {
+	e := &ct.ClusterEvent{Type: typ, AppID: appID, ObjectID: objectID}
+	var err error
+	if e.Data, err = json.Marshal(data); err == nil {
+		err = c.AddClusterEvent(e)
+	}
+	if err != nil {
+		grohl.Log(grohl.Data{"fn": "addClusterEvent", "type": typ, "object.id": objectID, "at": "error", "err": err})
+	}
+}
+
+// decision records a scheduler decision about a job of the formation in the
+// cluster event stream.
+func (f *Formation) decision(action string, job *Job) {
+	f.c.addClusterEvent(ct.ClusterEventScheduler, f.AppID, job.HostID+"-"+job.ID, &ct.SchedulerDecision{
+		Action:    action,
+		AppID:     f.AppID,
+		ReleaseID: f.Release.ID,
+		Type:      job.Type,
+		HostID:    job.HostID,
+		JobID:     job.HostID + "-" + job.ID,
+	})
+}
+
 func newHostClients() *hostClients {
 	return &hostClients{hosts: make(map[string]cluster.Host)}
 }
@@ -396,6 +584,18 @@ func (m *jobMap) Get(host, job string) *Job {
 	return m.jobs[jobKey{host, job}]
 }
 
+func (m *jobMap) HostJobs(hostID string) []*Job {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var jobs []*Job
+	for k, job := range m.jobs {
+		if k.hostID == hostID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
 func (m *jobMap) Len() int {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -449,13 +649,18 @@ func (fs *Formations) Len() int {
 
 func NewFormation(c *context, ef *ct.ExpandedFormation) *Formation {
 	return &Formation{
-		AppID:     ef.App.ID,
-		AppName:   ef.App.Name,
-		Release:   ef.Release,
-		Artifact:  ef.Artifact,
-		Processes: ef.Processes,
-		jobs:      make(jobTypeMap),
-		c:         c,
+		AppID:      ef.App.ID,
+		AppName:    ef.App.Name,
+		Release:    ef.Release,
+		Artifact:   ef.Artifact,
+		Artifacts:  ef.Artifacts,
+		Processes:  ef.Processes,
+		Hosts:      ef.Hosts,
+		Generation: ef.Generation,
+		jobs:       make(jobTypeMap),
+		jitter:     make(map[jitterKey]bool),
+		c:          c,
+		changedAt:  time.Now(),
 	}
 }
 
@@ -465,9 +670,94 @@ type Job struct {
 	Type      string
 	Formation *Formation
 
+	// Generation is the generation of the formation when the job was
+	// started
+	Generation int64
+
 	restarts  int
 	timer     *time.Timer
 	startedAt time.Time
+
+	// crashes are the times of the recent crashes of the job and the jobs
+	// it replaced, and failed is why the job was quarantined, if it was
+	crashes []time.Time
+	failed  string
+
+	// startupFailed is set when the job is stopped for not becoming healthy
+	// within its startup grace, and unhealthy when it is stopped for
+	// reaching the unhealthy threshold of its health check
+	startupFailed bool
+	unhealthy     bool
+
+	// stopping is set when the scheduler stops the job because it is no
+	// longer wanted, so its exit status doesn't make it a crash
+	stopping bool
+	flagMtx  sync.Mutex // protects startupFailed, unhealthy and stopping
+
+	up     chan struct{} // closed once the job has started
+	upOnce sync.Once
+
+	stopped  chan struct{} // closed once the job has exited
+	stopOnce sync.Once
+}
+
+func (j *Job) setStopping() {
+	j.flagMtx.Lock()
+	j.stopping = true
+	j.flagMtx.Unlock()
+}
+
+func (j *Job) isStopping() bool {
+	j.flagMtx.Lock()
+	defer j.flagMtx.Unlock()
+	return j.stopping
+}
+
+func (j *Job) setStartupFailed() {
+	j.flagMtx.Lock()
+	j.startupFailed = true
+	j.flagMtx.Unlock()
+}
+
+func (j *Job) isStartupFailed() bool {
+	j.flagMtx.Lock()
+	defer j.flagMtx.Unlock()
+	return j.startupFailed
+}
+
+func (j *Job) setUnhealthy() {
+	j.flagMtx.Lock()
+	j.unhealthy = true
+	j.flagMtx.Unlock()
+}
+
+func (j *Job) isUnhealthy() bool {
+	j.flagMtx.Lock()
+	defer j.flagMtx.Unlock()
+	return j.unhealthy
+}
+
+func (j *Job) setUp() {
+	j.upOnce.Do(func() {
+		close(j.up)
+		if f := j.Formation; f != nil && f.Release.Processes[j.Type].StartConcurrency > 0 {
+			// start any jobs which were held back by the concurrency limit
+			go f.Rectify()
+		}
+	})
+}
+
+func (j *Job) setStopped() {
+	j.stopOnce.Do(func() { close(j.stopped) })
+}
+
+func (j *Job) isUp() bool {
+	select {
+	case <-j.up:
+		return true
+	default:
+		return false
+	}
 }
 
 type jobTypeMap map[string]map[jobKey]*Job
@@ -478,7 +768,7 @@ func (m jobTypeMap) Add(typ, host, id string) *Job {
 		jobs = make(map[jobKey]*Job)
 		m[typ] = jobs
 	}
-	job := &Job{ID: id, HostID: host, Type: typ}
+	job := &Job{ID: id, HostID: host, Type: typ, up: make(chan struct{}), stopped: make(chan struct{})}
 	jobs[jobKey{host, id}] = job
 	return job
 }
@@ -499,29 +789,118 @@ type Formation struct {
 	AppName   string
 	Release   *ct.Release
 	Artifact  *ct.Artifact
+	Artifacts map[string]*ct.Artifact
 	Processes map[string]int
 
+	// Hosts are the IDs of the only hosts the formation's jobs may run on,
+	// if empty they may run on any host
+	Hosts []string
+
+	// Generation is the formation's generation in the controller, which new
+	// jobs are tagged with
+	Generation int64
+
 	jobs jobTypeMap
 	c    *context
+
+	// changedAt is when the formation's processes last changed, zero once
+	// it has converged
+	changedAt time.Time
+
+	// jitter tracks the delayed starts of omni jobs with a StartJitter, a
+	// start is false while it is delayed and true once it is due
+	jitter map[jitterKey]bool
 }
 
 func (f *Formation) key() formationKey {
 	return formationKey{f.AppID, f.Release.ID}
 }
 
+// SetGeneration sets the generation which jobs started from now on are
+// tagged with.
+func (f *Formation) SetGeneration(generation int64) {
+	f.mtx.Lock()
+	f.Generation = generation
+	f.mtx.Unlock()
+}
+
 func (f *Formation) SetProcesses(p map[string]int) {
 	f.mtx.Lock()
+	if !processesEqual(f.Processes, p) {
+		f.changedAt = time.Now()
+	}
 	f.Processes = p
 	f.mtx.Unlock()
 }
 
+func processesEqual(a, b map[string]int) bool {
+	for typ, n := range a {
+		if b[typ] != n {
+			return false
+		}
+	}
+	for typ, n := range b {
+		if a[typ] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// SetHosts sets the hosts the formation's jobs may run on. Jobs on hosts which
+// are no longer allowed are replaced by jobs on the allowed hosts, except for
+// omnipresent jobs, which are already running on all of them, and one-off
+// jobs.
+func (f *Formation) SetHosts(hosts []string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.Hosts = hosts
+
+	g := grohl.NewContext(grohl.Data{"fn": "SetHosts", "app.id": f.AppID, "release.id": f.Release.ID})
+	for typ, jobs := range f.jobs {
+		if typ == "" {
+			continue
+		}
+		for _, job := range jobs {
+			// quarantined jobs are not running, so stay where they are
+			if f.allowsHost(job.HostID) || job.failed != "" {
+				continue
+			}
+			if !f.Release.Processes[typ].Omni {
+				if newJob, err := f.start(typ, "", job.HostID); err != nil {
+					// the replacement is left pending when the formation
+					// is rectified
+					g.Log(grohl.Data{"at": "error", "host.id": job.HostID, "job.id": job.ID, "err": err})
+				} else {
+					g.Log(grohl.Data{"at": "replaced", "host.id": job.HostID, "job.id": job.ID, "new.host.id": newJob.HostID, "new.job.id": newJob.ID})
+				}
+			}
+			f.stop(job)
+		}
+	}
+}
+
+// allowsHost returns whether the formation's jobs may run on the host.
+func (f *Formation) allowsHost(hostID string) bool {
+	if len(f.Hosts) == 0 {
+		return true
+	}
+	for _, id := range f.Hosts {
+		if id == hostID {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *Formation) Rectify() {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 	f.rectify()
+	f.converged()
 }
 
-func (f *Formation) RestartJob(typ, hostID, jobID string) {
+func (f *Formation) RestartJob(typ, hostID, jobID string, crashed bool) {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
@@ -534,28 +913,156 @@ func (f *Formation) RestartJob(typ, hostID, jobID string) {
 		f.jobs.Remove(job)
 		return
 	}
+	if crashed && f.quarantine(job) {
+		return
+	}
+	if f.c.inMaintenance() {
+		// the job is replaced when maintenance mode is turned off
+		f.jobs.Remove(job)
+		return
+	}
 	// If the job was started more than backoffPeriod ago, reset it's restart count
 	// so that it will be restarted straight away
-	if job.startedAt.Before(time.Now().Add(-backoffPeriod)) {
+	if job.startedAt.Before(time.Now().Add(-f.c.backoffPeriod)) {
 		job.restarts = 0
 	}
 	if job.restarts == 0 {
-		f.restart(job)
+		if err := f.restart(job, crashed); err != nil {
+			// rectify so the job which could not be placed is recorded as
+			// pending
+			f.rectify()
+		}
 	} else {
 		// wait backoffPeriod * 2 ^ (restarts - 1) before restarting
-		duration := backoffPeriod
+		duration := f.c.backoffPeriod
 		for i := 0; i < job.restarts-1; i++ {
 			duration *= 2
 		}
 		job.timer = timeAfterFunc(duration, func() {
-			f.restart(job)
+			f.restart(job, crashed)
 		})
 	}
 }
 
+// FailJob leaves a job which failed permanently, such as one whose init
+// command failed, in the formation as failed rather than restarting it, in the
+// same way as a quarantined job.
+func (f *Formation) FailJob(typ, hostID, jobID, reason string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	job := f.jobs.Get(typ, hostID, jobID)
+	if job == nil {
+		return
+	}
+	if job.Type == "" {
+		f.jobs.Remove(job)
+		return
+	}
+	job.failed = reason
+	grohl.Log(grohl.Data{"fn": "FailJob", "app.id": f.AppID, "release.id": f.Release.ID, "host.id": hostID, "job.id": jobID, "reason": reason})
+}
+
+// quarantine records a crash of the job and quarantines it if it has crashed
+// too many times within the crash window of its type, returning whether it
+// did. A quarantined job is left in the formation as failed so that it is not
+// replaced, until the quarantine is cleared or the formation removed.
+func (f *Formation) quarantine(job *Job) bool {
+	proc := f.Release.Processes[job.Type]
+	max, window := proc.MaxCrashes, proc.CrashWindow
+	if max == 0 {
+		max = defaultMaxCrashes
+	}
+	if window == 0 {
+		window = defaultCrashWindow
+	}
+
+	now := time.Now()
+	crashes := make([]time.Time, 0, len(job.crashes)+1)
+	for _, t := range job.crashes {
+		if t.After(now.Add(-window)) {
+			crashes = append(crashes, t)
+		}
+	}
+	job.crashes = append(crashes, now)
+	if max < 0 || len(job.crashes) < max {
+		return false
+	}
+
+	job.failed = fmt.Sprintf("crashed %d times within %s", len(job.crashes), window)
+	grohl.Log(grohl.Data{"fn": "quarantine", "app.id": f.AppID, "release.id": f.Release.ID, "host.id": job.HostID, "job.id": job.ID, "reason": job.failed})
+	j := &ct.Job{ID: job.HostID + "-" + job.ID, AppID: f.AppID, ReleaseID: f.Release.ID, Type: job.Type, State: "failed", Generation: job.Generation}
+	if err := f.c.PutJob(j); err != nil {
+		grohl.Log(grohl.Data{"fn": "quarantine", "at": "error", "job.id": job.ID, "err": err})
+	}
+	return true
+}
+
+// ClearQuarantine removes the quarantined jobs of the given type, or of all
+// types if typ is empty, so that they are replaced with new jobs. It returns
+// the number of jobs which were cleared.
+func (f *Formation) ClearQuarantine(typ string) int {
+	f.mtx.Lock()
+	var cleared []*Job
+	for t, jobs := range f.jobs {
+		if typ != "" && t != typ {
+			continue
+		}
+		for _, job := range jobs {
+			if job.failed != "" {
+				f.jobs.Remove(job)
+				cleared = append(cleared, job)
+			}
+		}
+	}
+	if len(cleared) > 0 {
+		f.rectify()
+	}
+	f.mtx.Unlock()
+
+	// mark the cleared jobs as down so that they are not quarantined again
+	// when the scheduler restarts
+	for _, job := range cleared {
+		j := &ct.Job{ID: job.HostID + "-" + job.ID, AppID: f.AppID, ReleaseID: f.Release.ID, Type: job.Type, State: "down", Generation: job.Generation}
+		if err := f.c.PutJob(j); err != nil {
+			grohl.Log(grohl.Data{"fn": "ClearQuarantine", "at": "error", "job.id": job.ID, "err": err})
+		}
+	}
+	return len(cleared)
+}
+
+// restoreQuarantine adds the jobs of the formation which the controller
+// records as failed back to it as quarantined, so that a scheduler which
+// starts after they were quarantined does not replace them.
+func (f *Formation) restoreQuarantine() {
+	jobs, err := f.c.JobList(f.AppID)
+	if err != nil {
+		grohl.Log(grohl.Data{"fn": "restoreQuarantine", "at": "error", "app.id": f.AppID, "err": err})
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, j := range jobs {
+		if j.State != "failed" || j.ReleaseID != f.Release.ID {
+			continue
+		}
+		id := strings.SplitN(j.ID, "-", 2)
+		if len(id) != 2 || f.jobs.Get(j.Type, id[0], id[1]) != nil {
+			continue
+		}
+		job := f.jobs.Add(j.Type, id[0], id[1])
+		job.Formation = f
+		job.Generation = j.Generation
+		job.failed = "quarantined before the scheduler started"
+	}
+}
+
 func (f *Formation) rectify() {
 	g := grohl.NewContext(grohl.Data{"fn": "rectify", "app.id": f.AppID, "release.id": f.Release.ID})
 
+	pending := make(map[string][]error)
+	defer func() { f.c.setPending(f, pending) }()
+
 	var hosts map[string]host.Host
 	if _, ok := f.c.omni[f]; ok {
 		var err error
@@ -573,6 +1080,9 @@ func (f *Formation) rectify() {
 			// get job counts per host
 			hostCounts := make(map[string]int, len(hosts))
 			for _, h := range hosts {
+				if f.c.isDraining(h.ID) || !f.allowsHost(h.ID) {
+					continue
+				}
 				hostCounts[h.ID] = 0
 				for _, job := range h.Jobs {
 					if f.jobType(job) != t {
@@ -586,7 +1096,10 @@ func (f *Formation) rectify() {
 				diff := expected - actual
 				g.Log(grohl.Data{"at": "update", "type": t, "expected": expected, "actual": actual, "diff": diff})
 				if diff > 0 {
-					f.add(diff, t, hostID)
+					if f.delayStart(t, hostID) {
+						continue
+					}
+					pending[t] = append(pending[t], f.add(diff, t, hostID)...)
 				} else if diff < 0 {
 					f.remove(-diff, t, hostID)
 				}
@@ -595,8 +1108,23 @@ func (f *Formation) rectify() {
 			actual := len(f.jobs[t])
 			diff := expected - actual
 			g.Log(grohl.Data{"at": "update", "type": t, "expected": expected, "actual": actual, "diff": diff})
+			if limit := f.Release.Processes[t].StartConcurrency; diff > 0 && limit > 0 {
+				starting := 0
+				for _, job := range f.jobs[t] {
+					if !job.isUp() && job.failed == "" {
+						starting++
+					}
+				}
+				if diff > limit-starting {
+					// the rest are started as the starting jobs come up
+					diff = limit - starting
+					if diff < 0 {
+						diff = 0
+					}
+				}
+			}
 			if diff > 0 {
-				f.add(diff, t, "")
+				pending[t] = f.add(diff, t, "")
 			} else if diff < 0 {
 				f.remove(-diff, t, "")
 			}
@@ -616,56 +1144,201 @@ func (f *Formation) rectify() {
 	}
 }
 
-func (f *Formation) add(n int, name string, hostID string) {
+type jitterKey struct {
+	typ, hostID string
+}
+
+// delayStart returns whether starting jobs of the given omni type on the host
+// should be delayed by a random jitter, starting the delay if it has not
+// already started. The formation is rectified once the delay is over.
+func (f *Formation) delayStart(typ, hostID string) bool {
+	max := f.Release.Processes[typ].StartJitter
+	if max <= 0 {
+		return false
+	}
+	key := jitterKey{typ, hostID}
+	due, delayed := f.jitter[key]
+	if due {
+		return false
+	}
+	if !delayed {
+		f.jitter[key] = false
+		timeAfterFunc(randomJitter(max), func() {
+			f.mtx.Lock()
+			defer f.mtx.Unlock()
+			f.jitter[key] = true
+			f.rectify()
+			delete(f.jitter, key)
+		})
+	}
+	return true
+}
+
+// add starts n jobs of the given type, returning the errors of the jobs which
+// could not be started.
+func (f *Formation) add(n int, name string, hostID string) (errs []error) {
 	g := grohl.NewContext(grohl.Data{"fn": "add", "app.id": f.AppID, "release.id": f.Release.ID})
+	if f.c.inMaintenance() {
+		g.Log(grohl.Data{"at": "maintenance", "type": name, "count": n})
+		return nil
+	}
 	for i := 0; i < n; i++ {
-		job, err := f.start(name, hostID)
+		job, err := f.start(name, hostID, "")
 		if err != nil {
-			// TODO: handle error
-			g.Log(grohl.Data{"at": "error", "host.id": job.HostID, "job.id": job.ID, "err": err})
+			g.Log(grohl.Data{"at": "error", "host.id": hostID, "err": err})
+			errs = append(errs, err)
 			continue
 		}
 		g.Log(grohl.Data{"at": "started", "host.id": job.HostID, "job.id": job.ID})
 	}
+	return errs
 }
 
-func (f *Formation) restart(stoppedJob *Job) error {
+func (f *Formation) restart(stoppedJob *Job, crashed bool) error {
 	g := grohl.NewContext(grohl.Data{"fn": "restart", "app.id": f.AppID, "release.id": f.Release.ID})
 	g.Log(grohl.Data{"old.host.id": stoppedJob.HostID, "old.job.id": stoppedJob.ID})
 
 	f.jobs.Remove(stoppedJob)
 
-	var hostID string
+	var newJob *Job
+	var err error
 	if f.Release.Processes[stoppedJob.Type].Omni {
-		hostID = stoppedJob.HostID
+		newJob, err = f.start(stoppedJob.Type, stoppedJob.HostID, "")
+	} else {
+		if crashed && f.prefersLastHost(stoppedJob) {
+			newJob, err = f.start(stoppedJob.Type, stoppedJob.HostID, "")
+			if err != nil {
+				g.Log(grohl.Data{"at": "last_host_unavailable", "err": err})
+			}
+		}
+		if newJob == nil {
+			newJob, err = f.start(stoppedJob.Type, "", "")
+		}
 	}
-	newJob, err := f.start(stoppedJob.Type, hostID)
 	if err != nil {
 		return err
 	}
 	newJob.restarts = stoppedJob.restarts + 1
+	newJob.crashes = stoppedJob.crashes
 	g.Log(grohl.Data{"new.host.id": newJob.HostID, "new.job.id": newJob.ID})
 	return nil
 }
 
-func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
+// prefersLastHost returns whether the crashed job should be restarted on the
+// host it ran on, which must not be draining or, if the job's type has hard
+// anti-affinity, already running another job of the type. start checks the
+// host is otherwise still eligible.
+func (f *Formation) prefersLastHost(job *Job) bool {
+	proc := f.Release.Processes[job.Type]
+	if proc.RestartPolicy == ct.RestartAnyHost || f.c.isDraining(job.HostID) {
+		return false
+	}
+	if f.c.antiAffinity(proc) == ct.AntiAffinityHard {
+		for k := range f.jobs[job.Type] {
+			if k.hostID == job.HostID {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// start starts a job of the given type, either on hostID or, if hostID is
+// empty, on the least loaded host which is not draining, is one of the
+// formation's hosts if it is pinned to any, and is not exclude. Hosts already
+// running a job of the type are skipped if it has hard anti-affinity, and jobs
+// with named volumes which already exist always start on the host holding
+// them. Jobs of a type co-located with a service only start on hosts with an
+// instance of it.
+func (f *Formation) start(typ string, hostID string, exclude string) (job *Job, err error) {
 	config := f.jobConfig(typ)
 	config.ID = cluster.RandomJobID("")
+	err = utils.ResolveSecrets(config.Config.Env, func(name string) (string, error) {
+		return f.c.GetSecret(f.AppID, name)
+	})
+	if err != nil {
+		return nil, &placementError{ct.PlacementReasonSecret, fmt.Errorf("scheduler: error resolving secret: %s", err)}
+	}
 
 	hosts, err := f.c.ListHosts()
 	if err != nil {
-		return nil, err
+		return nil, &placementError{ct.PlacementReasonHostError, err}
 	}
 	if len(hosts) == 0 {
-		// TODO: log/handle error
+		return nil, &placementError{ct.PlacementReasonNoHosts, errors.New("scheduler: no hosts available")}
 	}
 	var h host.Host
 
+	// jobs with named volumes must run on the host holding them
+	volumeHost, err := f.c.volumeHost(config, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if volumeHost != "" {
+		if hostID != "" && hostID != volumeHost {
+			return nil, &placementError{ct.PlacementReasonVolume, fmt.Errorf("scheduler: the job's volumes are on host %s, not %s", volumeHost, hostID)}
+		}
+		if _, ok := hosts[volumeHost]; !ok || volumeHost == exclude {
+			return nil, &placementError{ct.PlacementReasonVolume, fmt.Errorf("scheduler: host %s holding the job's volumes is not available", volumeHost)}
+		}
+		hostID = volumeHost
+	}
+
+	// jobs co-located with a service must run on a host with an instance
+	var serviceHostIDs map[string]struct{}
+	service := f.Release.Processes[typ].Colocate
+	if service != "" {
+		ids, err := serviceHosts(service)
+		if err != nil {
+			return nil, &placementError{ct.PlacementReasonColocate, fmt.Errorf("scheduler: error getting the hosts of service %s: %s", service, err)}
+		}
+		serviceHostIDs = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			serviceHostIDs[id] = struct{}{}
+		}
+	}
+	hasService := func(hostID string) bool {
+		if serviceHostIDs == nil {
+			return true
+		}
+		_, ok := serviceHostIDs[hostID]
+		return ok
+	}
+
 	if hostID != "" {
-		h = hosts[hostID]
+		if !f.allowsHost(hostID) {
+			return nil, &placementError{ct.PlacementReasonHosts, fmt.Errorf("scheduler: host %s is not one of the formation's hosts", hostID)}
+		}
+		if !hasService(hostID) {
+			return nil, &placementError{ct.PlacementReasonColocate, fmt.Errorf("scheduler: host %s has no instance of service %s", hostID, service)}
+		}
+		var ok bool
+		if h, ok = hosts[hostID]; !ok {
+			return nil, &placementError{ct.PlacementReasonNoHosts, fmt.Errorf("scheduler: host %s is not available", hostID)}
+		}
+		if !hasResources(h, config) {
+			return nil, &placementError{ct.PlacementReasonResources, fmt.Errorf("scheduler: host %s has insufficient resources", hostID)}
+		}
 	} else {
+		hard := f.c.antiAffinity(f.Release.Processes[typ]) == ct.AntiAffinityHard
 		hostCounts := make(map[string]int, len(hosts))
+		var full, pinned, colocated, noService bool
 		for _, h := range hosts {
+			if h.ID == exclude || f.c.isDraining(h.ID) {
+				continue
+			}
+			if !f.allowsHost(h.ID) {
+				pinned = true
+				continue
+			}
+			if !hasService(h.ID) {
+				noService = true
+				continue
+			}
+			if !hasResources(h, config) {
+				full = true
+				continue
+			}
 			hostCounts[h.ID] = 0
 			for _, job := range h.Jobs {
 				if f.jobType(job) != typ {
@@ -673,6 +1346,28 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 				}
 				hostCounts[h.ID]++
 			}
+			if hard && hostCounts[h.ID] > 0 {
+				delete(hostCounts, h.ID)
+				colocated = true
+			}
+		}
+		if len(hostCounts) == 0 {
+			if colocated {
+				return nil, &placementError{ct.PlacementReasonAntiAffinity, fmt.Errorf("scheduler: every available host already runs a %s job", typ)}
+			}
+			if full {
+				return nil, &placementError{ct.PlacementReasonResources, errors.New("scheduler: no hosts have sufficient resources")}
+			}
+			if pinned {
+				return nil, &placementError{ct.PlacementReasonHosts, errors.New("scheduler: none of the formation's hosts are available")}
+			}
+			if noService {
+				return nil, &placementError{ct.PlacementReasonColocate, fmt.Errorf("scheduler: no available host has an instance of service %s", service)}
+			}
+			return nil, &placementError{ct.PlacementReasonNoHosts, errors.New("scheduler: no hosts available")}
+		}
+		if f.Release.Processes[typ].Spread == ct.SpreadZones {
+			f.zoneCandidates(typ, hosts, hostCounts)
 		}
 		sh := make(sortHosts, 0, len(hosts))
 		for id, count := range hostCounts {
@@ -685,17 +1380,79 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 
 	job = f.jobs.Add(typ, h.ID, config.ID)
 	job.Formation = f
+	job.Generation = f.Generation
 	f.c.jobs.Add(job)
 
 	_, err = f.c.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{h.ID: {config}}})
 	if err != nil {
 		f.jobs.Remove(job)
 		f.c.jobs.Remove(config.ID, h.ID)
-		return nil, err
+		return nil, &placementError{ct.PlacementReasonHostError, err}
 	}
+	f.c.addVolumes(config, h.ID)
+	f.decision("place", job)
 	return job, nil
 }
 
+// zoneCandidates removes the hosts from hostCounts which are not in the zone
+// running the fewest jobs of the given type out of the zones of the hosts in
+// hostCounts, so that jobs are spread across zones before hosts. Jobs on
+// every host are counted, including hosts which can't run further jobs.
+func (f *Formation) zoneCandidates(typ string, hosts map[string]host.Host, hostCounts map[string]int) {
+	zoneCounts := make(map[string]int)
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			if f.jobType(job) == typ {
+				zoneCounts[h.Metadata[host.ZoneMetadataKey]]++
+			}
+		}
+	}
+	min := -1
+	for id := range hostCounts {
+		if n := zoneCounts[hosts[id].Metadata[host.ZoneMetadataKey]]; min == -1 || n < min {
+			min = n
+		}
+	}
+	for id := range hostCounts {
+		if zoneCounts[hosts[id].Metadata[host.ZoneMetadataKey]] > min {
+			delete(hostCounts, id)
+		}
+	}
+}
+
+// placementError is returned when a job cannot be placed on a host.
+type placementError struct {
+	Reason ct.PlacementReason
+	Err    error
+}
+
+func (e *placementError) Error() string {
+	return e.Err.Error()
+}
+
+// hasResources returns whether h has enough free resources to run job. A
+// host with no memory limit has unlimited memory, but only has the devices it
+// advertises.
+func hasResources(h host.Host, job *host.Job) bool {
+	for typ, n := range job.Resources.Devices {
+		used := 0
+		for _, j := range h.Jobs {
+			used += j.Resources.Devices[typ]
+		}
+		if used+n > h.Resources.Devices[typ] {
+			return false
+		}
+	}
+	if h.Resources.Memory == 0 || job.Resources.Memory == 0 {
+		return true
+	}
+	used := 0
+	for _, j := range h.Jobs {
+		used += j.Resources.Memory
+	}
+	return used+job.Resources.Memory <= h.Resources.Memory
+}
+
 func (f *Formation) jobType(job *host.Job) string {
 	if job.Metadata["flynn-controller.app"] != f.AppID ||
 		job.Metadata["flynn-controller.release"] != f.Release.ID {
@@ -707,28 +1464,55 @@ func (f *Formation) jobType(job *host.Job) string {
 func (f *Formation) remove(n int, name string, hostID string) {
 	g := grohl.NewContext(grohl.Data{"fn": "remove", "app.id": f.AppID, "release.id": f.Release.ID})
 
-	i := 0
+	// quarantined jobs are removed first, as they are not running
+	jobs := make([]*Job, 0, len(f.jobs[name]))
+	for _, job := range f.jobs[name] {
+		if job.failed != "" {
+			jobs = append(jobs, job)
+		}
+	}
 	for _, job := range f.jobs[name] {
+		if job.failed == "" {
+			jobs = append(jobs, job)
+		}
+	}
+
+	i := 0
+	for _, job := range jobs {
 		g.Log(grohl.Data{"host.id": job.HostID, "job.id": job.ID})
 		if hostID != "" && job.HostID != hostID { // remove from a specific host
 			continue
 		}
-		// TODO: robust host handling
-		if err := f.c.hosts.Get(job.HostID).StopJob(job.ID); err != nil {
-			// TODO: log/handle error
-		}
-		f.jobs.Remove(job)
+		f.stop(job)
 		if i++; i == n {
 			break
 		}
 	}
 }
 
+// stop removes the job from the formation and stops it, the job will not be
+// restarted.
+func (f *Formation) stop(job *Job) {
+	f.jobs.Remove(job)
+	if job.failed != "" {
+		// the job has already exited
+		return
+	}
+	job.setStopping()
+	// TODO: robust host handling
+	if err := f.c.hosts.Get(job.HostID).StopJob(job.ID); err != nil {
+		// TODO: log/handle error
+	}
+	f.decision("stop", job)
+}
+
 func (f *Formation) jobConfig(name string) *host.Job {
 	return utils.JobConfig(&ct.ExpandedFormation{
-		App:      &ct.App{ID: f.AppID, Name: f.AppName},
-		Release:  f.Release,
-		Artifact: f.Artifact,
+		App:        &ct.App{ID: f.AppID, Name: f.AppName},
+		Release:    f.Release,
+		Artifact:   f.Artifact,
+		Artifacts:  f.Artifacts,
+		Generation: f.Generation,
 	}, name)
 }
 
@@ -747,3 +1531,362 @@ func (h sortHosts) Sort()              { sort.Sort(h) }
 type FormationEvent struct {
 	Formation *Formation
 }
+
+// volumeHost returns the ID of the host holding the named volumes mounted by
+// job, or an empty string if none of them have been created yet.
+func (c *context) volumeHost(job *host.Job, hosts map[string]host.Host) (string, error) {
+	var hostID string
+	for _, m := range job.Config.Mounts {
+		if m.Volume == "" {
+			continue
+		}
+		id := c.findVolume(m.Volume, hosts)
+		if id == "" {
+			continue
+		}
+		if hostID != "" && id != hostID {
+			return "", &placementError{ct.PlacementReasonVolume, fmt.Errorf("scheduler: the job's volumes are on different hosts (%s and %s)", hostID, id)}
+		}
+		hostID = id
+	}
+	return hostID, nil
+}
+
+// findVolume returns the ID of the host holding the named volume, either
+// known from placing a job which uses it, or reported by one of hosts, which
+// includes the volumes of jobs which are not running so that they are still
+// found after the scheduler restarts.
+func (c *context) findVolume(name string, hosts map[string]host.Host) string {
+	c.volumesMtx.RLock()
+	id, ok := c.volumes[name]
+	c.volumesMtx.RUnlock()
+	if ok {
+		return id
+	}
+	for _, h := range hosts {
+		for _, v := range h.Volumes {
+			if v == name {
+				c.volumesMtx.Lock()
+				c.volumes[name] = h.ID
+				c.volumesMtx.Unlock()
+				return h.ID
+			}
+		}
+		for _, job := range h.Jobs {
+			for _, m := range job.Config.Mounts {
+				if m.Volume == name {
+					c.addVolumes(job, h.ID)
+					return h.ID
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// addVolumes records that the named volumes mounted by job are on the host.
+func (c *context) addVolumes(job *host.Job, hostID string) {
+	c.volumesMtx.Lock()
+	defer c.volumesMtx.Unlock()
+	for _, m := range job.Config.Mounts {
+		if m.Volume != "" {
+			c.volumes[m.Volume] = hostID
+		}
+	}
+}
+
+func (c *context) isDraining(hostID string) bool {
+	c.drainMtx.RLock()
+	defer c.drainMtx.RUnlock()
+	_, ok := c.draining[hostID]
+	return ok
+}
+
+// RescheduleJob starts a replacement for the job on another host and stops
+// the original once the replacement is up. If the replacement doesn't start
+// within rescheduleTimeout, the original is left running.
+func (c *context) RescheduleJob(job *Job) (*Job, error) {
+	f := job.Formation
+	if job.Type == "" {
+		return nil, errors.New("scheduler: cannot reschedule one-off jobs")
+	}
+	g := grohl.NewContext(grohl.Data{"fn": "RescheduleJob", "app.id": f.AppID, "release.id": f.Release.ID, "host.id": job.HostID, "job.id": job.ID})
+
+	f.mtx.Lock()
+	if f.jobs.Get(job.Type, job.HostID, job.ID) == nil {
+		f.mtx.Unlock()
+		return nil, errors.New("scheduler: job is not running")
+	}
+	newJob, err := f.start(job.Type, "", job.HostID)
+	f.mtx.Unlock()
+	if err != nil {
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return nil, err
+	}
+	g.Log(grohl.Data{"at": "started", "new.host.id": newJob.HostID, "new.job.id": newJob.ID})
+
+	select {
+	case <-newJob.up:
+	case <-time.After(rescheduleTimeout):
+		g.Log(grohl.Data{"at": "timeout", "new.host.id": newJob.HostID, "new.job.id": newJob.ID})
+		return newJob, errors.New("scheduler: timed out waiting for rescheduled job to start")
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.jobs.Get(job.Type, job.HostID, job.ID) != nil {
+		f.stop(job)
+	}
+	g.Log(grohl.Data{"at": "stopped"})
+	return newJob, nil
+}
+
+// DrainHost stops new jobs being placed on a host and migrates its jobs to
+// other hosts in priority order, each job only being stopped once its
+// replacement is up. Omnipresent jobs are stopped once all other jobs have
+// migrated.
+//
+// One-off jobs can't be rescheduled, so they are given oneOffGrace to finish
+// before being stopped, and the IDs of those which had to be stopped are
+// returned. A negative grace leaves one-off jobs running.
+//
+// Before any jobs are stopped, the host registers itself as draining so that
+// routers stop sending new connections to the services on it.
+func (c *context) DrainHost(hostID string, oneOffGrace time.Duration) ([]string, error) {
+	g := grohl.NewContext(grohl.Data{"fn": "DrainHost", "host.id": hostID})
+	g.Log(grohl.Data{"at": "start"})
+
+	h := c.hosts.Get(hostID)
+	if h == nil {
+		return nil, fmt.Errorf("scheduler: unknown host %q", hostID)
+	}
+
+	c.drainMtx.Lock()
+	c.draining[hostID] = struct{}{}
+	c.drainMtx.Unlock()
+
+	if err := h.SetDraining(true); err != nil {
+		// the jobs are still migrated, but connections to them may be dropped
+		g.Log(grohl.Data{"at": "drain_routes", "status": "error", "err": err})
+	}
+
+	var jobs, omni []*Job
+	for _, job := range c.jobs.HostJobs(hostID) {
+		switch {
+		case job.Type == "":
+			// one-off jobs are listed by the host in waitOneOff
+		case job.Formation.Release.Processes[job.Type].Omni:
+			omni = append(omni, job)
+		default:
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Sort(jobsByPriority(jobs))
+
+	for _, job := range jobs {
+		if _, err := c.RescheduleJob(job); err != nil {
+			g.Log(grohl.Data{"at": "error", "job.id": job.ID, "err": err})
+			return nil, err
+		}
+	}
+	for _, job := range omni {
+		f := job.Formation
+		f.mtx.Lock()
+		if f.jobs.Get(job.Type, job.HostID, job.ID) != nil {
+			f.stop(job)
+		}
+		f.mtx.Unlock()
+	}
+	var killed []string
+	if oneOffGrace >= 0 {
+		var err error
+		if killed, err = c.waitOneOff(hostID, h, oneOffGrace); err != nil {
+			g.Log(grohl.Data{"at": "error", "err": err})
+			return nil, err
+		}
+	}
+	g.Log(grohl.Data{"at": "done", "killed": len(killed)})
+	return killed, nil
+}
+
+// UndrainHost allows new jobs to be placed on a drained host again and routers
+// to send it new connections, returning whether the host was draining. Hosts
+// stop draining when they leave the cluster.
+func (c *context) UndrainHost(hostID string) bool {
+	c.drainMtx.Lock()
+	_, ok := c.draining[hostID]
+	delete(c.draining, hostID)
+	c.drainMtx.Unlock()
+	if !ok {
+		return false
+	}
+	if h := c.hosts.Get(hostID); h != nil {
+		if err := h.SetDraining(false); err != nil {
+			grohl.Log(grohl.Data{"fn": "UndrainHost", "host.id": hostID, "at": "undrain_routes", "status": "error", "err": err})
+		}
+	}
+	return true
+}
+
+// loadDraining marks the hosts which are registered as draining as such, so
+// that a scheduler which takes over from one which drained hosts does not
+// place new jobs on them.
+func (c *context) loadDraining() {
+	g := grohl.NewContext(grohl.Data{"fn": "loadDraining"})
+	ids, err := drainingHosts()
+	if err != nil {
+		// the hosts are still excluded by routers, but may be given new jobs
+		g.Log(grohl.Data{"at": "error", "err": err})
+		return
+	}
+	c.drainMtx.Lock()
+	defer c.drainMtx.Unlock()
+	for _, id := range ids {
+		c.draining[id] = struct{}{}
+	}
+	g.Log(grohl.Data{"at": "loaded", "count": len(ids)})
+}
+
+// waitOneOff waits up to grace for the one-off jobs on the host to finish,
+// then stops those still running, returning their IDs.
+func (c *context) waitOneOff(hostID string, h cluster.Host, grace time.Duration) ([]string, error) {
+	g := grohl.NewContext(grohl.Data{"fn": "waitOneOff", "host.id": hostID})
+	running, err := waitOneOffStopped(h, grace)
+	if err != nil {
+		return nil, err
+	}
+	killed := make([]string, 0, len(running))
+	for id := range running {
+		g.Log(grohl.Data{"at": "kill", "job.id": id})
+		if err := h.StopJob(id); err != nil {
+			g.Log(grohl.Data{"at": "error", "job.id": id, "err": err})
+		}
+		killed = append(killed, hostID+"-"+id)
+	}
+	sort.Strings(killed)
+	return killed, nil
+}
+
+// waitOneOffStopped waits up to grace for the one-off jobs running on the host
+// to stop, returning the IDs of those still running. The host is asked for its
+// jobs rather than using those the scheduler tracks, as one-off jobs are
+// started by the controller without the scheduler seeing them. If the host
+// goes away while waiting, its jobs have gone with it.
+func waitOneOffStopped(h cluster.Host, grace time.Duration) (map[string]struct{}, error) {
+	// subscribe before listing the jobs so that none finish unnoticed
+	events := make(chan *host.Event)
+	stream := h.StreamEvents("all", events)
+	defer func() {
+		go func() {
+			// drain to prevent deadlock while closing the stream
+			for _ = range events {
+			}
+		}()
+		stream.Close()
+	}()
+
+	jobs, err := h.ListJobs()
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]struct{})
+	for id, job := range jobs {
+		if job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+			continue
+		}
+		if job.Job != nil && job.Job.Metadata["flynn-controller.type"] == "" {
+			running[id] = struct{}{}
+		}
+	}
+
+	deadline := time.After(grace)
+	for len(running) > 0 {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil, nil
+			}
+			if event.Event == "stop" || event.Event == "error" {
+				delete(running, event.JobID)
+			}
+		case <-deadline:
+			return running, nil
+		}
+	}
+	return running, nil
+}
+
+type jobsByPriority []*Job
+
+func (j jobsByPriority) Len() int      { return len(j) }
+func (j jobsByPriority) Swap(i, k int) { j[i], j[k] = j[k], j[i] }
+func (j jobsByPriority) Less(i, k int) bool {
+	pi := j[i].Formation.Release.Processes[j[i].Type].Priority
+	pk := j[k].Formation.Release.Processes[j[k].Type].Priority
+	if pi != pk {
+		return pi > pk
+	}
+	return j[i].Type < j[k].Type
+}
+
+// setPending records the jobs of the formation which could not be placed,
+// keyed by type, and reports the app's pending jobs to the controller if they
+// have changed.
+func (c *context) setPending(f *Formation, errs map[string][]error) {
+	c.pendingMtx.Lock()
+	defer c.pendingMtx.Unlock()
+
+	key := f.key()
+	prev := c.pending[key]
+	now := time.Now()
+	var changed bool
+	pending := make(map[string][]*ct.PendingJob, len(errs))
+	for typ, typeErrs := range errs {
+		if len(typeErrs) != len(prev[typ]) {
+			changed = true
+		}
+		for i, err := range typeErrs {
+			job := &ct.PendingJob{
+				AppID:     f.AppID,
+				ReleaseID: f.Release.ID,
+				Type:      typ,
+				Reason:    ct.PlacementReasonHostError,
+				Message:   err.Error(),
+				CreatedAt: &now,
+			}
+			if e, ok := err.(*placementError); ok {
+				job.Reason = e.Reason
+			}
+			// keep the time that previously pending jobs were first seen
+			if i < len(prev[typ]) {
+				job.CreatedAt = prev[typ][i].CreatedAt
+				if prev[typ][i].Reason != job.Reason {
+					changed = true
+				}
+			}
+			pending[typ] = append(pending[typ], job)
+		}
+	}
+	for typ, jobs := range prev {
+		if _, ok := pending[typ]; !ok && len(jobs) > 0 {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	c.pending[key] = pending
+
+	var jobs []*ct.PendingJob
+	for k, types := range c.pending {
+		if k.appID != f.AppID {
+			continue
+		}
+		for _, t := range types {
+			jobs = append(jobs, t...)
+		}
+	}
+	if err := c.PutPendingJobs(f.AppID, jobs); err != nil {
+		grohl.Log(grohl.Data{"fn": "setPending", "app.id": f.AppID, "at": "error", "err": err})
+	}
+}
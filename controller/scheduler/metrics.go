@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// metrics records how long formations take to converge.
+type metrics struct {
+	mtx          sync.Mutex
+	convergences int
+	last, max    time.Duration
+	formations   map[formationKey]*ct.FormationConvergence
+}
+
+func newMetrics() *metrics {
+	return &metrics{formations: make(map[formationKey]*ct.FormationConvergence)}
+}
+
+func (m *metrics) recordConvergence(f *Formation, d time.Duration) {
+	processes := make(map[string]int, len(f.Processes))
+	for typ, n := range f.Processes {
+		processes[typ] = n
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.convergences++
+	m.last = d
+	if d > m.max {
+		m.max = d
+	}
+	m.formations[f.key()] = &ct.FormationConvergence{
+		AppID:       f.AppID,
+		ReleaseID:   f.Release.ID,
+		Processes:   processes,
+		Duration:    d,
+		ConvergedAt: time.Now().UTC(),
+	}
+}
+
+// Metrics returns the scheduler's convergence metrics.
+func (c *context) Metrics() *ct.SchedulerMetrics {
+	c.metrics.mtx.Lock()
+	defer c.metrics.mtx.Unlock()
+	m := &ct.SchedulerMetrics{
+		Convergences:    c.metrics.convergences,
+		LastConvergence: c.metrics.last,
+		MaxConvergence:  c.metrics.max,
+		Formations:      make([]*ct.FormationConvergence, 0, len(c.metrics.formations)),
+	}
+	for _, fc := range c.metrics.formations {
+		m.Formations = append(m.Formations, fc)
+	}
+	sort.Sort(formationConvergencesByKey(m.Formations))
+	return m
+}
+
+// checkConverged records the time the formation took to converge since it
+// was last changed, if it has the desired number of jobs of each type up.
+func (f *Formation) checkConverged() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.converged()
+}
+
+func (f *Formation) converged() {
+	if f.changedAt.IsZero() {
+		return
+	}
+	for typ, n := range f.Processes {
+		jobs := f.jobs[typ]
+		for _, job := range jobs {
+			if job.failed != "" || !job.isUp() {
+				return
+			}
+		}
+		// omni types have n jobs per host, so just check there are some
+		if f.Release.Processes[typ].Omni && n > 0 && len(jobs) > 0 {
+			continue
+		}
+		if len(jobs) != n {
+			return
+		}
+	}
+	for typ, jobs := range f.jobs {
+		if _, ok := f.Processes[typ]; !ok && len(jobs) > 0 {
+			return
+		}
+	}
+	f.c.metrics.recordConvergence(f, time.Since(f.changedAt))
+	f.changedAt = time.Time{}
+}
+
+type formationConvergencesByKey []*ct.FormationConvergence
+
+func (f formationConvergencesByKey) Len() int      { return len(f) }
+func (f formationConvergencesByKey) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f formationConvergencesByKey) Less(i, j int) bool {
+	if f[i].AppID != f[j].AppID {
+		return f[i].AppID < f[j].AppID
+	}
+	return f[i].ReleaseID < f[j].ReleaseID
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,6 +18,7 @@ import (
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/attempt"
 )
 
 // Hook gocheck up to the "go test" runner
@@ -27,18 +35,26 @@ func newFakeControllerClient(appID string, release *ct.Release, artifact *ct.Art
 		formations: map[formationKey]*ct.Formation{
 			formationKey{appID, release.ID}: {AppID: appID, ReleaseID: release.ID, Processes: processes},
 		},
-		jobs:   make(map[string]*ct.Job),
-		stream: stream,
+		jobs:        make(map[string]*ct.Job),
+		pendingJobs: make(map[string][]*ct.PendingJob),
+		secrets:     make(map[string]string),
+		stream:      stream,
 	}
 }
 
 type fakeControllerClient struct {
-	releases   map[string]*ct.Release
-	artifacts  map[string]*ct.Artifact
-	formations map[formationKey]*ct.Formation
-	jobs       map[string]*ct.Job
-	stream     chan *ct.ExpandedFormation
-	mtx        sync.RWMutex
+	releases    map[string]*ct.Release
+	artifacts   map[string]*ct.Artifact
+	formations  map[formationKey]*ct.Formation
+	jobs        map[string]*ct.Job
+	jobEvents   []*ct.Job
+	pendingJobs map[string][]*ct.PendingJob
+	events      []*ct.ClusterEvent
+	secrets     map[string]string
+	config      *ct.SchedulerConfig
+	configErrs  int
+	stream      chan *ct.ExpandedFormation
+	mtx         sync.RWMutex
 }
 
 func (c *fakeControllerClient) GetRelease(releaseID string) (*ct.Release, error) {
@@ -70,10 +86,67 @@ func (c *fakeControllerClient) StreamFormations(since *time.Time) (*controller.F
 func (c *fakeControllerClient) PutJob(job *ct.Job) error {
 	c.mtx.Lock()
 	c.jobs[job.ID] = job
+	c.jobEvents = append(c.jobEvents, job)
 	c.mtx.Unlock()
 	return nil
 }
 
+func (c *fakeControllerClient) JobList(appID string) ([]*ct.Job, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var jobs []*ct.Job
+	for _, job := range c.jobs {
+		if job.AppID == appID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (c *fakeControllerClient) SchedulerConfig() (*ct.SchedulerConfig, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.configErrs > 0 {
+		c.configErrs--
+		return nil, errors.New("controller unavailable")
+	}
+	if c.config == nil {
+		return &ct.SchedulerConfig{}, nil
+	}
+	conf := *c.config
+	return &conf, nil
+}
+
+func (c *fakeControllerClient) PutPendingJobs(appID string, jobs []*ct.PendingJob) error {
+	c.mtx.Lock()
+	c.pendingJobs[appID] = jobs
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *fakeControllerClient) AddClusterEvent(e *ct.ClusterEvent) error {
+	c.mtx.Lock()
+	e.ID = int64(len(c.events) + 1)
+	c.events = append(c.events, e)
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *fakeControllerClient) clusterEvents() []*ct.ClusterEvent {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return append([]*ct.ClusterEvent(nil), c.events...)
+}
+
+func (c *fakeControllerClient) GetSecret(appID, name string) (string, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if value, ok := c.secrets[name]; ok {
+		return value, nil
+	}
+	return "", controller.ErrNotFound
+}
+
 func (c *fakeControllerClient) setFormationStream(s chan *ct.ExpandedFormation) {
 	c.stream = s
 }
@@ -134,6 +207,17 @@ func waitForWatchHostStart(events <-chan *host.Event, c *C) {
 	}
 }
 
+func waitForCondition(c *C, desc string, f func() bool) {
+	timeout := time.After(time.Second)
+	for !f() {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			c.Fatalf("timed out waiting for %s", desc)
+		}
+	}
+}
+
 func newRelease(id string, artifact *ct.Artifact, processes map[string]int) *ct.Release {
 	processTypes := make(map[string]ct.ProcessType, len(processes))
 	for t := range processes {
@@ -337,6 +421,88 @@ func (s *S) TestOmni(c *C) {
 	c.Assert(len(host2.Jobs), Equals, 1)
 }
 
+func (s *S) TestOmniRebalance(c *C) {
+	// Run the scheduler against a fake cluster which starts with two hosts
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	release := &ct.Release{
+		ID:         "release",
+		ArtifactID: artifact.ID,
+		Processes: map[string]ct.ProcessType{
+			"web":    {Cmd: []string{"start", "web"}, Omni: true},
+			"worker": {Cmd: []string{"start", "worker"}},
+		},
+	}
+	processes := map[string]int{"web": 1, "worker": 1}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+	c.Assert(cl.Size(), Equals, 2)
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil
+	})
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+
+	// countJobs returns the number of jobs of each type running on a host
+	countJobs := func(hostID string) map[string]int {
+		counts := make(map[string]int)
+		for _, job := range cl.GetHost(hostID).Jobs {
+			counts[job.Metadata["flynn-controller.type"]]++
+		}
+		return counts
+	}
+	workerHost := func() string {
+		hosts, _ := cl.ListHosts()
+		for id := range hosts {
+			if countJobs(id)["worker"] > 0 {
+				return id
+			}
+		}
+		return ""
+	}
+	for _, id := range []string{"host0", "host1"} {
+		c.Assert(countJobs(id)["web"], Equals, 1)
+	}
+	c.Assert(workerHost(), Not(Equals), "")
+
+	// A new host should get an omni job
+	cl.BootHost("host2")
+	c.Assert(cl.Size(), Equals, 3)
+	waitForCondition(c, "omni job on new host", func() bool {
+		return countJobs("host2")["web"] == 1
+	})
+
+	// Removing the host running the worker should reschedule the worker on
+	// one of the remaining hosts and leave one omni job per host
+	removed := workerHost()
+	c.Assert(cl.RemoveHost(removed), IsNil)
+	c.Assert(cl.Size(), Equals, 2)
+	waitForCondition(c, "worker to be rescheduled", func() bool {
+		id := workerHost()
+		return id != "" && id != removed
+	})
+	hosts, err := cl.ListHosts()
+	c.Assert(err, IsNil)
+	for id := range hosts {
+		c.Assert(countJobs(id)["web"], Equals, 1)
+	}
+}
+
 func (s *S) TestWatchHost(c *C) {
 	// Create a fake cluster with an existing running formation and a one-off job
 	appID := "app"
@@ -438,6 +604,7 @@ func (s *S) TestJobRestartBackoffPolicy(c *C) {
 
 	durations := make([]time.Duration, 0)
 	timeAfterFunc = testAfterFunc(&durations)
+	defer func() { timeAfterFunc = time.AfterFunc }()
 
 	// First restart: scheduled immediately
 	cl.RemoveJob(hostID, "job0", false)
@@ -463,3 +630,2255 @@ func (s *S) TestJobRestartBackoffPolicy(c *C) {
 	waitForJobStartEvent(events, c)
 	c.Assert(len(durations), Equals, 2)
 }
+
+func (s *S) TestClusterBackoffPeriod(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// the scheduler uses the backoff period of the cluster, and restarts
+	// are delayed by it in real time
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, processes, nil)
+	period := 200 * time.Millisecond
+	cl.SetBackoffPeriod(period)
+
+	cx := newContext(cc, cl)
+	c.Assert(cx.Config().BackoffPeriod, Equals, period)
+	events := make(chan *host.Event, 10)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	// the first restart is immediate
+	cl.RemoveJob(hostID, "job0", false)
+	e := waitForJobStartEvent(events, c)
+
+	// the second waits for the backoff period
+	crashed := time.Now()
+	cl.RemoveJob(hostID, e.JobID, false)
+	waitForJobStartEvent(events, c)
+	elapsed := time.Since(crashed)
+	c.Assert(elapsed >= period, Equals, true, Commentf("restarted after %s", elapsed))
+	c.Assert(elapsed < 10*period, Equals, true, Commentf("restarted after %s", elapsed))
+}
+
+func (s *S) TestJobExitState(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cl := newFakeCluster("host0", appID, release.ID, processes, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 10)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	durations := make([]time.Duration, 0)
+	timeAfterFunc = testAfterFunc(&durations)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	jobState := func(id string, state string, exitStatus int) func() bool {
+		return func() bool {
+			cc.mtx.RLock()
+			defer cc.mtx.RUnlock()
+			job, ok := cc.jobs[id]
+			if !ok || job.State != state {
+				return false
+			}
+			return state == "up" || job.ExitStatus != nil && *job.ExitStatus == exitStatus
+		}
+	}
+	waitForCondition(c, "job0 to be recorded as up", jobState("host0-job0", "up", 0))
+	waitForCondition(c, "job1 to be recorded as up", jobState("host0-job1", "up", 0))
+
+	// a job which exits nonzero is recorded as crashed with its exit
+	// status, and one which exits zero as down
+	cl.ExitJob("host0", "job0", 1)
+	waitForCondition(c, "job to be recorded as crashed", jobState("host0-job0", "crashed", 1))
+	cl.ExitJob("host0", "job1", 0)
+	waitForCondition(c, "job to be recorded as down", jobState("host0-job1", "down", 0))
+
+	// a job the scheduler is stopping is down whatever its exit status
+	job := cx.jobs.Get("host0", waitForJobStartEvent(events, c).JobID)
+	c.Assert(job, NotNil)
+	job.setStopping()
+	cl.ExitJob("host0", job.ID, 143)
+	waitForCondition(c, "stopped job to be recorded as down", jobState("host0-"+job.ID, "down", 143))
+	waitForJobStartEvent(events, c)
+}
+
+func (s *S) TestRestartOnLastHost(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// both jobs run on host0, so a new job would be placed on host1
+	cl := newFakeCluster("host0", appID, release.ID, processes, nil)
+	cl.AddHost("host1", host.Host{ID: "host1"})
+	cl.SetHostClient("host1", tu.NewFakeHostClient("host1"))
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 10)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	waitForWatchHostStart(events, c)
+
+	durations := make([]time.Duration, 0)
+	timeAfterFunc = testAfterFunc(&durations)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	jobHost := func(id string) string {
+		for _, hostID := range []string{"host0", "host1"} {
+			for _, job := range cl.GetHost(hostID).Jobs {
+				if job.ID == id {
+					return hostID
+				}
+			}
+		}
+		return ""
+	}
+
+	// a crashed job is restarted on the host it ran on while it is
+	// still healthy
+	cl.ExitJob("host0", "job0", 1)
+	jobID := waitForJobStartEvent(events, c).JobID
+	c.Assert(jobHost(jobID), Equals, "host0")
+	cl.ExitJob("host0", jobID, 1)
+	jobID = waitForJobStartEvent(events, c).JobID
+	c.Assert(jobHost(jobID), Equals, "host0")
+
+	// a job which exits cleanly is placed like any other new job
+	cl.ExitJob("host0", jobID, 0)
+	jobID = waitForJobStartEvent(events, c).JobID
+	c.Assert(jobHost(jobID), Equals, "host1")
+}
+
+func (s *S) TestQuarantineCrashingJob(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.MaxCrashes = 3
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	durations := make([]time.Duration, 0)
+	timeAfterFunc = testAfterFunc(&durations)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	jobID := waitForJobStartEvent(events, c).JobID
+
+	// the job always exits 1, and is restarted until it has crashed three
+	// times
+	for i := 0; i < 2; i++ {
+		cl.ExitJob(hostID, jobID, 1)
+		jobID = waitForJobStartEvent(events, c).JobID
+	}
+	cl.ExitJob(hostID, jobID, 1)
+	waitForCondition(c, "job to be marked as failed", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		job, ok := cc.jobs[hostID+"-"+jobID]
+		return ok && job.State == "failed"
+	})
+
+	// the quarantined job is not replaced, even when rectifying
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+	f.Rectify()
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+
+	state := cx.Dump()
+	c.Assert(state.Jobs, HasLen, 1)
+	c.Assert(state.Jobs[0].ID, Equals, jobID)
+	c.Assert(state.Jobs[0].State, Equals, "failed")
+	c.Assert(state.Jobs[0].Reason, Equals, "crashed 3 times within 6h0m0s")
+
+	// clearing the quarantine starts a new job
+	srv := httptest.NewServer(cx)
+	defer srv.Close()
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/quarantine?app=%s&release=%s", srv.URL, appID, release.ID), nil)
+	c.Assert(err, IsNil)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	var cleared ct.QuarantineClear
+	c.Assert(json.NewDecoder(res.Body).Decode(&cleared), IsNil)
+	c.Assert(cleared.Cleared, Equals, 1)
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 1)
+	c.Assert(cx.Dump().Jobs[0].State, Not(Equals), "failed")
+
+	// the cleared job is no longer recorded as failed
+	cc.mtx.RLock()
+	c.Assert(cc.jobs[hostID+"-"+jobID].State, Equals, "down")
+	cc.mtx.RUnlock()
+}
+
+func (s *S) TestInitCmdFailureNotRestarted(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	jobID := waitForJobStartEvent(events, c).JobID
+
+	// the job's init command fails, which is permanent so the job is
+	// recorded as failed and not restarted
+	cl.InitFailJob(hostID, jobID, "init command exited with status 1")
+	waitForCondition(c, "job to be marked as failed", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		job, ok := cc.jobs[hostID+"-"+jobID]
+		return ok && job.State == "failed"
+	})
+	waitForCondition(c, "job to be failed in the formation", func() bool {
+		state := cx.Dump()
+		return len(state.Jobs) == 1 && state.Jobs[0].State == "failed"
+	})
+	c.Assert(cx.Dump().Jobs[0].Reason, Equals, "init command exited with status 1")
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+	f.Rectify()
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+
+	// clearing the failed job starts a new one
+	c.Assert(f.ClearQuarantine("web"), Equals, 1)
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 1)
+}
+
+func (s *S) TestQuarantineRestored(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	// the job was quarantined by a previous scheduler
+	hostID := "host0"
+	cc.PutJob(&ct.Job{ID: hostID + "-job0", AppID: appID, ReleaseID: release.ID, Type: "web", State: "failed"})
+
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent)
+	defer close(events)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}
+	waitForFormationEvent(events, c)
+
+	// the quarantined job is not replaced
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+	state := cx.Dump()
+	c.Assert(state.Jobs, HasLen, 1)
+	c.Assert(state.Jobs[0].ID, Equals, "job0")
+	c.Assert(state.Jobs[0].State, Equals, "failed")
+
+	// clearing the quarantine starts a new job
+	c.Assert(cx.formations.Get(appID, release.ID).ClearQuarantine(""), Equals, 1)
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 1)
+}
+
+func (s *S) TestMultipleArtifacts(c *C) {
+	// Create a fake cluster with an existing web job from a release that
+	// also runs a sidecar process from a second artifact
+	appID := "app"
+	artifact := &ct.Artifact{ID: "busybox", Type: "docker", URI: "docker://flynn/busybox"}
+	sidecar := &ct.Artifact{ID: "sidecar", Type: "docker", URI: "docker://flynn/sidecar"}
+	processes := map[string]int{"web": 1, "logger": 1}
+	release := newRelease("release", artifact, processes)
+	logger := release.Processes["logger"]
+	logger.Artifact = sidecar.ID
+	release.Processes["logger"] = logger
+
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cc.artifacts[sidecar.ID] = sidecar
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, map[string]int{"web": 1}, nil)
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	formation := cx.formations.Get(appID, release.ID)
+	c.Assert(formation, NotNil)
+	c.Assert(formation.Artifact, DeepEquals, artifact)
+	c.Assert(formation.Artifacts, DeepEquals, map[string]*ct.Artifact{sidecar.ID: sidecar})
+
+	// Check the logger process is started from the sidecar artifact
+	var jobs []*host.Job
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if jobs = cl.GetHost(hostID).Jobs; len(jobs) == 2 {
+			break
+		}
+	}
+	c.Assert(jobs, HasLen, 2)
+	c.Assert(jobs[1].Metadata["flynn-controller.type"], Equals, "logger")
+	c.Assert(jobs[1].Artifact.URI, Equals, sidecar.URI)
+
+	// Check each process type is started from the correct artifact
+	formation.SetProcesses(map[string]int{"web": 2, "logger": 2})
+	formation.Rectify()
+
+	uris := make(map[string]int)
+	for _, job := range cl.GetHost(hostID).Jobs[1:] {
+		uris[job.Metadata["flynn-controller.type"]+" "+job.Artifact.URI]++
+	}
+	c.Assert(uris, DeepEquals, map[string]int{
+		"web " + artifact.URI:   1,
+		"logger " + sidecar.URI: 2,
+	})
+}
+
+func (s *S) TestDrainHost(c *C) {
+	// Create a fake cluster with a host running several jobs and a one-off job
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2, "worker": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.Priority = 10
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	jobMeta := func(typ string) map[string]string {
+		meta := map[string]string{"flynn-controller.app": appID, "flynn-controller.release": release.ID}
+		if typ != "" {
+			meta["flynn-controller.type"] = typ
+		}
+		return meta
+	}
+	host0ID := "host0"
+	cl := newFakeCluster(host0ID, appID, release.ID, nil, []*host.Job{
+		{ID: "worker0", Metadata: jobMeta("worker")},
+		{ID: "web0", Metadata: jobMeta("web")},
+		{ID: "web1", Metadata: jobMeta("web")},
+		{ID: "one-off", Metadata: jobMeta("")},
+	})
+	hc0 := tu.NewFakeHostClient(host0ID)
+	cl.SetHostClient(host0ID, hc0)
+	host1ID := "host1"
+	cl.AddHost(host1ID, host.Host{ID: host1ID})
+	cl.SetHostClient(host1ID, tu.NewFakeHostClient(host1ID))
+
+	// Record which jobs were down when host0 registered as draining
+	downJobs := -1
+	hc0.SetDrainingFunc(func(draining bool) error {
+		if !draining {
+			return nil
+		}
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		downJobs = 0
+		for _, job := range cc.jobEvents {
+			if job.State == "down" {
+				downJobs++
+			}
+		}
+		return nil
+	})
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	waitForWatchHostStart(events, c)
+
+	killed, err := cx.DrainHost(host0ID, -1)
+	c.Assert(err, IsNil)
+	c.Assert(killed, HasLen, 0)
+
+	// Check host0 registered as draining before any jobs were stopped
+	c.Assert(hc0.IsDraining(), Equals, true)
+	c.Assert(downJobs, Equals, 0)
+
+	// Check the jobs moved to host1 and the one-off job was left running
+	host0 := cl.GetHost(host0ID)
+	c.Assert(host0.Jobs, HasLen, 1)
+	c.Assert(host0.Jobs[0].ID, Equals, "one-off")
+	types := make(map[string]int)
+	for _, job := range cl.GetHost(host1ID).Jobs {
+		types[job.Metadata["flynn-controller.type"]]++
+	}
+	c.Assert(types, DeepEquals, processes)
+
+	// Check each job came up on host1 before an original went down, with the
+	// high priority jobs migrating first
+	var up, down int
+	var order []string
+	for start := time.Now(); down < 3 && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		up, down, order = 0, 0, nil
+		cc.mtx.RLock()
+		for _, job := range cc.jobEvents {
+			switch {
+			case job.State == "up" && strings.HasPrefix(job.ID, host1ID):
+				up++
+				order = append(order, job.Type)
+			case job.State == "down" && strings.HasPrefix(job.ID, host0ID):
+				down++
+				c.Assert(up >= down, Equals, true, Commentf("job %s went down before its replacement was up", job.ID))
+			}
+		}
+		cc.mtx.RUnlock()
+	}
+	c.Assert(up, Equals, 3)
+	c.Assert(down, Equals, 3)
+	c.Assert(order, DeepEquals, []string{"web", "web", "worker"})
+
+	// Check new jobs are not placed on the drained host
+	formation := cx.formations.Get(appID, release.ID)
+	formation.SetProcesses(map[string]int{"web": 3, "worker": 1})
+	formation.Rectify()
+	c.Assert(cl.GetHost(host0ID).Jobs, HasLen, 1)
+	c.Assert(cl.GetHost(host1ID).Jobs, HasLen, 4)
+
+	// Check undraining the host over HTTP lets jobs be placed on it again
+	srv := httptest.NewServer(cx)
+	defer srv.Close()
+	undrain := func() int {
+		req, err := http.NewRequest("DELETE", srv.URL+"/drain?host="+host0ID, nil)
+		c.Assert(err, IsNil)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	c.Assert(undrain(), Equals, 200)
+	c.Assert(cx.isDraining(host0ID), Equals, false)
+	c.Assert(hc0.IsDraining(), Equals, false)
+	c.Assert(undrain(), Equals, 404)
+	formation.SetProcesses(map[string]int{"web": 4, "worker": 1})
+	formation.Rectify()
+	c.Assert(cl.GetHost(host0ID).Jobs, HasLen, 2)
+}
+
+func (s *S) TestDrainHostOneOffGrace(c *C) {
+	// host0 runs a one-off job which finishes during the drain, host1 one
+	// which never finishes
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	release := newRelease("release", artifact, nil)
+	cc := newFakeControllerClient(appID, release, artifact, nil, nil)
+	meta := map[string]string{"flynn-controller.app": appID, "flynn-controller.release": release.ID}
+	cl := newFakeCluster("host0", appID, release.ID, nil, []*host.Job{{ID: "migration", Metadata: meta}})
+	cl.AddHost("host1", host.Host{ID: "host1", Jobs: []*host.Job{{ID: "stuck", Metadata: meta}}})
+	hc1 := tu.NewFakeHostClient("host1")
+	cl.SetHostClient("host1", hc1)
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	waitForWatchHostStart(events, c)
+
+	// the drain waits for the migration to finish, well within the grace
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cl.RemoveJob("host0", "migration", false)
+	}()
+	start := time.Now()
+	killed, err := cx.DrainHost("host0", 10*time.Second)
+	c.Assert(err, IsNil)
+	elapsed := time.Since(start)
+	c.Assert(killed, HasLen, 0)
+	c.Assert(elapsed >= 100*time.Millisecond, Equals, true, Commentf("drain returned after %s", elapsed))
+	c.Assert(elapsed < 10*time.Second, Equals, true, Commentf("drain returned after %s", elapsed))
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(cl.RemoveHost("host0"), IsNil)
+
+	// a one-off job started after the cluster was synced is also waited for
+	_, err = cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{"host1": {{ID: "late", Metadata: meta}}}})
+	c.Assert(err, IsNil)
+
+	// the stuck and late jobs are stopped once the grace expires, and
+	// reported, draining over HTTP as the controller does
+	srv := httptest.NewServer(cx)
+	defer srv.Close()
+	drain := func(hostID string, grace time.Duration) *http.Response {
+		data, err := json.Marshal(&ct.HostDrain{HostID: hostID, OneOffGrace: grace})
+		c.Assert(err, IsNil)
+		res, err := http.Post(srv.URL+"/drain", "application/json", bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		return res
+	}
+	res := drain("host1", 50*time.Millisecond)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	result := &ct.HostDrain{}
+	c.Assert(json.NewDecoder(res.Body).Decode(result), IsNil)
+	c.Assert(result.Killed, DeepEquals, []string{"host1-late", "host1-stuck"})
+	c.Assert(hc1.IsStopped("stuck"), Equals, true)
+	c.Assert(hc1.IsStopped("late"), Equals, true)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 0)
+
+	// draining a host which is removed stops waiting for its jobs
+	cl.AddHost("host2", host.Host{ID: "host2", Jobs: []*host.Job{{ID: "stuck", Metadata: meta}}})
+	cl.SetHostClient("host2", tu.NewFakeHostClient("host2"))
+	cl.SendEvent("host2", "add")
+	waitForCondition(c, "host2 to be watched", func() bool { return cx.hosts.Get("host2") != nil })
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cl.RemoveHost("host2")
+	}()
+	start = time.Now()
+	killed, err = cx.DrainHost("host2", 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(killed, HasLen, 0)
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	waitForCondition(c, "host2 to stop draining", func() bool { return !cx.isDraining("host2") })
+	c.Assert(cx.isDraining("host0"), Equals, false)
+
+	_, err = cx.DrainHost("host3", time.Second)
+	c.Assert(err, NotNil)
+	res = drain("host3", time.Second)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestLoadDraining(c *C) {
+	// a new leader finds the hosts which registered as draining under the
+	// previous one
+	defer func(f func() ([]string, error)) { drainingHosts = f }(drainingHosts)
+	drainingHosts = func() ([]string, error) { return []string{"host1"}, nil }
+
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	release := newRelease("release", artifact, nil)
+	cc := newFakeControllerClient(appID, release, artifact, nil, nil)
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	hc1 := tu.NewFakeHostClient("host1")
+	c.Assert(hc1.SetDraining(true), IsNil)
+	cl.AddHost("host1", host.Host{ID: "host1"})
+	cl.SetHostClient("host1", hc1)
+
+	cx := newContext(cc, cl)
+	cx.loadDraining()
+	c.Assert(cx.isDraining("host0"), Equals, false)
+	c.Assert(cx.isDraining("host1"), Equals, true)
+
+	// the host can be undrained by the new leader
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	waitForWatchHostStart(events, c)
+	c.Assert(cx.UndrainHost("host1"), Equals, true)
+	c.Assert(cx.isDraining("host1"), Equals, false)
+	c.Assert(hc1.IsDraining(), Equals, false)
+}
+
+func (s *S) TestPendingJobs(c *C) {
+	// Create a fake cluster with a host which only has enough memory for two
+	// web jobs
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 4}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.Resources = &ct.JobResources{Memory: 512 * 1024}
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := tu.NewFakeCluster()
+	cl.SetHosts(map[string]host.Host{hostID: {ID: hostID, Resources: host.JobResources{Memory: 1024 * 1024}}})
+	cl.SetHostClient(hostID, tu.NewFakeHostClient(hostID))
+
+	cx := newContext(cc, cl)
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+
+	// Check the excess jobs are pending with a resource reason
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 2)
+	cc.mtx.RLock()
+	pending := cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 2)
+	for _, job := range pending {
+		c.Assert(job.ReleaseID, Equals, release.ID)
+		c.Assert(job.Type, Equals, "web")
+		c.Assert(job.Reason, Equals, ct.PlacementReasonResources)
+		c.Assert(job.CreatedAt, NotNil)
+	}
+
+	// Check jobs which are still pending keep their original pending time
+	createdAt := pending[0].CreatedAt
+	f.SetProcesses(map[string]int{"web": 3})
+	f.Rectify()
+	cc.mtx.RLock()
+	pending = cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 1)
+	c.Assert(pending[0].CreatedAt, Equals, createdAt)
+
+	// Check scaling down clears the pending jobs
+	f.SetProcesses(map[string]int{"web": 2})
+	f.Rectify()
+	cc.mtx.RLock()
+	pending = cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 0)
+}
+
+func (s *S) TestDefaultResources(c *C) {
+	// Create a release with a default memory limit which the worker process
+	// overrides
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1, "worker": 1, "clock": 1}
+	release := newRelease("release", artifact, processes)
+	release.Resources = &ct.JobResources{Memory: 256 * 1024}
+	worker := release.Processes["worker"]
+	worker.Resources = &ct.JobResources{Memory: 1024 * 1024}
+	release.Processes["worker"] = worker
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+
+	memory := make(map[string]int)
+	for _, job := range cl.GetHost(hostID).Jobs {
+		memory[job.Metadata["flynn-controller.type"]] = job.Resources.Memory
+	}
+	c.Assert(memory, DeepEquals, map[string]int{
+		"web":    256 * 1024,
+		"worker": 1024 * 1024,
+		"clock":  256 * 1024,
+	})
+}
+
+func (s *S) TestDeviceResources(c *C) {
+	// Create a fake cluster with two hosts which have a GPU each and a host
+	// with no GPUs
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"train": 1}
+	release := newRelease("release", artifact, processes)
+	train := release.Processes["train"]
+	train.Resources = &ct.JobResources{Devices: map[string]int{"gpu": 1}}
+	release.Processes["train"] = train
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	gpuHosts := map[string]bool{"host0": true, "host1": true, "host2": false}
+	cl := tu.NewFakeCluster()
+	hosts := make(map[string]host.Host, len(gpuHosts))
+	for id, gpu := range gpuHosts {
+		h := host.Host{ID: id}
+		if gpu {
+			h.Resources.Devices = map[string]int{"gpu": 1}
+		}
+		hosts[id] = h
+	}
+	cl.SetHosts(hosts)
+	for id := range gpuHosts {
+		cl.SetHostClient(id, tu.NewFakeHostClient(id))
+	}
+
+	cx := newContext(cc, cl)
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+
+	gpuJobs := func() map[string]int {
+		jobs := make(map[string]int)
+		for id := range gpuHosts {
+			for _, job := range cl.GetHost(id).Jobs {
+				c.Assert(job.Resources.Devices, DeepEquals, map[string]int{"gpu": 1})
+				jobs[id]++
+			}
+		}
+		return jobs
+	}
+
+	// Check the job is placed on a GPU host
+	jobs := gpuJobs()
+	c.Assert(jobs, HasLen, 1)
+	for id := range jobs {
+		c.Assert(gpuHosts[id], Equals, true)
+	}
+
+	// Check a second job is placed on the other GPU host
+	f.SetProcesses(map[string]int{"train": 2})
+	f.Rectify()
+	c.Assert(gpuJobs(), DeepEquals, map[string]int{"host0": 1, "host1": 1})
+
+	// Check a third job waits for a GPU rather than running on the host
+	// without one
+	f.SetProcesses(map[string]int{"train": 3})
+	f.Rectify()
+	c.Assert(gpuJobs(), DeepEquals, map[string]int{"host0": 1, "host1": 1})
+	cc.mtx.RLock()
+	pending := cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 1)
+	c.Assert(pending[0].Type, Equals, "train")
+	c.Assert(pending[0].Reason, Equals, ct.PlacementReasonResources)
+}
+
+func (s *S) TestSecrets(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	release.Env = map[string]string{"DB_PASSWORD": ct.SecretRefPrefix + "db-password"}
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+
+	// Check the job is pending while the secret doesn't exist
+	f.Rectify()
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 0)
+	cc.mtx.RLock()
+	pending := cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 1)
+	c.Assert(pending[0].Reason, Equals, ct.PlacementReasonSecret)
+
+	// Check the job is started with the secret value, which is not stored
+	// in the release
+	cc.mtx.Lock()
+	cc.secrets["db-password"] = "s3cret"
+	cc.mtx.Unlock()
+	f.Rectify()
+	jobs := cl.GetHost(hostID).Jobs
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Config.Env["DB_PASSWORD"], Equals, "s3cret")
+	c.Assert(release.Env["DB_PASSWORD"], Equals, ct.SecretRefPrefix+"db-password")
+}
+
+func (s *S) TestHealthCheckStartupProbing(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.HealthCheck = &ct.HealthCheck{Type: "tcp", Port: 8080, Interval: 10 * time.Second}
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// Mock the clock so each wait between probes advances it immediately,
+	// with the service becoming ready 500ms after starting
+	var mtx sync.Mutex
+	var elapsed time.Duration
+	var delays []time.Duration
+	var addrs []string
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		elapsed += d
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	healthCheckProbe = func(check *ct.HealthCheck, addr string) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		addrs = append(addrs, addr)
+		if elapsed < 500*time.Millisecond {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	waitForJobStartEvent(events, c)
+
+	waitForCondition(c, "job to be up", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		for _, job := range cc.jobEvents {
+			if job.State == "up" {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Check the job was probed with exponentially increasing delays, being
+	// marked as up long before the steady state interval
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Assert(delays, DeepEquals, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+	})
+	c.Assert(elapsed < web.HealthCheck.Interval, Equals, true)
+	c.Assert(addrs, HasLen, 4)
+	c.Assert(addrs[0], Equals, "127.0.0.1:8080")
+}
+
+// startupGraceTest runs a web job with a health check and the given startup
+// grace, whose service becomes healthy once ready of probing has passed on
+// a mocked clock, or never if ready is zero, and whose probes each take probe
+// on the clock. It returns functions which return the backoff delays of
+// restarts after the first and the number of probes made.
+func startupGraceTest(c *C, grace, ready, probe time.Duration) (*fakeControllerClient, *tu.FakeCluster, func() []time.Duration, func() int) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.HealthCheck = &ct.HealthCheck{Type: "tcp", Port: 8080, Interval: 10 * time.Second}
+	web.StartupGrace = grace
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// each wait between probes and each probe advances the clock
+	var mtx sync.Mutex
+	var elapsed time.Duration
+	var probes int
+	start := time.Now()
+	timeNow = func() time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return start.Add(elapsed)
+	}
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		elapsed += d
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	healthCheckProbe = func(check *ct.HealthCheck, addr string) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		probes++
+		elapsed += probe
+		if ready == 0 || elapsed < ready {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+	// restarts after the first are recorded rather than run
+	var restarts []time.Duration
+	timeAfterFunc = func(d time.Duration, f func()) *time.Timer {
+		mtx.Lock()
+		defer mtx.Unlock()
+		restarts = append(restarts, d)
+		return nil
+	}
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	return cc, cl, func() []time.Duration {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return restarts
+		}, func() int {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return probes
+		}
+}
+
+func (s *S) TestHealthCheckStartupGrace(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+	defer func() { timeNow = time.Now }()
+
+	// a slow starter which is only healthy after 30s is left to start
+	cc, cl, _, _ := startupGraceTest(c, time.Minute, 30*time.Second, 0)
+	waitForCondition(c, "job to be up", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		for _, job := range cc.jobEvents {
+			if job.State == "up" {
+				return true
+			}
+		}
+		return false
+	})
+	jobs := cl.GetHost("host0").Jobs
+	c.Assert(jobs, HasLen, 1)
+	cc.mtx.RLock()
+	for _, job := range cc.jobEvents {
+		c.Assert(job.ID, Equals, "host0-"+jobs[0].ID, Commentf("the job was restarted"))
+		c.Assert(job.State, Not(Equals), "crashed")
+	}
+	cc.mtx.RUnlock()
+}
+
+func (s *S) TestHealthCheckStartupGraceExpired(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+	defer func() { timeNow = time.Now }()
+
+	// a job which is still unhealthy after the grace is restarted as if it
+	// had crashed, the replacement backing off once it fails too
+	cc, _, restarts, _ := startupGraceTest(c, 5*time.Second, 0, 0)
+	waitForCondition(c, "replacement to fail", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		crashed := 0
+		for _, job := range cc.jobEvents {
+			if job.State == "crashed" {
+				crashed++
+			}
+		}
+		return crashed == 2
+	})
+	c.Assert(restarts(), DeepEquals, []time.Duration{backoffPeriod})
+}
+
+func (s *S) TestHealthCheckStartupGraceSlowProbe(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+	defer func() { timeNow = time.Now }()
+
+	// the time spent in probes counts towards the grace, so a job whose
+	// probes time out after 10s fails a 5s grace after its first probe
+	cc, _, _, probes := startupGraceTest(c, 5*time.Second, 0, 10*time.Second)
+	waitForCondition(c, "job to fail", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		for _, job := range cc.jobEvents {
+			if job.State == "crashed" {
+				return true
+			}
+		}
+		return false
+	})
+	c.Assert(probes() <= 2, Equals, true, Commentf("made %d probes", probes()))
+}
+
+func (s *S) TestHealthCheckProbeBackoff(c *C) {
+	check := &ct.HealthCheck{Type: "tcp", Port: 8080, Interval: time.Second}
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.HealthCheck = check
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// Check a slow service is probed at most once per interval
+	var mtx sync.Mutex
+	var delays []time.Duration
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	timeAfter = func(d time.Duration) <-chan time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	healthCheckProbe = func(*ct.HealthCheck, string) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if len(delays) < 8 {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	job := waitForJobStartEvent(events, c)
+	<-cx.jobs.Get(hostID, job.JobID).up
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Assert(delays, DeepEquals, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+		time.Second,
+		time.Second,
+	})
+}
+
+// healthThresholdTest runs a web job whose health check has the given
+// thresholds, returning the results of the probes from probe, which is
+// passed the number of earlier probes. Waits between probes return
+// immediately.
+func healthThresholdTest(c *C, healthy, unhealthy int, probe func(n int) error) (*fakeControllerClient, *tu.FakeCluster) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.HealthCheck = &ct.HealthCheck{Type: "tcp", Port: 8080, HealthyThreshold: healthy, UnhealthyThreshold: unhealthy}
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	var mtx sync.Mutex
+	var probes int
+	timeAfter = func(time.Duration) <-chan time.Time {
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	healthCheckProbe = func(*ct.HealthCheck, string) error {
+		mtx.Lock()
+		n := probes
+		probes++
+		mtx.Unlock()
+		return probe(n)
+	}
+	// restarts are recorded rather than run
+	timeAfterFunc = func(time.Duration, func()) *time.Timer { return nil }
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	return cc, cl
+}
+
+func (s *S) TestHealthCheckIntermittentFailures(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	// the check of the up job fails twice then passes twice, never
+	// reaching the unhealthy threshold of three failures in a row as it
+	// recovers each time, until probing is held once enough probes have run
+	held := make(chan struct{})
+	var heldOnce sync.Once
+	cc, cl := healthThresholdTest(c, 2, 3, func(n int) error {
+		switch {
+		case n < 2:
+			return nil
+		case n >= 50:
+			heldOnce.Do(func() { close(held) })
+			select {}
+		case (n-2)%4 < 2:
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	})
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for health probes")
+	}
+
+	jobs := cl.GetHost("host0").Jobs
+	c.Assert(jobs, HasLen, 1)
+	cc.mtx.RLock()
+	var up bool
+	for _, job := range cc.jobEvents {
+		c.Assert(job.ID, Equals, "host0-"+jobs[0].ID, Commentf("the job was restarted"))
+		c.Assert(job.State, Not(Equals), "crashed")
+		up = up || job.State == "up"
+	}
+	cc.mtx.RUnlock()
+	c.Assert(up, Equals, true)
+}
+
+func (s *S) TestHealthCheckUnhealthyThreshold(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	// a job which passes its first probes then fails three in a row is
+	// restarted as if it had crashed, probing of the replacement is held
+	held := make(chan struct{})
+	cc, cl := healthThresholdTest(c, 1, 3, func(n int) error {
+		switch {
+		case n < 5:
+			return nil
+		case n == 8:
+			close(held)
+			select {}
+		}
+		return fmt.Errorf("connection refused")
+	})
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the replacement to be probed")
+	}
+
+	// the host only has the replacement, the stopped job having crashed
+	jobs := cl.GetHost("host0").Jobs
+	c.Assert(jobs, HasLen, 1)
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	var crashed []string
+	for _, job := range cc.jobEvents {
+		if job.State == "crashed" {
+			crashed = append(crashed, job.ID)
+		}
+	}
+	c.Assert(crashed, HasLen, 1)
+	c.Assert(crashed[0], Not(Equals), "host0-"+jobs[0].ID)
+}
+
+func (s *S) TestHealthCheckRecoveryThreshold(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	// a single passing probe between failures is less than the healthy
+	// threshold, so the job does not recover and is restarted once the
+	// failures reach the unhealthy threshold
+	held := make(chan struct{})
+	cc, cl := healthThresholdTest(c, 2, 3, func(n int) error {
+		switch {
+		case n < 2 || n == 4:
+			return nil
+		case n == 6:
+			close(held)
+			select {}
+		}
+		return fmt.Errorf("connection refused")
+	})
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the replacement to be probed")
+	}
+
+	jobs := cl.GetHost("host0").Jobs
+	c.Assert(jobs, HasLen, 1)
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	var crashed []string
+	for _, job := range cc.jobEvents {
+		if job.State == "crashed" {
+			crashed = append(crashed, job.ID)
+		}
+	}
+	c.Assert(crashed, HasLen, 1)
+	c.Assert(crashed[0], Not(Equals), "host0-"+jobs[0].ID)
+}
+
+func (s *S) TestHealthCheckAdoptedJob(c *C) {
+	defer func(f func(time.Duration) <-chan time.Time) { timeAfter = f }(timeAfter)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	defer func() { timeAfterFunc = time.AfterFunc }()
+
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.HealthCheck = &ct.HealthCheck{Type: "tcp", Port: 8080, UnhealthyThreshold: 2}
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	timeAfter = func(time.Duration) <-chan time.Time {
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	// the adopted job fails its probes once its host is being watched,
+	// probing of the replacement is held
+	watching := make(chan struct{})
+	held := make(chan struct{})
+	var heldOnce sync.Once
+	healthCheckProbe = func(_ *ct.HealthCheck, addr string) error {
+		if addr != "10.0.0.2:8080" {
+			heldOnce.Do(func() { close(held) })
+			select {}
+		}
+		<-watching
+		return fmt.Errorf("connection refused")
+	}
+	timeAfterFunc = func(_ time.Duration, f func()) *time.Timer {
+		f()
+		return nil
+	}
+
+	// the job was running before the scheduler started
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, processes, nil)
+	h, err := cl.DialHost(hostID)
+	c.Assert(err, IsNil)
+	h.(*tu.FakeHostClient).SetInternalIP("job0", "10.0.0.2")
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	close(watching)
+
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the replacement to be probed")
+	}
+
+	// the adopted job crashed once it reached the unhealthy threshold
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	var crashed []string
+	for _, job := range cc.jobEvents {
+		if job.State == "crashed" {
+			crashed = append(crashed, job.ID)
+		}
+	}
+	c.Assert(crashed, DeepEquals, []string{"host0-job0"})
+}
+
+func (s *S) TestStartConcurrency(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 10}
+	release := newRelease("release", artifact, processes)
+	web := release.Processes["web"]
+	web.StartConcurrency = 2
+	web.HealthCheck = &ct.HealthCheck{Type: "tcp", Port: 8080}
+	release.Processes["web"] = web
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// Mock the health check so that each started job stays starting until
+	// the test lets its probe pass
+	probes := make(chan chan struct{}, 10)
+	defer func(f func(*ct.HealthCheck, string) error) { healthCheckProbe = f }(healthCheckProbe)
+	healthCheckProbe = func(*ct.HealthCheck, string) error {
+		pass := make(chan struct{})
+		probes <- pass
+		<-pass
+		return nil
+	}
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 100)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	jobStates := func() (total, starting int) {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		for _, job := range f.jobs["web"] {
+			if !job.isUp() {
+				starting++
+			}
+		}
+		return len(f.jobs["web"]), starting
+	}
+	f.Rectify()
+
+	// Check that jobs are started two at a time as each one comes up
+	for i := 0; i < 10; i++ {
+		var pass chan struct{}
+		select {
+		case pass = <-probes:
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for job %d to be probed", i)
+		}
+		_, starting := jobStates()
+		c.Assert(starting <= 2, Equals, true, Commentf("%d jobs starting", starting))
+		close(pass)
+	}
+	waitForCondition(c, "all jobs to be up", func() bool {
+		total, starting := jobStates()
+		return total == 10 && starting == 0
+	})
+	c.Assert(cl.GetHost(hostID).Jobs, HasLen, 10)
+}
+
+func (s *S) TestDump(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2, "worker": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	waitForHostEvents(3, events, c)
+
+	// scale the app up and check the dump reflects the new formation
+	f.SetProcesses(map[string]int{"web": 3, "worker": 1})
+	f.Rectify()
+	waitForHostEvents(1, events, c)
+
+	// fetch the dump over HTTP, as the controller does, which requires the
+	// auth key
+	srv := httptest.NewServer(authHandler("key", cx))
+	defer srv.Close()
+	for _, key := range []string{"", "wrong"} {
+		req, err := http.NewRequest("GET", srv.URL+"/dump", nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", key)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 401)
+	}
+	req, err := http.NewRequest("GET", srv.URL+"/dump", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", "key")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	state := &ct.SchedulerState{}
+	c.Assert(json.NewDecoder(res.Body).Decode(state), IsNil)
+
+	c.Assert(state.CreatedAt.IsZero(), Equals, false)
+	c.Assert(state.Hosts, DeepEquals, []*ct.SchedulerHost{{ID: hostID}})
+	c.Assert(state.Formations, DeepEquals, []*ct.SchedulerFormation{{
+		AppID:     appID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 3, "worker": 1},
+	}})
+	c.Assert(state.Jobs, HasLen, 4)
+	types := make(map[string]int)
+	hostJobs := make(map[string]struct{})
+	for _, job := range cl.GetHost(hostID).Jobs {
+		hostJobs[job.ID] = struct{}{}
+	}
+	for _, job := range state.Jobs {
+		c.Assert(job.HostID, Equals, hostID)
+		c.Assert(job.AppID, Equals, appID)
+		c.Assert(job.ReleaseID, Equals, release.ID)
+		c.Assert(job.State, Equals, "up")
+		c.Assert(job.Restarts, Equals, 0)
+		_, ok := hostJobs[job.ID]
+		c.Assert(ok, Equals, true, Commentf("job %s is not running on the host", job.ID))
+		types[job.Type]++
+	}
+	c.Assert(types, DeepEquals, map[string]int{"web": 3, "worker": 1})
+	c.Assert(state.Pending, HasLen, 0)
+
+	req, err = http.NewRequest("GET", srv.URL+"/foo", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", "key")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestConvergenceMetrics(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"echoer": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	srv := httptest.NewServer(cx)
+	defer srv.Close()
+	getMetrics := func() *ct.SchedulerMetrics {
+		res, err := http.Get(srv.URL + "/metrics")
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		metrics := &ct.SchedulerMetrics{}
+		c.Assert(json.NewDecoder(res.Body).Decode(metrics), IsNil)
+		return metrics
+	}
+	waitForConvergence := func(n int) *ct.SchedulerMetrics {
+		var metrics *ct.SchedulerMetrics
+		waitForCondition(c, "the formation to converge", func() bool {
+			metrics = getMetrics()
+			return metrics.Convergences == n
+		})
+		return metrics
+	}
+	c.Assert(getMetrics().Convergences, Equals, 0)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	waitForHostEvents(1, events, c)
+	waitForConvergence(1)
+
+	// scale up and check the time taken to converge is reported
+	const bound = 5 * time.Second
+	f.SetProcesses(map[string]int{"echoer": 5})
+	f.Rectify()
+	waitForHostEvents(4, events, c)
+	metrics := waitForConvergence(2)
+	c.Assert(metrics.Formations, HasLen, 1)
+	fc := metrics.Formations[0]
+	c.Assert(fc.AppID, Equals, appID)
+	c.Assert(fc.ReleaseID, Equals, release.ID)
+	c.Assert(fc.Processes, DeepEquals, map[string]int{"echoer": 5})
+	c.Assert(fc.Duration > 0, Equals, true)
+	c.Assert(fc.Duration < bound, Equals, true, Commentf("took %s to converge", fc.Duration))
+	c.Assert(metrics.LastConvergence, Equals, fc.Duration)
+	c.Assert(metrics.MaxConvergence >= fc.Duration, Equals, true)
+
+	// rectifying an unchanged formation does not record another convergence
+	f.SetProcesses(map[string]int{"echoer": 5})
+	f.Rectify()
+	c.Assert(getMetrics().Convergences, Equals, 2)
+}
+
+func (s *S) TestClusterEvents(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 0}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	// add a host, then scale up once it is being watched
+	cl.AddHost("host1", host.Host{ID: "host1"})
+	cl.SetHostClient("host1", tu.NewFakeHostClient("host1"))
+	cl.SendEvent("host1", "add")
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: map[string]int{"web": 2},
+	}))
+	f.Rectify()
+
+	var clusterEvents []*ct.ClusterEvent
+	waitForCondition(c, "the cluster events", func() bool {
+		clusterEvents = cc.clusterEvents()
+		return len(clusterEvents) == 4
+	})
+	for i, e := range clusterEvents {
+		c.Assert(e.ID, Equals, int64(i+1))
+	}
+	for i, hostID := range []string{"host0", "host1"} {
+		e := clusterEvents[i]
+		c.Assert(e.Type, Equals, ct.ClusterEventHost)
+		c.Assert(e.ObjectID, Equals, hostID)
+		data := &ct.ClusterHostEvent{}
+		c.Assert(json.Unmarshal(e.Data, data), IsNil)
+		c.Assert(data, DeepEquals, &ct.ClusterHostEvent{HostID: hostID, Event: "up"})
+	}
+	placed := make(map[string]struct{})
+	for _, e := range clusterEvents[2:] {
+		c.Assert(e.Type, Equals, ct.ClusterEventScheduler)
+		c.Assert(e.AppID, Equals, appID)
+		data := &ct.SchedulerDecision{}
+		c.Assert(json.Unmarshal(e.Data, data), IsNil)
+		c.Assert(data.Action, Equals, "place")
+		c.Assert(data.ReleaseID, Equals, release.ID)
+		c.Assert(data.Type, Equals, "web")
+		c.Assert(data.JobID, Equals, e.ObjectID)
+		placed[data.HostID] = struct{}{}
+	}
+	// the jobs are spread across both hosts
+	c.Assert(placed, HasLen, 2)
+}
+
+func (s *S) TestPinnedHosts(c *C) {
+	// Run the scheduler against a fake cluster with three hosts and a
+	// formation pinned to one of them
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 3}
+	release := newRelease("release", artifact, processes)
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+	cl.BootHost("host2")
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil && cx.hosts.Get("host2") != nil
+	})
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		Hosts:     []string{"host1"},
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+
+	// all of the jobs run on the pinned host
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 3)
+	c.Assert(cl.GetHost("host2").Jobs, HasLen, 0)
+
+	// removing the pinned host leaves the jobs pending rather than moving
+	// them to the other hosts
+	c.Assert(cl.RemoveHost("host1"), IsNil)
+	waitForCondition(c, "jobs to be pending", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		return len(cc.pendingJobs[appID]) == 3
+	})
+	cc.mtx.RLock()
+	for _, job := range cc.pendingJobs[appID] {
+		c.Assert(job.Reason, Equals, ct.PlacementReasonHosts)
+	}
+	cc.mtx.RUnlock()
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(cl.GetHost("host2").Jobs, HasLen, 0)
+}
+
+func (s *S) TestPinnedHostsChanged(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 3}
+	release := newRelease("release", artifact, processes)
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+	cl.BootHost("host2")
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil && cx.hosts.Get("host2") != nil
+	})
+
+	pin := func(hosts ...string) {
+		stream <- &ct.ExpandedFormation{
+			App:       &ct.App{ID: appID},
+			Release:   release,
+			Artifact:  artifact,
+			Processes: processes,
+			Hosts:     hosts,
+			UpdatedAt: time.Now(),
+		}
+		waitForFormationEvent(events, c)
+	}
+	pin("host1")
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 3)
+
+	// the jobs on the host which is no longer pinned are replaced on the
+	// newly pinned host
+	pin("host2")
+	waitForCondition(c, "jobs to move", func() bool {
+		return len(cl.GetHost("host1").Jobs) == 0 && len(cl.GetHost("host2").Jobs) == 3
+	})
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	f := cx.formations.Get(appID, release.ID)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	c.Assert(f.jobs["web"], HasLen, 3)
+	for _, job := range f.jobs["web"] {
+		c.Assert(job.HostID, Equals, "host2")
+	}
+}
+
+func (s *S) TestAntiAffinity(c *C) {
+	for _, t := range []struct {
+		affinity ct.AntiAffinity
+		running  int
+		pending  int
+	}{
+		// soft anti-affinity falls back to packing the third job
+		{ct.AntiAffinitySoft, 3, 0},
+		// hard anti-affinity leaves it pending instead
+		{ct.AntiAffinityHard, 2, 1},
+	} {
+		appID := "app"
+		artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+		processes := map[string]int{"web": 3}
+		release := newRelease("release", artifact, processes)
+		release.Processes["web"] = ct.ProcessType{Cmd: []string{"start", "web"}, AntiAffinity: t.affinity}
+		stream := make(chan *ct.ExpandedFormation)
+		cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+		cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+		cl.BootHost("host1")
+
+		cx := newContext(cc, cl)
+		events := make(chan *FormationEvent, 1)
+		go cx.watchFormations(events, nil)
+		waitForFormationEvent(events, c)
+		waitForCondition(c, "hosts to be watched", func() bool {
+			return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil
+		})
+
+		stream <- &ct.ExpandedFormation{
+			App:       &ct.App{ID: appID},
+			Release:   release,
+			Artifact:  artifact,
+			Processes: processes,
+			UpdatedAt: time.Now(),
+		}
+		waitForFormationEvent(events, c)
+
+		hostJobs := []int{len(cl.GetHost("host0").Jobs), len(cl.GetHost("host1").Jobs)}
+		c.Assert(hostJobs[0]+hostJobs[1], Equals, t.running, Commentf("affinity: %s", t.affinity))
+		if t.affinity == ct.AntiAffinityHard {
+			c.Assert(hostJobs, DeepEquals, []int{1, 1})
+		}
+		cc.mtx.RLock()
+		pending := cc.pendingJobs[appID]
+		cc.mtx.RUnlock()
+		c.Assert(pending, HasLen, t.pending, Commentf("affinity: %s", t.affinity))
+		for _, job := range pending {
+			c.Assert(job.Reason, Equals, ct.PlacementReasonAntiAffinity)
+		}
+	}
+}
+
+func (s *S) TestSpreadZones(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 4}
+	release := newRelease("release", artifact, processes)
+	release.Processes["web"] = ct.ProcessType{Cmd: []string{"start", "web"}, Spread: ct.SpreadZones}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	// zone a has two hosts and zone b has one
+	zones := map[string]string{"host0": "a", "host1": "a", "host2": "b"}
+	cl := tu.NewFakeCluster()
+	hosts := make(map[string]host.Host, len(zones))
+	for id, zone := range zones {
+		hosts[id] = host.Host{ID: id, Metadata: map[string]string{host.ZoneMetadataKey: zone}}
+	}
+	cl.SetHosts(hosts)
+	for id := range zones {
+		cl.SetHostClient(id, tu.NewFakeHostClient(id))
+	}
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil && cx.hosts.Get("host2") != nil
+	})
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+
+	// the jobs are balanced across the zones, and across the hosts within
+	// zone a, with zone b's share packed onto its only host
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 1)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 1)
+	c.Assert(cl.GetHost("host2").Jobs, HasLen, 2)
+}
+
+func (s *S) TestColocateWithService(c *C) {
+	// the helper service is registered on host1 only
+	instances := map[string][]string{}
+	defer func(f func(string) ([]string, error)) { serviceHosts = f }(serviceHosts)
+	var mtx sync.Mutex
+	serviceHosts = func(name string) ([]string, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return instances[name], nil
+	}
+
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2}
+	release := newRelease("release", artifact, processes)
+	release.Processes["web"] = ct.ProcessType{Cmd: []string{"start", "web"}, Colocate: "helper"}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil
+	})
+
+	// without an instance of the service the jobs are pending
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 0)
+	cc.mtx.RLock()
+	pending := cc.pendingJobs[appID]
+	cc.mtx.RUnlock()
+	c.Assert(pending, HasLen, 2)
+	for _, job := range pending {
+		c.Assert(job.Reason, Equals, ct.PlacementReasonColocate)
+	}
+
+	// once the service is registered the jobs land on its host
+	mtx.Lock()
+	instances["helper"] = []string{"host1"}
+	mtx.Unlock()
+	f := cx.formations.Get(appID, release.ID)
+	c.Assert(f, NotNil)
+	f.Rectify()
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 2)
+	cc.mtx.RLock()
+	c.Assert(cc.pendingJobs[appID], HasLen, 0)
+	cc.mtx.RUnlock()
+}
+
+func (s *S) TestJobGeneration(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "host to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil
+	})
+
+	// scale twice in quick succession, each at a new generation
+	for i, n := range []int{1, 3} {
+		stream <- &ct.ExpandedFormation{
+			App:        &ct.App{ID: appID},
+			Release:    release,
+			Artifact:   artifact,
+			Processes:  map[string]int{"web": n},
+			Generation: int64(i + 1),
+			UpdatedAt:  time.Now(),
+		}
+		waitForFormationEvent(events, c)
+	}
+
+	jobs := cl.GetHost("host0").Jobs
+	c.Assert(jobs, HasLen, 3)
+	generations := make(map[string]int64, len(jobs))
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		g := job.Metadata[ct.JobMetaGeneration]
+		counts[g]++
+		generations["host0-"+job.ID], _ = strconv.ParseInt(g, 10, 64)
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"1": 1, "2": 2})
+
+	// the controller is told the generation of each job
+	waitForCondition(c, "jobs to be up", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		return len(cc.jobs) == 3
+	})
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	for id, generation := range generations {
+		c.Assert(cc.jobs[id], NotNil)
+		c.Assert(cc.jobs[id].Generation, Equals, generation)
+	}
+}
+
+func (s *S) TestConfig(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 2}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	srv := httptest.NewServer(cx)
+	defer srv.Close()
+	putConfig := func(conf *ct.SchedulerConfig) *http.Response {
+		data, _ := json.Marshal(conf)
+		req, err := http.NewRequest("PUT", srv.URL+"/config", bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	// turn on maintenance mode with hard anti-affinity by default
+	res := putConfig(&ct.SchedulerConfig{Maintenance: true, DefaultAntiAffinity: ct.AntiAffinityHard})
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err := http.Get(srv.URL + "/config")
+	c.Assert(err, IsNil)
+	conf := &ct.SchedulerConfig{}
+	c.Assert(json.NewDecoder(res.Body).Decode(conf), IsNil)
+	res.Body.Close()
+	c.Assert(conf, DeepEquals, &ct.SchedulerConfig{
+		Maintenance:         true,
+		DefaultAntiAffinity: ct.AntiAffinityHard,
+		BackoffPeriod:       backoffPeriod,
+		RescheduleTimeout:   rescheduleTimeout,
+		MaxCrashes:          defaultMaxCrashes,
+		CrashWindow:         defaultCrashWindow,
+	})
+	c.Assert(putConfig(&ct.SchedulerConfig{DefaultAntiAffinity: "sometimes"}).StatusCode, Equals, 400)
+
+	// no jobs are started during maintenance
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+
+	// turning it off starts the jobs, with only one on the single host as
+	// the web type uses the default anti-affinity
+	c.Assert(putConfig(&ct.SchedulerConfig{DefaultAntiAffinity: ct.AntiAffinityHard}).StatusCode, Equals, 200)
+	waitForCondition(c, "jobs to be placed", func() bool {
+		cc.mtx.RLock()
+		defer cc.mtx.RUnlock()
+		return len(cl.GetHost("host0").Jobs) == 1 && len(cc.pendingJobs[appID]) == 1
+	})
+	cc.mtx.RLock()
+	defer cc.mtx.RUnlock()
+	c.Assert(cc.pendingJobs[appID][0].Reason, Equals, ct.PlacementReasonAntiAffinity)
+}
+
+func (s *S) TestConfigLoaded(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cc.config = &ct.SchedulerConfig{Maintenance: true, DefaultAntiAffinity: ct.AntiAffinityHard}
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+
+	// a new leader carries on with the stored config
+	c.Assert(cx.loadConfig(), IsNil)
+	conf := cx.Config()
+	c.Assert(conf.Maintenance, Equals, true)
+	c.Assert(conf.DefaultAntiAffinity, Equals, ct.AntiAffinityHard)
+	c.Assert(cx.inMaintenance(), Equals, true)
+}
+
+func (s *S) TestConfigLoadRetry(c *C) {
+	defer func(a attempt.Strategy) { configAttempts = a }(configAttempts)
+	configAttempts = attempt.Strategy{Total: time.Second, Delay: time.Millisecond}
+
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cc.config = &ct.SchedulerConfig{Maintenance: true}
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+
+	// the stored config is applied once the controller is available
+	cc.configErrs = 3
+	c.Assert(cx.loadConfig(), IsNil)
+	c.Assert(cx.inMaintenance(), Equals, true)
+
+	// the error is returned if the controller stays unavailable
+	configAttempts = attempt.Strategy{Total: 10 * time.Millisecond, Delay: time.Millisecond}
+	cc.configErrs = 1000
+	c.Assert(cx.loadConfig(), NotNil)
+}
+
+func (s *S) TestNamedVolume(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"db": 1}
+	release := newRelease("release", artifact, processes)
+	release.Processes["db"] = ct.ProcessType{
+		Cmd:     []string{"start", "db"},
+		Volumes: []ct.VolumeMount{{Name: "data", Path: "/data"}},
+	}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil
+	})
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+
+	// the job is started with the volume mounted
+	var volumeHost, otherHost string
+	for _, id := range []string{"host0", "host1"} {
+		if jobs := cl.GetHost(id).Jobs; len(jobs) == 1 {
+			volumeHost = id
+			c.Assert(jobs[0].Config.Mounts, DeepEquals, []host.Mount{{Location: "/data", Writeable: true, Volume: "app-data"}})
+		} else {
+			otherHost = id
+		}
+	}
+	c.Assert(volumeHost, Not(Equals), "")
+	c.Assert(otherHost, Not(Equals), "")
+	jobID := cl.GetHost(volumeHost).Jobs[0].ID
+
+	// load the volume's host so that the other host would otherwise be
+	// preferred
+	_, err := cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{volumeHost: {{
+		ID: "untracked",
+		Metadata: map[string]string{
+			"flynn-controller.app":     appID,
+			"flynn-controller.release": release.ID,
+			"flynn-controller.type":    "db",
+		},
+	}}}})
+	c.Assert(err, IsNil)
+
+	// the job is restarted on the host holding its volume
+	cl.RemoveJob(volumeHost, jobID, true)
+	waitForCondition(c, "job to restart", func() bool {
+		for _, job := range cl.GetHost(volumeHost).Jobs {
+			if job.ID != jobID && job.ID != "untracked" {
+				return true
+			}
+		}
+		return false
+	})
+	c.Assert(cl.GetHost(otherHost).Jobs, HasLen, 0)
+	for _, job := range cl.GetHost(volumeHost).Jobs {
+		if job.ID != "untracked" {
+			c.Assert(job.Config.Mounts, DeepEquals, []host.Mount{{Location: "/data", Writeable: true, Volume: "app-data"}})
+		}
+	}
+}
+
+func (s *S) TestNamedVolumeHeldByHost(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"db": 1}
+	release := newRelease("release", artifact, processes)
+	release.Processes["db"] = ct.ProcessType{
+		Cmd:     []string{"start", "db"},
+		Volumes: []ct.VolumeMount{{Name: "data", Path: "/data"}},
+	}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+
+	// host1 holds the volume but no job using it is running, as if the
+	// scheduler restarted while the job was down
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cl.BootHost("host1")
+	cl.AddHost("host1", host.Host{ID: "host1", Volumes: []string{"app-data"}})
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "hosts to be watched", func() bool {
+		return cx.hosts.Get("host0") != nil && cx.hosts.Get("host1") != nil
+	})
+	hosts, err := cl.ListHosts()
+	c.Assert(err, IsNil)
+	volumeHost, err := cx.volumeHost(&host.Job{Config: host.ContainerConfig{Mounts: []host.Mount{{Volume: "app-data"}}}}, hosts)
+	c.Assert(err, IsNil)
+	c.Assert(volumeHost, Equals, "host1")
+
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+	jobs := cl.GetHost("host1").Jobs
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Config.Mounts, DeepEquals, []host.Mount{{Location: "/data", Writeable: true, Volume: "app-data"}})
+}
+
+func (s *S) TestOmniStartJitter(c *C) {
+	timeAfterFunc = time.AfterFunc
+	defer func() { timeAfterFunc = time.AfterFunc }()
+	defer func(f func(time.Duration) time.Duration) { randomJitter = f }(randomJitter)
+	var mtx sync.Mutex
+	var calls int
+	jitter := 400 * time.Millisecond
+	randomJitter = func(max time.Duration) time.Duration {
+		mtx.Lock()
+		defer mtx.Unlock()
+		c.Assert(max, Equals, jitter)
+		calls++
+		return time.Duration(calls%4) * max / 4
+	}
+
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	release := &ct.Release{
+		ID:         "release",
+		ArtifactID: artifact.ID,
+		Processes: map[string]ct.ProcessType{
+			"web": {Cmd: []string{"start", "web"}, Omni: true, StartJitter: jitter},
+		},
+	}
+	processes := map[string]int{"web": 1}
+	stream := make(chan *ct.ExpandedFormation)
+	cc := newFakeControllerClient(appID, release, artifact, processes, stream)
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+
+	cx := newContext(cc, cl)
+	events := make(chan *FormationEvent, 1)
+	go cx.watchFormations(events, nil)
+	waitForFormationEvent(events, c)
+	stream <- &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		UpdatedAt: time.Now(),
+	}
+	waitForFormationEvent(events, c)
+	waitForCondition(c, "omni job on host0", func() bool {
+		return len(cl.GetHost("host0").Jobs) == 1
+	})
+
+	// several hosts join at once, as when they are rebooted together, and
+	// their omni jobs should start at different times within the window
+	hostIDs := []string{"host1", "host2", "host3"}
+	booted := time.Now()
+	for _, id := range hostIDs {
+		cl.BootHost(id)
+	}
+	started := make(map[string]time.Time, len(hostIDs))
+	for time.Since(booted) < 2*jitter && len(started) < len(hostIDs) {
+		for _, id := range hostIDs {
+			if _, ok := started[id]; !ok && len(cl.GetHost(id).Jobs) > 0 {
+				started[id] = time.Now()
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Assert(started, HasLen, len(hostIDs))
+	var first, last time.Time
+	for _, t := range started {
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	c.Assert(last.Sub(first) >= jitter/4, Equals, true, Commentf("jobs started within %s", last.Sub(first)))
+	c.Assert(last.Sub(booted) < jitter+100*time.Millisecond, Equals, true, Commentf("jobs started after %s", last.Sub(booted)))
+	for _, id := range append(hostIDs, "host0") {
+		c.Assert(cl.GetHost(id).Jobs, HasLen, 1)
+	}
+}
+
+func (s *S) TestProcessArgs(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1, "worker": 1}
+	release := newRelease("release", artifact, processes)
+	release.Processes["web"] = ct.ProcessType{
+		Cmd:        []string{"ignored"},
+		Entrypoint: []string{"/bin/server"},
+		Args:       []string{"--port", "8080", "with spaces"},
+	}
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+	cl := newFakeCluster("host0", appID, release.ID, nil, nil)
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 20)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	f := cx.formations.Add(NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	}))
+	f.Rectify()
+	waitForJobStartEvent(events, c)
+	waitForJobStartEvent(events, c)
+
+	configs := make(map[string]host.ContainerConfig)
+	for _, job := range cl.GetHost("host0").Jobs {
+		configs[job.Metadata["flynn-controller.type"]] = job.Config
+	}
+	// Args take precedence over Cmd and are passed to the entrypoint as is
+	c.Assert(configs["web"].Entrypoint, DeepEquals, []string{"/bin/server"})
+	c.Assert(configs["web"].Cmd, DeepEquals, []string{"--port", "8080", "with spaces"})
+	// Cmd is still used when Args is not set, with the image entrypoint
+	c.Assert(configs["worker"].Entrypoint, HasLen, 0)
+	c.Assert(configs["worker"].Cmd, DeepEquals, []string{"start", "worker"})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// fakeScheduler serves the config, drain and quarantine endpoints of the
+// scheduler leader.
+type fakeScheduler struct {
+	mtx       sync.Mutex
+	conf      ct.SchedulerConfig
+	drained   []*ct.HostDrain
+	undrained []string
+	cleared   []url.Values
+}
+
+func (f *fakeScheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, password, _ := req.BasicAuth(); password != authKey {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method == "POST" && req.URL.Path == "/drain" {
+		drain := &ct.HostDrain{}
+		if err := json.NewDecoder(req.Body).Decode(drain); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if drain.HostID == "invalid" {
+			http.Error(w, "invalid host", 400)
+			return
+		}
+		f.drained = append(f.drained, drain)
+		json.NewEncoder(w).Encode(&ct.HostDrain{HostID: drain.HostID, OneOffGrace: drain.OneOffGrace, Killed: []string{drain.HostID + "-stuck"}})
+		return
+	}
+	if req.Method == "DELETE" && req.URL.Path == "/drain" {
+		hostID := req.URL.Query().Get("host")
+		if hostID == "missing" {
+			http.NotFound(w, req)
+			return
+		}
+		f.undrained = append(f.undrained, hostID)
+		json.NewEncoder(w).Encode(&ct.HostDrain{HostID: hostID})
+		return
+	}
+	if req.Method == "DELETE" && req.URL.Path == "/quarantine" {
+		f.cleared = append(f.cleared, req.URL.Query())
+		json.NewEncoder(w).Encode(&ct.QuarantineClear{Cleared: 2})
+		return
+	}
+	if req.URL.Path != "/config" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method == "PUT" {
+		conf := ct.SchedulerConfig{}
+		if err := json.NewDecoder(req.Body).Decode(&conf); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f.conf.Maintenance = conf.Maintenance
+		f.conf.DefaultAntiAffinity = conf.DefaultAntiAffinity
+	}
+	json.NewEncoder(w).Encode(&f.conf)
+}
+
+func (s *S) TestClusterConfig(c *C) {
+	scheduler := &fakeScheduler{conf: ct.SchedulerConfig{
+		DefaultAntiAffinity: ct.AntiAffinitySoft,
+		MaxCrashes:          5,
+	}}
+	srv := httptest.NewServer(scheduler)
+	defer srv.Close()
+	s.m.Map(newSchedulerClient(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String()}}
+		},
+	}, authKey))
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	conf, err := client.ClusterConfig()
+	c.Assert(err, IsNil)
+	c.Assert(conf.Scheduler.Maintenance, Equals, false)
+	c.Assert(conf.Scheduler.DefaultAntiAffinity, Equals, ct.AntiAffinitySoft)
+	c.Assert(conf.Features[ct.FeatureMaintenance], Equals, false)
+	c.Assert(conf.Features[ct.FeatureQuarantine], Equals, true)
+
+	// turn on maintenance mode and hard anti-affinity by default
+	maintenance := true
+	sched, err := client.UpdateSchedulerConfig(&ct.SchedulerConfigUpdate{Maintenance: &maintenance, DefaultAntiAffinity: ct.AntiAffinityHard})
+	c.Assert(err, IsNil)
+	c.Assert(sched.Maintenance, Equals, true)
+
+	// updates are merged, leaving fields which are not set as they are
+	sched, err = client.UpdateSchedulerConfig(&ct.SchedulerConfigUpdate{DefaultAntiAffinity: ct.AntiAffinityHard})
+	c.Assert(err, IsNil)
+	c.Assert(sched.Maintenance, Equals, true)
+	sched, err = client.UpdateSchedulerConfig(&ct.SchedulerConfigUpdate{Maintenance: &maintenance})
+	c.Assert(err, IsNil)
+	c.Assert(sched.DefaultAntiAffinity, Equals, ct.AntiAffinityHard)
+
+	// the config is stored for the next scheduler leader
+	stored, err := client.SchedulerConfig()
+	c.Assert(err, IsNil)
+	c.Assert(stored.Maintenance, Equals, true)
+	c.Assert(stored.DefaultAntiAffinity, Equals, ct.AntiAffinityHard)
+
+	conf, err = client.ClusterConfig()
+	c.Assert(err, IsNil)
+	c.Assert(conf.Scheduler.Maintenance, Equals, true)
+	c.Assert(conf.Scheduler.DefaultAntiAffinity, Equals, ct.AntiAffinityHard)
+	c.Assert(conf.Scheduler.MaxCrashes, Equals, 5)
+	c.Assert(conf.Features[ct.FeatureMaintenance], Equals, true)
+
+	_, err = client.UpdateSchedulerConfig(&ct.SchedulerConfigUpdate{DefaultAntiAffinity: "sometimes"})
+	c.Assert(err, NotNil)
+
+	// reset the stored config for other tests
+	maintenance = false
+	_, err = client.UpdateSchedulerConfig(&ct.SchedulerConfigUpdate{Maintenance: &maintenance, DefaultAntiAffinity: ct.AntiAffinitySoft})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestDrainHost(c *C) {
+	scheduler := &fakeScheduler{}
+	srv := httptest.NewServer(scheduler)
+	defer srv.Close()
+	s.m.Map(newSchedulerClient(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String()}}
+		},
+	}, authKey))
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	killed, err := client.DrainHost("host0", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(killed, DeepEquals, []string{"host0-stuck"})
+	c.Assert(scheduler.drained, DeepEquals, []*ct.HostDrain{{HostID: "host0", OneOffGrace: time.Minute}})
+
+	_, err = client.DrainHost("", time.Minute)
+	c.Assert(err, NotNil)
+	c.Assert(scheduler.drained, HasLen, 1)
+
+	c.Assert(client.UndrainHost("host0"), IsNil)
+	c.Assert(scheduler.undrained, DeepEquals, []string{"host0"})
+
+	// errors from the scheduler are passed on
+	_, err = client.DrainHost("invalid", time.Minute)
+	c.Assert(err, DeepEquals, ct.ValidationError{Message: "invalid host"})
+	c.Assert(client.UndrainHost("missing"), Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestClearQuarantine(c *C) {
+	scheduler := &fakeScheduler{}
+	srv := httptest.NewServer(scheduler)
+	defer srv.Close()
+	s.m.Map(newSchedulerClient(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String()}}
+		},
+	}, authKey))
+
+	app := s.createTestApp(c, &ct.App{Name: "clear-quarantine"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	cleared, err := client.ClearQuarantine(app.ID, release.ID, "web")
+	c.Assert(err, IsNil)
+	c.Assert(cleared, Equals, 2)
+	c.Assert(scheduler.cleared, DeepEquals, []url.Values{{"app": {app.ID}, "release": {release.ID}, "type": {"web"}}})
+
+	_, err = client.ClearQuarantine(app.ID, "nonexistent", "")
+	c.Assert(err, NotNil)
+	c.Assert(scheduler.cleared, HasLen, 1)
+}
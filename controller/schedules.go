@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cron"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type JobScheduleRepo struct {
+	db *DB
+}
+
+func NewJobScheduleRepo(db *DB) *JobScheduleRepo {
+	return &JobScheduleRepo{db}
+}
+
+func scanJobSchedule(s Scanner) (*ct.JobSchedule, error) {
+	schedule := &ct.JobSchedule{}
+	var overlap string
+	var job []byte
+	err := s.Scan(&schedule.ID, &schedule.AppID, &schedule.Schedule, &overlap, &job, &schedule.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	schedule.ID = cleanUUID(schedule.ID)
+	schedule.AppID = cleanUUID(schedule.AppID)
+	schedule.Overlap = ct.OverlapPolicy(overlap)
+	err = json.Unmarshal(job, &schedule.Job)
+	return schedule, err
+}
+
+func (r *JobScheduleRepo) Add(schedule *ct.JobSchedule) error {
+	if _, err := cron.Parse(schedule.Schedule); err != nil {
+		return ct.ValidationError{Field: "schedule", Message: err.Error()}
+	}
+	switch schedule.Overlap {
+	case "":
+		schedule.Overlap = ct.OverlapSkip
+	case ct.OverlapSkip, ct.OverlapAllow, ct.OverlapReplace:
+	default:
+		return ct.ValidationError{Field: "overlap", Message: "must be one of skip, allow or replace"}
+	}
+	if schedule.Job == nil || schedule.Job.ReleaseID == "" {
+		return ct.ValidationError{Field: "job.release", Message: "must be set"}
+	}
+	if err := validateMeta("job.meta", schedule.Job.Meta); err != nil {
+		return err
+	}
+	job, err := json.Marshal(schedule.Job)
+	if err != nil {
+		return err
+	}
+	if schedule.ID == "" {
+		schedule.ID = random.UUID()
+	}
+	err = r.db.QueryRow("INSERT INTO job_schedules (schedule_id, app_id, schedule, overlap, job) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		schedule.ID, schedule.AppID, schedule.Schedule, string(schedule.Overlap), job).Scan(&schedule.CreatedAt)
+	schedule.ID = cleanUUID(schedule.ID)
+	return err
+}
+
+func (r *JobScheduleRepo) Get(appID, id string) (*ct.JobSchedule, error) {
+	row := r.db.QueryRow("SELECT schedule_id, app_id, schedule, overlap, job, created_at FROM job_schedules WHERE app_id = $1 AND schedule_id = $2 AND deleted_at IS NULL", appID, id)
+	return scanJobSchedule(row)
+}
+
+func (r *JobScheduleRepo) List(appID string) ([]*ct.JobSchedule, error) {
+	return r.list("SELECT schedule_id, app_id, schedule, overlap, job, created_at FROM job_schedules WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", appID)
+}
+
+// ListAll returns the schedules of all apps.
+func (r *JobScheduleRepo) ListAll() ([]*ct.JobSchedule, error) {
+	return r.list("SELECT schedule_id, app_id, schedule, overlap, job, created_at FROM job_schedules WHERE deleted_at IS NULL ORDER BY created_at")
+}
+
+func (r *JobScheduleRepo) list(query string, args ...interface{}) ([]*ct.JobSchedule, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	schedules := []*ct.JobSchedule{}
+	for rows.Next() {
+		schedule, err := scanJobSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func (r *JobScheduleRepo) Remove(appID, id string) error {
+	return r.db.Exec("UPDATE job_schedules SET deleted_at = now() WHERE app_id = $1 AND schedule_id = $2 AND deleted_at IS NULL", appID, id)
+}
+
+func createJobSchedule(schedule ct.JobSchedule, app *ct.App, repo *JobScheduleRepo, releases *ReleaseRepo, r ResponseHelper) {
+	schedule.AppID = app.ID
+	if schedule.Job != nil && schedule.Job.ReleaseID != "" {
+		if _, err := releases.Get(schedule.Job.ReleaseID); err == ErrNotFound {
+			r.Error(ct.ValidationError{Field: "job.release", Message: "does not exist"})
+			return
+		} else if err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if err := repo.Add(&schedule); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &schedule)
+}
+
+func getJobSchedule(app *ct.App, params martini.Params, repo *JobScheduleRepo, r ResponseHelper) {
+	schedule, err := repo.Get(app.ID, params["schedules_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, schedule)
+}
+
+func listJobSchedules(app *ct.App, repo *JobScheduleRepo, r ResponseHelper) {
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+func deleteJobSchedule(app *ct.App, params martini.Params, repo *JobScheduleRepo, r ResponseHelper) {
+	if _, err := repo.Get(app.ID, params["schedules_id"]); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := repo.Remove(app.ID, params["schedules_id"]); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
+// scheduleInterval is how often the schedule runner checks for due schedules.
+var scheduleInterval = time.Second
+
+type scheduleLister interface {
+	ListAll() ([]*ct.JobSchedule, error)
+}
+
+type jobRecorder interface {
+	Add(*ct.Job) error
+	ListScheduled(scheduleID string) ([]*ct.Job, error)
+}
+
+type getter interface {
+	Get(id string) (interface{}, error)
+}
+
+// scheduleRunner launches the one-off jobs of job schedules when they are
+// due, tracking the runs of each schedule to apply its overlap policy.
+type scheduleRunner struct {
+	schedules scheduleLister
+	jobs      jobRecorder
+	apps      getter
+	releases  getter
+	artifacts getter
+	secrets   secretGetter
+	cl        clusterClient
+
+	specs map[string]cron.Schedule
+	next  map[string]time.Time
+	runs  map[string][]*scheduledRun
+
+	// restored is the set of schedules whose runs have been restored from
+	// the job records, so that runs launched by a previous leader are
+	// tracked
+	restored map[string]struct{}
+	mtx      sync.Mutex
+}
+
+type scheduledRun struct {
+	job    *ct.Job
+	hostID string
+	jobID  string
+}
+
+func newScheduleRunner(schedules scheduleLister, jobs jobRecorder, apps, releases, artifacts getter, secrets secretGetter, cl clusterClient) *scheduleRunner {
+	return &scheduleRunner{
+		schedules: schedules,
+		jobs:      jobs,
+		apps:      apps,
+		releases:  releases,
+		artifacts: artifacts,
+		secrets:   secrets,
+		cl:        cl,
+		specs:     make(map[string]cron.Schedule),
+		next:      make(map[string]time.Time),
+		runs:      make(map[string][]*scheduledRun),
+		restored:  make(map[string]struct{}),
+	}
+}
+
+func (s *scheduleRunner) Run() {
+	for now := range time.Tick(scheduleInterval) {
+		s.tick(now)
+	}
+}
+
+// tick launches the jobs of the schedules which have become due since the
+// previous tick. Schedules are first seen by a tick without being run, so a
+// schedule only fires at times after it was created. The runner is only
+// locked while working out which schedules are due, not while running them.
+func (s *scheduleRunner) tick(now time.Time) {
+	schedules, err := s.schedules.ListAll()
+	if err != nil {
+		log.Println("error listing job schedules:", err)
+		return
+	}
+
+	s.mtx.Lock()
+	var due, restore []*ct.JobSchedule
+	current := make(map[string]struct{}, len(schedules))
+	for _, schedule := range schedules {
+		current[schedule.ID] = struct{}{}
+		if _, ok := s.restored[schedule.ID]; !ok {
+			restore = append(restore, schedule)
+		}
+		spec, ok := s.specs[schedule.ID]
+		if !ok {
+			if spec, err = cron.Parse(schedule.Schedule); err != nil {
+				log.Printf("error parsing job schedule %s: %s", schedule.ID, err)
+				continue
+			}
+			s.specs[schedule.ID] = spec
+			s.next[schedule.ID] = spec.Next(now)
+			continue
+		}
+		next := s.next[schedule.ID]
+		if next.IsZero() || now.Before(next) {
+			continue
+		}
+		s.next[schedule.ID] = spec.Next(now)
+		due = append(due, schedule)
+	}
+
+	// forget deleted schedules, leaving their active runs to finish
+	for id := range s.specs {
+		if _, ok := current[id]; !ok {
+			delete(s.specs, id)
+			delete(s.next, id)
+			delete(s.runs, id)
+			delete(s.restored, id)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, schedule := range restore {
+		if err := s.restoreRuns(schedule.ID); err != nil {
+			log.Printf("error restoring runs of job schedule %s: %s", schedule.ID, err)
+		}
+	}
+	for _, schedule := range due {
+		if err := s.run(schedule); err != nil {
+			log.Printf("error running job schedule %s: %s", schedule.ID, err)
+		}
+	}
+}
+
+// restoreRuns tracks the runs of the schedule which its job records show to
+// be active, which were launched before the runner started.
+func (s *scheduleRunner) restoreRuns(scheduleID string) error {
+	jobs, err := s.jobs.ListScheduled(scheduleID)
+	if err != nil {
+		return err
+	}
+	runs := make([]*scheduledRun, 0, len(jobs))
+	for _, job := range jobs {
+		hostID, jobID := parseJobID(job.ID)
+		if hostID == "" {
+			continue
+		}
+		runs = append(runs, &scheduledRun{job: job, hostID: hostID, jobID: jobID})
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.runs[scheduleID] = append(runs, s.runs[scheduleID]...)
+	s.restored[scheduleID] = struct{}{}
+	return nil
+}
+
+func (s *scheduleRunner) run(schedule *ct.JobSchedule) error {
+	s.mtx.Lock()
+	_, restored := s.restored[schedule.ID]
+	runs := s.runs[schedule.ID]
+	s.mtx.Unlock()
+	if !restored {
+		return errors.New("skipping run, the previous runs of the schedule are unknown")
+	}
+
+	active, err := s.activeRuns(runs)
+	s.setRuns(schedule.ID, active)
+	if err != nil {
+		// the overlap policy can't be applied without knowing whether
+		// the previous runs are active
+		return fmt.Errorf("skipping run, could not get the state of a previous run: %s", err)
+	}
+	if len(active) > 0 {
+		switch schedule.Overlap {
+		case ct.OverlapAllow:
+		case ct.OverlapReplace:
+			for i, run := range active {
+				if err := s.stop(run); err != nil {
+					s.setRuns(schedule.ID, active[i:])
+					return err
+				}
+			}
+			active = nil
+			s.setRuns(schedule.ID, nil)
+		default:
+			log.Printf("skipping job schedule %s, previous run is still active", schedule.ID)
+			return nil
+		}
+	}
+
+	data, err := s.apps.Get(schedule.AppID)
+	if err != nil {
+		return err
+	}
+	app := data.(*ct.App)
+	data, err = s.releases.Get(schedule.Job.ReleaseID)
+	if err != nil {
+		return err
+	}
+	release := data.(*ct.Release)
+	data, err = s.artifacts.Get(release.ArtifactID)
+	if err != nil {
+		return err
+	}
+	artifact := data.(*ct.Artifact)
+
+	config := oneOffJobConfig(app, release, artifact, schedule.Job)
+	config.Metadata[ct.JobMetaSchedule] = schedule.ID
+	if err := resolveSecrets(app.ID, config.Config.Env, s.secrets); err != nil {
+		return err
+	}
+	hostID, err := randomHost(s.cl)
+	if err != nil {
+		return err
+	}
+	if _, err := s.cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {config}}}); err != nil {
+		return err
+	}
+
+	job := &ct.Job{
+		ID:        hostID + "-" + config.ID,
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		State:     "starting",
+		Cmd:       schedule.Job.Cmd,
+		Meta:      map[string]string{ct.JobMetaSchedule: schedule.ID},
+	}
+	if err := s.jobs.Add(job); err != nil {
+		log.Printf("error recording job %s: %s", job.ID, err)
+	}
+	s.setRuns(schedule.ID, append(active, &scheduledRun{job: job, hostID: hostID, jobID: config.ID}))
+	return nil
+}
+
+// setRuns sets the tracked runs of the schedule, unless it has been deleted.
+func (s *scheduleRunner) setRuns(scheduleID string, runs []*scheduledRun) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.specs[scheduleID]; ok {
+		s.runs[scheduleID] = runs
+	}
+}
+
+// activeRuns returns the runs which are still active, recording the final
+// state of those which have finished. Runs whose state can't be looked up
+// are returned as active along with the lookup error.
+func (s *scheduleRunner) activeRuns(runs []*scheduledRun) ([]*scheduledRun, error) {
+	var active []*scheduledRun
+	var lookupErr error
+	for _, run := range runs {
+		state, err := s.runState(run)
+		if err != nil {
+			lookupErr = err
+			active = append(active, run)
+			continue
+		}
+		if state == "" {
+			active = append(active, run)
+			continue
+		}
+		s.setState(run, state)
+	}
+	return active, lookupErr
+}
+
+// runState returns the final state of run, or an empty string if it is still
+// active. A job which its host doesn't know about has gone away, so is down.
+func (s *scheduleRunner) runState(run *scheduledRun) (string, error) {
+	client, err := s.cl.DialHost(run.hostID)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	job, err := client.GetJob(run.jobID)
+	if err != nil {
+		return "", err
+	}
+	if job.Job == nil {
+		return "down", nil
+	}
+	switch job.Status {
+	case host.StatusDone:
+		return "down", nil
+	case host.StatusCrashed, host.StatusFailed:
+		return "crashed", nil
+	}
+	return "", nil
+}
+
+func (s *scheduleRunner) stop(run *scheduledRun) error {
+	client, err := s.cl.DialHost(run.hostID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.StopJob(run.jobID); err != nil {
+		return err
+	}
+	s.setState(run, "down")
+	return nil
+}
+
+func (s *scheduleRunner) setState(run *scheduledRun, state string) {
+	job := *run.job
+	job.State = state
+	if err := s.jobs.Add(&job); err != nil {
+		log.Printf("error recording job %s: %s", job.ID, err)
+	}
+}
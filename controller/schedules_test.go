@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestJobSchedules(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "schedule-test"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	out := &ct.JobSchedule{}
+	res, err := s.Post("/apps/"+app.ID+"/schedules", &ct.JobSchedule{
+		Schedule: "0 3 * * *",
+		Job:      &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"cleanup"}},
+	}, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.ID, Not(Equals), "")
+	c.Assert(out.AppID, Equals, app.ID)
+	c.Assert(out.Overlap, Equals, ct.OverlapSkip)
+
+	var list []*ct.JobSchedule
+	res, err = s.Get("/apps/"+app.ID+"/schedules", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, out.ID)
+	c.Assert(list[0].Job.Cmd, DeepEquals, []string{"cleanup"})
+
+	for _, invalid := range []*ct.JobSchedule{
+		{Schedule: "not a schedule", Job: &ct.NewJob{ReleaseID: release.ID}},
+		{Schedule: "@hourly", Overlap: "sometimes", Job: &ct.NewJob{ReleaseID: release.ID}},
+		{Schedule: "@hourly"},
+		{Schedule: "@hourly", Job: &ct.NewJob{ReleaseID: random.UUID()}},
+		{Schedule: "@hourly", Job: &ct.NewJob{ReleaseID: release.ID, Meta: map[string]string{"flynn-controller.type": "web"}}},
+	} {
+		res, err = s.Post("/apps/"+app.ID+"/schedules", invalid, &ct.JobSchedule{})
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+
+	path := "/apps/" + app.ID + "/schedules/" + out.ID
+	res, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get(path, &ct.JobSchedule{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+// ScheduleRunnerSuite tests the schedule runner against a fake cluster
+// without needing a database
+type ScheduleRunnerSuite struct {
+	cl       *tu.FakeCluster
+	cluster  *scheduleCluster
+	jobs     *fakeJobRecorder
+	schedule *ct.JobSchedule
+	release  *ct.Release
+	secrets  fakeSecrets
+	runner   *scheduleRunner
+}
+
+var _ = Suite(&ScheduleRunnerSuite{})
+
+type fakeGetter map[string]interface{}
+
+func (g fakeGetter) Get(id string) (interface{}, error) {
+	if thing, ok := g[id]; ok {
+		return thing, nil
+	}
+	return nil, ErrNotFound
+}
+
+type fakeScheduleLister []*ct.JobSchedule
+
+func (l fakeScheduleLister) ListAll() ([]*ct.JobSchedule, error) {
+	return l, nil
+}
+
+// fakeSecrets is a secret store keyed by secret name
+type fakeSecrets map[string]string
+
+func (s fakeSecrets) Get(appID, name string) (string, error) {
+	if value, ok := s[name]; ok {
+		return value, nil
+	}
+	return "", ErrNotFound
+}
+
+type fakeJobRecorder struct {
+	jobs []ct.Job
+}
+
+func (r *fakeJobRecorder) Add(job *ct.Job) error {
+	r.jobs = append(r.jobs, *job)
+	return nil
+}
+
+func (r *fakeJobRecorder) ListScheduled(scheduleID string) ([]*ct.Job, error) {
+	latest := make(map[string]ct.Job)
+	var ids []string
+	for _, job := range r.jobs {
+		if job.Meta[ct.JobMetaSchedule] != scheduleID {
+			continue
+		}
+		if _, ok := latest[job.ID]; !ok {
+			ids = append(ids, job.ID)
+		}
+		latest[job.ID] = job
+	}
+	var jobs []*ct.Job
+	for _, id := range ids {
+		if job := latest[id]; job.State == "starting" || job.State == "up" {
+			jobs = append(jobs, &job)
+		}
+	}
+	return jobs, nil
+}
+
+func (r *fakeJobRecorder) states() []string {
+	states := make([]string, len(r.jobs))
+	for i, job := range r.jobs {
+		states[i] = job.State
+	}
+	return states
+}
+
+// scheduleCluster is a fake cluster whose hosts return an empty job for jobs
+// they don't know about, as real hosts do, and which fails to dial hosts if
+// dialErr is set.
+type scheduleCluster struct {
+	*tu.FakeCluster
+	dialErr error
+}
+
+func (c *scheduleCluster) DialHost(id string) (cluster.Host, error) {
+	if c.dialErr != nil {
+		return nil, c.dialErr
+	}
+	h, err := c.FakeCluster.DialHost(id)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduleHost{Host: h, cluster: c.FakeCluster, hostID: id}, nil
+}
+
+type scheduleHost struct {
+	cluster.Host
+	cluster *tu.FakeCluster
+	hostID  string
+}
+
+func (h *scheduleHost) GetJob(id string) (*host.ActiveJob, error) {
+	for _, job := range h.cluster.GetHost(h.hostID).Jobs {
+		if job.ID == id {
+			return h.Host.GetJob(id)
+		}
+	}
+	return &host.ActiveJob{}, nil
+}
+
+func (s *ScheduleRunnerSuite) SetUpTest(c *C) {
+	hostID := "host0"
+	s.cl = tu.NewFakeCluster()
+	s.cl.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	s.cl.SetHostClient(hostID, tu.NewFakeHostClient(hostID))
+	s.cluster = &scheduleCluster{FakeCluster: s.cl}
+
+	app := &ct.App{ID: "app", Name: "app"}
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	release := &ct.Release{ID: "release", ArtifactID: artifact.ID}
+	s.release = release
+	s.secrets = fakeSecrets{}
+	s.schedule = &ct.JobSchedule{
+		ID:       "schedule",
+		AppID:    app.ID,
+		Schedule: "*/2 * * * * *",
+		Overlap:  ct.OverlapSkip,
+		Job:      &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"cleanup"}},
+	}
+	s.jobs = &fakeJobRecorder{}
+	s.runner = newScheduleRunner(
+		fakeScheduleLister{s.schedule},
+		s.jobs,
+		fakeGetter{app.ID: app},
+		fakeGetter{release.ID: release},
+		fakeGetter{artifact.ID: artifact},
+		s.secrets,
+		s.cluster,
+	)
+}
+
+func (s *ScheduleRunnerSuite) hostJobs() []*host.Job {
+	return s.cl.GetHost("host0").Jobs
+}
+
+func (s *ScheduleRunnerSuite) finishJobs() {
+	for _, job := range s.hostJobs() {
+		s.cl.RemoveJob("host0", job.ID, false)
+	}
+}
+
+func (s *ScheduleRunnerSuite) TestCadence(c *C) {
+	start := time.Date(2014, 10, 16, 9, 0, 0, 500e6, time.UTC)
+	var launched []time.Time
+	for i := 0; i <= 10; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		s.runner.tick(now)
+		if jobs := s.hostJobs(); len(jobs) > 0 {
+			c.Assert(jobs, HasLen, 1)
+			c.Assert(jobs[0].Metadata[ct.JobMetaSchedule], Equals, s.schedule.ID)
+			c.Assert(jobs[0].Config.Cmd, DeepEquals, []string{"cleanup"})
+			launched = append(launched, now)
+			s.finishJobs()
+		}
+	}
+	// the schedule fires every 2 seconds from when it was first seen
+	c.Assert(launched, HasLen, 5)
+	for i, t := range launched {
+		c.Assert(t, Equals, start.Add(time.Duration(2*(i+1))*time.Second))
+	}
+
+	c.Assert(s.jobs.jobs[0].Meta, DeepEquals, map[string]string{ct.JobMetaSchedule: s.schedule.ID})
+	c.Assert(s.jobs.jobs[0].AppID, Equals, "app")
+	c.Assert(s.jobs.jobs[0].ReleaseID, Equals, "release")
+}
+
+func (s *ScheduleRunnerSuite) TestSkipOverlap(c *C) {
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	jobs := s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	first := jobs[0].ID
+
+	// the previous run is still active so the next run is skipped
+	s.runner.tick(start.Add(4 * time.Second))
+	jobs = s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].ID, Equals, first)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting"})
+
+	// once the previous run finishes, the next run is launched
+	s.finishJobs()
+	s.runner.tick(start.Add(6 * time.Second))
+	jobs = s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].ID, Not(Equals), first)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting", "down", "starting"})
+}
+
+func (s *ScheduleRunnerSuite) TestReplaceOverlap(c *C) {
+	s.schedule.Overlap = ct.OverlapReplace
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	first := s.hostJobs()[0].ID
+
+	s.runner.tick(start.Add(4 * time.Second))
+	jobs := s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].ID, Not(Equals), first)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting", "down", "starting"})
+}
+
+func (s *ScheduleRunnerSuite) TestAllowOverlap(c *C) {
+	s.schedule.Overlap = ct.OverlapAllow
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	s.runner.tick(start.Add(4 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 2)
+}
+
+func (s *ScheduleRunnerSuite) TestSecrets(c *C) {
+	s.release.Env = map[string]string{"DB_PASSWORD": ct.SecretRefPrefix + "db-password", "FOO": "bar"}
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	// a job referencing a missing secret is not started
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 0)
+
+	s.secrets["db-password"] = "s3cret"
+	s.runner.tick(start.Add(4 * time.Second))
+	jobs := s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Config.Env["DB_PASSWORD"], Equals, "s3cret")
+	c.Assert(jobs[0].Config.Env["FOO"], Equals, "bar")
+	c.Assert(s.release.Env["DB_PASSWORD"], Equals, ct.SecretRefPrefix+"db-password")
+}
+
+func (s *ScheduleRunnerSuite) TestLookupErrorSkipsRun(c *C) {
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 1)
+
+	// whether the previous run is active can't be looked up, so the next
+	// run is skipped without recording the previous one as finished
+	s.finishJobs()
+	s.cluster.dialErr = errors.New("host unreachable")
+	s.runner.tick(start.Add(4 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 0)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting"})
+
+	s.cluster.dialErr = nil
+	s.runner.tick(start.Add(6 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 1)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting", "down", "starting"})
+}
+
+func (s *ScheduleRunnerSuite) TestRestoreRuns(c *C) {
+	start := time.Date(2014, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.runner.tick(start)
+	s.runner.tick(start.Add(2 * time.Second))
+	first := s.hostJobs()[0].ID
+
+	// a new runner, as on a new leader, tracks the run which is still
+	// active and skips the next run
+	s.runner = newScheduleRunner(s.runner.schedules, s.jobs, s.runner.apps, s.runner.releases, s.runner.artifacts, s.secrets, s.cluster)
+	s.runner.tick(start.Add(3 * time.Second))
+	s.runner.tick(start.Add(4 * time.Second))
+	jobs := s.hostJobs()
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].ID, Equals, first)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting"})
+
+	// and records its final state once it finishes
+	s.finishJobs()
+	s.runner.tick(start.Add(6 * time.Second))
+	c.Assert(s.hostJobs(), HasLen, 1)
+	c.Assert(s.jobs.states(), DeepEquals, []string{"starting", "down", "starting"})
+}
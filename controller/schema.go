@@ -135,5 +135,116 @@ $$ LANGUAGE plpgsql`,
 
 		`CREATE SEQUENCE name_ids MAXVALUE 4294967295`,
 	)
+	m.Add(2,
+		`CREATE TABLE pending_jobs (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    process_type text NOT NULL,
+    reason text NOT NULL,
+    message text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON pending_jobs (app_id)`,
+	)
+	m.Add(3,
+		`ALTER TABLE formations ADD COLUMN generation bigint NOT NULL DEFAULT 1`,
+	)
+	m.Add(4,
+		`CREATE TABLE job_schedules (
+    schedule_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    schedule text NOT NULL,
+    overlap text NOT NULL,
+    job text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`ALTER TABLE job_cache ADD COLUMN meta hstore`,
+		// scheduled one-off jobs may run releases which have no formation, so
+		// only the foreign key to formations is dropped, the app_id and
+		// release_id columns still reference apps and releases
+		`ALTER TABLE job_cache DROP CONSTRAINT job_cache_app_id_release_id_fkey`,
+	)
+	m.Add(5,
+		`CREATE TABLE secrets (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    name text NOT NULL,
+    value text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, name)
+)`,
+	)
+	m.Add(6,
+		`ALTER TABLE formations ADD COLUMN hosts text`,
+	)
+	m.Add(7,
+		`ALTER TABLE apps ADD COLUMN log_retention text`,
+	)
+	// enum values can't be added inside a transaction, so the type is
+	// replaced to add the state of quarantined jobs
+	m.Add(8,
+		`ALTER TYPE job_state RENAME TO job_state_old`,
+		`CREATE TYPE job_state AS ENUM ('starting', 'up', 'down', 'crashed', 'failed')`,
+		`ALTER TABLE job_cache ALTER COLUMN state TYPE job_state USING state::text::job_state`,
+		`ALTER TABLE job_events ALTER COLUMN state TYPE job_state USING state::text::job_state`,
+		`DROP TYPE job_state_old`,
+	)
+	m.Add(9,
+		`CREATE TABLE deploys (
+    deploy_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    old_release_id uuid NOT NULL REFERENCES releases (release_id),
+    new_release_id uuid NOT NULL REFERENCES releases (release_id),
+    strategy text NOT NULL,
+    status text NOT NULL,
+    jobs_up integer NOT NULL DEFAULT 0,
+    jobs_expected integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    finished_at timestamptz
+)`,
+		`CREATE INDEX ON deploys (app_id)`,
+	)
+	m.Add(10,
+		`ALTER TABLE job_events ADD COLUMN exit_status integer`,
+	)
+	m.Add(11,
+		`CREATE SEQUENCE cluster_event_ids`,
+		`CREATE TABLE cluster_events (
+    event_id bigint PRIMARY KEY DEFAULT nextval('cluster_event_ids'),
+    type text NOT NULL,
+    app_id uuid,
+    object_id text NOT NULL DEFAULT '',
+    data text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE FUNCTION notify_cluster_event() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('cluster_events', NEW.event_id || '');
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_cluster_event
+    AFTER INSERT ON cluster_events
+    FOR EACH ROW EXECUTE PROCEDURE notify_cluster_event()`,
+	)
+	m.Add(12,
+		`ALTER TABLE job_cache ADD COLUMN generation bigint NOT NULL DEFAULT 0`,
+	)
+	m.Add(13,
+		`CREATE INDEX ON cluster_events (created_at)`,
+	)
+	m.Add(14,
+		`CREATE TABLE scheduler_config (
+    id bool PRIMARY KEY DEFAULT true CHECK (id),
+    maintenance bool NOT NULL DEFAULT false,
+    default_anti_affinity text NOT NULL DEFAULT 'soft',
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`INSERT INTO scheduler_config DEFAULT VALUES`,
+	)
+	m.Add(15,
+		`ALTER TABLE deploys ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now()`,
+	)
 	return m.Migrate(db)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+)
+
+type SecretRepo struct {
+	db *DB
+}
+
+func NewSecretRepo(db *DB) *SecretRepo {
+	return &SecretRepo{db}
+}
+
+// Set creates or replaces the secret with the given name.
+func (r *SecretRepo) Set(appID string, secret *ct.Secret) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM secrets WHERE app_id = $1 AND name = $2", appID, secret.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow("INSERT INTO secrets (app_id, name, value) VALUES ($1, $2, $3) RETURNING created_at",
+		appID, secret.Name, secret.Value).Scan(&secret.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get returns the value of the secret with the given name.
+func (r *SecretRepo) Get(appID, name string) (string, error) {
+	var value string
+	err := r.db.QueryRow("SELECT value FROM secrets WHERE app_id = $1 AND name = $2", appID, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return value, err
+}
+
+// List returns the secrets of the given app without their values.
+func (r *SecretRepo) List(appID string) ([]*ct.Secret, error) {
+	rows, err := r.db.Query("SELECT name, created_at FROM secrets WHERE app_id = $1 ORDER BY name", appID)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []*ct.Secret{}
+	for rows.Next() {
+		secret := &ct.Secret{}
+		if err := rows.Scan(&secret.Name, &secret.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, rows.Err()
+}
+
+func (r *SecretRepo) Remove(appID, name string) error {
+	return r.db.Exec("DELETE FROM secrets WHERE app_id = $1 AND name = $2", appID, name)
+}
+
+// resolveSecrets replaces the secret references in env with the values of
+// the app's secrets.
+func resolveSecrets(appID string, env map[string]string, secrets secretGetter) error {
+	return utils.ResolveSecrets(env, func(name string) (string, error) {
+		value, err := secrets.Get(appID, name)
+		if err == ErrNotFound {
+			err = ct.ValidationError{Field: "env", Message: fmt.Sprintf("secret %q does not exist", name)}
+		}
+		return value, err
+	})
+}
+
+type secretGetter interface {
+	Get(appID, name string) (string, error)
+}
+
+func putSecret(secret ct.Secret, app *ct.App, params martini.Params, repo *SecretRepo, r ResponseHelper) {
+	secret.Name = params["secrets_name"]
+	if secret.Value == "" {
+		r.Error(ct.ValidationError{Field: "value", Message: "must be set"})
+		return
+	}
+	if err := repo.Set(app.ID, &secret); err != nil {
+		r.Error(err)
+		return
+	}
+	secret.Value = ""
+	r.JSON(200, &secret)
+}
+
+func getSecret(app *ct.App, params martini.Params, repo *SecretRepo, r ResponseHelper) {
+	value, err := repo.Get(app.ID, params["secrets_name"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &ct.Secret{Name: params["secrets_name"], Value: value})
+}
+
+func listSecrets(app *ct.App, repo *SecretRepo, r ResponseHelper) {
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+func deleteSecret(app *ct.App, params martini.Params, repo *SecretRepo, r ResponseHelper) {
+	if _, err := repo.Get(app.ID, params["secrets_name"]); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := repo.Remove(app.ID, params["secrets_name"]); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
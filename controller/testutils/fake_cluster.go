@@ -3,6 +3,7 @@ package testutils
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
@@ -18,6 +19,8 @@ type FakeCluster struct {
 	mtx         sync.RWMutex
 	listeners   []chan<- *host.HostEvent
 	listenMtx   sync.RWMutex
+
+	backoffPeriod time.Duration
 }
 
 func (c *FakeCluster) ListHosts() (map[string]host.Host, error) {
@@ -25,7 +28,7 @@ func (c *FakeCluster) ListHosts() (map[string]host.Host, error) {
 	defer c.mtx.RUnlock()
 	hosts := make(map[string]host.Host, len(c.hosts))
 	for id := range c.hosts {
-		hosts[id] = c.GetHost(id)
+		hosts[id] = c.getHost(id)
 	}
 	return hosts, nil
 }
@@ -33,17 +36,23 @@ func (c *FakeCluster) ListHosts() (map[string]host.Host, error) {
 func (c *FakeCluster) GetHost(id string) host.Host {
 	c.mtx.RLock()
 	defer c.mtx.RUnlock()
+	return c.getHost(id)
+}
+
+func (c *FakeCluster) getHost(id string) host.Host {
 	h := c.hosts[id]
 
 	// copy the jobs to avoid races
 	jobs := make([]*host.Job, len(h.Jobs))
 	copy(jobs, h.Jobs)
 
-	return host.Host{ID: h.ID, Jobs: jobs, Metadata: h.Metadata}
+	return host.Host{ID: h.ID, Jobs: jobs, Metadata: h.Metadata, Resources: h.Resources, Volumes: h.Volumes}
 }
 
 func (c *FakeCluster) DialHost(id string) (cluster.Host, error) {
+	c.mtx.RLock()
 	client, ok := c.hostClients[id]
+	c.mtx.RUnlock()
 	if !ok {
 		return nil, errors.New("FakeCluster: unknown host")
 	}
@@ -70,11 +79,58 @@ func (c *FakeCluster) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
 }
 
 func (c *FakeCluster) RemoveJob(hostID, jobID string, errored bool) error {
+	event := "stop"
+	if errored {
+		event = "error"
+	}
+	return c.removeJob(hostID, jobID, event, 0)
+}
+
+// ExitJob removes the job from the host as if it had exited with the given
+// status.
+func (c *FakeCluster) ExitJob(hostID, jobID string, status int) error {
+	return c.removeJob(hostID, jobID, "stop", status)
+}
+
+// InitFailJob removes the job from the host as if its init command had failed
+// with the given error.
+func (c *FakeCluster) InitFailJob(hostID, jobID, errStr string) error {
+	client, err := c.removeHostJob(hostID, jobID)
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		client.listenMtx.RLock()
+		defer client.listenMtx.RUnlock()
+		client.sendJobEvent("error", &host.ActiveJob{
+			Job:        &host.Job{ID: jobID},
+			Status:     host.StatusFailed,
+			Error:      &errStr,
+			InitFailed: true,
+		})
+	}
+	return nil
+}
+
+func (c *FakeCluster) removeJob(hostID, jobID, event string, status int) error {
+	client, err := c.removeHostJob(hostID, jobID)
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		client.sendEvent(event, jobID, status)
+	}
+	return nil
+}
+
+// removeHostJob removes the job from the host, returning the host's client
+// if it has one.
+func (c *FakeCluster) removeHostJob(hostID, jobID string) (*FakeHostClient, error) {
 	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	h, ok := c.hosts[hostID]
 	if !ok {
-		c.mtx.Unlock()
-		return errors.New("FakeCluster: unknown host")
+		return nil, errors.New("FakeCluster: unknown host")
 	}
 	jobs := make([]*host.Job, 0, len(h.Jobs))
 	for _, job := range h.Jobs {
@@ -84,31 +140,104 @@ func (c *FakeCluster) RemoveJob(hostID, jobID string, errored bool) error {
 	}
 	h.Jobs = jobs
 	c.hosts[hostID] = h
-	c.mtx.Unlock()
+	return c.hostClients[hostID], nil
+}
 
-	if client, ok := c.hostClients[hostID]; ok {
-		if errored {
-			client.SendEvent("error", jobID)
-		} else {
-			client.SendEvent("stop", jobID)
+func (c *FakeCluster) SetJobResources(hostID, jobID string, r *host.JobResources) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	h, ok := c.hosts[hostID]
+	if !ok {
+		return errors.New("FakeCluster: unknown host")
+	}
+	for _, job := range h.Jobs {
+		if job.ID == jobID {
+			job.Resources = *r
+			return nil
 		}
 	}
-	return nil
+	return errors.New("host: unknown job")
 }
 
 func (c *FakeCluster) SetHosts(h map[string]host.Host) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	c.hosts = h
 }
 
 func (c *FakeCluster) AddHost(id string, h host.Host) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]host.Host)
+	}
 	c.hosts[id] = h
 }
 
 func (c *FakeCluster) SetHostClient(id string, h *FakeHostClient) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	h.cluster = c
 	c.hostClients[id] = h
 }
 
+// BootHost simulates a new host joining the cluster by adding an empty host
+// with a fake host client and emitting a host "add" event.
+func (c *FakeCluster) BootHost(id string) *FakeHostClient {
+	client := NewFakeHostClient(id)
+	c.AddHost(id, host.Host{ID: id})
+	c.SetHostClient(id, client)
+	c.SendEvent(id, "add")
+	return client
+}
+
+// RemoveHost simulates a host leaving the cluster. The host is removed, a
+// "stop" event is emitted for each of its jobs and then a host "remove" event
+// is emitted.
+func (c *FakeCluster) RemoveHost(id string) error {
+	c.mtx.Lock()
+	h, ok := c.hosts[id]
+	if !ok {
+		c.mtx.Unlock()
+		return errors.New("FakeCluster: unknown host")
+	}
+	client := c.hostClients[id]
+	delete(c.hosts, id)
+	delete(c.hostClients, id)
+	c.mtx.Unlock()
+
+	if client != nil {
+		for _, job := range h.Jobs {
+			client.SendEvent("stop", job.ID)
+		}
+	}
+	c.SendEvent(id, "remove")
+	return nil
+}
+
+// BackoffPeriod returns the restart backoff period the scheduler uses with
+// the cluster, zero meaning the scheduler's default.
+func (c *FakeCluster) BackoffPeriod() time.Duration {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.backoffPeriod
+}
+
+// SetBackoffPeriod sets the restart backoff period, which a scheduler reads
+// when it is created with the cluster.
+func (c *FakeCluster) SetBackoffPeriod(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.backoffPeriod = d
+}
+
+// Size returns the number of hosts in the cluster.
+func (c *FakeCluster) Size() int {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return len(c.hosts)
+}
+
 func (c *FakeCluster) StreamHostEvents(ch chan<- *host.HostEvent) cluster.Stream {
 	c.listenMtx.Lock()
 	defer c.listenMtx.Unlock()
@@ -14,6 +14,8 @@ func NewFakeHostClient(hostID string) *FakeHostClient {
 		hostID:  hostID,
 		stopped: make(map[string]bool),
 		attach:  make(map[string]attachFunc),
+		procs:   make(map[string][]host.Process),
+		ips:     make(map[string]string),
 	}
 }
 
@@ -21,13 +23,27 @@ type FakeHostClient struct {
 	hostID    string
 	stopped   map[string]bool
 	attach    map[string]attachFunc
+	procs     map[string][]host.Process
+	ips       map[string]string
 	cluster   *FakeCluster
 	listeners []chan<- *host.Event
 	listenMtx sync.RWMutex
+
+	draining  bool
+	drainFunc func(bool) error
+	drainMtx  sync.Mutex
+}
+
+func (c *FakeHostClient) ListJobs() (map[string]host.ActiveJob, error) {
+	h := c.cluster.GetHost(c.hostID)
+	jobs := make(map[string]host.ActiveJob, len(h.Jobs))
+	for _, job := range h.Jobs {
+		jobs[job.ID] = host.ActiveJob{Job: job, Status: host.StatusRunning}
+	}
+	return jobs, nil
 }
 
-func (c *FakeHostClient) ListJobs() (map[string]host.ActiveJob, error) { return nil, nil }
-func (c *FakeHostClient) Close() error                                 { return nil }
+func (c *FakeHostClient) Close() error { return nil }
 func (c *FakeHostClient) Attach(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
 	f, ok := c.attach[req.JobID]
 	if !ok {
@@ -45,18 +61,90 @@ func (c *FakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
 	for _, h := range hosts {
 		for _, job := range h.Jobs {
 			if job.ID == id {
-				return &host.ActiveJob{Job: job}, nil
+				return &host.ActiveJob{Job: job, InternalIP: c.ips[id]}, nil
 			}
 		}
 	}
 	return nil, errors.New("job not found")
 }
 
+// SetInternalIP sets the IP address returned for the job by GetJob.
+func (c *FakeHostClient) SetInternalIP(jobID, ip string) {
+	c.ips[jobID] = ip
+}
+
 func (c *FakeHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream {
 	c.listenMtx.Lock()
 	defer c.listenMtx.Unlock()
 	c.listeners = append(c.listeners, ch)
-	return &FakeHostEventStream{ch: ch}
+	return &FakeHostEventStream{client: c, ch: ch}
+}
+
+func (c *FakeHostClient) StreamEventsSince(id string, since uint64, ch chan<- *host.Event) cluster.Stream {
+	return c.StreamEvents(id, ch)
+}
+
+func (c *FakeHostClient) PullProgress(id string, ch chan<- *host.PullProgress) cluster.Stream {
+	go func() {
+		ch <- &host.PullProgress{JobID: id, Done: true}
+		close(ch)
+	}()
+	return nopStream{}
+}
+
+func (c *FakeHostClient) StreamLogs(ch chan<- *host.LogLine) cluster.Stream {
+	return &FakeHostLogStream{ch: ch}
+}
+
+func (c *FakeHostClient) StreamStats(interval time.Duration, ch chan<- *host.HostStats) cluster.Stream {
+	return nopStream{}
+}
+
+func (c *FakeHostClient) JobProcessTree(jobID string) ([]host.Process, error) {
+	procs, ok := c.procs[jobID]
+	if !ok {
+		return nil, errors.New("host: unknown job")
+	}
+	return procs, nil
+}
+
+func (c *FakeHostClient) SetProcessTree(jobID string, procs []host.Process) {
+	c.procs[jobID] = procs
+}
+
+func (c *FakeHostClient) SetJobResources(jobID string, r *host.JobResources) error {
+	return c.cluster.SetJobResources(c.hostID, jobID, r)
+}
+
+func (c *FakeHostClient) PruneArtifacts(keep []string) (int64, error) {
+	return 0, nil
+}
+
+func (c *FakeHostClient) SetDraining(draining bool) error {
+	c.drainMtx.Lock()
+	defer c.drainMtx.Unlock()
+	if c.drainFunc != nil {
+		if err := c.drainFunc(draining); err != nil {
+			return err
+		}
+	}
+	c.draining = draining
+	return nil
+}
+
+// IsDraining returns whether the host was last set to be draining.
+func (c *FakeHostClient) IsDraining() bool {
+	c.drainMtx.Lock()
+	defer c.drainMtx.Unlock()
+	return c.draining
+}
+
+// SetDrainingFunc sets a function which is called each time the host is set
+// to be draining or not, an error fails the call.
+func (c *FakeHostClient) SetDrainingFunc(f func(bool) error) {
+	c.drainMtx.Lock()
+	defer c.drainMtx.Unlock()
+	c.drainFunc = f
 }
 
 func (c *FakeHostClient) StopJob(id string) error {
@@ -80,13 +168,22 @@ func (c *FakeHostClient) SetAttachFunc(id string, f attachFunc) {
 }
 
 func (c *FakeHostClient) SendEvent(event, id string) {
+	c.sendEvent(event, id, 0)
+}
+
+func (c *FakeHostClient) sendEvent(event, id string, exitStatus int) {
 	c.listenMtx.RLock()
 	defer c.listenMtx.RUnlock()
-	job := &host.ActiveJob{Job: &host.Job{ID: id}}
+	job := &host.ActiveJob{Job: &host.Job{ID: id}, ExitStatus: exitStatus}
 	if event == "start" {
 		job.StartedAt = time.Now().UTC()
+		job.InternalIP = "127.0.0.1"
 	}
-	e := &host.Event{Event: event, JobID: id, Job: job}
+	c.sendJobEvent(event, job)
+}
+
+func (c *FakeHostClient) sendJobEvent(event string, job *host.ActiveJob) {
+	e := &host.Event{Event: event, JobID: job.Job.ID, Job: job}
 	for _, ch := range c.listeners {
 		ch <- e
 	}
@@ -95,10 +192,21 @@ func (c *FakeHostClient) SendEvent(event, id string) {
 type attachFunc func(req *host.AttachReq, wait bool) (cluster.AttachClient, error)
 
 type FakeHostEventStream struct {
-	ch chan<- *host.Event
+	client *FakeHostClient
+	ch     chan<- *host.Event
 }
 
+// Close stops sending events to the stream's channel and closes it, the
+// channel must be drained while closing as an event may be being sent.
 func (h *FakeHostEventStream) Close() error {
+	h.client.listenMtx.Lock()
+	defer h.client.listenMtx.Unlock()
+	for i, ch := range h.client.listeners {
+		if ch == h.ch {
+			h.client.listeners = append(h.client.listeners[:i], h.client.listeners[i+1:]...)
+			break
+		}
+	}
 	close(h.ch)
 	return nil
 }
@@ -106,3 +214,21 @@ func (h *FakeHostEventStream) Close() error {
 func (h *FakeHostEventStream) Err() error {
 	return nil
 }
+
+type FakeHostLogStream struct {
+	ch chan<- *host.LogLine
+}
+
+func (h *FakeHostLogStream) Close() error {
+	close(h.ch)
+	return nil
+}
+
+func (h *FakeHostLogStream) Err() error {
+	return nil
+}
+
+type nopStream struct{}
+
+func (nopStream) Close() error { return nil }
+func (nopStream) Err() error   { return nil }
@@ -3,24 +3,49 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"time"
 )
 
 type ExpandedFormation struct {
-	App       *App           `json:"app,omitempty"`
-	Release   *Release       `json:"release,omitempty"`
-	Artifact  *Artifact      `json:"artifact,omitempty"`
-	Processes map[string]int `json:"processes,omitempty"`
-	UpdatedAt time.Time      `json:"updated_at,omitempty"`
+	App        *App                 `json:"app,omitempty"`
+	Release    *Release             `json:"release,omitempty"`
+	Artifact   *Artifact            `json:"artifact,omitempty"`
+	Processes  map[string]int       `json:"processes,omitempty"`
+	Artifacts  map[string]*Artifact `json:"artifacts,omitempty"` // additional process type artifacts, keyed by ID
+	Hosts      []string             `json:"hosts,omitempty"`
+	Generation int64                `json:"generation,omitempty"`
+	UpdatedAt  time.Time            `json:"updated_at,omitempty"`
 }
 
 type App struct {
-	ID        string            `json:"id,omitempty"`
-	Name      string            `json:"name,omitempty"`
-	Protected bool              `json:"protected"`
-	Meta      map[string]string `json:"meta,omitempty"`
-	CreatedAt *time.Time        `json:"created_at,omitempty"`
-	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Protected    bool              `json:"protected"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	LogRetention *LogRetention     `json:"log_retention,omitempty"` // defaults to the host's retention
+	CreatedAt    *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time        `json:"updated_at,omitempty"`
+}
+
+// AppUpdate changes an existing app, fields which are not set are left as
+// they are.
+type AppUpdate struct {
+	Name string            `json:"name,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// CloneAppReq is a request to clone an app into a new app with the given
+// name.
+type CloneAppReq struct {
+	Name string `json:"name,omitempty"`
+}
+
+// LogRetention limits how much of the output of an app's jobs is kept, older
+// output being removed as the logs are rotated.
+type LogRetention struct {
+	MaxBytes int64         `json:"max_bytes,omitempty"`
+	MaxAge   time.Duration `json:"max_age,omitempty"` // rounded up to whole days
 }
 
 type Release struct {
@@ -28,16 +53,232 @@ type Release struct {
 	ArtifactID string                 `json:"artifact,omitempty"`
 	Env        map[string]string      `json:"env,omitempty"`
 	Processes  map[string]ProcessType `json:"processes,omitempty"`
+	Resources  *JobResources          `json:"resources,omitempty"` // defaults for process types which don't set their own
 	CreatedAt  *time.Time             `json:"created_at,omitempty"`
 }
 
 type ProcessType struct {
-	Cmd        []string          `json:"cmd,omitempty"`
-	Entrypoint []string          `json:"entrypoint,omitempty`
-	Env        map[string]string `json:"env,omitempty"`
-	Ports      []Port            `json:"ports,omitempty"`
-	Data       bool              `json:"data,omitempty"`
-	Omni       bool              `json:"omni,omitempty"` // omnipresent - present on all hosts
+	Cmd         []string          `json:"cmd,omitempty"`        // shorthand for Args, ignored if Args is set
+	Entrypoint  []string          `json:"entrypoint,omitempty"` // overrides the image entrypoint
+	Args        []string          `json:"args,omitempty"`       // arguments passed to the entrypoint
+	Env         map[string]string `json:"env,omitempty"`
+	Ports       []Port            `json:"ports,omitempty"`
+	Data        bool              `json:"data,omitempty"`
+	Omni        bool              `json:"omni,omitempty"`     // omnipresent - present on all hosts
+	Artifact    string            `json:"artifact,omitempty"` // defaults to the release artifact
+	Priority    int               `json:"priority,omitempty"` // higher priority jobs migrate first when draining a host
+	Resources   *JobResources     `json:"resources,omitempty"`
+	HealthCheck *HealthCheck      `json:"health_check,omitempty"` // jobs are only up once the check passes
+
+	// StartConcurrency is the maximum number of jobs of the type which are
+	// starting at once when scaling up, zero being unlimited. Further jobs
+	// are started as the starting jobs come up.
+	StartConcurrency int `json:"start_concurrency,omitempty"`
+
+	// StartupGrace is how long jobs of the type with a health check have to
+	// pass it after starting, failed probes being expected until then. A
+	// job which is still unhealthy once the grace is over is stopped and
+	// restarted as if it had crashed. Zero waits for jobs to become healthy
+	// indefinitely.
+	StartupGrace time.Duration `json:"startup_grace,omitempty"`
+
+	// StartJitter is the maximum random delay before starting each job of an
+	// omni process type, so that the jobs of hosts which boot together do
+	// not all start at once.
+	StartJitter time.Duration `json:"start_jitter,omitempty"`
+
+	// AntiAffinity is how strictly jobs of the type are kept on separate
+	// hosts, it defaults to AntiAffinitySoft.
+	AntiAffinity AntiAffinity `json:"anti_affinity,omitempty"`
+
+	// DNS are the nameservers used by jobs of the type instead of those of
+	// the host, and Hostname is their hostname instead of their job ID.
+	DNS      []string `json:"dns,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+
+	// RestartPolicy is where crashed jobs of the type are restarted, it
+	// defaults to RestartPreferLastHost.
+	RestartPolicy RestartPolicy `json:"restart_policy,omitempty"`
+
+	// Spread is how jobs of the type are spread across the cluster, it
+	// defaults to SpreadHosts.
+	Spread SpreadPolicy `json:"spread,omitempty"`
+
+	// Colocate is the name of a discoverd service, jobs of the type are only
+	// placed on hosts where an instance of the service is registered, and
+	// are left pending while there are none.
+	Colocate string `json:"colocate,omitempty"`
+
+	// Volumes are named host-local volumes mounted into jobs of the type.
+	// A volume is created on the host the first job is placed on, and later
+	// jobs are always placed on that host.
+	Volumes []VolumeMount `json:"volumes,omitempty"`
+
+	// InitCmd is run to completion in each job's container before the main
+	// command, so that setup such as fetching config happens in the same
+	// filesystem. A job whose init command exits nonzero fails to start.
+	InitCmd []string `json:"init_cmd,omitempty"`
+
+	// User is the name or uid of the user which jobs of the type run as
+	// inside their containers, instead of the image default.
+	User string `json:"user,omitempty"`
+
+	// PreStop is run in each job's container before it is stopped, so that
+	// the job can drain connections or deregister itself first. The job is
+	// sent the stop signal once it exits, or after ShutdownTimeout if it has
+	// not, and then killed if it is still running after ShutdownTimeout
+	// again. ShutdownTimeout defaults to ten seconds.
+	PreStop         []string      `json:"pre_stop,omitempty"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout,omitempty"`
+
+	// MaxCrashes is how many times jobs of the type may crash within
+	// CrashWindow before the scheduler quarantines them, marking them as
+	// failed and no longer restarting them until the quarantine is cleared
+	// or a new release is deployed. Zero uses the scheduler's default policy
+	// and a negative value disables quarantine.
+	MaxCrashes  int           `json:"max_crashes,omitempty"`
+	CrashWindow time.Duration `json:"crash_window,omitempty"`
+}
+
+// OneOffType is the process type of one-off jobs, which is reserved so that
+// jobs of a release's process types are never mistaken for one-off jobs.
+const OneOffType = ""
+
+var processTypePattern = regexp.MustCompile(`^[A-Za-z\d_-]+$`)
+
+// ValidProcessType returns whether name can be used as the name of a process
+// type of a release. Names are made of letters, digits, hyphens and
+// underscores, at most 63 characters long, and can't be OneOffType.
+func ValidProcessType(name string) bool {
+	return name != OneOffType && len(name) <= 63 && processTypePattern.MatchString(name)
+}
+
+type VolumeMount struct {
+	Name string `json:"name,omitempty"` // unique within the app
+	Path string `json:"path,omitempty"` // where the volume is mounted in the job
+}
+
+// AntiAffinity is a placement policy for spreading the jobs of a process type
+// across hosts.
+type AntiAffinity string
+
+const (
+	// AntiAffinitySoft places each job on the host running the fewest jobs
+	// of the type, so jobs share hosts once there are more jobs than hosts.
+	AntiAffinitySoft AntiAffinity = "soft"
+
+	// AntiAffinityHard never places two jobs of the type on the same host,
+	// jobs are left pending until there is a host without one.
+	AntiAffinityHard AntiAffinity = "hard"
+)
+
+// RestartPolicy is a placement policy for restarting crashed jobs.
+type RestartPolicy string
+
+const (
+	// RestartPreferLastHost restarts a crashed job on the host it ran on,
+	// reusing the image already pulled there, as long as that host could
+	// still be chosen for the job. Otherwise the job is placed like any
+	// other new job.
+	RestartPreferLastHost RestartPolicy = "prefer-last-host"
+
+	// RestartAnyHost places restarted jobs like any other new job.
+	RestartAnyHost RestartPolicy = "any-host"
+)
+
+// SpreadPolicy is a placement policy for spreading the jobs of a process type
+// across failure domains.
+type SpreadPolicy string
+
+const (
+	// SpreadHosts places each job on the host running the fewest jobs of
+	// the type, subject to AntiAffinity.
+	SpreadHosts SpreadPolicy = "hosts"
+
+	// SpreadZones places each job in the zone running the fewest jobs of the
+	// type, and then on the host in that zone running the fewest, so jobs
+	// are balanced across zones before hosts. The zone of a host is given
+	// by its metadata, hosts without one are treated as one zone.
+	SpreadZones SpreadPolicy = "zones"
+)
+
+// JobArgs returns the arguments passed to the entrypoint of jobs of the
+// process type, which is Args if set and Cmd otherwise. The entrypoint is
+// Entrypoint if set and the image entrypoint otherwise, so as with Docker,
+// setting Entrypoint without any arguments does not run the image's default
+// command.
+func (t ProcessType) JobArgs() []string {
+	if len(t.Args) > 0 {
+		return t.Args
+	}
+	return t.Cmd
+}
+
+// HealthCheck checks a job is serving on a port before it is considered up.
+// A job is probed quickly after it starts, backing off exponentially to
+// Interval, so jobs which start quickly are marked up soon after starting.
+//
+// A job is marked up once HealthyThreshold probes pass in a row. If
+// UnhealthyThreshold is set, up jobs continue to be probed every Interval
+// and are restarted once that many probes fail in a row, so occasional
+// failures do not cause restarts.
+type HealthCheck struct {
+	Type     string        `json:"type"`               // "tcp" or "http"
+	Port     int           `json:"port,omitempty"`     // defaults to the first port of the process type
+	Path     string        `json:"path,omitempty"`     // the path requested by http checks, defaults to "/"
+	Interval time.Duration `json:"interval,omitempty"` // the steady state time between probes
+	Timeout  time.Duration `json:"timeout,omitempty"`  // how long each probe may take
+
+	HealthyThreshold   int `json:"healthy_threshold,omitempty"`   // defaults to 1
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"` // up jobs are not probed if zero
+}
+
+// HealthResult is the result of running a health check once against a job.
+type HealthResult struct {
+	Healthy bool          `json:"healthy"`
+	Latency time.Duration `json:"latency"`
+	Detail  string        `json:"detail,omitempty"` // the response, or why the check failed
+}
+
+type JobResources struct {
+	Memory  int            `json:"memory,omitempty"`  // in KiB
+	Devices map[string]int `json:"devices,omitempty"` // counts of devices such as "gpu"
+}
+
+// ProcessResources returns the resources of the given process type, with
+// any unset values inherited from the release defaults.
+func (r *Release) ProcessResources(name string) JobResources {
+	var res JobResources
+	if r.Resources != nil {
+		res = *r.Resources
+	}
+	if t := r.Processes[name].Resources; t != nil {
+		if t.Memory != 0 {
+			res.Memory = t.Memory
+		}
+		if len(t.Devices) > 0 {
+			res.Devices = t.Devices
+		}
+	}
+	return res
+}
+
+// ArtifactIDs returns the IDs of all artifacts referenced by the release, with
+// the primary artifact first.
+func (r *Release) ArtifactIDs() []string {
+	ids := []string{r.ArtifactID}
+	seen := map[string]struct{}{r.ArtifactID: {}}
+	for _, t := range r.Processes {
+		if t.Artifact == "" {
+			continue
+		}
+		if _, ok := seen[t.Artifact]; ok {
+			continue
+		}
+		seen[t.Artifact] = struct{}{}
+		ids = append(ids, t.Artifact)
+	}
+	return ids
 }
 
 type Port struct {
@@ -54,11 +295,29 @@ type Artifact struct {
 }
 
 type Formation struct {
-	AppID     string         `json:"app,omitempty"`
-	ReleaseID string         `json:"release,omitempty"`
-	Processes map[string]int `json:"processes,omitempty"`
-	CreatedAt *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+	AppID      string         `json:"app,omitempty"`
+	ReleaseID  string         `json:"release,omitempty"`
+	Processes  map[string]int `json:"processes,omitempty"`
+	Hosts      []string       `json:"hosts,omitempty"`      // if set, the IDs of the only hosts the formation's jobs may run on
+	Generation int64          `json:"generation,omitempty"` // incremented on each write, if set on a write it must match the stored generation
+	CreatedAt  *time.Time     `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time     `json:"updated_at,omitempty"`
+}
+
+// FormationSnapshot is the desired state of every formation in the cluster
+// at a point in time, which can be restored after the formations have been
+// changed, for example by scaling everything down for maintenance.
+type FormationSnapshot struct {
+	Formations []*Formation `json:"formations"`
+	CreatedAt  *time.Time   `json:"created_at,omitempty"`
+}
+
+// FormationStatus is the number of jobs of each process type of an app which
+// the app's formations want running and the number which are actually up.
+type FormationStatus struct {
+	AppID   string         `json:"app,omitempty"`
+	Desired map[string]int `json:"desired,omitempty"`
+	Running map[string]int `json:"running,omitempty"`
 }
 
 type Key struct {
@@ -69,20 +328,320 @@ type Key struct {
 }
 
 type Job struct {
-	ID        string     `json:"id,omitempty"`
-	AppID     string     `json:"app,omitempty"`
-	ReleaseID string     `json:"release,omitempty"`
-	Type      string     `json:"type,omitempty"`
-	State     string     `json:"state,omitempty"`
-	Cmd       []string   `json:"cmd,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	AppID     string            `json:"app,omitempty"`
+	ReleaseID string            `json:"release,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	State     string            `json:"state,omitempty"`
+	Cmd       []string          `json:"cmd,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+
+	// ExitStatus is the exit status of a job which has stopped, it is only
+	// set on the job when its state changes to down or crashed.
+	ExitStatus *int `json:"exit_status,omitempty"`
+
+	// Generation is the generation of the formation when the scheduler
+	// started the job, so jobs started for the current formation can be
+	// told apart from those left over from earlier ones while it converges.
+	// It is zero for jobs not started for a formation.
+	Generation int64 `json:"generation,omitempty"`
+}
+
+// JobMetaGeneration is the host job metadata key holding the generation of
+// the formation which the job was started for.
+const JobMetaGeneration = "flynn-controller.generation"
+
+// JobMetaSchedule is the Job.Meta key identifying the schedule which
+// launched a job.
+const JobMetaSchedule = "flynn-controller.schedule"
+
+// OverlapPolicy determines what happens when a scheduled job is due while
+// the previous run of the schedule is still active.
+type OverlapPolicy string
+
+const (
+	OverlapSkip    OverlapPolicy = "skip"    // don't launch the new run
+	OverlapAllow   OverlapPolicy = "allow"   // launch the new run alongside the previous one
+	OverlapReplace OverlapPolicy = "replace" // stop the previous run, then launch the new run
+)
+
+// JobSchedule launches a one-off job at the times given by a cron-style
+// schedule, see the pkg/cron package for the supported syntax.
+type JobSchedule struct {
+	ID        string        `json:"id,omitempty"`
+	AppID     string        `json:"app,omitempty"`
+	Schedule  string        `json:"schedule,omitempty"`
+	Overlap   OverlapPolicy `json:"overlap,omitempty"` // defaults to OverlapSkip
+	Job       *NewJob       `json:"job,omitempty"`
+	CreatedAt *time.Time    `json:"created_at,omitempty"`
+}
+
+const (
+	DeployStatusRunning  = "running"
+	DeployStatusComplete = "complete"
+	DeployStatusFailed   = "failed"
+	DeployStatusStopped  = "stopped"
+)
+
+// Deploy is a deploy of a release to an app, which the client performing it
+// records in the controller so that deploys in progress can be seen and
+// stopped from anywhere in the cluster.
+type Deploy struct {
+	ID           string     `json:"id,omitempty"`
+	AppID        string     `json:"app,omitempty"`
+	OldReleaseID string     `json:"old_release,omitempty"`
+	NewReleaseID string     `json:"new_release,omitempty"`
+	Strategy     string     `json:"strategy,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	JobsUp       int        `json:"jobs_up"`       // jobs of the new release which are up
+	JobsExpected int        `json:"jobs_expected"` // jobs of the new release once complete
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"` // when the client performing it last reported progress
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// SecretRefPrefix prefixes release and job env values which reference a
+// secret of the app, e.g. "secret://db-password". References are resolved when
+// jobs are started, so the secret values are never stored in releases.
+const SecretRefPrefix = "secret://"
+
+// Secret is a named value of an app which env values can reference. Values
+// are only returned when getting a single secret.
+type Secret struct {
+	Name      string     `json:"name,omitempty"`
+	Value     string     `json:"value,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
-	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// PlacementReason describes why the scheduler was unable to place a job on a
+// host.
+type PlacementReason string
+
+const (
+	PlacementReasonNoHosts   PlacementReason = "no_hosts"   // there are no hosts available to run the job
+	PlacementReasonResources PlacementReason = "resources"  // no host has enough free resources for the job
+	PlacementReasonHostError PlacementReason = "host_error" // the chosen host failed to start the job
+	PlacementReasonSecret    PlacementReason = "secret"     // a secret referenced by the release could not be resolved
+	PlacementReasonHosts     PlacementReason = "hosts"      // none of the hosts the formation is pinned to are available
+
+	PlacementReasonAntiAffinity PlacementReason = "anti_affinity" // every host already runs a job of the type with hard anti-affinity
+	PlacementReasonVolume       PlacementReason = "volume"        // the host holding the job's volumes is not available
+	PlacementReasonColocate     PlacementReason = "colocate"      // no available host has an instance of the service the job is co-located with
+)
+
+// PendingJob is a job which the scheduler wants to run but has not yet been
+// able to place on a host.
+type PendingJob struct {
+	AppID     string          `json:"app,omitempty"`
+	ReleaseID string          `json:"release,omitempty"`
+	Type      string          `json:"type,omitempty"`
+	Reason    PlacementReason `json:"reason,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	CreatedAt *time.Time      `json:"created_at,omitempty"` // when the job first became pending
+}
+
+// PendingFor returns how long the job has been pending.
+func (j *PendingJob) PendingFor() time.Duration {
+	if j.CreatedAt == nil {
+		return 0
+	}
+	return time.Since(*j.CreatedAt)
+}
+
+// SchedulerState is a point in time snapshot of the scheduler's view of the
+// cluster, used for debugging.
+type SchedulerState struct {
+	Hosts      []*SchedulerHost      `json:"hosts"`
+	Formations []*SchedulerFormation `json:"formations"`
+	Jobs       []*SchedulerJob       `json:"jobs"`
+	Pending    []*PendingJob         `json:"pending"`
+	CreatedAt  time.Time             `json:"created_at"`
+}
+
+// SchedulerMetrics are measurements of how quickly the scheduler converges
+// formations to their desired process counts.
+type SchedulerMetrics struct {
+	// Convergences is the number of times a formation has converged after
+	// being changed, and LastConvergence and MaxConvergence are the latest
+	// and longest times taken to converge.
+	Convergences    int           `json:"convergences"`
+	LastConvergence time.Duration `json:"last_convergence"`
+	MaxConvergence  time.Duration `json:"max_convergence"`
+
+	// Formations is the latest convergence of each formation.
+	Formations []*FormationConvergence `json:"formations"`
+}
+
+// FormationConvergence is the time taken from a formation being changed to it
+// having the desired number of jobs of each type up.
+type FormationConvergence struct {
+	AppID       string         `json:"app"`
+	ReleaseID   string         `json:"release"`
+	Processes   map[string]int `json:"processes"` // the process counts converged to
+	Duration    time.Duration  `json:"duration"`
+	ConvergedAt time.Time      `json:"converged_at"`
+}
+
+type SchedulerHost struct {
+	ID       string `json:"id"`
+	Draining bool   `json:"draining,omitempty"`
+}
+
+type SchedulerFormation struct {
+	AppID     string         `json:"app"`
+	ReleaseID string         `json:"release"`
+	Processes map[string]int `json:"processes"` // the desired number of jobs of each type
+}
+
+type SchedulerJob struct {
+	ID        string `json:"id"`
+	HostID    string `json:"host_id"`
+	AppID     string `json:"app"`
+	ReleaseID string `json:"release"`
+	Type      string `json:"type"`
+	State     string `json:"state"`            // starting, up, restarting or failed
+	Restarts  int    `json:"restarts"`         // the backoff level of the job
+	Reason    string `json:"reason,omitempty"` // why a failed job was quarantined
+}
+
+// SchedulerConfig is the scheduler's placement and restart policy, of which
+// Maintenance and DefaultAntiAffinity can be changed at runtime.
+type SchedulerConfig struct {
+	// Maintenance stops the scheduler starting and restarting jobs, running
+	// jobs are left alone and missing ones started once it is turned off
+	Maintenance bool `json:"maintenance"`
+
+	// DefaultAntiAffinity is used for process types which don't set their
+	// own AntiAffinity
+	DefaultAntiAffinity AntiAffinity `json:"default_anti_affinity"`
+
+	BackoffPeriod     time.Duration `json:"backoff_period"`     // the delay before restarting a job which exited soon after starting
+	RescheduleTimeout time.Duration `json:"reschedule_timeout"` // how long a job moved off a draining host has to start
+	MaxCrashes        int           `json:"max_crashes"`        // the default quarantine policy of process types
+	CrashWindow       time.Duration `json:"crash_window"`
+}
+
+// QuarantineClear is the result of clearing the quarantine of a formation's
+// failed jobs.
+type QuarantineClear struct {
+	Cleared int `json:"cleared"`
+}
+
+// HostDrain is a request to drain a host and the result of draining it.
+type HostDrain struct {
+	HostID string `json:"host_id"`
+
+	// OneOffGrace is how long one-off jobs are given to finish before they
+	// are stopped, a negative grace leaves them running
+	OneOffGrace time.Duration `json:"one_off_grace"`
+
+	// Killed is the IDs of the one-off jobs which had to be stopped
+	Killed []string `json:"killed,omitempty"`
+}
+
+// SchedulerConfigUpdate changes the runtime configurable parts of the
+// scheduler's policy, fields which are not set are left as they are.
+type SchedulerConfigUpdate struct {
+	Maintenance         *bool        `json:"maintenance,omitempty"`
+	DefaultAntiAffinity AntiAffinity `json:"default_anti_affinity,omitempty"`
+}
+
+// ClusterConfig is the active configuration of the cluster, so that tools can
+// discover which policies and features are enabled.
+type ClusterConfig struct {
+	Scheduler          *SchedulerConfig `json:"scheduler"`
+	DefaultRouteDomain string           `json:"default_route_domain,omitempty"`
+	Features           map[string]bool  `json:"features"`
+}
+
+// The feature flags of ClusterConfig.
+const (
+	FeatureDefaultRoutes = "default_routes" // apps get a route under DefaultRouteDomain
+	FeatureMaintenance   = "maintenance"    // the scheduler is in maintenance mode
+	FeatureQuarantine    = "quarantine"     // crashing jobs are quarantined by default
+)
+
+// ReconcileReport is the result of reconciling the jobs running in the
+// cluster with the formations of an app.
+type ReconcileReport struct {
+	AppID   string           `json:"app"`
+	Stopped []*ReconciledJob `json:"stopped"` // jobs which no formation accounts for
+	Missing []*ReconciledJob `json:"missing"` // jobs which formations expected but were missing, the scheduler is asked to start them
+	Errors  []string         `json:"errors,omitempty"`
+}
+
+type ReconciledJob struct {
+	ID        string `json:"id"`
+	HostID    string `json:"host_id"`
+	ReleaseID string `json:"release"`
+	Type      string `json:"type"`
 }
 
 type JobEvent struct {
 	Job
-	ID    int64  `json:"id"`
-	JobID string `json:"job_id,omitempty"`
+	ID     int64  `json:"id"`
+	JobID  string `json:"job_id,omitempty"`
+	HostID string `json:"host_id,omitempty"`
+
+	// Dropped is the number of events which were dropped before this event,
+	// it is only set on events with the JobEventGap state.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// JobEventGap is the state of the event sent in a job event stream when
+// events were dropped because the consumer was too slow, so consumers know
+// to reconcile using the job list.
+const JobEventGap = "gap"
+
+// JobEventCaughtUp is the state of the event sent in a job event stream which
+// requested paced replay once the past events requested when connecting have
+// all been replayed, so consumers know that subsequent events are live.
+const JobEventCaughtUp = "caught_up"
+
+type ClusterEventType string
+
+const (
+	ClusterEventHost      ClusterEventType = "host"
+	ClusterEventJob       ClusterEventType = "job"
+	ClusterEventDeploy    ClusterEventType = "deploy"
+	ClusterEventFormation ClusterEventType = "formation"
+	ClusterEventScheduler ClusterEventType = "scheduler"
+)
+
+// ClusterEvent is an event in the cluster wide event stream, which combines
+// host, job, deploy, formation and scheduler events in the order they
+// happened. ID is a sequence number global to the cluster, and Data is the
+// object the event is about: a ClusterHostEvent, Job, Deploy, Formation or
+// SchedulerDecision depending on Type.
+type ClusterEvent struct {
+	ID        int64            `json:"id,omitempty"`
+	Type      ClusterEventType `json:"type"`
+	AppID     string           `json:"app,omitempty"`
+	ObjectID  string           `json:"object_id,omitempty"`
+	Data      json.RawMessage  `json:"data,omitempty"`
+	CreatedAt *time.Time       `json:"created_at,omitempty"`
+}
+
+// ClusterHostEvent is the data of a host cluster event, Event is either
+// "up" or "down".
+type ClusterHostEvent struct {
+	HostID string `json:"host_id"`
+	Event  string `json:"event"`
+}
+
+// SchedulerDecision is the data of a scheduler cluster event, Action is
+// either "place" when a job is started on a host or "stop" when a job is
+// stopped to scale a formation down.
+type SchedulerDecision struct {
+	Action    string `json:"action"`
+	AppID     string `json:"app"`
+	ReleaseID string `json:"release"`
+	Type      string `json:"type"`
+	HostID    string `json:"host_id"`
+	JobID     string `json:"job_id"`
 }
 
 type NewJob struct {
@@ -93,6 +652,27 @@ type NewJob struct {
 	TTY        bool              `json:"tty,omitempty"`
 	Columns    int               `json:"tty_columns,omitempty"`
 	Lines      int               `json:"tty_lines,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+// StopJobsReq selects the one-off jobs of an app to stop by their meta, a job
+// matches if its meta contains every key and value in Selector.
+type StopJobsReq struct {
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// StopJobsRes lists the IDs of the jobs which were stopped, and if stopping
+// the rest of the matching jobs failed, why.
+type StopJobsRes struct {
+	Stopped []string `json:"stopped"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// StreamFormationsReq selects the formations of an app to stream, starting
+// with those updated since Since.
+type StreamFormationsReq struct {
+	AppID string    `json:"app_id,omitempty"`
+	Since time.Time `json:"since"`
 }
 
 type Frontend struct {
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// HealthCheckAddr returns the address to probe for the given job, using the
+// port of the check, or the first port of the process type.
+func HealthCheckAddr(check *ct.HealthCheck, proc ct.ProcessType, job *host.ActiveJob) (string, error) {
+	if job.InternalIP == "" {
+		return "", errors.New("health check: job has no IP address")
+	}
+	port := check.Port
+	if port == 0 && len(proc.Ports) > 0 {
+		port = proc.Ports[0].Port
+	}
+	if port == 0 && job.Job != nil {
+		port, _ = strconv.Atoi(job.Job.Config.Env["PORT"])
+	}
+	if port == 0 {
+		return "", errors.New("health check: unable to determine port")
+	}
+	return net.JoinHostPort(job.InternalIP, strconv.Itoa(port)), nil
+}
+
+// ProbeHealth runs the check against addr once, returning a description of
+// the response and an error if the check fails.
+func ProbeHealth(check *ct.HealthCheck, addr string) (string, error) {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	switch check.Type {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return "", err
+		}
+		return "connected to " + addr, conn.Close()
+	case "http":
+		path := check.Path
+		if path == "" {
+			path = "/"
+		}
+		client := &http.Client{Timeout: timeout}
+		res, err := client.Get("http://" + addr + path)
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return res.Status, fmt.Errorf("health check: unexpected status %s", res.Status)
+		}
+		return res.Status, nil
+	default:
+		return "", fmt.Errorf("health check: unknown type %q", check.Type)
+	}
+}
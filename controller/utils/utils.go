@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"net/url"
+	"strconv"
 	"strings"
 
 	ct "github.com/flynn/flynn/controller/types"
@@ -23,6 +24,23 @@ func FormatEnv(envs ...map[string]string) []string {
 	return res
 }
 
+// ResolveSecrets replaces the values of env which reference secrets with the
+// values returned by get for the referenced names, returning the first error
+// returned by get.
+func ResolveSecrets(env map[string]string, get func(name string) (string, error)) error {
+	for k, v := range env {
+		if !strings.HasPrefix(v, ct.SecretRefPrefix) {
+			continue
+		}
+		value, err := get(strings.TrimPrefix(v, ct.SecretRefPrefix))
+		if err != nil {
+			return err
+		}
+		env[k] = value
+	}
+	return nil
+}
+
 func DockerImage(uri string) (string, error) {
 	// TODO: ID refs (see https://github.com/dotcloud/docker/issues/4106)
 	u, err := url.Parse(uri)
@@ -53,6 +71,10 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 	}
 	env["FLYNN_APP_ID"] = f.App.ID
 	env["FLYNN_RELEASE_ID"] = f.Release.ID
+	artifact := f.Artifact
+	if a, ok := f.Artifacts[t.Artifact]; ok {
+		artifact = a
+	}
 	job := &host.Job{
 		Metadata: map[string]string{
 			"flynn-controller.app":      f.App.ID,
@@ -61,17 +83,41 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 			"flynn-controller.type":     name,
 		},
 		Artifact: host.Artifact{
-			Type: f.Artifact.Type,
-			URI:  f.Artifact.URI,
+			Type: artifact.Type,
+			URI:  artifact.URI,
 		},
 		Config: host.ContainerConfig{
-			Cmd: t.Cmd,
-			Env: env,
+			Cmd:      t.JobArgs(),
+			Env:      env,
+			DNS:      t.DNS,
+			Hostname: t.Hostname,
 		},
 	}
+	resources := f.Release.ProcessResources(name)
+	job.Resources.Memory = resources.Memory
+	if len(resources.Devices) > 0 {
+		job.Resources.Devices = make(map[string]int, len(resources.Devices))
+		for typ, n := range resources.Devices {
+			job.Resources.Devices[typ] = n
+		}
+	}
 	if len(t.Entrypoint) > 0 {
 		job.Config.Entrypoint = t.Entrypoint
 	}
+	if len(t.InitCmd) > 0 {
+		job.Config.InitCmd = t.InitCmd
+	}
+	job.Config.User = t.User
+	if len(t.PreStop) > 0 {
+		job.Config.PreStop = t.PreStop
+	}
+	job.Config.ShutdownTimeout = t.ShutdownTimeout
+	if f.Generation > 0 {
+		job.Metadata[ct.JobMetaGeneration] = strconv.FormatInt(f.Generation, 10)
+	}
+	if r := f.App.LogRetention; r != nil {
+		job.LogRetention = host.LogRetention{MaxBytes: r.MaxBytes, MaxAge: r.MaxAge}
+	}
 	job.Config.Ports = make([]host.Port, len(t.Ports))
 	for i, p := range t.Ports {
 		job.Config.Ports[i].Proto = p.Proto
@@ -81,5 +127,13 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 	if t.Data {
 		job.Config.Mounts = []host.Mount{{Location: "/data", Writeable: true}}
 	}
+	for _, v := range t.Volumes {
+		// volume names are only unique within an app
+		job.Config.Mounts = append(job.Config.Mounts, host.Mount{
+			Location:  v.Path,
+			Writeable: true,
+			Volume:    f.App.ID + "-" + v.Name,
+		})
+	}
 	return job
 }
@@ -9,19 +9,30 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 )
 
-// KeyPrefix is used to create the full service path.
-const KeyPrefix = "/discover"
+// DefaultKeyPrefix is the key prefix used when EtcdBackend.KeyPrefix is empty.
+const DefaultKeyPrefix = "/discover"
 
 // EtcdBackend for service discovery.
 type EtcdBackend struct {
 	Client *etcd.Client
+
+	// KeyPrefix is used to create the full service path, so that multiple
+	// clusters can share an etcd cluster by using distinct prefixes.
+	KeyPrefix string
+}
+
+func (b *EtcdBackend) keyPrefix() string {
+	if b.KeyPrefix == "" {
+		return DefaultKeyPrefix
+	}
+	return "/" + strings.Trim(b.KeyPrefix, "/")
 }
 
-func servicePath(name, addr string) string {
+func (b *EtcdBackend) servicePath(name, addr string) string {
 	if addr == "" {
-		return KeyPrefix + "/services/" + name
+		return b.keyPrefix() + "/services/" + name
 	}
-	return KeyPrefix + "/services/" + name + "/" + addr
+	return b.keyPrefix() + "/services/" + name + "/" + addr
 }
 
 // Subscribe to changes in services of a given name.
@@ -71,7 +82,7 @@ func (b *EtcdBackend) Subscribe(name string) (UpdateStream, error) {
 				if _, ok := newKeys[k]; ok {
 					continue
 				}
-				serviceName, serviceAddr := splitServiceNameAddr(k)
+				serviceName, serviceAddr := b.splitServiceNameAddr(k)
 				if serviceName == "" {
 					continue
 				}
@@ -83,7 +94,7 @@ func (b *EtcdBackend) Subscribe(name string) (UpdateStream, error) {
 			keys = newKeys
 			newKeys = make(map[string]uint64)
 
-			path := servicePath(name, "")
+			path := b.servicePath(name, "")
 			for {
 				watch := make(chan *etcd.Response)
 				watchDone := make(chan struct{})
@@ -128,7 +139,7 @@ func (s *etcdStream) Close() { s.stopOnce.Do(func() { close(s.stop) }) }
 
 func (b *EtcdBackend) responseToUpdate(resp *etcd.Response, node *etcd.Node, keys map[string]uint64) *ServiceUpdate {
 	keys[node.Key] = node.ModifiedIndex
-	serviceName, serviceAddr := splitServiceNameAddr(node.Key)
+	serviceName, serviceAddr := b.splitServiceNameAddr(node.Key)
 	if serviceName == "" {
 		return nil
 	}
@@ -147,7 +158,7 @@ func (b *EtcdBackend) responseToUpdate(resp *etcd.Response, node *etcd.Node, key
 			Attrs:   serviceAttrs,
 			Created: uint(node.CreatedIndex),
 		}
-	} else if "delete" == resp.Action || "expire" == resp.Action {
+	} else if "delete" == resp.Action || "compareAndDelete" == resp.Action || "expire" == resp.Action {
 		delete(keys, node.Key)
 		return &ServiceUpdate{
 			Name: serviceName,
@@ -158,17 +169,21 @@ func (b *EtcdBackend) responseToUpdate(resp *etcd.Response, node *etcd.Node, key
 	}
 }
 
-func splitServiceNameAddr(key string) (string, string) {
+func (b *EtcdBackend) splitServiceNameAddr(key string) (string, string) {
 	// expected key structure: /PREFIX/services/NAME/ADDR
-	splitKey := strings.SplitN(key, "/", 5)
-	if len(splitKey) < 5 {
+	prefix := b.keyPrefix() + "/services/"
+	if !strings.HasPrefix(key, prefix) {
+		return "", ""
+	}
+	splitKey := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+	if len(splitKey) < 2 {
 		return "", ""
 	}
-	return splitKey[3], splitKey[4]
+	return splitKey[0], splitKey[1]
 }
 
 func (b *EtcdBackend) getCurrentState(name string) (*etcd.Response, error) {
-	return b.Client.Get(servicePath(name, ""), false, true)
+	return b.Client.Get(b.servicePath(name, ""), false, true)
 }
 
 // Register a service with etcd.
@@ -178,7 +193,7 @@ func (b *EtcdBackend) Register(name, addr string, attrs map[string]string) error
 		return err
 	}
 	attrsString := string(attrsJSON)
-	path := servicePath(name, addr)
+	path := b.servicePath(name, addr)
 	ttl := uint64(HeartbeatIntervalSecs + MissedHearbeatTTL)
 
 	_, err = b.Client.Update(path, attrsString, ttl)
@@ -193,6 +208,6 @@ func (b *EtcdBackend) Register(name, addr string, attrs map[string]string) error
 
 // Unregister a service with etcd.
 func (b *EtcdBackend) Unregister(name, addr string) error {
-	_, err := b.Client.Delete(servicePath(name, addr), false)
+	_, err := b.Client.Delete(b.servicePath(name, addr), false)
 	return err
 }
@@ -4,6 +4,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/flynn/flynn/discoverd/testutil/etcdrunner"
@@ -24,10 +25,10 @@ func TestEtcdBackend_RegisterAndUnregister(t *testing.T) {
 	serviceName := "test_register"
 	serviceAddr := "127.0.0.1"
 
-	client.Delete(KeyPrefix+"/services/"+serviceName+"/"+serviceAddr, true)
+	client.Delete(DefaultKeyPrefix+"/services/"+serviceName+"/"+serviceAddr, true)
 	backend.Register(serviceName, serviceAddr, nil)
 
-	servicePath := KeyPrefix + "/services/" + serviceName + "/" + serviceAddr
+	servicePath := DefaultKeyPrefix + "/services/" + serviceName + "/" + serviceAddr
 	response, err := client.Get(servicePath, false, false)
 	if err != nil {
 		t.Fatal(err)
@@ -57,7 +58,7 @@ func TestEtcdBackend_Attributes(t *testing.T) {
 		"baz": "qux",
 	}
 
-	client.Delete(KeyPrefix+"/services/"+serviceName+"/"+serviceAddr, true)
+	client.Delete(DefaultKeyPrefix+"/services/"+serviceName+"/"+serviceAddr, true)
 	backend.Register(serviceName, serviceAddr, serviceAttrs)
 	defer backend.Unregister(serviceName, serviceAddr)
 
@@ -119,3 +120,87 @@ func TestEtcdBackend_Subscribe(t *testing.T) {
 		t.Fatal("Expected service to be offline:", update)
 	}
 }
+
+func TestEtcdBackend_SubscribeReregister(t *testing.T) {
+	client, done := runEtcdServer(t)
+	defer done()
+
+	backend := EtcdBackend{Client: client}
+
+	updates, _ := backend.Subscribe("test_reregister")
+	defer updates.Close()
+	<-updates.Chan() // skip the update that signals "up to current"
+
+	backend.Register("test_reregister", "10.0.0.1", map[string]string{"foo": "bar"})
+	defer backend.Unregister("test_reregister", "10.0.0.1")
+	<-updates.Chan() // .1 comes online
+
+	// re-registering with new attributes is a single online update
+	backend.Register("test_reregister", "10.0.0.1", map[string]string{"foo": "baz"})
+	update := <-updates.Chan()
+	if update.Addr != "10.0.0.1" || !update.Online || update.Attrs["foo"] != "baz" {
+		t.Fatal("Expected an online update with the new attributes, got:", update)
+	}
+
+	// re-registering with the same attributes is a heartbeat, so no update
+	backend.Register("test_reregister", "10.0.0.1", map[string]string{"foo": "baz"})
+	select {
+	case update := <-updates.Chan():
+		t.Fatal("Unexpected update:", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEtcdBackend_KeyPrefix(t *testing.T) {
+	client, done := runEtcdServer(t)
+	defer done()
+
+	backend1 := EtcdBackend{Client: client, KeyPrefix: "/cluster1"}
+	backend2 := EtcdBackend{Client: client, KeyPrefix: "/cluster2"}
+	serviceName := "test_prefix"
+	serviceAddr := "127.0.0.1"
+
+	updates1, _ := backend1.Subscribe(serviceName)
+	defer updates1.Close()
+	updates2, _ := backend2.Subscribe(serviceName)
+	defer updates2.Close()
+
+	// skip the updates that signal "up to current"
+	<-updates1.Chan()
+	<-updates2.Chan()
+
+	if err := backend1.Register(serviceName, serviceAddr, map[string]string{"cluster": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer backend1.Unregister(serviceName, serviceAddr)
+	if err := backend2.Register(serviceName, serviceAddr, map[string]string{"cluster": "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for cluster, updates := range map[string]UpdateStream{"1": updates1, "2": updates2} {
+		update := <-updates.Chan()
+		if update.Name != serviceName || update.Addr != serviceAddr || !update.Online {
+			t.Fatal("Unexpected service update: ", update)
+		}
+		if update.Attrs["cluster"] != cluster {
+			t.Fatalf("Expected update from cluster %s, got %v", cluster, update)
+		}
+	}
+
+	// unregistering from one prefix must not affect the other
+	if err := backend2.Unregister(serviceName, serviceAddr); err != nil {
+		t.Fatal(err)
+	}
+	update := <-updates2.Chan()
+	if update.Online || update.Addr != serviceAddr {
+		t.Fatal("Expected service to be offline: ", update)
+	}
+	if _, err := client.Get("/cluster1/services/"+serviceName+"/"+serviceAddr, false, false); err != nil {
+		t.Fatal("Registration with other prefix was removed: ", err)
+	}
+	select {
+	case update := <-updates1.Chan():
+		t.Fatal("Unexpected service update: ", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	// JanitorInterval is the interval at which the janitor checks for stale
+	// service entries.
+	JanitorInterval = time.Minute
+	// StaleEntryAge is how long an entry without a TTL may go without being
+	// modified before the janitor removes it.
+	StaleEntryAge = 10 * time.Minute
+)
+
+// staleEntry records when the janitor first saw a service entry at a given
+// modified index.
+type staleEntry struct {
+	index uint64
+	since time.Time
+}
+
+// RunJanitor removes stale service entries every interval until stop is
+// closed, starting with an immediate sweep.
+//
+// Entries registered by Register always have a TTL, so an entry without one
+// was either written by an older registrant or left behind after a crash
+// part way through registration, and will never expire. An entry like that
+// which has not been modified for maxAge is provably abandoned, as any live
+// registrant would have refreshed it with a heartbeat, so it is deleted and
+// subscribers see the instance go offline.
+func (b *EtcdBackend) RunJanitor(interval, maxAge time.Duration, stop <-chan struct{}) {
+	seen := make(map[string]*staleEntry)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := b.sweep(seen, maxAge, time.Now()); err != nil {
+			log.Printf("Error sweeping stale service entries: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep deletes entries without a TTL which have been at the same modified
+// index in seen for at least maxAge, and records any other TTL-less entries
+// in seen so that later sweeps can tell whether they have changed.
+func (b *EtcdBackend) sweep(seen map[string]*staleEntry, maxAge time.Duration, now time.Time) error {
+	res, err := b.Client.Get(b.keyPrefix()+"/services", false, true)
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+		// nothing has been registered yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	current := make(map[string]struct{})
+	for _, service := range res.Node.Nodes {
+		for _, n := range service.Nodes {
+			if n.Dir || n.Expiration != nil {
+				continue
+			}
+			current[n.Key] = struct{}{}
+			entry, ok := seen[n.Key]
+			if !ok || entry.index != n.ModifiedIndex {
+				seen[n.Key] = &staleEntry{index: n.ModifiedIndex, since: now}
+				continue
+			}
+			if now.Sub(entry.since) < maxAge {
+				continue
+			}
+			// compare on the index so that an entry which is refreshed
+			// concurrently is not deleted
+			if _, err := b.Client.CompareAndDelete(n.Key, "", n.ModifiedIndex); err != nil {
+				log.Printf("Error removing stale service entry %s: %s", n.Key, err)
+				continue
+			}
+			log.Printf("Removed stale service entry %s, unmodified since index %d", n.Key, n.ModifiedIndex)
+			delete(seen, n.Key)
+		}
+	}
+	for key := range seen {
+		if _, ok := current[key]; !ok {
+			delete(seen, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEtcdBackend_JanitorRemovesStale(t *testing.T) {
+	client, done := runEtcdServer(t)
+	defer done()
+
+	backend := EtcdBackend{Client: client}
+	serviceName := "test_janitor"
+
+	// an entry without a TTL, as left by a registrant which crashed, and
+	// one which is being kept alive by heartbeats
+	stalePath := backend.servicePath(serviceName, "10.0.0.1")
+	if _, err := client.Set(stalePath, NoAttrService, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Register(serviceName, "10.0.0.2", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unregister(serviceName, "10.0.0.2")
+
+	updates, _ := backend.Subscribe(serviceName)
+	defer updates.Close()
+	for i := 0; i < 3; i++ {
+		<-updates.Chan() // both come online and "up to current"
+	}
+
+	// the first sweep only records the entry, it is removed once it has
+	// gone unmodified for maxAge
+	seen := make(map[string]*staleEntry)
+	now := time.Now()
+	if err := backend.sweep(seen, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(stalePath, false, false); err != nil {
+		t.Fatal("Stale entry removed before maxAge: ", err)
+	}
+	if err := backend.sweep(seen, time.Minute, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(stalePath, false, false); err == nil {
+		t.Fatal("Stale entry not removed")
+	}
+
+	select {
+	case update := <-updates.Chan():
+		if update.Addr != "10.0.0.1" || update.Online {
+			t.Fatal("Expected stale service to go offline, got: ", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for offline update")
+	}
+
+	// the live registration is left alone
+	if _, err := client.Get(backend.servicePath(serviceName, "10.0.0.2"), false, false); err != nil {
+		t.Fatal("Live entry was removed: ", err)
+	}
+}
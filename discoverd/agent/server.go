@@ -62,8 +62,9 @@ var Attempts = attempt.Strategy{
 	Delay: 200 * time.Millisecond,
 }
 
-// NewServer creates a new discoverd server listening at addr and backed by etcd.
-func NewServer(addr string, etcdAddrs []string) *Agent {
+// NewServer creates a new discoverd server listening at addr and backed by
+// etcd, with services stored under keyPrefix (DefaultKeyPrefix if empty).
+func NewServer(addr string, etcdAddrs []string, keyPrefix string) *Agent {
 	client := etcd.NewClient(etcdAddrs)
 
 	// check to make sure that etcd is online and accepting connections
@@ -76,8 +77,11 @@ func NewServer(addr string, etcdAddrs []string) *Agent {
 		log.Fatalf("Failed to connect to etcd at %v: %q", etcdAddrs, err)
 	}
 
+	backend := &EtcdBackend{Client: client, KeyPrefix: keyPrefix}
+	go backend.RunJanitor(JanitorInterval, StaleEntryAge, nil)
+
 	return &Agent{
-		Backend: &EtcdBackend{Client: client},
+		Backend: backend,
 		Address: addr,
 	}
 }
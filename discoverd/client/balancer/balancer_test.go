@@ -31,6 +31,8 @@ func (test *TestSet) Watch(bringCurrent bool) chan *agent.ServiceUpdate { return
 
 func (test *TestSet) Unwatch(chan *agent.ServiceUpdate) {}
 
+func (test *TestSet) Resync() error { return nil }
+
 func (test *TestSet) Close() error { return nil }
 
 func NewTestSet() discoverd.ServiceSet {
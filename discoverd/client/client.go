@@ -35,6 +35,7 @@ type Service struct {
 
 type serviceSet struct {
 	l         sync.Mutex
+	name      string
 	services  map[string]*Service
 	filters   map[string]string
 	watches   map[chan *agent.ServiceUpdate]struct{}
@@ -44,6 +45,10 @@ type serviceSet struct {
 	closed    bool
 	closedMtx sync.RWMutex
 	c         *Client
+
+	// liveUpdates counts the updates received from the subscription, so
+	// that Resync can tell whether its snapshot is stale
+	liveUpdates uint64
 }
 
 // A ServiceSet is long-running query of services, giving you a real-time representation of a
@@ -93,6 +98,14 @@ type ServiceSet interface {
 	// Unwatch removes a channel from the watch list of the ServiceSet. It will also close the channel.
 	Unwatch(chan *agent.ServiceUpdate)
 
+	// Resync re-reads the current services from discoverd and reconciles the
+	// set with them, sending updates to watchers for any services which were
+	// added, changed or removed without the set seeing the update. It is a
+	// cheaper way to recover from drift than recreating the ServiceSet. The
+	// services read are only applied if the set received no updates while
+	// reading them, and an error is returned if updates keep arriving.
+	Resync() error
+
 	// Close will stop a ServiceSet from being updated.
 	Close() error
 }
@@ -120,6 +133,7 @@ func (s *serviceSet) SelfAddr() string {
 }
 
 func (s *serviceSet) bind(name string) chan error {
+	s.name = name
 	// current is an event when enough service updates have been
 	// received to bring us to "current" state (when subscribed)
 	current := make(chan error)
@@ -166,24 +180,52 @@ func (s *serviceSet) bind(name string) chan error {
 					continue
 				}
 				s.l.Lock()
+				s.liveUpdates++
 				if s.filters != nil && !s.matchFilters(update.Attrs) {
+					// a known service which re-registered with attributes
+					// that no longer match has gone offline as far as
+					// this set is concerned
+					service, exists := services[update.Addr]
+					if !exists || !update.Online {
+						s.l.Unlock()
+						continue
+					}
+					delete(services, update.Addr)
 					s.l.Unlock()
+					s.updateWatches(&agent.ServiceUpdate{
+						Name:    service.Name,
+						Addr:    service.Addr,
+						Online:  false,
+						Attrs:   service.Attrs,
+						Created: service.Created,
+					})
 					continue
 				}
 				// add a new service if the address is unrecognized
 				// and the address is online
 				if s.selfAddr != update.Addr && update.Online {
-					if _, exists := services[update.Addr]; !exists {
-						host, port, _ := net.SplitHostPort(update.Addr)
-						services[update.Addr] = &Service{
-							Name:    update.Name,
-							Addr:    update.Addr,
-							Host:    host,
-							Port:    port,
-							Created: update.Created,
+					if service, exists := services[update.Addr]; exists {
+						// a re-registration of a known service updates it
+						// in place, and is only passed on to watchers if
+						// its attributes changed
+						if attrsEqual(service.Attrs, update.Attrs) {
+							s.l.Unlock()
+							continue
 						}
+						service.Attrs = update.Attrs
+						s.l.Unlock()
+						s.updateWatches(update)
+						continue
+					}
+					host, port, _ := net.SplitHostPort(update.Addr)
+					services[update.Addr] = &Service{
+						Name:    update.Name,
+						Addr:    update.Addr,
+						Host:    host,
+						Port:    port,
+						Attrs:   update.Attrs,
+						Created: update.Created,
 					}
-					services[update.Addr].Attrs = update.Attrs
 				} else {
 					if _, exists := services[update.Addr]; exists {
 						delete(services, update.Addr)
@@ -254,6 +296,18 @@ func (s *serviceSet) matchFilters(attrs map[string]string) bool {
 	return true
 }
 
+func attrsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *serviceSet) Leader() *Service {
 	services := s.Services()
 	if len(services) > 0 {
@@ -307,6 +361,7 @@ func (s *serviceSet) setServices(services map[string]*Service) {
 	s.l.Lock()
 	defer s.l.Unlock()
 	s.services = services
+	s.liveUpdates++
 }
 
 func (s *serviceSet) Addrs() []string {
@@ -379,6 +434,86 @@ func (s *serviceSet) Unwatch(ch chan *agent.ServiceUpdate) {
 	delete(s.watches, ch)
 }
 
+// resyncAttempts is the number of snapshots Resync takes before giving up if
+// live updates keep arriving while they are taken.
+const resyncAttempts = 3
+
+var errResyncRaced = errors.New("discover: services changed during resync")
+
+// Allow simulating updates which arrive while Resync takes a snapshot in tests
+var resyncSnapshot = (*Client).currentServices
+
+func (s *serviceSet) Resync() error {
+	for i := 0; i < resyncAttempts; i++ {
+		s.l.Lock()
+		seen := s.liveUpdates
+		s.l.Unlock()
+
+		current, err := resyncSnapshot(s.c, s.name)
+		if err != nil {
+			return err
+		}
+
+		s.l.Lock()
+		if s.liveUpdates != seen {
+			// the snapshot may be older than the updates, so applying
+			// it could undo them
+			s.l.Unlock()
+			continue
+		}
+		changes := s.resync(current)
+		s.l.Unlock()
+
+		for _, update := range changes {
+			s.updateWatches(update)
+		}
+		return nil
+	}
+	return errResyncRaced
+}
+
+// resync updates the services to match current, returning the changes for
+// watchers. Caller must hold s.l.
+func (s *serviceSet) resync(current map[string]*agent.ServiceUpdate) []*agent.ServiceUpdate {
+	var changes []*agent.ServiceUpdate
+	for addr, update := range current {
+		if addr == s.selfAddr || !s.matchFilters(update.Attrs) {
+			continue
+		}
+		if service, exists := s.services[addr]; exists {
+			if attrsEqual(service.Attrs, update.Attrs) {
+				continue
+			}
+			service.Attrs = update.Attrs
+		} else {
+			host, port, _ := net.SplitHostPort(addr)
+			s.services[addr] = &Service{
+				Name:    update.Name,
+				Addr:    addr,
+				Host:    host,
+				Port:    port,
+				Attrs:   update.Attrs,
+				Created: update.Created,
+			}
+		}
+		changes = append(changes, update)
+	}
+	for addr, service := range s.services {
+		if update, exists := current[addr]; exists && s.matchFilters(update.Attrs) {
+			continue
+		}
+		delete(s.services, addr)
+		changes = append(changes, &agent.ServiceUpdate{
+			Name:    service.Name,
+			Addr:    service.Addr,
+			Online:  false,
+			Attrs:   service.Attrs,
+			Created: service.Created,
+		})
+	}
+	return changes
+}
+
 func (s *serviceSet) Close() error {
 	s.setClosed()
 	return s.call.CloseStream()
@@ -414,9 +549,8 @@ type Client struct {
 	l                sync.Mutex
 	client           *rpcplus.Client
 	addr             string
-	heartbeats       map[string]chan struct{}
+	heartbeats       map[registration]chan struct{}
 	expandedAddrs    map[string]string
-	names            map[string]string
 	reconnecting     bool
 	reconnMtx        sync.RWMutex
 	clientMtx        sync.RWMutex
@@ -425,13 +559,19 @@ type Client struct {
 	reconnectWatches map[chan ConnEvent]struct{}
 }
 
+// registration identifies a service registered by a client, as the same
+// address may be registered under more than one name.
+type registration struct {
+	name string
+	addr string
+}
+
 func newClient(c *rpcplus.Client, addr string) *Client {
 	return &Client{
 		client:           c,
 		addr:             addr,
-		heartbeats:       make(map[string]chan struct{}),
+		heartbeats:       make(map[registration]chan struct{}),
 		expandedAddrs:    make(map[string]string),
-		names:            make(map[string]string),
 		reconnectWatches: make(map[chan ConnEvent]struct{}),
 	}
 }
@@ -575,14 +715,14 @@ func (c *Client) RegisterWithAttributes(name, addr string, attributes map[string
 		return errors.New("discover: register failed: " + err.Error())
 	}
 	done := make(chan struct{})
+	reg := registration{name: name, addr: args.Addr}
 	c.l.Lock()
-	if ch, exists := c.heartbeats[args.Addr]; exists {
+	if ch, exists := c.heartbeats[reg]; exists {
 		// stop the old heartbeat if this is a re-registration
 		close(ch)
 	}
-	c.heartbeats[args.Addr] = done
+	c.heartbeats[reg] = done
 	c.expandedAddrs[args.Addr] = ret
-	c.names[args.Addr] = name
 	c.l.Unlock()
 	go func() {
 		ticker := time.NewTicker(agent.HeartbeatIntervalSecs * time.Second) // TODO: add jitter
@@ -603,6 +743,62 @@ func (c *Client) RegisterWithAttributes(name, addr string, attributes map[string
 	return nil
 }
 
+// DrainingService is the name of the service under which hosts which are being
+// drained register themselves, at the address of their flynn-host registration,
+// so the registration lasts as long as the host rather than the scheduler which
+// drained it. Routers exclude backends on draining hosts so they stop receiving
+// new connections before their jobs are stopped.
+const DrainingService = "flynn-host-draining"
+
+// DrainingHosts returns the IDs of the hosts which are registered as draining.
+func (c *Client) DrainingHosts() ([]string, error) {
+	services, err := c.currentServices(DrainingService)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(services))
+	for _, s := range services {
+		if id := s.Attrs["id"]; id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ServiceHosts returns the IDs of the hosts which an instance of the named
+// service is registered on, those being the hosts registered as the flynn-host
+// service at the IP address of an instance.
+func (c *Client) ServiceHosts(name string) ([]string, error) {
+	instances, err := c.currentServices(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, nil
+	}
+	hosts, err := c.currentServices("flynn-host")
+	if err != nil {
+		return nil, err
+	}
+	ips := make(map[string]struct{}, len(instances))
+	for addr := range instances {
+		if ip, _, err := net.SplitHostPort(addr); err == nil {
+			ips[ip] = struct{}{}
+		}
+	}
+	var ids []string
+	for addr, h := range hosts {
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil || h.Attrs["id"] == "" {
+			continue
+		}
+		if _, ok := ips[ip]; ok {
+			ids = append(ids, h.Attrs["id"])
+		}
+	}
+	return ids, nil
+}
+
 func (c *Client) rpcClient() *rpcplus.Client {
 	c.clientMtx.RLock()
 	defer c.clientMtx.RUnlock()
@@ -630,6 +826,39 @@ func (c *Client) call(method string, args interface{}, reply interface{}, waitFo
 	return err
 }
 
+// currentServices returns the services which are currently online with the
+// given name, keyed by address, by subscribing and reading updates until
+// discoverd signals that it has sent the current state.
+func (c *Client) currentServices(name string) (map[string]*agent.ServiceUpdate, error) {
+	if c.isReconnecting() {
+		return nil, ErrDisconnected
+	}
+	updates := make(chan *agent.ServiceUpdate)
+	_, call := c.streamGo("Agent.Subscribe", &agent.Args{Name: name}, updates)
+	defer func() {
+		call.CloseStream()
+		// drain to prevent deadlock while the stream is closed
+		for _ = range updates {
+		}
+	}()
+
+	services := make(map[string]*agent.ServiceUpdate)
+	for update := range updates {
+		if update.Addr == "" && update.Name == "" {
+			return services, nil
+		}
+		if update.Online {
+			services[update.Addr] = update
+		} else {
+			delete(services, update.Addr)
+		}
+	}
+	if call.Error != nil {
+		return nil, call.Error
+	}
+	return nil, ErrDisconnected
+}
+
 func (c *Client) streamGo(method string, args interface{}, reply interface{}) (*rpcplus.Client, *rpcplus.Call) {
 	client := c.rpcClient()
 	return client, client.StreamGo(method, args, reply)
@@ -718,14 +947,15 @@ func (c *Client) Unregister(name, addr string) error {
 		Name: name,
 		Addr: addr,
 	}
+	reg := registration{name: name, addr: addr}
 	c.l.Lock()
-	ch, ok := c.heartbeats[args.Addr]
+	ch, ok := c.heartbeats[reg]
 	if !ok {
 		c.l.Unlock()
 		return ErrUnknownRegistration
 	}
 	close(ch)
-	delete(c.heartbeats, args.Addr)
+	delete(c.heartbeats, reg)
 	c.l.Unlock()
 	err := c.call("Agent.Unregister", args, &struct{}{}, false)
 	if err != nil {
@@ -737,15 +967,13 @@ func (c *Client) Unregister(name, addr string) error {
 // UnregisterAll will call Unregister on all services that have been registered with this client.
 func (c *Client) UnregisterAll() error {
 	c.l.Lock()
-	addrs := make([]string, 0, len(c.heartbeats))
-	names := make([]string, 0, len(c.heartbeats))
-	for addr := range c.heartbeats {
-		addrs = append(addrs, addr)
-		names = append(names, c.names[addr])
+	regs := make([]registration, 0, len(c.heartbeats))
+	for reg := range c.heartbeats {
+		regs = append(regs, reg)
 	}
 	c.l.Unlock()
-	for i := range addrs {
-		err := c.Unregister(names[i], addrs[i])
+	for _, reg := range regs {
+		err := c.Unregister(reg.name, reg.addr)
 		if err != nil {
 			return err
 		}
@@ -867,6 +1095,23 @@ func RegisterWithAttributes(name, addr string, attributes map[string]string) err
 	return DefaultClient.RegisterWithAttributes(name, addr, attributes)
 }
 
+// DrainingHosts returns the IDs of the hosts which are registered as draining.
+func DrainingHosts() ([]string, error) {
+	if err := ensureDefaultConnected(); err != nil {
+		return nil, err
+	}
+	return DefaultClient.DrainingHosts()
+}
+
+// ServiceHosts returns the IDs of the hosts which an instance of the named
+// service is registered on.
+func ServiceHosts(name string) ([]string, error) {
+	if err := ensureDefaultConnected(); err != nil {
+		return nil, err
+	}
+	return DefaultClient.ServiceHosts(name)
+}
+
 // Unregister will explicitly unregister a service and as such it will stop any heartbeats
 // being sent from this client.
 func Unregister(name, addr string) error {
@@ -241,6 +241,149 @@ func TestNewAttributes(t *testing.T) {
 	assert(set.Close(), t)
 }
 
+func TestReregisterUpdatesInPlace(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	serviceName := "reregisterTest"
+
+	set, err := client.NewServiceSet(serviceName)
+	assert(err, t)
+	defer set.Close()
+
+	assert(client.RegisterWithAttributes(serviceName, ":1111", map[string]string{"foo": "bar"}), t)
+	waitUpdates(t, set, true, 1)()
+
+	updates := set.Watch(false)
+	defer set.Unwatch(updates)
+	assert(client.RegisterWithAttributes(serviceName, ":1111", map[string]string{"foo": "baz"}), t)
+	addr := set.Services()[0].Addr
+	assert(checkUpdate(updates, &agent.ServiceUpdate{
+		Name:   serviceName,
+		Addr:   addr,
+		Online: true,
+		Attrs:  map[string]string{"foo": "baz"},
+	}), t)
+
+	// re-registering with the same attributes is not passed on
+	assert(client.RegisterWithAttributes(serviceName, ":1111", map[string]string{"foo": "baz"}), t)
+	select {
+	case u := <-updates:
+		t.Fatalf("Expected a single update, got another: %#v", u)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	services := set.Services()
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(services))
+	}
+	if services[0].Attrs["foo"] != "baz" {
+		t.Fatalf(`Expected attribute to be updated to "baz", not %q`, services[0].Attrs["foo"])
+	}
+}
+
+func TestResync(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	serviceName := "resyncTest"
+
+	assert(client.Register(serviceName, "127.0.0.1:1111"), t)
+	assert(client.Register(serviceName, "127.0.0.1:2222"), t)
+
+	set, err := client.NewServiceSet(serviceName)
+	assert(err, t)
+	defer set.Close()
+	waitUpdates(t, set, true, 2)()
+
+	// the set misses :1111 coming online and :3333 going offline
+	discoverd.MissUpdate(set, &agent.ServiceUpdate{Name: serviceName, Addr: "127.0.0.1:1111", Online: false})
+	discoverd.MissUpdate(set, &agent.ServiceUpdate{Name: serviceName, Addr: "127.0.0.1:3333", Online: true})
+	checkServices(t, set.Services(), []*discoverd.Service{
+		{Name: serviceName, Addr: "127.0.0.1:2222", Host: "127.0.0.1", Port: "2222"},
+		{Name: serviceName, Addr: "127.0.0.1:3333", Host: "127.0.0.1", Port: "3333"},
+	})
+
+	updates := set.Watch(false)
+	defer set.Unwatch(updates)
+	assert(set.Resync(), t)
+	assert(checkUpdates(updates, []*agent.ServiceUpdate{
+		{Name: serviceName, Addr: "127.0.0.1:1111", Online: true},
+		{Name: serviceName, Addr: "127.0.0.1:3333", Online: false},
+	}), t)
+	if n := len(set.Services()); n != 2 {
+		t.Fatalf("Expected 2 services, got %d", n)
+	}
+	checkServices(t, set.Services(), []*discoverd.Service{
+		{Name: serviceName, Addr: "127.0.0.1:1111", Host: "127.0.0.1", Port: "1111"},
+		{Name: serviceName, Addr: "127.0.0.1:2222", Host: "127.0.0.1", Port: "2222"},
+	})
+
+	// resyncing a set which matches discoverd is a no-op
+	assert(set.Resync(), t)
+	select {
+	case u := <-updates:
+		t.Fatalf("Expected no updates, got %#v", u)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResyncLiveUpdate(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	serviceName := "resyncLiveTest"
+	assert(client.Register(serviceName, "127.0.0.1:1111"), t)
+
+	set, err := client.NewServiceSet(serviceName)
+	assert(err, t)
+	defer set.Close()
+	waitUpdates(t, set, true, 1)()
+
+	// :2222 comes online after the first snapshot is read but before it
+	// is applied, so applying it would remove :2222 again
+	var snapshots int
+	defer discoverd.SetResyncSnapshot(func(c *discoverd.Client, name string) (map[string]*agent.ServiceUpdate, error) {
+		current, err := discoverd.CurrentServices(c, name)
+		if snapshots++; snapshots == 1 {
+			wait := waitUpdates(t, set, false, 1)
+			assert(client.Register(serviceName, "127.0.0.1:2222"), t)
+			wait()
+		}
+		return current, err
+	})()
+
+	assert(set.Resync(), t)
+	if snapshots != 2 {
+		t.Fatalf("Expected the stale snapshot to be read again, read %d", snapshots)
+	}
+	checkServices(t, set.Services(), []*discoverd.Service{
+		{Name: serviceName, Addr: "127.0.0.1:1111", Host: "127.0.0.1", Port: "1111"},
+		{Name: serviceName, Addr: "127.0.0.1:2222", Host: "127.0.0.1", Port: "2222"},
+	})
+}
+
+func TestServiceHosts(t *testing.T) {
+	client, cleanup := testutil.SetupDiscoverd(t)
+	defer cleanup()
+
+	assert(client.RegisterWithAttributes("flynn-host", "127.0.0.1:1113", map[string]string{"id": "host1"}), t)
+	assert(client.RegisterWithAttributes("flynn-host", "127.0.0.2:1113", map[string]string{"id": "host2"}), t)
+
+	hosts, err := client.ServiceHosts("helper")
+	assert(err, t)
+	if len(hosts) != 0 {
+		t.Fatalf("Expected no hosts, got %v", hosts)
+	}
+
+	assert(client.Register("helper", "127.0.0.2:5000"), t)
+	hosts, err = client.ServiceHosts("helper")
+	assert(err, t)
+	if len(hosts) != 1 || hosts[0] != "host2" {
+		t.Fatalf("Expected [host2], got %v", hosts)
+	}
+}
+
 func TestFiltering(t *testing.T) {
 	client, cleanup := testutil.SetupDiscoverd(t)
 	defer cleanup()
@@ -0,0 +1,41 @@
+package discoverd
+
+import (
+	"net"
+
+	"github.com/flynn/flynn/discoverd/agent"
+)
+
+// MissUpdate applies an update to the set without notifying its watchers, as
+// if the set had missed the real update and drifted from discoverd.
+func MissUpdate(set ServiceSet, update *agent.ServiceUpdate) {
+	s := set.(*serviceSet)
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !update.Online {
+		delete(s.services, update.Addr)
+		return
+	}
+	host, port, _ := net.SplitHostPort(update.Addr)
+	s.services[update.Addr] = &Service{
+		Name:    update.Name,
+		Addr:    update.Addr,
+		Host:    host,
+		Port:    port,
+		Attrs:   update.Attrs,
+		Created: update.Created,
+	}
+}
+
+// SetResyncSnapshot replaces the function Resync uses to read the current
+// services, returning a function which restores it.
+func SetResyncSnapshot(f func(c *Client, name string) (map[string]*agent.ServiceUpdate, error)) func() {
+	prev := resyncSnapshot
+	resyncSnapshot = f
+	return func() { resyncSnapshot = prev }
+}
+
+// CurrentServices reads the current services from discoverd as Resync does.
+func CurrentServices(c *Client, name string) (map[string]*agent.ServiceUpdate, error) {
+	return c.currentServices(name)
+}
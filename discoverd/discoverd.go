@@ -10,10 +10,11 @@ import (
 
 var addr = flag.String("bind", ":1111", "address to bind on")
 var etcd = flag.String("etcd", "http://127.0.0.1:4001", "etcd servers")
+var prefix = flag.String("prefix", agent.DefaultKeyPrefix, "etcd key prefix, use a distinct prefix for each cluster sharing etcd")
 
 func main() {
 	flag.Parse()
-	server := agent.NewServer(*addr, strings.Split(*etcd, ","))
+	server := agent.NewServer(*addr, strings.Split(*etcd, ","), *prefix)
 	log.Printf("Starting server on %s...\n", server.Address)
 	log.Fatal(agent.ListenAndServe(server))
 }
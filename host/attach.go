@@ -75,6 +75,9 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 		Height:   req.Height,
 		Width:    req.Width,
 		Attached: attached,
+
+		StdoutOffset: req.StdoutOffset,
+		StderrOffset: req.StderrOffset,
 	}
 	var stdinW *io.PipeWriter
 	if req.Flags&host.AttachFlagStdin != 0 {
@@ -179,9 +182,14 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 			}
 		default:
 			close(failed)
-			writeMtx.Lock()
-			writeError(err.Error())
-			writeMtx.Unlock()
+			// writeMtx is still held from before the attach as it is only
+			// released on success
+			if err == ErrLogsTruncated {
+				w.WriteByte(host.AttachTruncated)
+				w.Flush()
+			} else {
+				writeError(err.Error())
+			}
 		}
 		if err != nil {
 			g.Log(grohl.Data{"at": "attach", "status": "error", "err": err.Error()})
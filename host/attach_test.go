@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// truncatedBackend is a backend whose Attach fails as if the logs had been
+// rotated past the requested offsets.
+type truncatedBackend struct {
+	Backend
+	req *AttachRequest
+}
+
+func (b *truncatedBackend) Attach(req *AttachRequest) error {
+	b.req = req
+	return ErrLogsTruncated
+}
+
+func TestAttachTruncated(t *testing.T) {
+	state := NewState()
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	backend := &truncatedBackend{}
+	h := &attachHandler{state: state, backend: backend}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		h.attach(&host.AttachReq{
+			JobID:        "a",
+			Flags:        host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
+			StdoutOffset: 5,
+			StderrOffset: 3,
+		}, server)
+		close(done)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var attachState [1]byte
+	if _, err := client.Read(attachState[:]); err != nil {
+		t.Fatal(err)
+	}
+	if attachState[0] != host.AttachTruncated {
+		t.Fatalf("expected attach state %d, got %d", host.AttachTruncated, attachState[0])
+	}
+	<-done
+	if backend.req.StdoutOffset != 5 || backend.req.StderrOffset != 3 {
+		t.Fatalf("expected offsets 5 and 3, got %d and %d", backend.req.StdoutOffset, backend.req.StderrOffset)
+	}
+}
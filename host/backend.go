@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 
 	"github.com/flynn/flynn/host/types"
@@ -14,6 +15,11 @@ type AttachRequest struct {
 	Height uint16
 	Width  uint16
 
+	// StdoutOffset and StderrOffset are the number of bytes of each stream
+	// to skip when replaying the logs
+	StdoutOffset int64
+	StderrOffset int64
+
 	Attached chan struct{}
 
 	Stdout io.WriteCloser
@@ -21,6 +27,10 @@ type AttachRequest struct {
 	Stdin  io.Reader
 }
 
+// ErrLogsTruncated is returned by Backend.Attach when the logs no longer
+// retain the output from the requested offsets onwards.
+var ErrLogsTruncated = errors.New("host: job logs truncated")
+
 type Backend interface {
 	Run(*host.Job) error
 	Stop(string) error
@@ -34,3 +44,17 @@ type Backend interface {
 type StateSaver interface {
 	SaveState(*json.Encoder) error
 }
+
+// ArtifactPruner is implemented by backends which cache artifacts and can
+// remove those which are no longer needed.
+type ArtifactPruner interface {
+	// PruneArtifacts removes cached artifacts other than those with the
+	// given URIs and those of the host's jobs, returning the bytes freed.
+	PruneArtifacts(keep []string) (int64, error)
+}
+
+// InitPIDer is implemented by backends which can find the host PID of the
+// init process of a job's container.
+type InitPIDer interface {
+	InitPID(id string) (int, error)
+}
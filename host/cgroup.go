@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// Allow using a fake cgroup filesystem in tests
+var cgroupPath = "/sys/fs/cgroup"
+
+// memoryCgroup returns the directory of the memory cgroup of the process with
+// the given PID.
+func memoryCgroup(pid int) (string, error) {
+	f, err := os.Open(filepath.Join(procPath, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// lines are of the form "hierarchy-ID:controller-list:cgroup-path"
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				return filepath.Join(cgroupPath, "memory", fields[2]), nil
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no memory cgroup found for process %d", pid)
+}
+
+func readCgroupInt(dir, name string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// setMemoryLimit sets the memory limit of the cgroup in dir to the given
+// number of KiB, zero being unlimited. It refuses to lower the limit below
+// the memory currently in use, which would cause the kernel to reclaim or
+// OOM kill the job's processes.
+func setMemoryLimit(dir string, kib int) error {
+	limit := int64(-1)
+	if kib > 0 {
+		limit = int64(kib) * 1024
+		usage, err := readCgroupInt(dir, "memory.usage_in_bytes")
+		if err != nil {
+			return err
+		}
+		if limit < usage {
+			return fmt.Errorf("host: cannot lower memory limit to %d KiB, %d KiB is in use", kib, usage/1024)
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "memory.limit_in_bytes"), []byte(strconv.FormatInt(limit, 10)), 0644)
+}
+
+// SetJobResources adjusts the resource limits of a running job in place,
+// without restarting it. Only the memory limit can be changed.
+func (h *Host) SetJobResources(req *host.SetJobResourcesReq, res *struct{}) error {
+	job := h.state.GetJob(req.JobID)
+	if job == nil {
+		return errors.New("host: unknown job")
+	}
+	if job.Status != host.StatusRunning {
+		return errors.New("host: job is not running")
+	}
+	if !devicesEqual(job.Job.Resources.Devices, req.Resources.Devices) {
+		return errors.New("host: devices cannot be changed while a job is running")
+	}
+	b, ok := h.backend.(InitPIDer)
+	if !ok {
+		return errors.New("host: backend does not support setting resources")
+	}
+	pid, err := b.InitPID(req.JobID)
+	if err != nil {
+		return err
+	}
+	dir, err := memoryCgroup(pid)
+	if err != nil {
+		return err
+	}
+	if err := setMemoryLimit(dir, req.Resources.Memory); err != nil {
+		return err
+	}
+	h.state.SetMemory(req.JobID, req.Resources.Memory)
+	return nil
+}
+
+func devicesEqual(a, b map[string]int) bool {
+	for typ, n := range a {
+		if b[typ] != n {
+			return false
+		}
+	}
+	for typ, n := range b {
+		if a[typ] != n {
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/flynn/flynn/host/types"
 )
@@ -27,9 +30,65 @@ func parseConfig(r io.Reader) (*host.Host, error) {
 
 type Config struct {
 	Metadata map[string]string `json:"metadata"`
+
+	// Resources are the resources the host advertises as available to
+	// jobs, for example {"memory": 4194304, "devices": {"gpu": 2}}. Jobs
+	// which request devices are only placed on hosts which advertise them.
+	Resources ResourcesConfig `json:"resources"`
+}
+
+type ResourcesConfig struct {
+	Memory  int            `json:"memory"` // in KiB, zero is unlimited
+	Devices map[string]int `json:"devices"`
 }
 
 func (c *Config) hostConfig() (*host.Host, error) {
 	h := &host.Host{Metadata: c.Metadata}
+	if c.Resources.Memory < 0 {
+		return nil, fmt.Errorf("host: invalid memory %d", c.Resources.Memory)
+	}
+	h.Resources.Memory = c.Resources.Memory
+	for name, n := range c.Resources.Devices {
+		if err := setDevice(h, name, n); err != nil {
+			return nil, err
+		}
+	}
 	return h, nil
 }
+
+// applyResourceFlags sets the resources advertised by the host from the
+// --memory and --device flags, overriding those set in its config.
+func applyResourceFlags(h *host.Host, memory string, devices []string) error {
+	if memory != "" {
+		n, err := strconv.Atoi(memory)
+		if err != nil || n < 0 {
+			return fmt.Errorf("host: invalid memory %q", memory)
+		}
+		h.Resources.Memory = n
+	}
+	for _, s := range devices {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("host: invalid device %q, must be NAME=COUNT", s)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("host: invalid count of device %q", kv[0])
+		}
+		if err := setDevice(h, kv[0], n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setDevice(h *host.Host, name string, n int) error {
+	if name == "" || n < 0 {
+		return fmt.Errorf("host: invalid device %q with count %d", name, n)
+	}
+	if h.Resources.Devices == nil {
+		h.Resources.Devices = make(map[string]int)
+	}
+	h.Resources.Devices[name] = n
+	return nil
+}
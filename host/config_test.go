@@ -20,3 +20,37 @@ func TestConfig(t *testing.T) {
 		t.Errorf("incorrect config: got %#v, want %#v", actual, expected)
 	}
 }
+
+func TestConfigResources(t *testing.T) {
+	actual, err := parseConfig(bytes.NewBuffer([]byte(`{ "resources": { "memory": 1048576, "devices": { "gpu": 2 } } }`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := host.JobResources{Memory: 1048576, Devices: map[string]int{"gpu": 2}}
+	if !reflect.DeepEqual(actual.Resources, expected) {
+		t.Errorf("incorrect resources: got %#v, want %#v", actual.Resources, expected)
+	}
+
+	// flags override the config
+	if err := applyResourceFlags(actual, "2097152", []string{"gpu=4", "fpga=1"}); err != nil {
+		t.Fatal(err)
+	}
+	expected = host.JobResources{Memory: 2097152, Devices: map[string]int{"gpu": 4, "fpga": 1}}
+	if !reflect.DeepEqual(actual.Resources, expected) {
+		t.Errorf("incorrect resources: got %#v, want %#v", actual.Resources, expected)
+	}
+
+	for _, conf := range []string{
+		`{ "resources": { "memory": -1 } }`,
+		`{ "resources": { "devices": { "gpu": -1 } } }`,
+	} {
+		if _, err := parseConfig(bytes.NewBuffer([]byte(conf))); err == nil {
+			t.Errorf("expected an error parsing %s", conf)
+		}
+	}
+	for _, device := range []string{"gpu", "gpu=x", "=1"} {
+		if err := applyResourceFlags(&host.Host{}, "", []string{device}); err == nil {
+			t.Errorf("expected an error for device flag %q", device)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -26,6 +27,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -50,6 +52,7 @@ type ContainerInitArgs struct {
 	child      bool
 	env        []string
 	args       []string
+	initCmd    []string
 }
 
 const SharedPath = "/.container-shared"
@@ -61,6 +64,10 @@ const (
 	StateRunning
 	StateExited
 	StateFailed
+
+	// StateInitFailed is a failure of the init command, which is permanent
+	// so the job should not be restarted
+	StateInitFailed
 )
 
 func (s State) String() string {
@@ -73,6 +80,8 @@ func (s State) String() string {
 		return "exited"
 	case StateFailed:
 		return "failed"
+	case StateInitFailed:
+		return "init_failed"
 	default:
 		return "unknown"
 	}
@@ -147,8 +156,21 @@ func (c *Client) Signal(signal int) error {
 	return err
 }
 
+// PreStopArgs are the command run by ContainerInit.PreStop and how long to
+// wait for it to exit.
+type PreStopArgs struct {
+	Cmd     []string
+	Timeout time.Duration
+}
+
+// PreStop runs cmd in the container and waits up to timeout for it to exit.
+func (c *Client) PreStop(cmd []string, timeout time.Duration) error {
+	return c.c.Call("ContainerInit.PreStop", &PreStopArgs{Cmd: cmd, Timeout: timeout}, &struct{}{})
+}
+
 func newContainerInit(args *ContainerInitArgs) *ContainerInit {
 	return &ContainerInit{
+		args:      args,
 		resume:    make(chan struct{}),
 		streams:   make(map[chan StateChange]struct{}),
 		openStdin: args.openStdin,
@@ -156,6 +178,7 @@ func newContainerInit(args *ContainerInitArgs) *ContainerInit {
 }
 
 type ContainerInit struct {
+	args       *ContainerInitArgs
 	mtx        sync.Mutex
 	state      State
 	resume     chan struct{}
@@ -201,6 +224,48 @@ func (c *ContainerInit) Signal(sig int, res *struct{}) error {
 	return nil
 }
 
+// PreStop runs a command with the same environment and user as the app,
+// waiting up to the timeout for it to exit and killing it if it has not. The container is
+// stopped whether or not the command succeeds, so failures are only logged.
+func (c *ContainerInit) PreStop(args *PreStopArgs, res *struct{}) error {
+	if len(args.Cmd) == 0 {
+		return nil
+	}
+	cmdPath, err := getCmdPath(c.args, args.Cmd[0])
+	if err != nil {
+		log.Printf("pre-stop command: %s", err)
+		return nil
+	}
+	cred, err := getCredential(c.args)
+	if err != nil {
+		log.Printf("pre-stop command: %s", err)
+		return nil
+	}
+	cmd := exec.Command(cmdPath, args.Cmd[1:]...)
+	cmd.Dir = c.args.workDir
+	cmd.Env = c.args.env
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("pre-stop command: %s", err)
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(args.Timeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timed out after %s", args.Timeout)
+	}
+	if err != nil {
+		log.Printf("pre-stop command: %s", err)
+	}
+	return nil
+}
+
 func (c *ContainerInit) GetPtyMaster(arg struct{}, fd *fdrpc.FD) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -335,13 +400,23 @@ func setupNetworking(args *ContainerInitArgs) error {
 	return nil
 }
 
+// getCredential returns the credential to run the app as, looking args.user
+// up in the container's passwd file by name or uid. A uid without a passwd
+// entry runs with the group of the same id.
 func getCredential(args *ContainerInitArgs) (*syscall.Credential, error) {
 	if args.user == "" {
 		return nil, nil
 	}
+	uid, uidErr := strconv.ParseUint(args.user, 10, 32)
 	users, err := user.ParsePasswdFilter(func(u *user.User) bool {
+		if uidErr == nil {
+			return u.Uid == int(uid)
+		}
 		return u.Name == args.user
 	})
+	if uidErr == nil && (err != nil || len(users) == 0) {
+		return &syscall.Credential{Uid: uint32(uid), Gid: uint32(uid)}, nil
+	}
 	if err != nil || len(users) == 0 {
 		if err == nil {
 			err = errors.New("unknown user")
@@ -374,19 +449,19 @@ func getEnv(args *ContainerInitArgs, key string) string {
 	return ""
 }
 
-func getCmdPath(args *ContainerInitArgs) (string, error) {
+func getCmdPath(args *ContainerInitArgs, name string) (string, error) {
 	// Set PATH in containerinit so we can find the cmd
 	if envPath := getEnv(args, "PATH"); envPath != "" {
 		os.Setenv("PATH", envPath)
 	}
 
 	// Find the cmd
-	cmdPath, err := exec.LookPath(args.args[0])
+	cmdPath, err := exec.LookPath(name)
 	if err != nil {
 		if args.workDir == "" {
 			return "", err
 		}
-		if cmdPath, err = exec.LookPath(path.Join(args.workDir, args.args[0])); err != nil {
+		if cmdPath, err = exec.LookPath(path.Join(args.workDir, name)); err != nil {
 			return "", err
 		}
 	}
@@ -420,6 +495,70 @@ func babySit(process *os.Process) int {
 	return wstatus.ExitStatus()
 }
 
+// runInitCmd runs the init command to completion with the same environment,
+// user and output as the app. The lock is released while it runs so that it can be
+// signalled if the container is stopped. Caller must hold lock.
+func (c *ContainerInit) runInitCmd(args *ContainerInitArgs, cred *syscall.Credential, stdout, stderr io.Writer) error {
+	cmdPath, err := getCmdPath(args, args.initCmd[0])
+	if err != nil {
+		return fmt.Errorf("init command: %s", err)
+	}
+	cmd := exec.Command(cmdPath, args.initCmd[1:]...)
+	cmd.Dir = args.workDir
+	cmd.Env = args.env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("init command: %s", err)
+	}
+	c.process = cmd.Process
+
+	c.mtx.Unlock()
+	err = cmd.Wait()
+	c.mtx.Lock()
+
+	c.process = nil
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("init command exited with status %d", exitErr.Sys().(syscall.WaitStatus).ExitStatus())
+	} else if err != nil {
+		return fmt.Errorf("init command: %s", err)
+	}
+	return nil
+}
+
+// startApp runs the init command, if any, and then starts the app, moving to
+// the init failed or failed state without starting the app if either fails.
+// Caller must hold lock.
+func (c *ContainerInit) startApp(args *ContainerInitArgs, cmd *exec.Cmd) error {
+	cred, err := getCredential(args)
+	if err != nil {
+		c.changeState(StateFailed, err.Error(), -1)
+		return err
+	}
+	if len(args.initCmd) > 0 {
+		if err := c.runInitCmd(args, cred, cmd.Stdout, cmd.Stderr); err != nil {
+			c.changeState(StateInitFailed, err.Error(), -1)
+			return err
+		}
+	}
+	if cred != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	if err := cmd.Start(); err != nil {
+		c.changeState(StateFailed, err.Error(), -1)
+		return err
+	}
+	c.process = cmd.Process
+	c.changeState(StateRunning, "", -1)
+	return nil
+}
+
 // Run as pid 1 and monitor the contained process to return its exit code.
 func containerInitApp(args *ContainerInitArgs) error {
 	init := newContainerInit(args)
@@ -431,7 +570,7 @@ func containerInitApp(args *ContainerInitArgs) error {
 
 	// Prepare the cmd based on the given args
 	// If this fails we report that below
-	cmdPath, cmdErr := getCmdPath(args)
+	cmdPath, cmdErr := getCmdPath(args, args.args[0])
 	cmd := exec.Command(cmdPath, args.args[1:]...)
 	cmd.Dir = args.workDir
 	cmd.Env = args.env
@@ -497,12 +636,10 @@ func containerInitApp(args *ContainerInitArgs) error {
 	if err := setupCommon(args); err != nil {
 		init.changeState(StateFailed, err.Error(), -1)
 	}
-	// Start the app
-	if err := cmd.Start(); err != nil {
-		init.changeState(StateFailed, err.Error(), -1)
+	// Run the init command and start the app
+	if err := init.startApp(args, cmd); err != nil {
+		return err
 	}
-	init.process = cmd.Process
-	init.changeState(StateRunning, "", -1)
 
 	init.mtx.Unlock() // Allow calls
 	exitCode = babySit(init.process)
@@ -557,6 +694,16 @@ func Main() {
 	// Propagate the plugin-specific container env variable
 	env = append(env, "container="+os.Getenv("container"))
 
+	// Get the init command, which is only written if the job has one
+	var initCmd []string
+	if content, err := ioutil.ReadFile("/.containerinitcmd"); err == nil {
+		if err := json.Unmarshal(content, &initCmd); err != nil {
+			log.Fatalf("Unable to unmarshal init command: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Unable to load init command: %v", err)
+	}
+
 	args := &ContainerInitArgs{
 		user:       *user,
 		gateway:    *gateway,
@@ -567,6 +714,7 @@ func Main() {
 		openStdin:  *openStdin,
 		env:        env,
 		args:       flag.Args(),
+		initCmd:    initCmd,
 	}
 
 	if err := containerInitApp(args); err != nil {
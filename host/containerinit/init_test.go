@@ -0,0 +1,200 @@
+package containerinit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testInitArgs(t *testing.T, initCmd ...string) (*ContainerInitArgs, func()) {
+	dir, err := ioutil.TempDir("", "containerinit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &ContainerInitArgs{
+		workDir: dir,
+		env:     []string{"PATH=" + os.Getenv("PATH")},
+		initCmd: initCmd,
+	}
+	return args, func() { os.RemoveAll(dir) }
+}
+
+func TestInitCmd(t *testing.T) {
+	args, cleanup := testInitArgs(t, "sh", "-c", "echo configured > config")
+	defer cleanup()
+
+	var out bytes.Buffer
+	cmd := exec.Command("cat", "config")
+	cmd.Dir = args.workDir
+	cmd.Stdout = &out
+
+	init := newContainerInit(args)
+	init.mtx.Lock()
+	err := init.startApp(args, cmd)
+	init.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if init.state != StateRunning {
+		t.Fatalf("expected state running, got %s", init.state)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the app sees the file written by the init command
+	if out.String() != "configured\n" {
+		t.Fatalf("expected app output %q, got %q", "configured\n", out.String())
+	}
+}
+
+func TestInitCmdFailure(t *testing.T) {
+	args, cleanup := testInitArgs(t, "sh", "-c", "exit 1")
+	defer cleanup()
+
+	cmd := exec.Command("touch", "started")
+	cmd.Dir = args.workDir
+
+	init := newContainerInit(args)
+	changes := make(chan StateChange, 10)
+	init.streams[changes] = struct{}{}
+	init.mtx.Lock()
+	err := init.startApp(args, cmd)
+	init.mtx.Unlock()
+	if err == nil {
+		t.Fatal("expected an error starting the app")
+	}
+	close(changes)
+
+	// the container fails without ever running the app
+	var states []State
+	for change := range changes {
+		states = append(states, change.State)
+	}
+	if len(states) != 1 || states[0] != StateInitFailed {
+		t.Fatalf("expected only an init failed state change, got %v", states)
+	}
+	if init.error != "init command exited with status 1" {
+		t.Fatalf("unexpected error %q", init.error)
+	}
+	if cmd.Process != nil || init.process != nil {
+		t.Fatal("expected the app not to be started")
+	}
+	if _, err := os.Stat(filepath.Join(args.workDir, "started")); !os.IsNotExist(err) {
+		t.Fatalf("expected the app not to have run, got %v", err)
+	}
+}
+
+func TestUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user requires root")
+	}
+	args, cleanup := testInitArgs(t)
+	defer cleanup()
+	args.user = "1234"
+	// the app must be able to enter the work dir as the new user
+	if err := os.Chmod(args.workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "id -u; id -g")
+	cmd.Dir = args.workDir
+	cmd.Stdout = &out
+
+	init := newContainerInit(args)
+	init.mtx.Lock()
+	err := init.startApp(args, cmd)
+	init.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1234\n1234\n" {
+		t.Fatalf("expected the app to run as uid and gid 1234, got %q", out.String())
+	}
+}
+
+func TestPreStop(t *testing.T) {
+	args, cleanup := testInitArgs(t)
+	defer cleanup()
+
+	// the app records whether the marker existed when it got SIGTERM
+	cmd := exec.Command("sh", "-c", `trap 'test -f marker && echo ran > result; exit 0' TERM; while true; do sleep 0.1; done`)
+	cmd.Dir = args.workDir
+
+	init := newContainerInit(args)
+	init.mtx.Lock()
+	err := init.startApp(args, cmd)
+	init.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := init.PreStop(&PreStopArgs{Cmd: []string{"touch", "marker"}, Timeout: time.Second}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.Signal(int(syscall.SIGTERM), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile(filepath.Join(args.workDir, "result"))
+	if err != nil {
+		t.Fatalf("expected the pre-stop command to have run before SIGTERM, got %v", err)
+	}
+	if string(result) != "ran\n" {
+		t.Fatalf("unexpected result %q", result)
+	}
+}
+
+func TestPreStopUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user requires root")
+	}
+	args, cleanup := testInitArgs(t)
+	defer cleanup()
+	args.user = "1234"
+	if err := os.Chmod(args.workDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	init := newContainerInit(args)
+	if err := init.PreStop(&PreStopArgs{Cmd: []string{"sh", "-c", "id -u > result"}, Timeout: time.Second}, nil); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile(filepath.Join(args.workDir, "result"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "1234\n" {
+		t.Fatalf("expected the pre-stop command to run as uid 1234, got %q", result)
+	}
+}
+
+func TestPreStopTimeout(t *testing.T) {
+	args, cleanup := testInitArgs(t)
+	defer cleanup()
+
+	init := newContainerInit(args)
+	start := time.Now()
+	if err := init.PreStop(&PreStopArgs{Cmd: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a slow pre-stop command is killed so the stop can continue
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected the pre-stop command to be killed after the timeout, took %s", d)
+	}
+
+	// a failing pre-stop command does not fail the stop either
+	if err := init.PreStop(&PreStopArgs{Cmd: []string{"sh", "-c", "exit 1"}, Timeout: time.Second}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
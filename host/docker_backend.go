@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,9 +9,11 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
@@ -54,6 +57,8 @@ type dockerClient interface {
 	AttachToContainer(docker.AttachToContainerOptions) error
 	KillContainer(docker.KillContainerOptions) error
 	ListContainers(docker.ListContainersOptions) ([]docker.APIContainers, error)
+	ListImages(bool) ([]docker.APIImages, error)
+	RemoveImage(string) error
 }
 
 func (d *DockerBackend) Run(job *host.Job) error {
@@ -65,9 +70,25 @@ func (d *DockerBackend) Run(job *host.Job) error {
 		g.Log(grohl.Data{"at": "parse_artifact_uri", "status": "error", "err": err})
 		return err
 	}
+	for _, m := range job.Config.Mounts {
+		if m.Volume != "" {
+			g.Log(grohl.Data{"at": "check_mounts", "status": "error", "volume": m.Volume})
+			return fmt.Errorf("docker: named volumes are not supported, job mounts %q", m.Volume)
+		}
+	}
+	if len(job.Config.InitCmd) > 0 {
+		g.Log(grohl.Data{"at": "check_init_cmd", "status": "error"})
+		return errors.New("docker: init commands are not supported")
+	}
+	if len(job.Config.PreStop) > 0 {
+		g.Log(grohl.Data{"at": "check_pre_stop", "status": "error"})
+		return errors.New("docker: pre-stop commands are not supported")
+	}
 
 	config := &docker.Config{
 		Image:        image,
+		Hostname:     job.Config.Hostname,
+		User:         job.Config.User,
 		Entrypoint:   job.Config.Entrypoint,
 		Cmd:          job.Config.Cmd,
 		Tty:          job.Config.TTY,
@@ -83,6 +104,7 @@ func (d *DockerBackend) Run(job *host.Job) error {
 	opts := docker.CreateContainerOptions{Config: config}
 	hostConfig := &docker.HostConfig{
 		PortBindings: make(map[docker.Port][]docker.PortBinding, len(job.Config.Ports)),
+		Dns:          job.Config.DNS,
 	}
 	for k, v := range job.Config.Env {
 		config.Env = append(config.Env, k+"="+v)
@@ -132,8 +154,10 @@ func (d *DockerBackend) Run(job *host.Job) error {
 	container, err := d.docker.CreateContainer(opts)
 	if err == docker.ErrNoSuchImage {
 		g.Log(grohl.Data{"at": "pull_image"})
-		pullOpts.OutputStream = os.Stdout
+		d.state.StartPull(job.ID)
+		pullOpts.OutputStream = io.MultiWriter(os.Stdout, &dockerPullProgress{state: d.state, jobID: job.ID})
 		err = d.docker.PullImage(*pullOpts, docker.AuthConfiguration{})
+		d.state.FinishPull(job.ID, err)
 		if err != nil {
 			g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
 			return err
@@ -162,9 +186,111 @@ func (d *DockerBackend) Run(job *host.Job) error {
 	return nil
 }
 
+func (d *DockerBackend) InitPID(id string) (int, error) {
+	job := d.state.GetJob(id)
+	if job == nil {
+		return 0, errors.New("unknown job")
+	}
+	container, err := d.docker.InspectContainer(job.ContainerID)
+	if err != nil {
+		return 0, err
+	}
+	if !container.State.Running {
+		return 0, errors.New("job is not running")
+	}
+	return container.State.Pid, nil
+}
+
 func (d *DockerBackend) Stop(id string) error {
-	const stopTimeout = 10
-	return d.docker.StopContainer(d.state.GetJob(id).ContainerID, stopTimeout)
+	job := d.state.GetJob(id)
+	stopTimeout := job.Job.Config.StopTimeout()
+	return d.docker.StopContainer(job.ContainerID, uint(stopTimeout/time.Second))
+}
+
+func (d *DockerBackend) PruneArtifacts(keep []string) (int64, error) {
+	g := grohl.NewContext(grohl.Data{"backend": "docker", "fn": "prune_artifacts"})
+
+	// never remove the images of the host's jobs, even if they are not in
+	// the keep set
+	uris := append([]string{}, keep...)
+	for _, job := range d.state.Get() {
+		if job.Job != nil {
+			uris = append(uris, job.Job.Artifact.URI)
+		}
+	}
+	kept := make([]dockerKeptImage, 0, len(uris))
+	for _, uri := range uris {
+		k, err := parseDockerKeptImage(uri)
+		if err != nil {
+			continue
+		}
+		kept = append(kept, k)
+	}
+
+	images, err := d.docker.ListImages(false)
+	if err != nil {
+		g.Log(grohl.Data{"at": "list_images", "status": "error", "err": err})
+		return 0, err
+	}
+	var freed int64
+	for _, image := range images {
+		if dockerImageKept(image, kept) {
+			continue
+		}
+		if err := d.docker.RemoveImage(image.ID); err != nil {
+			// the image may be in use by a container which is not a job,
+			// or be the parent of another image
+			g.Log(grohl.Data{"at": "remove_image", "status": "error", "image.id": image.ID, "err": err})
+			continue
+		}
+		g.Log(grohl.Data{"at": "remove_image", "image.id": image.ID, "size": image.Size})
+		freed += image.Size
+	}
+	return freed, nil
+}
+
+// dockerKeptImage identifies an image which is kept when pruning, either by
+// ID or, if the URI has no ID, by repository and tag.
+type dockerKeptImage struct {
+	id      string
+	repoTag string
+}
+
+func parseDockerKeptImage(uri string) (dockerKeptImage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return dockerKeptImage{}, err
+	}
+	if id := u.Query().Get("id"); id != "" {
+		return dockerKeptImage{id: id}, nil
+	}
+	_, opts, err := parseDockerImageURI(uri)
+	if err != nil {
+		return dockerKeptImage{}, err
+	}
+	tag := opts.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	return dockerKeptImage{repoTag: opts.Repository + ":" + tag}, nil
+}
+
+// dockerImageKept returns whether the image is one of the kept images.
+func dockerImageKept(image docker.APIImages, kept []dockerKeptImage) bool {
+	for _, k := range kept {
+		if k.id != "" {
+			if strings.HasPrefix(image.ID, k.id) {
+				return true
+			}
+			continue
+		}
+		for _, repoTag := range image.RepoTags {
+			if repoTag == k.repoTag {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (d *DockerBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *json.Decoder) error {
@@ -199,6 +325,9 @@ func (d *DockerBackend) Signal(id string, sig int) error {
 }
 
 func (d *DockerBackend) Attach(req *AttachRequest) error {
+	if req.StdoutOffset > 0 || req.StderrOffset > 0 {
+		return errors.New("docker backend does not support resuming from log offsets")
+	}
 	outR, outW := io.Pipe()
 	opts := docker.AttachToContainerOptions{
 		Container:    req.Job.ContainerID,
@@ -370,3 +499,71 @@ func parseDockerImageURI(s string) (name string, opts *docker.PullImageOptions,
 	}
 	return
 }
+
+// dockerPullProgress parses the progress output of a docker image pull and
+// records it as the pull progress of a job.
+type dockerPullProgress struct {
+	state    *State
+	jobID    string
+	buf      []byte
+	progress host.PullProgress
+}
+
+var dockerProgressBytes = regexp.MustCompile(`([0-9.]+) ?([kKMG]?B)/([0-9.]+) ?([kKMG]?B)`)
+
+func (p *dockerPullProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+		if line != "" {
+			p.parseLine(line)
+		}
+	}
+	return len(b), nil
+}
+
+func (p *dockerPullProgress) parseLine(line string) {
+	status := line
+	if i := strings.Index(line, "["); i > 0 {
+		status = strings.TrimSpace(line[:i])
+	}
+	switch {
+	case strings.HasPrefix(status, "Pulling fs layer"):
+		p.progress.LayersTotal++
+	case strings.HasPrefix(status, "Already exists"):
+		p.progress.LayersTotal++
+		p.progress.LayersDone++
+	case strings.HasPrefix(status, "Download complete"):
+		p.progress.LayersDone++
+		p.progress.Current, p.progress.Total = 0, 0
+	case strings.HasPrefix(status, "Downloading"):
+		if m := dockerProgressBytes.FindStringSubmatch(line); m != nil {
+			p.progress.Current = parseDockerSize(m[1], m[2])
+			p.progress.Total = parseDockerSize(m[3], m[4])
+		}
+	}
+	p.progress.Status = status
+	p.state.SetPullProgress(p.jobID, p.progress)
+}
+
+// parseDockerSize parses sizes formatted by docker, which uses SI units.
+func parseDockerSize(n, unit string) int64 {
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return 0
+	}
+	switch strings.ToUpper(unit) {
+	case "KB":
+		f *= 1e3
+	case "MB":
+		f *= 1e6
+	case "GB":
+		f *= 1e9
+	}
+	return int64(f)
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/host/ports"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
 )
 
 type nullLogger struct{}
@@ -30,9 +33,13 @@ type fakeDockerClient struct {
 	pullErr     error
 	created     docker.CreateContainerOptions
 	pulled      string
+	pullOutput  []string
+	pullStep    chan struct{} // if not nil, a receive is required after each line of pull output
 	started     bool
 	hostConf    *docker.HostConfig
 	listeners   map[chan<- *docker.APIEvents]struct{}
+	images      []docker.APIImages
+	removed     []string
 	mtx         sync.RWMutex
 	newListener chan struct{}
 }
@@ -74,6 +81,12 @@ func (c *fakeDockerClient) PullImage(opts docker.PullImageOptions, auth docker.A
 	if c.pullErr != nil {
 		return c.pullErr
 	}
+	for _, line := range c.pullOutput {
+		opts.OutputStream.Write([]byte(line))
+		if c.pullStep != nil {
+			<-c.pullStep
+		}
+	}
 	c.pulled = opts.Repository
 	return nil
 }
@@ -131,6 +144,25 @@ func (c *fakeDockerClient) ListContainers(docker.ListContainersOptions) ([]docke
 	return nil, nil
 }
 
+func (c *fakeDockerClient) ListImages(bool) ([]docker.APIImages, error) {
+	return c.images, nil
+}
+
+func (c *fakeDockerClient) RemoveImage(id string) error {
+	images := make([]docker.APIImages, 0, len(c.images))
+	for _, image := range c.images {
+		if image.ID != id {
+			images = append(images, image)
+		}
+	}
+	if len(images) == len(c.images) {
+		return docker.ErrNoSuchImage
+	}
+	c.images = images
+	c.removed = append(c.removed, id)
+	return nil
+}
+
 func testDockerRun(job *host.Job, t *testing.T) (*State, *fakeDockerClient) {
 	client := NewFakeDockerClient()
 	return testDockerRunWithOpts(job, "", client, t), client
@@ -238,6 +270,24 @@ func TestProcessWithImplicitPortsAndIP(t *testing.T) {
 	}
 }
 
+func TestProcessWithDNSAndHostname(t *testing.T) {
+	job := &host.Job{
+		ID: "a",
+		Config: host.ContainerConfig{
+			DNS:      []string{"10.0.0.2"},
+			Hostname: "web-1",
+		},
+	}
+	_, client := testDockerRun(job, t)
+
+	if client.created.Config.Hostname != "web-1" {
+		t.Errorf("expected hostname web-1, got %q", client.created.Config.Hostname)
+	}
+	if dns := client.hostConf.Dns; len(dns) != 1 || dns[0] != "10.0.0.2" {
+		t.Errorf("expected nameserver 10.0.0.2, got %v", dns)
+	}
+}
+
 func sliceHasString(slice []string, str string) bool {
 	for _, s := range slice {
 		if s == str {
@@ -258,6 +308,223 @@ func TestProcessWithPull(t *testing.T) {
 	}
 }
 
+func TestProcessWithPullProgress(t *testing.T) {
+	job := &host.Job{ID: "a", Artifact: host.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/test/foo"}}
+	client := NewFakeDockerClient()
+	client.createErr = docker.ErrNoSuchImage
+	client.pullOutput = []string{
+		"Pulling fs layer\n",
+		"Pulling fs layer\n",
+		"Downloading [=====>      ] 1.5 MB/3 MB 1s\r",
+		"Download complete\n",
+		"Downloading [=>          ] 500 kB/2 MB 4s\r",
+		"Download complete\n",
+	}
+	client.pullStep = make(chan struct{})
+
+	state := NewState()
+	h := &Host{state: state}
+	progress := make(chan interface{})
+	stream := rpcplus.Stream{Send: progress, Error: make(chan error)}
+	streamDone := make(chan struct{})
+	go func() {
+		h.PullProgress(job.ID, stream)
+		close(streamDone)
+	}()
+
+	runErr := make(chan error)
+	go func() {
+		runErr <- (&DockerBackend{
+			docker: client,
+			state:  state,
+			ports:  map[string]*ports.Allocator{"tcp": ports.NewAllocator(500, 550)},
+		}).Run(job)
+	}()
+
+	next := func() *host.PullProgress {
+		select {
+		case p := <-progress:
+			return p.(*host.PullProgress)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for pull progress")
+		}
+		return nil
+	}
+	expected := []host.PullProgress{
+		{Status: "Pulling fs layer", LayersTotal: 1},
+		{Status: "Pulling fs layer", LayersTotal: 2},
+		{Status: "Downloading", LayersTotal: 2, Current: 1500000, Total: 3000000},
+		{Status: "Download complete", LayersTotal: 2, LayersDone: 1},
+		{Status: "Downloading", LayersTotal: 2, LayersDone: 1, Current: 500000, Total: 2000000},
+		{Status: "Download complete", LayersTotal: 2, LayersDone: 2},
+	}
+	percents := []int{0, 0, 25, 50, 62, 100}
+	for i, e := range expected {
+		e.JobID = job.ID
+		p := next()
+		if *p != e {
+			t.Fatalf("%d: expected %+v, got %+v", i, e, p)
+		}
+		if p.Percent() != percents[i] {
+			t.Errorf("%d: expected %d%%, got %d%%", i, percents[i], p.Percent())
+		}
+		client.pullStep <- struct{}{}
+	}
+
+	// the stream ends with a done progress once the pull completes
+	if p := next(); !p.Done || p.Error != "" || p.LayersDone != 2 {
+		t.Fatalf("expected done progress, got %+v", p)
+	}
+	select {
+	case <-streamDone:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for pull progress stream to end")
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+	if job := state.GetJob(job.ID); job.Status != host.StatusRunning {
+		t.Fatalf("expected job to be running, got %s", job.Status)
+	}
+
+	// watching a job which has started ends immediately
+	w := state.AddPullWatcher(job.ID)
+	defer state.RemovePullWatcher(job.ID, w)
+	select {
+	case <-w.notify:
+		if p := w.Latest(); !p.Done {
+			t.Fatalf("expected done progress, got %+v", p)
+		}
+	default:
+		t.Fatal("expected done progress")
+	}
+}
+
+// pullLimitDockerClient requires the image of each container to be pulled
+// before it is created, blocking each pull until a value is received on step
+// and recording the most pulls which were in progress at once.
+type pullLimitDockerClient struct {
+	*fakeDockerClient
+	step chan struct{}
+
+	mtx     sync.Mutex
+	pulled  map[string]bool
+	active  int
+	maxSeen int
+}
+
+func (c *pullLimitDockerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.pulled[opts.Config.Image] {
+		return nil, docker.ErrNoSuchImage
+	}
+	return &docker.Container{ID: opts.Name}, nil
+}
+
+func (c *pullLimitDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	c.mtx.Lock()
+	c.active++
+	if c.active > c.maxSeen {
+		c.maxSeen = c.active
+	}
+	c.mtx.Unlock()
+
+	<-c.step
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.active--
+	c.pulled[opts.Repository] = true
+	return nil
+}
+
+func (c *pullLimitDockerClient) StartContainer(id string, config *docker.HostConfig) error {
+	return nil
+}
+
+func (c *pullLimitDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{NetworkSettings: &docker.NetworkSettings{}}, nil
+}
+
+func TestProcessWithPullLimit(t *testing.T) {
+	const jobCount, limit = 6, 2
+	client := &pullLimitDockerClient{
+		fakeDockerClient: NewFakeDockerClient(),
+		step:             make(chan struct{}),
+		pulled:           make(map[string]bool),
+	}
+	state := NewState()
+	state.SetPullLimit(limit)
+	backend := &DockerBackend{
+		docker: client,
+		state:  state,
+		ports:  map[string]*ports.Allocator{"tcp": ports.NewAllocator(500, 550)},
+	}
+
+	runErr := make(chan error)
+	for i := 0; i < jobCount; i++ {
+		job := &host.Job{
+			ID:       fmt.Sprintf("job%d", i),
+			Artifact: host.Artifact{Type: "docker", URI: fmt.Sprintf("https://registry.hub.docker.com/test/foo%d", i)},
+		}
+		go func() { runErr <- backend.Run(job) }()
+	}
+
+	// queued returns the number of jobs whose pulls are queued
+	queued := func() int {
+		state.pullMtx.Lock()
+		defer state.pullMtx.Unlock()
+		var n int
+		for _, p := range state.pulls {
+			if p.Status == host.PullStatusQueued {
+				n++
+			}
+		}
+		return n
+	}
+	waitPulls := func(active, waiting int) {
+		timeout := time.After(time.Second)
+		for {
+			client.mtx.Lock()
+			n := client.active
+			client.mtx.Unlock()
+			if n == active && queued() == waiting {
+				return
+			}
+			select {
+			case <-timeout:
+				t.Fatalf("timed out waiting for %d active and %d queued pulls, got %d and %d", active, waiting, n, queued())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// pulls beyond the limit are queued, and start as others finish
+	for remaining := jobCount; remaining > 0; remaining-- {
+		active := remaining
+		if active > limit {
+			active = limit
+		}
+		waitPulls(active, remaining-active)
+		client.step <- struct{}{}
+	}
+	for i := 0; i < jobCount; i++ {
+		if err := <-runErr; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if client.maxSeen != limit {
+		t.Fatalf("expected at most %d concurrent pulls, got %d", limit, client.maxSeen)
+	}
+	for i := 0; i < jobCount; i++ {
+		if job := state.GetJob(fmt.Sprintf("job%d", i)); job.Status != host.StatusRunning {
+			t.Fatalf("expected job%d to be running, got %s", i, job.Status)
+		}
+	}
+}
+
 func TestProcessWithCreateFailure(t *testing.T) {
 	job := &host.Job{ID: "a"}
 	err := errors.New("undefined failure")
@@ -344,3 +611,46 @@ func TestStreamEvents(t *testing.T) {
 		t.Error("incorrect exit status")
 	}
 }
+
+func TestPruneArtifacts(t *testing.T) {
+	client := NewFakeDockerClient()
+	client.images = []docker.APIImages{
+		{ID: "1111", RepoTags: []string{"test/foo:latest"}, Size: 100},
+		{ID: "2222", RepoTags: []string{"test/bar:latest"}, Size: 200},
+		{ID: "3333", RepoTags: []string{"test/baz:v1"}, Size: 400},
+	}
+	// the image of a job on the host is kept even though it is not in the
+	// keep set
+	state := NewState()
+	state.AddJob(&host.Job{ID: "a", Artifact: host.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/test/baz?tag=v1"}})
+	h := &Host{state: state, backend: &DockerBackend{docker: client, state: state}}
+
+	var freed int64
+	if err := h.PruneArtifacts([]string{"https://registry.hub.docker.com/test/foo"}, &freed); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.removed) != 1 || client.removed[0] != "2222" {
+		t.Fatalf("expected only the unused image to be removed, got %v", client.removed)
+	}
+	if freed != 200 {
+		t.Fatalf("expected 200 bytes to be freed, got %d", freed)
+	}
+
+	// images can also be kept by ID
+	client.removed = nil
+	if err := h.PruneArtifacts([]string{"https://registry.hub.docker.com/test/foo?id=1111"}, &freed); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.removed) != 0 || freed != 0 {
+		t.Fatalf("expected no images to be removed, got %v freeing %d bytes", client.removed, freed)
+	}
+
+	// a tag is not compared against image IDs
+	client.images = append(client.images, docker.APIImages{ID: "abcd1234", RepoTags: []string{"test/qux:v2"}, Size: 800})
+	if err := h.PruneArtifacts([]string{"https://registry.hub.docker.com/test/foo?id=1111", "https://registry.hub.docker.com/test/qux?tag=abcd"}, &freed); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.removed) != 1 || client.removed[0] != "abcd1234" || freed != 800 {
+		t.Fatalf("expected the image to be removed, got %v freeing %d bytes", client.removed, freed)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+)
+
+// An agent is upgraded in place by starting the new agent with --upgrade,
+// which connects to the handoff socket of the running agent. The running
+// agent stops serving, persists its state, sends the new agent its RPC
+// listener and event history, and then exits without stopping any jobs once the new agent has
+// restored the state and is serving on the listener. Clients which were
+// streaming events reconnect to the same address and resume from the last
+// event they saw, as the new agent continues the same event sequence.
+
+// handoffState is the state which is not in the state file that the new agent
+// needs to carry on from the old one.
+type handoffState struct {
+	EventSeq uint64
+	Events   []host.Event
+	Draining bool
+}
+
+// handoffState returns the event history of the host and whether it is
+// draining.
+func (s *State) handoffState() *handoffState {
+	s.eventMtx.Lock()
+	defer s.eventMtx.Unlock()
+	events := make([]host.Event, len(s.events))
+	copy(events, s.events)
+	return &handoffState{EventSeq: s.eventSeq, Events: events, Draining: s.Draining()}
+}
+
+// restoreHandoff continues the event history of the old agent, it must be
+// called before any events are sent.
+func (s *State) restoreHandoff(h *handoffState) {
+	s.eventMtx.Lock()
+	defer s.eventMtx.Unlock()
+	s.eventSeq = h.EventSeq
+	s.events = h.Events
+	s.SetDraining(h.Draining)
+}
+
+// handoffFlag records whether the agent has handed off its jobs, it is safe
+// for concurrent use.
+type handoffFlag struct {
+	mtx sync.Mutex
+	set bool
+}
+
+func (f *handoffFlag) Set() {
+	f.mtx.Lock()
+	f.set = true
+	f.mtx.Unlock()
+}
+
+func (f *handoffFlag) Get() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.set
+}
+
+// handoffListener is the listener of the agent's RPC server, which can stop
+// accepting and serving connections while the agent hands off so that the
+// state can't change once it has been snapshotted.
+type handoffListener struct {
+	*net.TCPListener
+
+	mtx       sync.Mutex
+	cond      *sync.Cond
+	paused    bool
+	accepting bool
+	conns     map[net.Conn]struct{}
+}
+
+func newHandoffListener(l *net.TCPListener) *handoffListener {
+	hl := &handoffListener{TCPListener: l, conns: make(map[net.Conn]struct{})}
+	hl.cond = sync.NewCond(&hl.mtx)
+	return hl
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	for {
+		l.mtx.Lock()
+		for l.paused {
+			l.cond.Wait()
+		}
+		tl := l.TCPListener
+		l.accepting = true
+		l.mtx.Unlock()
+
+		conn, err := tl.Accept()
+
+		l.mtx.Lock()
+		l.accepting = false
+		l.cond.Broadcast()
+		l.mtx.Unlock()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// interrupted by pause
+				continue
+			}
+			return nil, err
+		}
+
+		l.mtx.Lock()
+		if l.paused {
+			// accepted while pausing, the client will reconnect to
+			// whichever agent is serving
+			l.mtx.Unlock()
+			conn.Close()
+			continue
+		}
+		c := &handoffConn{Conn: conn, l: l}
+		l.conns[c] = struct{}{}
+		l.mtx.Unlock()
+		return c, nil
+	}
+}
+
+func (l *handoffListener) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.TCPListener.Close()
+}
+
+// pause stops accepting connections, leaving new ones queued for whichever
+// agent accepts next, and closes the connections being served.
+func (l *handoffListener) pause() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.paused = true
+	// interrupt a blocked Accept, and wait for it to return so that the
+	// listener is not in use when its file is taken
+	l.TCPListener.SetDeadline(time.Now())
+	for l.accepting {
+		l.cond.Wait()
+	}
+	for c := range l.conns {
+		c.(*handoffConn).Conn.Close()
+		delete(l.conns, c)
+	}
+}
+
+// resume starts accepting connections again after a failed handoff. Taking
+// the file of the listener for the handoff puts it in blocking mode, so if f,
+// the file which was to be handed off, is given the listener is replaced with
+// one for f.
+func (l *handoffListener) resume(f *os.File) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if f != nil {
+		nl, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		l.TCPListener.Close()
+		l.TCPListener = nl.(*net.TCPListener)
+	} else {
+		l.TCPListener.SetDeadline(time.Time{})
+	}
+	l.paused = false
+	l.cond.Broadcast()
+	return nil
+}
+
+type handoffConn struct {
+	net.Conn
+	l *handoffListener
+}
+
+func (c *handoffConn) Close() error {
+	c.l.mtx.Lock()
+	delete(c.l.conns, c)
+	c.l.mtx.Unlock()
+	return c.Conn.Close()
+}
+
+// serveHandoff listens on the unix socket at path and hands off the listener
+// l and the state to the first agent which connects. Before the state is
+// snapshotted, l stops serving and runMtx is locked so that no jobs are
+// started. done is called once the new agent has taken over, after which this
+// agent should exit without stopping any jobs.
+func serveHandoff(path string, l *handoffListener, runMtx *sync.Mutex, state *State, done func()) error {
+	os.Remove(path)
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: path})
+	if err != nil {
+		return err
+	}
+	go func() {
+		g := grohl.NewContext(grohl.Data{"fn": "serve_handoff"})
+		for {
+			conn, err := ul.AcceptUnix()
+			if err != nil {
+				g.Log(grohl.Data{"at": "accept", "status": "error", "err": err})
+				return
+			}
+			g.Log(grohl.Data{"at": "start"})
+			runMtx.Lock()
+			l.pause()
+			f, err := l.File()
+			if err != nil {
+				g.Log(grohl.Data{"at": "listener_file", "status": "error", "err": err})
+				conn.Close()
+				l.resume(nil)
+				runMtx.Unlock()
+				continue
+			}
+			err = sendHandoff(conn, f, state)
+			if err != nil {
+				g.Log(grohl.Data{"at": "send", "status": "error", "err": err})
+				conn.Close()
+				if err := l.resume(f); err != nil {
+					// the jobs keep running, but RPCs are no longer
+					// served until the agent is restarted
+					g.Log(grohl.Data{"at": "resume", "status": "error", "err": err})
+				}
+				f.Close()
+				runMtx.Unlock()
+				continue
+			}
+			f.Close()
+			g.Log(grohl.Data{"at": "finish"})
+			// remove the socket before closing the connection so the new
+			// agent can create its own once the connection is closed
+			ul.Close()
+			conn.Close()
+			done()
+			return
+		}
+	}()
+	return nil
+}
+
+// sendHandoff sends the listener file f and the state to the new agent,
+// returning once it has taken over.
+func sendHandoff(conn *net.UnixConn, f *os.File, state *State) error {
+	// persist synchronously so the new agent restores the latest state
+	state.persist()
+
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(conn).Encode(state.handoffState()); err != nil {
+		return err
+	}
+	// wait for the new agent to take over
+	ack := make([]byte, 1)
+	if _, err := conn.Read(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// receiveHandoff connects to the handoff socket of the running agent at path,
+// returning its listener and state. finish must be called once the listener
+// is being served and the state restored, after which the old agent exits.
+func receiveHandoff(path string) (l net.Listener, state *handoffState, finish func() error, err error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Net: "unix", Name: path})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, nil, nil, errors.New("host: handoff did not include a listener")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(fds) != 1 {
+		return nil, nil, nil, errors.New("host: handoff did not include a listener")
+	}
+	f := os.NewFile(uintptr(fds[0]), "listener")
+	l, err = net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	state = &handoffState{}
+	if err := json.NewDecoder(conn).Decode(state); err != nil {
+		l.Close()
+		return nil, nil, nil, err
+	}
+	finish = func() error {
+		defer conn.Close()
+		if _, err := conn.Write([]byte{0}); err != nil {
+			return err
+		}
+		// wait for the old agent to close the connection, by which time
+		// it has removed its handoff socket
+		conn.Read(make([]byte, 1))
+		return nil
+	}
+	return l, state, finish, nil
+}
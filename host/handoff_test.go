@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/rpcplus"
+	"github.com/flynn/flynn/pkg/rpcplus/comborpc"
+)
+
+// restoreBackend is a backend whose jobs keep running when the agent exits,
+// so restoring them is a no-op.
+type restoreBackend struct {
+	Backend
+}
+
+func (restoreBackend) RestoreState(map[string]*host.ActiveJob, *json.Decoder) error {
+	return nil
+}
+
+func serveHostRPC(t *testing.T, h *Host, l net.Listener) {
+	srv := rpcplus.NewServer()
+	if err := srv.Register(h); err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, comborpc.New(srv))
+}
+
+func dialHost(t *testing.T, addr string) cluster.Host {
+	client, err := rpcplus.DialHTTPPath("tcp", addr, rpcplus.DefaultRPCPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cluster.NewHostClient(addr, client, nil)
+}
+
+func nextEvent(t *testing.T, events chan *host.Event) *host.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	socket := filepath.Join(dir, "handoff.sock")
+	backend := restoreBackend{}
+
+	// the old agent is running a job
+	oldState := NewState()
+	if err := oldState.Restore(stateFile, backend); err != nil {
+		t.Fatal(err)
+	}
+	oldState.AddJob(&host.Job{ID: "a"})
+	oldState.SetStatusRunning("a")
+	oldState.SetDraining(true)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	hl := newHandoffListener(l.(*net.TCPListener))
+	serveHostRPC(t, &Host{state: oldState, backend: backend}, hl)
+
+	oldClient := dialHost(t, addr)
+	events := make(chan *host.Event)
+	oldClient.StreamEventsSince("a", 0, events)
+	var lastSeq uint64
+	for e := nextEvent(t, events); ; e = nextEvent(t, events) {
+		lastSeq = e.Seq
+		if e.Event == "start" {
+			break
+		}
+	}
+
+	oldExited := make(chan struct{})
+	var runMtx sync.Mutex
+	if err := serveHandoff(socket, hl, &runMtx, oldState, func() {
+		l.Close()
+		close(oldExited)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// upgrade to a new agent
+	newL, handoff, finish, err := receiveHandoff(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old agent stopped serving before handing off its state, so its
+	// clients can't change the state the new agent restores
+	if _, err := oldClient.GetJob("a"); err == nil {
+		t.Fatal("expected the old agent to have stopped serving")
+	}
+	newState := NewState()
+	newState.restoreHandoff(handoff)
+	if !newState.Draining() {
+		t.Fatal("expected the new agent to be draining")
+	}
+	if err := newState.Restore(stateFile, backend); err != nil {
+		t.Fatal(err)
+	}
+	serveHostRPC(t, &Host{state: newState, backend: backend}, newL)
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-oldExited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the old agent to exit")
+	}
+	oldClient.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the old handoff socket to be removed, got %v", err)
+	}
+
+	// the job is still running under the new agent, which serves on the
+	// same address
+	newClient := dialHost(t, addr)
+	defer newClient.Close()
+	job, err := newClient.GetJob("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != host.StatusRunning {
+		t.Fatalf("expected job to be running, got %v", job.Status)
+	}
+
+	// events resume from where the old agent left off
+	events = make(chan *host.Event)
+	newClient.StreamEventsSince("a", lastSeq, events)
+	newState.SetStatusDone("a", 0)
+	e := nextEvent(t, events)
+	if e.JobID != "a" || e.Event != "stop" {
+		t.Fatalf("expected stop event for job a, got %+v", e)
+	}
+	if e.Seq != lastSeq+1 {
+		t.Fatalf("expected event sequence %d, got %d", lastSeq+1, e.Seq)
+	}
+}
+
+func TestHandoffFailureResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	socket := filepath.Join(dir, "handoff.sock")
+	backend := restoreBackend{}
+
+	state := NewState()
+	if err := state.Restore(stateFile, backend); err != nil {
+		t.Fatal(err)
+	}
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hl := newHandoffListener(l.(*net.TCPListener))
+	serveHostRPC(t, &Host{state: state, backend: backend}, hl)
+
+	var runMtx sync.Mutex
+	if err := serveHandoff(socket, hl, &runMtx, state, func() {
+		t.Error("unexpected handoff")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new agent goes away before taking over
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the agent resumes serving and starting jobs, clients reconnecting
+	// once the handoff has failed
+	var job *host.ActiveJob
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		client, err := rpcplus.DialHTTPPath("tcp", l.Addr().String(), rpcplus.DefaultRPCPath, nil)
+		if err != nil {
+			continue
+		}
+		job, err = cluster.NewHostClient(l.Addr().String(), client, nil).GetJob("a")
+		client.Close()
+		if err == nil {
+			break
+		}
+	}
+	if job == nil {
+		t.Fatal("timed out waiting for the agent to resume serving")
+	}
+	if job.Status != host.StatusRunning {
+		t.Fatalf("expected job to be running, got %v", job.Status)
+	}
+	runMtx.Lock()
+	runMtx.Unlock()
+}
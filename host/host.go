@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -35,7 +37,7 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
 
 	cli.Register("daemon", runDaemon, `
-usage: flynn-host daemon [options] [--meta=<KEY=VAL>...]
+usage: flynn-host daemon [options] [--meta=<KEY=VAL>...] [--device=<NAME=COUNT>...]
 
 options:
   --external=IP          external IP of host
@@ -47,8 +49,13 @@ options:
   --volpath=PATH         directory to create volumes in [default: /var/lib/flynn-host]
   --backend=BACKEND      runner backend (docker or libvirt-lxc) [default: libvirt-lxc]
   --meta=<KEY=VAL>...    key=value pair to add as metadata
+  --memory=KIB           memory available to jobs in KiB, overriding the config (0 is unlimited)
+  --device=<NAME=COUNT>...  number of a device such as a gpu available to jobs, overriding the config
   --bind=IP              bind containers to IP
   --flynn-init=PATH      path to flynn-init binary [default: /usr/bin/flynn-init]
+  --handoff=PATH         path to the socket used to hand off jobs to an upgraded daemon [default: /var/run/flynn-host.sock]
+  --upgrade              take over the jobs of the running daemon rather than starting afresh, requires --state
+  --max-pulls=N          maximum number of job artifacts to pull at once, further pulls are queued (0 is unlimited) [default: 0]
 	`)
 }
 
@@ -78,6 +85,14 @@ func runDaemon(args *docopt.Args) {
 	backendName := args.String["--backend"]
 	flynnInit := args.String["--flynn-init"]
 	metadata := args.All["--meta"].([]string)
+	memory := args.String["--memory"]
+	devices := args.All["--device"].([]string)
+	handoffPath := args.String["--handoff"]
+	upgrade := args.Bool["--upgrade"]
+	maxPulls, err := strconv.Atoi(args.String["--max-pulls"])
+	if err != nil || maxPulls < 0 {
+		log.Fatal("--max-pulls must be a non-negative integer")
+	}
 
 	grohl.AddContext("app", "host")
 	grohl.Log(grohl.Data{"at": "start"})
@@ -89,6 +104,9 @@ func runDaemon(args *docopt.Args) {
 	if strings.Contains(hostID, "-") {
 		log.Fatal("host id must not contain dashes")
 	}
+	if upgrade && stateFile == "" {
+		log.Fatal("--upgrade requires --state")
+	}
 
 	portAlloc := map[string]*ports.Allocator{
 		"tcp": ports.NewAllocator(55000, 65535),
@@ -97,8 +115,8 @@ func runDaemon(args *docopt.Args) {
 
 	sh := newShutdownHandler()
 	state := NewState()
+	state.SetPullLimit(maxPulls)
 	var backend Backend
-	var err error
 
 	switch backendName {
 	case "libvirt-lxc":
@@ -112,7 +130,29 @@ func runDaemon(args *docopt.Args) {
 		sh.Fatal(err)
 	}
 
-	if err := serveHTTP(&Host{state: state, backend: backend}, &attachHandler{state: state, backend: backend}, sh); err != nil {
+	// when upgrading, the running daemon hands over its listener and event
+	// history, and exits once the state it persisted has been restored
+	var l net.Listener
+	var finishHandoff func() error
+	if upgrade {
+		var handoff *handoffState
+		l, handoff, finishHandoff, err = receiveHandoff(handoffPath)
+		if err != nil {
+			sh.Fatal(err)
+		}
+		state.restoreHandoff(handoff)
+		g.Log(grohl.Data{"at": "handoff_received"})
+	} else {
+		l, err = net.Listen("tcp", ":1113")
+		if err != nil {
+			sh.Fatal(err)
+		}
+	}
+
+	hl := newHandoffListener(l.(*net.TCPListener))
+	rpcHost := &Host{state: state, backend: backend}
+	go rpcHost.retainLastLogs(nil)
+	if err := serveHTTP(rpcHost, &attachHandler{state: state, backend: backend}, hl, sh); err != nil {
 		sh.Fatal(err)
 	}
 
@@ -122,12 +162,35 @@ func runDaemon(args *docopt.Args) {
 		}
 	}
 
+	if finishHandoff != nil {
+		if err := finishHandoff(); err != nil {
+			sh.Fatal(err)
+		}
+		g.Log(grohl.Data{"at": "handoff_finished"})
+	}
+
+	// handedOff is set once the jobs have been handed off to an upgraded
+	// daemon, which must then be left running. runMtx is held while starting
+	// a job so that none are started once the state is being handed off.
+	handedOff := &handoffFlag{}
+	var runMtx sync.Mutex
+	if stateFile != "" {
+		if err := serveHandoff(handoffPath, hl, &runMtx, state, func() {
+			handedOff.Set()
+			sh.shutdown(nil)
+		}); err != nil {
+			sh.Fatal(err)
+		}
+	}
+
 	var jobStream cluster.Stream
 	sh.BeforeExit(func() {
 		if jobStream != nil {
 			jobStream.Close()
 		}
-		backend.Cleanup()
+		if !handedOff.Get() {
+			backend.Cleanup()
+		}
 	})
 
 	if force {
@@ -147,7 +210,8 @@ func runDaemon(args *docopt.Args) {
 
 	discAddr := os.Getenv("DISCOVERD")
 	var disc *discoverd.Client
-	if manifestFile != "" {
+	// the services in the manifest are already running when upgrading
+	if manifestFile != "" && !upgrade {
 		var r io.Reader
 		var f *os.File
 		if manifestFile == "-" {
@@ -191,11 +255,19 @@ func runDaemon(args *docopt.Args) {
 			sh.Fatal(err)
 		}
 	}
-	sh.BeforeExit(func() { disc.UnregisterAll() })
+	sh.BeforeExit(func() {
+		// the upgraded daemon keeps the registrations alive
+		if !handedOff.Get() {
+			disc.UnregisterAll()
+		}
+	})
 	sampiStandby, err := disc.RegisterAndStandby("flynn-host", externalAddr+":1113", map[string]string{"id": hostID})
 	if err != nil {
 		sh.Fatal(err)
 	}
+	if err := rpcHost.setDiscoverd(disc, externalAddr+":1113", hostID); err != nil {
+		g.Log(grohl.Data{"at": "register_draining", "status": "error", "err": err})
+	}
 
 	// Check if we are the leader so that we can use the cluster functions directly
 	sampiCluster := sampi.NewCluster(sampi.NewState())
@@ -235,12 +307,18 @@ func runDaemon(args *docopt.Args) {
 		kv := strings.SplitN(s, "=", 2)
 		h.Metadata[kv[0]] = kv[1]
 	}
+	if err := applyResourceFlags(h, memory, devices); err != nil {
+		sh.Fatal(err)
+	}
 	h.ID = hostID
 
 	for {
 		newLeader := cluster.NewLeaderSignal()
 
 		h.Jobs = state.ClusterJobs()
+		if h.Volumes, err = listVolumes(volPath); err != nil {
+			g.Log(grohl.Data{"at": "list_volumes", "status": "error", "err": err})
+		}
 		jobs := make(chan *host.Job)
 		jobStream = cluster.RegisterHost(h, jobs)
 		g.Log(grohl.Data{"at": "host_registered"})
@@ -252,9 +330,11 @@ func runDaemon(args *docopt.Args) {
 				job.Config.Env["EXTERNAL_IP"] = externalAddr
 				job.Config.Env["DISCOVERD"] = discAddr
 			}
+			runMtx.Lock()
 			if err := backend.Run(job); err != nil {
 				state.SetStatusFailed(job.ID, err)
 			}
+			runMtx.Unlock()
 		}
 		g.Log(grohl.Data{"at": "sampi_disconnected", "err": jobStream.Err})
 
@@ -21,7 +21,6 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/alexzorin/libvirt-go"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/networkdriver/ipallocator"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/term"
-	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/lumberjack"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/host/containerinit"
 	lt "github.com/flynn/flynn/host/libvirt"
@@ -82,6 +81,7 @@ type LibvirtLXCBackend struct {
 
 type libvirtContainer struct {
 	RootPath string
+	ImageID  string
 	IP       net.IP
 	job      *host.Job
 	l        *LibvirtLXCBackend
@@ -125,6 +125,15 @@ func writeContainerEnv(path string, envs ...map[string]string) error {
 	return json.NewEncoder(f).Encode(data)
 }
 
+func writeContainerInitCmd(path string, cmd []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(cmd)
+}
+
 func writeHostname(path, hostname string) error {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -144,6 +153,22 @@ func writeHostname(path, hostname string) error {
 	return err
 }
 
+// writeResolvConf writes a resolv.conf to path which uses the given
+// nameservers.
+func writeResolvConf(path string, nameservers []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, ns := range nameservers {
+		if _, err := fmt.Fprintf(f, "nameserver %s\n", ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func readDockerImageConfig(id string) (*dockerImageConfig, error) {
 	res := &struct{ Config dockerImageConfig }{}
 	f, err := os.Open(filepath.Join(dockerBase, "graph", id, "json"))
@@ -179,7 +204,14 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	}()
 
 	g.Log(grohl.Data{"at": "pull_image"})
-	layers, err := pinkerton.Pull(job.Artifact.URI)
+	l.state.StartPull(job.ID)
+	var pullProgress host.PullProgress
+	layers, err := pinkerton.Pull(job.Artifact.URI, func(layer pinkerton.LayerPullInfo) {
+		pullProgress.LayersDone++
+		pullProgress.Status = layer.Status
+		l.state.SetPullProgress(job.ID, pullProgress)
+	})
+	l.state.FinishPull(job.ID, err)
 	if err != nil {
 		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
 		return err
@@ -192,6 +224,8 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		return err
 	}
 
+	container.ImageID = imageID
+
 	g.Log(grohl.Data{"at": "read_config"})
 	imageConfig, err := readDockerImageConfig(imageID)
 	if err != nil {
@@ -216,11 +250,20 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		g.Log(grohl.Data{"at": "mkdir", "dir": "etc", "status": "error", "err": err})
 		return err
 	}
-	if err := bindMount("/etc/resolv.conf", filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
+	if len(job.Config.DNS) > 0 {
+		if err := writeResolvConf(filepath.Join(rootPath, "etc/resolv.conf"), job.Config.DNS); err != nil {
+			g.Log(grohl.Data{"at": "write_resolv_conf", "status": "error", "err": err})
+			return err
+		}
+	} else if err := bindMount("/etc/resolv.conf", filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
 		g.Log(grohl.Data{"at": "mount", "file": "resolv.conf", "status": "error", "err": err})
 		return err
 	}
-	if err := writeHostname(filepath.Join(rootPath, "etc/hosts"), job.ID); err != nil {
+	hostname := job.Config.Hostname
+	if hostname == "" {
+		hostname = job.ID
+	}
+	if err := writeHostname(filepath.Join(rootPath, "etc/hosts"), hostname); err != nil {
 		g.Log(grohl.Data{"at": "write_hosts", "status": "error", "err": err})
 		return err
 	}
@@ -233,7 +276,15 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 			g.Log(grohl.Data{"at": "mkdir_mount", "dir": m.Location, "status": "error", "err": err})
 			return err
 		}
-		if m.Target == "" {
+		if m.Volume != "" {
+			dir, err := volumeDir(l.VolPath, m.Volume)
+			if err != nil {
+				g.Log(grohl.Data{"at": "mkdir_vol", "volume": m.Volume, "status": "error", "err": err})
+				return err
+			}
+			m.Target = dir
+			job.Config.Mounts[i].Target = m.Target
+		} else if m.Target == "" {
 			m.Target = filepath.Join(l.VolPath, cluster.RandomJobID(""))
 			job.Config.Mounts[i].Target = m.Target
 			if err := os.MkdirAll(m.Target, 0755); err != nil {
@@ -297,7 +348,7 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		},
 		job.Config.Env,
 		map[string]string{
-			"HOSTNAME": job.ID,
+			"HOSTNAME": hostname,
 		},
 	)
 	if err != nil {
@@ -305,6 +356,14 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		return err
 	}
 
+	if len(job.Config.InitCmd) > 0 {
+		g.Log(grohl.Data{"at": "write_init_cmd"})
+		if err := writeContainerInitCmd(filepath.Join(rootPath, ".containerinitcmd"), job.Config.InitCmd); err != nil {
+			g.Log(grohl.Data{"at": "write_init_cmd", "status": "error", "err": err})
+			return err
+		}
+	}
+
 	args := []string{
 		"-i", ip.String() + "/24",
 		"-g", defaultGW.String(),
@@ -320,7 +379,9 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	} else if imageConfig.WorkingDir != "" {
 		args = append(args, "-w", imageConfig.WorkingDir)
 	}
-	if job.Config.Uid > 0 {
+	if job.Config.User != "" {
+		args = append(args, "-u", job.Config.User)
+	} else if job.Config.Uid > 0 {
 		args = append(args, "-u", strconv.Itoa(job.Config.Uid))
 	} else if imageConfig.User != "" {
 		// TODO: check and lookup user from image config
@@ -425,15 +486,14 @@ func enableHairpinMode(iface string) error {
 	return ioutil.WriteFile("/sys/class/net/"+iface+"/brport/hairpin_mode", []byte("1"), 0666)
 }
 
-func (l *LibvirtLXCBackend) openLog(id string) *logbuf.Log {
+func (l *LibvirtLXCBackend) openLog(job *host.Job) *logbuf.Log {
 	l.logsMtx.Lock()
 	defer l.logsMtx.Unlock()
-	if _, ok := l.logs[id]; !ok {
-		// TODO: configure retention and log size
-		l.logs[id] = logbuf.NewLog(&lumberjack.Logger{Dir: filepath.Join(l.LogPath, id)})
+	if _, ok := l.logs[job.ID]; !ok {
+		l.logs[job.ID] = logbuf.NewLog(jobLogger(filepath.Join(l.LogPath, job.ID), job.LogRetention))
 	}
 	// TODO: do reference counting and remove logs that are not in use from memory
-	return l.logs[id]
+	return l.logs[job.ID]
 }
 
 func (c *libvirtContainer) watch(ready chan<- error) error {
@@ -491,7 +551,7 @@ func (c *libvirtContainer) watch(ready chan<- error) error {
 			g.Log(grohl.Data{"at": "get_stdout", "status": "error", "err": err.Error()})
 			return err
 		}
-		log := c.l.openLog(c.job.ID)
+		log := c.l.openLog(c.job)
 		defer log.Close()
 		// TODO: log errors from these
 		go log.ReadFrom(1, stdout)
@@ -501,6 +561,12 @@ func (c *libvirtContainer) watch(ready chan<- error) error {
 	g.Log(grohl.Data{"at": "watch_changes"})
 	for change := range c.Client.StreamState() {
 		g.Log(grohl.Data{"at": "change", "state": change.State.String()})
+		if change.State == containerinit.StateInitFailed {
+			err := errors.New(change.Error)
+			g.Log(grohl.Data{"at": "init_failed", "status": "error", "err": err})
+			c.l.state.SetStatusInitFailed(c.job.ID, err)
+			return err
+		}
 		if change.Error != "" {
 			err := errors.New(change.Error)
 			g.Log(grohl.Data{"at": "change", "status": "error", "err": err})
@@ -541,8 +607,10 @@ func (c *libvirtContainer) cleanup() error {
 	if err := syscall.Unmount(filepath.Join(c.RootPath, ".containerinit"), 0); err != nil {
 		g.Log(grohl.Data{"at": "unmount", "file": ".containerinit", "status": "error", "err": err})
 	}
-	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
-		g.Log(grohl.Data{"at": "unmount", "file": "resolv.conf", "status": "error", "err": err})
+	if len(c.job.Config.DNS) == 0 {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "file": "resolv.conf", "status": "error", "err": err})
+		}
 	}
 	if err := pinkerton.Cleanup(c.job.ID); err != nil {
 		g.Log(grohl.Data{"at": "pinkerton", "status": "error", "err": err})
@@ -582,10 +650,18 @@ func (c *libvirtContainer) WaitStop(timeout time.Duration) error {
 }
 
 func (c *libvirtContainer) Stop() error {
+	timeout := c.job.Config.StopTimeout()
+	if len(c.job.Config.PreStop) > 0 {
+		// the pre-stop command is killed by containerinit after the timeout,
+		// so the job is stopped whether or not it succeeds
+		if err := c.PreStop(c.job.Config.PreStop, timeout); err != nil {
+			grohl.Log(grohl.Data{"backend": "libvirt-lxc", "fn": "stop", "job.id": c.job.ID, "at": "pre_stop", "status": "error", "err": err})
+		}
+	}
 	if err := c.Signal(int(syscall.SIGTERM)); err != nil {
 		return err
 	}
-	if err := c.WaitStop(10 * time.Second); err != nil {
+	if err := c.WaitStop(timeout); err != nil {
 		return c.Signal(int(syscall.SIGKILL))
 	}
 	return nil
@@ -599,6 +675,50 @@ func (l *LibvirtLXCBackend) Stop(id string) error {
 	return c.Stop()
 }
 
+func (l *LibvirtLXCBackend) PruneArtifacts(keep []string) (int64, error) {
+	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "prune_artifacts"})
+
+	// never remove the images of the host's jobs, keeping those of running
+	// containers by the ID they were started with in case their tag has
+	// since moved
+	uris := append([]string{}, keep...)
+	for _, job := range l.state.Get() {
+		if job.Job != nil {
+			uris = append(uris, job.Job.Artifact.URI)
+		}
+	}
+	l.containersMtx.RLock()
+	for _, c := range l.containers {
+		if c.ImageID == "" {
+			uris = append(uris, c.job.Artifact.URI)
+			continue
+		}
+		uri, err := pinkerton.ImageURI(c.job.Artifact.URI, c.ImageID)
+		if err != nil {
+			l.containersMtx.RUnlock()
+			return 0, err
+		}
+		uris = append(uris, uri)
+	}
+	l.containersMtx.RUnlock()
+
+	freed, err := pinkerton.Prune(uris)
+	if err != nil {
+		g.Log(grohl.Data{"at": "prune", "status": "error", "err": err})
+		return 0, err
+	}
+	g.Log(grohl.Data{"at": "prune", "freed": freed})
+	return freed, nil
+}
+
+func (l *LibvirtLXCBackend) InitPID(id string) (int, error) {
+	c, err := l.getContainer(id)
+	if err != nil {
+		return 0, err
+	}
+	return rootInitPID(c.RootPath)
+}
+
 func (l *LibvirtLXCBackend) getContainer(id string) (*libvirtContainer, error) {
 	l.containersMtx.RLock()
 	defer l.containersMtx.RUnlock()
@@ -684,13 +804,28 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		}()
 	}
 
-	log := l.openLog(req.Job.Job.ID)
+	log := l.openLog(req.Job.Job)
 	r := log.NewReader()
 	defer r.Close()
-	if !req.Logs {
-		if err := r.SeekToEnd(); err != nil {
-			return err
+	// offsets are the positions to resume each stream from, they are
+	// removed once the replay reaches them
+	offsets := make(map[int]int64, 2)
+	if req.Logs {
+		for stream, offset := range map[int]int64{1: req.StdoutOffset, 2: req.StderrOffset} {
+			if offset == 0 {
+				continue
+			}
+			truncated, err := log.Truncated(stream, offset)
+			if err != nil {
+				return err
+			}
+			if truncated {
+				return ErrLogsTruncated
+			}
+			offsets[stream] = offset
 		}
+	} else if err := r.SeekToEnd(); err != nil {
+		return err
 	}
 
 	if req.Attached != nil {
@@ -702,19 +837,32 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		if err != nil {
 			return err
 		}
+		msg := data.Message
+		if offset, ok := offsets[data.Stream]; ok {
+			if data.Offset > offset {
+				// the log has been rotated since it was checked
+				return ErrLogsTruncated
+			}
+			skip := offset - data.Offset
+			if skip >= int64(len(msg)) {
+				continue
+			}
+			msg = msg[skip:]
+			delete(offsets, data.Stream)
+		}
 		switch data.Stream {
 		case 1:
 			if req.Stdout == nil {
 				continue
 			}
-			if _, err := req.Stdout.Write([]byte(data.Message)); err != nil {
+			if _, err := req.Stdout.Write([]byte(msg)); err != nil {
 				return nil
 			}
 		case 2:
 			if req.Stderr == nil {
 				continue
 			}
-			if _, err := req.Stderr.Write([]byte(data.Message)); err != nil {
+			if _, err := req.Stderr.Write([]byte(msg)); err != nil {
 				return nil
 			}
 		}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -21,8 +22,9 @@ func NewLog(l *lumberjack.Logger) *Log {
 	if l.MaxSize == 0 {
 		l.MaxSize = 100 * lumberjack.Megabyte
 	}
-	log := &Log{l: l, files: make(map[string]*file)}
+	log := &Log{l: l, files: make(map[string]*file), ends: make(map[int]int64)}
 	log.changed.L = log.mtx.RLocker()
+	log.restoreEnds()
 	return log
 }
 
@@ -35,6 +37,10 @@ type Log struct {
 	size    int64
 	closed  bool
 
+	// ends is the number of bytes written to each stream, which is the
+	// offset of the next entry of the stream
+	ends map[int]int64
+
 	filesMtx sync.Mutex
 	files    map[string]*file
 }
@@ -43,6 +49,9 @@ type Data struct {
 	Stream    int      `json:"s"`
 	Timestamp UnixTime `json:"t"`
 	Message   string   `json:"m"`
+
+	// Offset is the number of bytes written to the stream before Message
+	Offset int64 `json:"o,omitempty"`
 }
 
 type UnixTime struct{ time.Time }
@@ -68,12 +77,18 @@ func (l *Log) ReadFrom(stream int, r io.Reader) error {
 	for {
 		n, err := r.Read(buf)
 		if n > 0 {
+			l.mtx.RLock()
+			data.Offset = l.ends[stream]
+			l.mtx.RUnlock()
 			data.Timestamp = UnixTime{time.Now()}
 			data.Message = string(buf[:n])
 			if err := j.Encode(data); err != nil {
 				return err
 			}
 			l.mtx.Lock()
+			// the end only moves once the entry is written so that Truncated
+			// does not expect output which is not yet readable
+			l.ends[stream] = data.Offset + int64(n)
 			l.name, l.size = l.l.File()
 			l.changed.Broadcast()
 			l.mtx.Unlock()
@@ -87,6 +102,64 @@ func (l *Log) ReadFrom(stream int, r io.Reader) error {
 	}
 }
 
+// restoreEnds sets the end of each stream from the entries in the log
+// directory, so that the offsets of a log which is reopened, for example after
+// the host restarts, carry on from those already written.
+func (l *Log) restoreEnds() {
+	if l.l.Dir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(l.l.Dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(l.l.Dir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		dec := json.NewDecoder(f)
+		for {
+			data := &Data{}
+			if err := dec.Decode(data); err != nil {
+				break
+			}
+			if end := data.Offset + int64(len(data.Message)); end > l.ends[data.Stream] {
+				l.ends[data.Stream] = end
+			}
+		}
+		f.Close()
+	}
+}
+
+// Truncated returns whether any of the output of stream from offset onwards
+// has already been removed from the log by rotation.
+func (l *Log) Truncated(stream int, offset int64) (bool, error) {
+	l.mtx.RLock()
+	end := l.ends[stream]
+	l.mtx.RUnlock()
+	if offset >= end {
+		return false, nil
+	}
+	r := l.NewReader()
+	defer r.Close()
+	for {
+		data, err := r.ReadData(false)
+		if err == io.EOF {
+			// output was written after offset but none of it is retained
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if data.Stream == stream {
+			return data.Offset > offset, nil
+		}
+	}
+}
+
 func (l *Log) Close() error {
 	l.mtx.Lock()
 	l.closed = true
@@ -237,36 +310,45 @@ func (r *Reader) openNextFile() error {
 	}
 	r.l.mtx.RUnlock()
 
-	// TODO: investigate if this can race and list files that don't exist
-	// when logs are going too fast
+	// old files are sorted newest first, a new reader starts with the oldest
+	// retained file and then moves towards the current one
 	var fi os.FileInfo
 	files := r.l.l.OldFiles()
-	for i, f := range files {
-		if r.f != nil && f.Name() == r.f.name {
-			if i < len(files)-1 {
-				fi = files[i+1]
+	if r.f == nil {
+		if len(files) > 0 {
+			fi = files[len(files)-1]
+		}
+	} else {
+		for i, f := range files {
+			if f.Name() == r.f.name {
+				if i > 0 {
+					fi = files[i-1]
+				}
+				break
 			}
-			break
 		}
 	}
 	r.l.mtx.RLock()
 	name := r.l.name
 	r.l.mtx.RUnlock()
-	if name == "" && fi == nil && len(files) > 0 {
-		fi = files[0]
-	}
 	if r.f != nil {
 		r.f.Close()
 	}
 	var err error
 	if fi != nil {
 		r.f, err = r.l.openFile(filepath.Join(r.l.l.Dir, fi.Name()), fi.Size())
-	} else {
-		if name == "" {
-			return io.EOF
+		if !os.IsNotExist(err) {
+			r.d = &jsonDecoder{f: r.f}
+			return err
 		}
-		r.f, err = r.l.openFile(name, 0)
+		// the file has been removed by retention since it was listed,
+		// carry on with the current file
+	}
+	if name == "" {
+		r.f = nil
+		return io.EOF
 	}
+	r.f, err = r.l.openFile(name, 0)
 	r.d = &jsonDecoder{f: r.f}
 	return err
 }
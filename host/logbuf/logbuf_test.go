@@ -180,3 +180,36 @@ func (s *S) TestSeekToEnd(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(data.Message, Equals, "3")
 }
+
+func (s *S) TestOffsets(c *C) {
+	dir := c.MkDir()
+	l := NewLog(&lumberjack.Logger{Dir: dir})
+	l.ReadFrom(1, strings.NewReader("12"))
+	l.ReadFrom(2, strings.NewReader("a"))
+	l.ReadFrom(1, strings.NewReader("345"))
+	l.Close()
+
+	// a reopened log carries on from the offsets already written
+	l = NewLog(&lumberjack.Logger{Dir: dir})
+	defer l.Close()
+	l.ReadFrom(1, strings.NewReader("6"))
+
+	r := l.NewReader()
+	defer r.Close()
+	for _, expected := range []Data{
+		{Stream: 1, Message: "12", Offset: 0},
+		{Stream: 2, Message: "a", Offset: 0},
+		{Stream: 1, Message: "345", Offset: 2},
+		{Stream: 1, Message: "6", Offset: 5},
+	} {
+		data, err := r.ReadData(false)
+		c.Assert(err, IsNil)
+		c.Assert(data.Stream, Equals, expected.Stream)
+		c.Assert(data.Message, Equals, expected.Message)
+		c.Assert(data.Offset, Equals, expected.Offset)
+	}
+
+	truncated, err := l.Truncated(1, 2)
+	c.Assert(err, IsNil)
+	c.Assert(truncated, Equals, false)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/lumberjack"
+	"github.com/flynn/flynn/host/types"
+)
+
+// jobLogger returns a logger which writes to dir and applies the retention
+// policy r.
+//
+// MaxBytes is enforced by rotating the log when it reaches half of the limit
+// and only keeping the previous file, so that readers can always see at least
+// the most recent half.
+func jobLogger(dir string, r host.LogRetention) *lumberjack.Logger {
+	l := &lumberjack.Logger{Dir: dir}
+	if r.MaxBytes > 0 {
+		if r.MaxBytes < host.MinLogRetentionBytes {
+			r.MaxBytes = host.MinLogRetentionBytes
+		}
+		l.MaxSize = r.MaxBytes / 2
+		l.MaxBackups = 1
+	}
+	if r.MaxAge > 0 {
+		l.MaxAge = int((r.MaxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	return l
+}
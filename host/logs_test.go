@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+)
+
+func logDirSize(t *testing.T, dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return size
+}
+
+func TestJobLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retention := host.LogRetention{MaxBytes: host.MinLogRetentionBytes}
+	log := logbuf.NewLog(jobLogger(filepath.Join(dir, "job"), retention))
+	defer log.Close()
+
+	// a verbose job writes several times the retained size
+	var output bytes.Buffer
+	for i := 0; output.Len() < 8*host.MinLogRetentionBytes; i++ {
+		fmt.Fprintf(&output, "line %06d %s\n", i, strings.Repeat("x", 100))
+	}
+	written := output.String()
+	if err := log.ReadFrom(1, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated files are removed asynchronously
+	var size int64
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if size = logDirSize(t, filepath.Join(dir, "job")); size <= retention.MaxBytes {
+			break
+		}
+	}
+	if size > retention.MaxBytes {
+		t.Fatalf("expected the log to be at most %d bytes, got %d", retention.MaxBytes, size)
+	}
+
+	// reading the log returns the retained tail of the output
+	r := log.NewReader()
+	defer r.Close()
+	var retained bytes.Buffer
+	start := int64(-1)
+	for {
+		data, err := r.ReadData(false)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if start == -1 {
+			start = data.Offset
+		}
+		if data.Offset != start+int64(retained.Len()) {
+			t.Fatalf("expected offset %d, got %d", start+int64(retained.Len()), data.Offset)
+		}
+		retained.WriteString(data.Message)
+	}
+	if retained.Len() < int(retention.MaxBytes/4) {
+		t.Fatalf("expected at least %d bytes of output, got %d", retention.MaxBytes/4, retained.Len())
+	}
+	if !strings.HasSuffix(written, retained.String()) {
+		t.Fatal("expected the retained output to be the tail of the written output")
+	}
+	if strings.HasPrefix(retained.String(), "line 000000 ") {
+		t.Fatal("expected the start of the output to have been removed")
+	}
+	if start+int64(retained.Len()) != int64(len(written)) {
+		t.Fatalf("expected the retained output to end at offset %d, got %d", len(written), start+int64(retained.Len()))
+	}
+
+	// resuming is only possible from an offset which is still retained
+	for _, test := range []struct {
+		offset    int64
+		truncated bool
+	}{
+		{0, true},
+		{start - 1, true},
+		{start, false},
+		{int64(len(written)), false},
+	} {
+		truncated, err := log.Truncated(1, test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if truncated != test.truncated {
+			t.Fatalf("expected offset %d truncated to be %t, got %t", test.offset, test.truncated, truncated)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/url"
 	"os/exec"
+	"strconv"
 )
 
 type LayerPullInfo struct {
@@ -15,7 +16,9 @@ type LayerPullInfo struct {
 	Status string
 }
 
-func Pull(url string) ([]LayerPullInfo, error) {
+// Pull pulls the image at url, calling progress (if not nil) as each layer is
+// pulled.
+func Pull(url string, progress func(LayerPullInfo)) ([]LayerPullInfo, error) {
 	var layers []LayerPullInfo
 	var errBuf bytes.Buffer
 	cmd := exec.Command("pinkerton", "pull", "--json", url)
@@ -35,6 +38,9 @@ func Pull(url string) ([]LayerPullInfo, error) {
 			return nil, err
 		}
 		layers = append(layers, l)
+		if progress != nil {
+			progress(l)
+		}
 	}
 	if err := cmd.Wait(); err != nil {
 		return nil, &Error{Output: errBuf.String(), Err: err}
@@ -72,6 +78,19 @@ func Cleanup(id string) error {
 	return nil
 }
 
+// Prune removes the images other than those at urls, returning the number of
+// bytes freed.
+func Prune(urls []string) (int64, error) {
+	var errBuf bytes.Buffer
+	cmd := exec.Command("pinkerton", append([]string{"prune"}, urls...)...)
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, &Error{Output: errBuf.String(), Err: err}
+	}
+	return strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64)
+}
+
 var ErrNoImageID = errors.New("pinkerton: missing image id")
 
 func ImageID(s string) (string, error) {
@@ -86,3 +105,16 @@ func ImageID(s string) (string, error) {
 	}
 	return id, nil
 }
+
+// ImageURI returns s with its tag replaced by the image ID id.
+func ImageURI(s, id string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Del("tag")
+	q.Set("id", id)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
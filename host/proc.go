@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// Allow using a fake /proc in tests
+var procPath = "/proc"
+
+// namespaceProcesses returns the processes which are in the same PID namespace
+// as the process with the given PID.
+func namespaceProcesses(initPID int) ([]host.Process, error) {
+	ns, err := os.Readlink(filepath.Join(procPath, strconv.Itoa(initPID), "ns", "pid"))
+	if err != nil {
+		return nil, err
+	}
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+	var procs []host.Process
+	for _, pid := range pids {
+		if link, err := os.Readlink(filepath.Join(procPath, strconv.Itoa(pid), "ns", "pid")); err != nil || link != ns {
+			continue
+		}
+		proc, err := readProcess(pid)
+		if err != nil {
+			// the process exited while listing
+			continue
+		}
+		procs = append(procs, *proc)
+	}
+	return procs, nil
+}
+
+// rootInitPID returns the PID of the first process which has the given root
+// directory, which is the init process of a container rooted there.
+func rootInitPID(root string) (int, error) {
+	pids, err := listPIDs()
+	if err != nil {
+		return 0, err
+	}
+	rooted := make(map[int]struct{})
+	for _, pid := range pids {
+		if link, err := os.Readlink(filepath.Join(procPath, strconv.Itoa(pid), "root")); err == nil && link == root {
+			rooted[pid] = struct{}{}
+		}
+	}
+	for pid := range rooted {
+		proc, err := readProcess(pid)
+		if err != nil {
+			continue
+		}
+		if _, ok := rooted[proc.PPID]; !ok {
+			return pid, nil
+		}
+	}
+	return 0, errors.New("no process found with root " + root)
+}
+
+func listPIDs() ([]int, error) {
+	names, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(names))
+	for _, fi := range names {
+		if pid, err := strconv.Atoi(fi.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func readProcess(pid int) (*host.Process, error) {
+	dir := filepath.Join(procPath, strconv.Itoa(pid))
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// the command name is in parens and may contain spaces and parens, so
+	// split on the last paren
+	start := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndex(stat, []byte(")"))
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid stat for process %d", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid stat for process %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid stat for process %d", pid)
+	}
+	proc := &host.Process{PID: pid, PPID: ppid, State: fields[0], Command: string(stat[start+1 : end])}
+
+	// prefer the full command line, which kernel threads and zombies don't have
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		proc.Command = strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ")
+	}
+	return proc, nil
+}
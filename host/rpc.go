@@ -1,26 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/rpcplus"
 	rpc "github.com/flynn/flynn/pkg/rpcplus/comborpc"
 )
 
-func serveHTTP(host *Host, attach *attachHandler, sh *shutdownHandler) error {
+func serveHTTP(host *Host, attach *attachHandler, l net.Listener, sh *shutdownHandler) error {
 	if err := rpc.Register(host); err != nil {
 		return err
 	}
 	rpc.HandleHTTP()
 	http.Handle("/attach", attach)
 
-	l, err := net.Listen("tcp", ":1113")
-	if err != nil {
-		return err
-	}
 	sh.BeforeExit(func() { l.Close() })
 	go http.Serve(l, nil)
 	return nil
@@ -29,6 +31,47 @@ func serveHTTP(host *Host, attach *attachHandler, sh *shutdownHandler) error {
 type Host struct {
 	state   *State
 	backend Backend
+
+	// disc is used to register the host as draining at addr, it is set
+	// once the host has registered itself with discoverd
+	discMtx sync.Mutex
+	disc    *discoverd.Client
+	addr    string
+	id      string
+}
+
+// setDiscoverd sets the discoverd client used to register the host as
+// draining, registering it straight away if the host was draining before it
+// was upgraded.
+func (h *Host) setDiscoverd(disc *discoverd.Client, addr, id string) error {
+	h.discMtx.Lock()
+	h.disc, h.addr, h.id = disc, addr, id
+	h.discMtx.Unlock()
+	if !h.state.Draining() {
+		return nil
+	}
+	return h.SetDraining(true, &struct{}{})
+}
+
+// SetDraining registers the host as draining, or unregisters it, so that
+// routers stop or resume sending new connections to the jobs on it. The
+// registration is held by the host so it is not lost when the scheduler which
+// drained the host is replaced.
+func (h *Host) SetDraining(draining bool, res *struct{}) error {
+	h.discMtx.Lock()
+	defer h.discMtx.Unlock()
+	if h.disc == nil {
+		return errors.New("host: not registered with discoverd")
+	}
+	if draining {
+		if err := h.disc.RegisterWithAttributes(discoverd.DrainingService, h.addr, map[string]string{"id": h.id}); err != nil {
+			return err
+		}
+	} else if err := h.disc.Unregister(discoverd.DrainingService, h.addr); err != nil && err != discoverd.ErrUnknownRegistration {
+		return err
+	}
+	h.state.SetDraining(draining)
+	return nil
 }
 
 func (h *Host) ListJobs(arg struct{}, res *map[string]host.ActiveJob) error {
@@ -40,6 +83,7 @@ func (h *Host) GetJob(id string, res *host.ActiveJob) error {
 	job := h.state.GetJob(id)
 	if job != nil {
 		*res = *job
+		res.LastLogs = h.state.LastLogs(id)
 	}
 	return nil
 }
@@ -58,14 +102,261 @@ func (h *Host) StopJob(id string, res *struct{}) error {
 func (h *Host) StreamEvents(id string, stream rpcplus.Stream) error {
 	ch := h.state.AddListener(id)
 	defer h.state.RemoveListener(id, ch)
+	return streamEvents(ch, nil, 0, stream)
+}
+
+// StreamEventsSince streams events like StreamEvents, first replaying any
+// buffered events with a sequence number greater than req.Since.
+func (h *Host) StreamEventsSince(req *host.StreamEventsReq, stream rpcplus.Stream) error {
+	ch, replay := h.state.AddListenerSince(req.JobID, req.Since)
+	defer h.state.RemoveListener(req.JobID, ch)
+	return streamEvents(ch, replay, req.Since, stream)
+}
+
+// PullProgress streams the progress of pulling the artifact of the job with
+// the given ID, ending once the pull is done or the job has started.
+func (h *Host) PullProgress(id string, stream rpcplus.Stream) error {
+	w := h.state.AddPullWatcher(id)
+	defer h.state.RemovePullWatcher(id, w)
 	for {
 		select {
-		case event := <-ch:
+		case <-w.notify:
+			p := w.Latest()
 			select {
-			case stream.Send <- event:
+			case stream.Send <- p:
 			case <-stream.Error:
 				return nil
 			}
+			if p.Done {
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+// JobProcessTree returns the processes in the PID namespace of the container
+// of the job with the given ID.
+func (h *Host) JobProcessTree(id string, res *[]host.Process) error {
+	job := h.state.GetJob(id)
+	if job == nil {
+		return errors.New("host: unknown job")
+	}
+	if job.Status != host.StatusRunning {
+		return errors.New("host: job is not running")
+	}
+	b, ok := h.backend.(InitPIDer)
+	if !ok {
+		return errors.New("host: backend does not support listing processes")
+	}
+	pid, err := b.InitPID(id)
+	if err != nil {
+		return err
+	}
+	procs, err := namespaceProcesses(pid)
+	if err != nil {
+		return err
+	}
+	*res = procs
+	return nil
+}
+
+// PruneArtifacts removes the artifacts cached by the backend other than those
+// with the URIs in keep and those of the host's jobs, setting freed to the
+// number of bytes freed.
+func (h *Host) PruneArtifacts(keep []string, freed *int64) error {
+	b, ok := h.backend.(ArtifactPruner)
+	if !ok {
+		return errors.New("host: backend does not support pruning artifacts")
+	}
+	n, err := b.PruneArtifacts(keep)
+	*freed = n
+	return err
+}
+
+// StreamLogs streams the output of all jobs running on the host, including
+// jobs which start after the stream begins, with each line tagged with the
+// ID of the job which wrote it.
+func (h *Host) StreamLogs(arg struct{}, stream rpcplus.Stream) error {
+	events := h.state.AddListener("all")
+	defer h.state.RemoveListener("all", events)
+
+	lines := make(chan *host.LogLine)
+	done := make(chan struct{})
+	defer close(done)
+
+	attached := make(map[string]struct{})
+	attach := func(job *host.ActiveJob) {
+		if _, ok := attached[job.Job.ID]; ok {
+			return
+		}
+		attached[job.Job.ID] = struct{}{}
+		go h.streamJobLogs(job, lines, done)
+	}
+	for _, job := range h.state.Get() {
+		if job.Status == host.StatusRunning {
+			j := job
+			attach(&j)
+		}
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if event.Event != "start" {
+				continue
+			}
+			if job := h.state.GetJob(event.JobID); job != nil {
+				attach(job)
+			}
+		case line := <-lines:
+			select {
+			case stream.Send <- line:
+			case <-stream.Error:
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+// retainLastLogs attaches to the output of each job when it starts and
+// retains its most recent lines in the state, so they are available from
+// GetJob after the job stops. It runs until done is closed.
+func (h *Host) retainLastLogs(done <-chan struct{}) {
+	events := h.state.AddListener("all")
+	defer h.state.RemoveListener("all", events)
+
+	lines := make(chan *host.LogLine)
+	for {
+		select {
+		case event := <-events:
+			if event.Event != "start" {
+				continue
+			}
+			if job := h.state.GetJob(event.JobID); job != nil {
+				go h.streamJobLogs(job, lines, done)
+			}
+		case line := <-lines:
+			h.state.AddLastLog(line)
+		case <-done:
+			return
+		}
+	}
+}
+
+// minStatsInterval is the shortest interval at which host stats are sampled.
+const minStatsInterval = 100 * time.Millisecond
+
+// StreamStats streams samples of the host's resource usage at the given
+// interval, with CPU usage measured over each interval.
+func (h *Host) StreamStats(interval time.Duration, stream rpcplus.Stream) error {
+	if interval < minStatsInterval {
+		interval = minStatsInterval
+	}
+	sampler, err := newStatsSampler()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats, err := sampler.Sample()
+			if err != nil {
+				return err
+			}
+			select {
+			case stream.Send <- stats:
+			case <-stream.Error:
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+// streamJobLogs attaches to the output of job, sending each line to lines
+// until the job exits or done is closed.
+func (h *Host) streamJobLogs(job *host.ActiveJob, lines chan<- *host.LogLine, done <-chan struct{}) {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	go func() {
+		h.backend.Attach(&AttachRequest{
+			Job:    job,
+			Stream: true,
+			Stdout: stdoutW,
+			Stderr: stderrW,
+		})
+		stdoutW.Close()
+		stderrW.Close()
+	}()
+
+	var wg sync.WaitGroup
+	scan := func(name string, r io.Reader) {
+		defer wg.Done()
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := &host.LogLine{JobID: job.Job.ID, Stream: name, Timestamp: time.Now().UTC(), Message: s.Text()}
+			select {
+			case lines <- line:
+			case <-done:
+				return
+			}
+		}
+		// keep reading if the scanner failed (e.g. on a very long line) so
+		// the backend does not block writing to the pipe
+		io.Copy(ioutil.Discard, r)
+	}
+	wg.Add(2)
+	go scan("stdout", stdoutR)
+	go scan("stderr", stderrR)
+
+	exited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-done:
+	}
+	// unblock the backend if it is still writing
+	stdoutR.Close()
+	stderrR.Close()
+}
+
+// streamEvents sends the replayed events followed by events from ch, skipping
+// any events with a sequence number which has already been sent.
+func streamEvents(ch chan host.Event, replay []host.Event, since uint64, stream rpcplus.Stream) error {
+	last := since
+	send := func(event host.Event) bool {
+		if event.Seq <= last {
+			return true
+		}
+		last = event.Seq
+		select {
+		case stream.Send <- event:
+			return true
+		case <-stream.Error:
+			return false
+		}
+	}
+	for _, event := range replay {
+		if !send(event) {
+			return nil
+		}
+	}
+	for {
+		select {
+		case event := <-ch:
+			if !send(event) {
+				return nil
+			}
 		case <-stream.Error:
 			return nil
 		}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+type logOutput struct {
+	stdout, stderr []string
+}
+
+// logBackend is a backend whose Attach writes the configured output of the
+// job and then waits for the backend to be closed, like a job which keeps
+// running.
+type logBackend struct {
+	Backend
+	output map[string]logOutput
+	closed chan struct{}
+	mtx    sync.Mutex
+}
+
+func (b *logBackend) Attach(req *AttachRequest) error {
+	b.mtx.Lock()
+	out := b.output[req.Job.Job.ID]
+	b.mtx.Unlock()
+	for _, line := range out.stdout {
+		fmt.Fprintln(req.Stdout, line)
+	}
+	for _, line := range out.stderr {
+		fmt.Fprintln(req.Stderr, line)
+	}
+	<-b.closed
+	return nil
+}
+
+func TestStreamLogs(t *testing.T) {
+	backend := &logBackend{
+		output: map[string]logOutput{
+			"a": {stdout: []string{"a1", "a2"}},
+			"b": {stdout: []string{"b1"}, stderr: []string{"b2"}},
+			"c": {stderr: []string{"c1"}},
+		},
+		closed: make(chan struct{}),
+	}
+	defer close(backend.closed)
+
+	state := NewState()
+	for _, id := range []string{"a", "b"} {
+		state.AddJob(&host.Job{ID: id})
+		state.SetStatusRunning(id)
+	}
+	h := &Host{state: state, backend: backend}
+
+	lines := make(chan interface{})
+	stream := rpcplus.Stream{Send: lines, Error: make(chan error)}
+	done := make(chan struct{})
+	go func() {
+		h.StreamLogs(struct{}{}, stream)
+		close(done)
+	}()
+
+	type line struct{ jobID, stream, message string }
+	receive := func(n int) map[line]struct{} {
+		received := make(map[line]struct{}, n)
+		for i := 0; i < n; i++ {
+			select {
+			case l := <-lines:
+				logLine := l.(*host.LogLine)
+				if logLine.Timestamp.IsZero() {
+					t.Errorf("expected line %+v to have a timestamp", logLine)
+				}
+				received[line{logLine.JobID, logLine.Stream, logLine.Message}] = struct{}{}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for log line")
+			}
+		}
+		return received
+	}
+	assertLines := func(received map[line]struct{}, expected ...line) {
+		if len(received) != len(expected) {
+			t.Fatalf("expected %d lines, got %d: %v", len(expected), len(received), received)
+		}
+		for _, l := range expected {
+			if _, ok := received[l]; !ok {
+				t.Errorf("expected line %+v, got %v", l, received)
+			}
+		}
+	}
+
+	assertLines(receive(4),
+		line{"a", "stdout", "a1"},
+		line{"a", "stdout", "a2"},
+		line{"b", "stdout", "b1"},
+		line{"b", "stderr", "b2"},
+	)
+
+	// jobs which start after the stream begins are included
+	state.AddJob(&host.Job{ID: "c"})
+	state.SetStatusRunning("c")
+	assertLines(receive(1), line{"c", "stderr", "c1"})
+
+	close(stream.Error)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for log stream to end")
+	}
+}
+
+// pidBackend is a backend whose jobs are processes running on the host.
+type pidBackend struct {
+	Backend
+	pids map[string]int
+}
+
+func (b *pidBackend) InitPID(id string) (int, error) {
+	return b.pids[id], nil
+}
+
+func TestJobProcessTree(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	state := NewState()
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	h := &Host{state: state, backend: &pidBackend{pids: map[string]int{"a": cmd.Process.Pid}}}
+
+	// wait for the shell to start its child
+	var procs []host.Process
+	var child *host.Process
+	for start := time.Now(); child == nil && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if err := h.JobProcessTree("a", &procs); err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range procs {
+			if p.PPID == cmd.Process.Pid && strings.HasPrefix(p.Command, "sleep") {
+				child = &procs[i]
+			}
+		}
+	}
+	if child == nil {
+		t.Fatalf("expected a sleep process with parent %d, got %+v", cmd.Process.Pid, procs)
+	}
+
+	var parent *host.Process
+	for i, p := range procs {
+		if p.PID == cmd.Process.Pid {
+			parent = &procs[i]
+		}
+	}
+	if parent == nil {
+		t.Fatalf("expected process %d, got %+v", cmd.Process.Pid, procs)
+	}
+	if parent.Command != "sh -c sleep 10 & wait" {
+		t.Errorf("expected parent command %q, got %q", "sh -c sleep 10 & wait", parent.Command)
+	}
+	if parent.State == "" || child.State == "" {
+		t.Errorf("expected processes to have a state, got %+v and %+v", parent, child)
+	}
+
+	if err := h.JobProcessTree("b", &procs); err == nil {
+		t.Error("expected an error for an unknown job")
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	h := &Host{state: NewState()}
+	samples := make(chan interface{})
+	stream := rpcplus.Stream{Send: samples, Error: make(chan error)}
+	defer close(stream.Error)
+	go h.StreamStats(100*time.Millisecond, stream)
+
+	receive := func() *host.HostStats {
+		select {
+		case s := <-samples:
+			return s.(*host.HostStats)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for stats")
+		}
+		return nil
+	}
+
+	idle := 1.0
+	for i := 0; i < 3; i++ {
+		stats := receive()
+		if stats.MemoryTotal == 0 || stats.MemoryUsed == 0 || stats.MemoryUsed > stats.MemoryTotal {
+			t.Errorf("unexpected memory usage %d/%d", stats.MemoryUsed, stats.MemoryTotal)
+		}
+		if stats.DiskTotal == 0 || stats.DiskUsed > stats.DiskTotal {
+			t.Errorf("unexpected disk usage %d/%d", stats.DiskUsed, stats.DiskTotal)
+		}
+		if stats.CPU < idle {
+			idle = stats.CPU
+		}
+	}
+
+	// burn every core, and check the reported CPU usage rises
+	for i := 0; i < runtime.NumCPU(); i++ {
+		cmd := exec.Command("sh", "-c", "while :; do :; done")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+	}
+	receive() // the first sample may cover the time before the jobs started
+	var busy float64
+	for i := 0; i < 3; i++ {
+		if stats := receive(); stats.CPU > busy {
+			busy = stats.CPU
+		}
+	}
+	if busy < idle+0.25 {
+		t.Errorf("expected CPU usage to rise from %.2f, got %.2f", idle, busy)
+	}
+}
+
+// exitBackend is a backend whose Attach writes the configured output of the
+// job and then returns, like a job which has exited.
+type exitBackend struct {
+	Backend
+	stdout  []string
+	written chan struct{}
+}
+
+func (b *exitBackend) Attach(req *AttachRequest) error {
+	for _, line := range b.stdout {
+		fmt.Fprintln(req.Stdout, line)
+	}
+	close(b.written)
+	return nil
+}
+
+func TestRetainLastLogs(t *testing.T) {
+	backend := &exitBackend{written: make(chan struct{})}
+	for i := 0; i < maxLastLogs+10; i++ {
+		backend.stdout = append(backend.stdout, fmt.Sprintf("line %d", i))
+	}
+	state := NewState()
+	h := &Host{state: state, backend: backend}
+	done := make(chan struct{})
+	defer close(done)
+	go h.retainLastLogs(done)
+
+	// wait for the listener to be added before starting the job
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		state.listenMtx.RLock()
+		n := len(state.listeners["all"])
+		state.listenMtx.RUnlock()
+		if n > 0 {
+			break
+		}
+	}
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	select {
+	case <-backend.written:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for job output")
+	}
+	state.SetStatusDone("a", 1)
+
+	var job host.ActiveJob
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if err := h.GetJob("a", &job); err != nil {
+			t.Fatal(err)
+		}
+		if len(job.LastLogs) == maxLastLogs && job.LastLogs[maxLastLogs-1].Message == backend.stdout[len(backend.stdout)-1] {
+			break
+		}
+	}
+	if job.Status != host.StatusCrashed {
+		t.Errorf("expected job to have crashed, got %s", job.Status)
+	}
+	if len(job.LastLogs) != maxLastLogs {
+		t.Fatalf("expected %d lines, got %d", maxLastLogs, len(job.LastLogs))
+	}
+	for i, line := range job.LastLogs {
+		if expected := backend.stdout[i+10]; line.Message != expected || line.Stream != "stdout" {
+			t.Errorf("expected line %d to be %q on stdout, got %q on %s", i, expected, line.Message, line.Stream)
+		}
+	}
+}
+
+func TestSetJobResources(t *testing.T) {
+	// fake the /proc and cgroup filesystems
+	dir, err := ioutil.TempDir("", "flynn-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p, c string) { procPath, cgroupPath = p, c }(procPath, cgroupPath)
+	procPath = filepath.Join(dir, "proc")
+	cgroupPath = filepath.Join(dir, "cgroup")
+	memDir := filepath.Join(cgroupPath, "memory", "flynn", "a")
+	for path, data := range map[string]string{
+		filepath.Join(procPath, "1234", "cgroup"):      "5:cpuacct,cpu:/flynn/a\n4:memory:/flynn/a\n",
+		filepath.Join(memDir, "memory.limit_in_bytes"): "268435456\n",
+		filepath.Join(memDir, "memory.usage_in_bytes"): "104857600\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := NewState()
+	state.AddJob(&host.Job{ID: "a", Resources: host.JobResources{Memory: 256 * 1024}})
+	state.SetStatusRunning("a")
+	h := &Host{state: state, backend: &pidBackend{pids: map[string]int{"a": 1234}}}
+
+	limit := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(memDir, "memory.limit_in_bytes"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	// raise the limit
+	req := &host.SetJobResourcesReq{JobID: "a", Resources: host.JobResources{Memory: 512 * 1024}}
+	if err := h.SetJobResources(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if l := limit(); l != "536870912" {
+		t.Errorf("expected memory limit 536870912, got %s", l)
+	}
+	if m := state.GetJob("a").Job.Resources.Memory; m != 512*1024 {
+		t.Errorf("expected job memory %d, got %d", 512*1024, m)
+	}
+
+	// lowering the limit below the memory in use fails
+	req.Resources.Memory = 64 * 1024
+	if err := h.SetJobResources(req, &struct{}{}); err == nil {
+		t.Error("expected an error lowering the limit below usage")
+	}
+	if l := limit(); l != "536870912" {
+		t.Errorf("expected memory limit to be unchanged, got %s", l)
+	}
+
+	// devices cannot be changed
+	req.Resources = host.JobResources{Memory: 512 * 1024, Devices: map[string]int{"gpu": 1}}
+	if err := h.SetJobResources(req, &struct{}{}); err == nil {
+		t.Error("expected an error changing devices")
+	}
+
+	req.JobID = "b"
+	if err := h.SetJobResources(req, &struct{}{}); err == nil {
+		t.Error("expected an error for an unknown job")
+	}
+}
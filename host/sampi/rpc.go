@@ -108,6 +108,13 @@ func (s *Cluster) StreamHostEvents(arg struct{}, stream rpcplus.Stream) error {
 		s.state.RemoveListener(ch)
 		close(ch)
 	}()
+	// send an empty event so the client knows the listener has been added
+	// and no later events will be missed
+	select {
+	case stream.Send <- host.HostEvent{}:
+	case <-stream.Error:
+		return nil
+	}
 	for {
 		select {
 		case event := <-ch:
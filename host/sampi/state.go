@@ -80,12 +80,37 @@ func (s *State) AddJobs(hostID string, jobs []*host.Job) error {
 	copy(newJobs, h.Jobs)
 	newJobs = append(newJobs, jobs...)
 	h.Jobs = newJobs
+	h.Volumes = addVolumes(h.Volumes, jobs)
 
 	(*s.next)[hostID] = h
 	s.nextModified = true
 	return nil
 }
 
+// addVolumes returns the volumes with those mounted by jobs added, as the
+// host creates the volumes of the jobs it runs.
+func addVolumes(volumes []string, jobs []*host.Job) []string {
+	res := make([]string, len(volumes))
+	copy(res, volumes)
+	for _, job := range jobs {
+		for _, m := range job.Config.Mounts {
+			if m.Volume != "" && !hasVolume(res, m.Volume) {
+				res = append(res, m.Volume)
+			}
+		}
+	}
+	return res
+}
+
+func hasVolume(volumes []string, name string) bool {
+	for _, v := range volumes {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *State) SendJob(host string, job *host.Job) {
 	if ch, ok := s.streams[host]; ok {
 		ch <- job
@@ -45,3 +45,29 @@ func TestStateRace(t *testing.T) {
 		t.Log("Got '2'")
 	}
 }
+
+func TestStateAddJobsVolumes(t *testing.T) {
+	state := NewState()
+	state.Begin()
+	state.AddHost(&host.Host{ID: "foo", Volumes: []string{"existing"}}, nil)
+	state.Commit()
+
+	// the volumes of added jobs are recorded as held by the host, even
+	// once the jobs are removed
+	state.Begin()
+	if err := state.AddJobs("foo", []*host.Job{{
+		ID:     "job",
+		Config: host.ContainerConfig{Mounts: []host.Mount{{Volume: "data"}, {Volume: "existing"}, {Location: "/tmp"}}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+	state.Begin()
+	state.RemoveJobs("foo", "job")
+	state.Commit()
+
+	volumes := state.Get()["foo"].Volumes
+	if len(volumes) != 2 || volumes[0] != "existing" || volumes[1] != "data" {
+		t.Fatalf("unexpected volumes %v", volumes)
+	}
+}
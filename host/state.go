@@ -17,23 +17,51 @@ type State struct {
 	jobs map[string]*host.ActiveJob
 	mtx  sync.RWMutex
 
-	containers map[string]*host.ActiveJob              // container ID -> job
-	listeners  map[string]map[chan host.Event]struct{} // job id -> listener list (ID "all" gets all events)
+	containers map[string]*host.ActiveJob                    // container ID -> job
+	listeners  map[string]map[chan host.Event]*eventListener // job id -> listener list (ID "all" gets all events)
 	listenMtx  sync.RWMutex
 	attachers  map[string]map[chan struct{}]struct{}
 
+	eventMtx sync.Mutex
+	eventSeq uint64
+	events   []host.Event // recent events which can be replayed to listeners
+
+	pulls        map[string]*host.PullProgress // job id -> progress of an in-progress pull
+	pullWatchers map[string]map[*pullWatcher]struct{}
+	pullSlots    chan struct{}            // limits concurrent pulls, nil is unlimited
+	pullHolders  map[string]chan struct{} // job id -> the slots it holds one of
+	pullMtx      sync.Mutex
+
+	lastLogs     map[string][]*host.LogLine // job id -> most recent output
+	lastLogsJobs []string                   // job ids in lastLogs, oldest first
+	lastLogsMtx  sync.Mutex
+
+	// draining is whether the host is registered as draining
+	draining    bool
+	drainingMtx sync.Mutex
+
 	stateFileMtx sync.Mutex
 	stateFile    *os.File
 	backend      Backend
 }
 
+// maxEventHistory is the number of events kept for replaying to listeners
+// which reconnect.
+const maxEventHistory = 1000
+
 func NewState() *State {
-	return &State{
+	s := &State{
 		jobs:       make(map[string]*host.ActiveJob),
 		containers: make(map[string]*host.ActiveJob),
-		listeners:  make(map[string]map[chan host.Event]struct{}),
+		listeners:  make(map[string]map[chan host.Event]*eventListener),
 		attachers:  make(map[string]map[chan struct{}]struct{}),
+
+		pulls:        make(map[string]*host.PullProgress),
+		pullWatchers: make(map[string]map[*pullWatcher]struct{}),
+		pullHolders:  make(map[string]chan struct{}),
+		lastLogs:     make(map[string][]*host.LogLine),
 	}
+	return s
 }
 
 func (s *State) Restore(file string, backend Backend) error {
@@ -110,6 +138,63 @@ func (s *State) RemoveJob(id string) {
 	defer s.mtx.Unlock()
 	delete(s.jobs, id)
 	go s.persist()
+
+	s.lastLogsMtx.Lock()
+	s.removeLastLogs(id)
+	s.lastLogsMtx.Unlock()
+}
+
+const (
+	// maxLastLogs is the number of lines of output retained for each job.
+	maxLastLogs = 100
+
+	// maxLastLogsJobs is the number of jobs whose output is retained, as
+	// jobs which have stopped are not usually removed from the state.
+	maxLastLogsJobs = 1000
+)
+
+// AddLastLog retains line as the most recent output of the job, discarding
+// the oldest line if more than maxLastLogs lines are retained, and the output
+// of the job which was seen first if the output of more than maxLastLogsJobs
+// jobs is retained.
+func (s *State) AddLastLog(line *host.LogLine) {
+	s.lastLogsMtx.Lock()
+	defer s.lastLogsMtx.Unlock()
+	if _, ok := s.lastLogs[line.JobID]; !ok {
+		if len(s.lastLogsJobs) >= maxLastLogsJobs {
+			s.removeLastLogs(s.lastLogsJobs[0])
+		}
+		s.lastLogsJobs = append(s.lastLogsJobs, line.JobID)
+	}
+	lines := append(s.lastLogs[line.JobID], line)
+	if len(lines) > maxLastLogs {
+		lines = lines[len(lines)-maxLastLogs:]
+	}
+	s.lastLogs[line.JobID] = lines
+}
+
+// removeLastLogs discards the retained output of the job, lastLogsMtx must be
+// held.
+func (s *State) removeLastLogs(jobID string) {
+	if _, ok := s.lastLogs[jobID]; !ok {
+		return
+	}
+	delete(s.lastLogs, jobID)
+	for i, id := range s.lastLogsJobs {
+		if id == jobID {
+			s.lastLogsJobs = append(s.lastLogsJobs[:i], s.lastLogsJobs[i+1:]...)
+			break
+		}
+	}
+}
+
+// LastLogs returns the retained output of the job, oldest first.
+func (s *State) LastLogs(jobID string) []*host.LogLine {
+	s.lastLogsMtx.Lock()
+	defer s.lastLogsMtx.Unlock()
+	lines := make([]*host.LogLine, len(s.lastLogs[jobID]))
+	copy(lines, s.lastLogs[jobID])
+	return lines
 }
 
 func (s *State) Get() map[string]host.ActiveJob {
@@ -148,6 +233,15 @@ func (s *State) SetInternalIP(jobID, ip string) {
 	go s.persist()
 }
 
+// SetMemory records the memory limit of a job which was changed while it was
+// running.
+func (s *State) SetMemory(jobID string, kib int) {
+	s.mtx.Lock()
+	s.jobs[jobID].Job.Resources.Memory = kib
+	s.mtx.Unlock()
+	go s.persist()
+}
+
 func (s *State) SetManifestID(jobID, manifestID string) {
 	s.mtx.Lock()
 	s.jobs[jobID].ManifestID = manifestID
@@ -166,6 +260,7 @@ func (s *State) SetStatusRunning(jobID string) {
 
 	job.StartedAt = time.Now().UTC()
 	job.Status = host.StatusRunning
+	s.FinishPull(jobID, nil)
 	s.sendEvent(job, "start")
 	go s.persist()
 }
@@ -197,6 +292,7 @@ func (s *State) setStatusDone(job *host.ActiveJob, exitStatus int) {
 	}
 	job.EndedAt = time.Now().UTC()
 	job.ExitStatus = exitStatus
+	s.FinishPull(job.Job.ID, nil)
 	if exitStatus == 0 {
 		job.Status = host.StatusDone
 	} else {
@@ -207,6 +303,16 @@ func (s *State) setStatusDone(job *host.ActiveJob, exitStatus int) {
 }
 
 func (s *State) SetStatusFailed(jobID string, err error) {
+	s.setStatusFailed(jobID, err, false)
+}
+
+// SetStatusInitFailed marks the job as failed because its init command
+// failed, which restarting the job would not fix.
+func (s *State) SetStatusInitFailed(jobID string, err error) {
+	s.setStatusFailed(jobID, err, true)
+}
+
+func (s *State) setStatusFailed(jobID string, err error, initFailed bool) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -215,9 +321,11 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 		return
 	}
 	job.Status = host.StatusFailed
+	job.InitFailed = initFailed
 	job.EndedAt = time.Now().UTC()
 	errStr := err.Error()
 	job.Error = &errStr
+	s.FinishPull(jobID, err)
 	s.sendEvent(job, "error")
 	go s.persist()
 	go s.WaitAttach(jobID)
@@ -262,42 +370,272 @@ func (s *State) WaitAttach(jobID string) {
 }
 
 func (s *State) AddListener(jobID string) chan host.Event {
-	ch := make(chan host.Event)
+	l := newEventListener()
 	s.listenMtx.Lock()
 	if _, ok := s.listeners[jobID]; !ok {
-		s.listeners[jobID] = make(map[chan host.Event]struct{})
+		s.listeners[jobID] = make(map[chan host.Event]*eventListener)
 	}
-	s.listeners[jobID][ch] = struct{}{}
+	s.listeners[jobID][l.ch] = l
 	s.listenMtx.Unlock()
-	return ch
+	return l.ch
 }
 
-func (s *State) RemoveListener(jobID string, ch chan host.Event) {
-	go func() {
-		// drain to prevent deadlock while removing the listener
-		for _ = range ch {
+// AddListenerSince adds a listener like AddListener and also returns any
+// buffered events for the job with a sequence number greater than since.
+// Events may appear both in the returned slice and on the channel, so callers
+// should skip events which they have already seen.
+func (s *State) AddListenerSince(jobID string, since uint64) (chan host.Event, []host.Event) {
+	ch := s.AddListener(jobID)
+	s.eventMtx.Lock()
+	defer s.eventMtx.Unlock()
+	var events []host.Event
+	for _, e := range s.events {
+		if e.Seq <= since || jobID != "all" && e.JobID != jobID {
+			continue
 		}
-	}()
+		events = append(events, e)
+	}
+	return ch, events
+}
+
+func (s *State) RemoveListener(jobID string, ch chan host.Event) {
 	s.listenMtx.Lock()
+	l := s.listeners[jobID][ch]
 	delete(s.listeners[jobID], ch)
 	if len(s.listeners[jobID]) == 0 {
 		delete(s.listeners, jobID)
 	}
 	s.listenMtx.Unlock()
-	close(ch)
+	if l != nil {
+		l.Close()
+	}
 }
 
 func (s *State) sendEvent(job *host.ActiveJob, event string) {
 	j := *job
-	go func() {
-		s.listenMtx.RLock()
-		defer s.listenMtx.RUnlock()
-		e := host.Event{JobID: job.Job.ID, Job: &j, Event: event}
-		for ch := range s.listeners["all"] {
-			ch <- e
+	s.eventMtx.Lock()
+	defer s.eventMtx.Unlock()
+	s.eventSeq++
+	e := host.Event{JobID: job.Job.ID, Job: &j, Event: event, Seq: s.eventSeq}
+	s.events = append(s.events, e)
+	if len(s.events) > maxEventHistory {
+		s.events = s.events[len(s.events)-maxEventHistory:]
+	}
+
+	// events are queued for each listener so that a slow listener doesn't
+	// hold up the others, and are queued with eventMtx held so that every
+	// listener receives them in sequence order
+	s.listenMtx.RLock()
+	defer s.listenMtx.RUnlock()
+	for _, l := range s.listeners["all"] {
+		l.push(e)
+	}
+	for _, l := range s.listeners[e.JobID] {
+		l.push(e)
+	}
+}
+
+// eventListener sends the events queued for a listener to its channel in a
+// goroutine of its own. Events are queued without blocking, so the queue of a
+// slow listener grows rather than delaying events for other listeners.
+type eventListener struct {
+	ch chan host.Event
+
+	mtx    sync.Mutex
+	queue  []host.Event
+	notify chan struct{}
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newEventListener() *eventListener {
+	l := &eventListener{
+		ch:      make(chan host.Event),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *eventListener) push(e host.Event) {
+	l.mtx.Lock()
+	l.queue = append(l.queue, e)
+	l.mtx.Unlock()
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (l *eventListener) run() {
+	defer close(l.stopped)
+	for {
+		select {
+		case <-l.notify:
+		case <-l.done:
+			return
 		}
-		for ch := range s.listeners[job.Job.ID] {
-			ch <- e
+		l.mtx.Lock()
+		events := l.queue
+		l.queue = nil
+		l.mtx.Unlock()
+		for _, e := range events {
+			select {
+			case l.ch <- e:
+			case <-l.done:
+				return
+			}
 		}
-	}()
+	}
+}
+
+// Close stops sending events and closes the listener's channel.
+func (l *eventListener) Close() {
+	close(l.done)
+	<-l.stopped
+	close(l.ch)
+}
+
+// pullWatcher receives the pull progress of a job. Progress updates are not
+// queued, so a slow watcher only sees the latest progress.
+type pullWatcher struct {
+	mtx    sync.Mutex
+	latest *host.PullProgress
+	notify chan struct{}
+}
+
+func (w *pullWatcher) set(p host.PullProgress) {
+	w.mtx.Lock()
+	w.latest = &p
+	w.mtx.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Latest returns the most recent pull progress.
+func (w *pullWatcher) Latest() *host.PullProgress {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.latest
+}
+
+// AddPullWatcher returns a watcher for the pull progress of the given job. If
+// the job has already started, the watcher receives a single progress with
+// Done set.
+func (s *State) AddPullWatcher(jobID string) *pullWatcher {
+	// s.mtx is held so the job can't start between checking its status and
+	// adding the watcher
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	s.pullMtx.Lock()
+	defer s.pullMtx.Unlock()
+
+	w := &pullWatcher{notify: make(chan struct{}, 1)}
+	if job, ok := s.jobs[jobID]; ok && job.Status != host.StatusStarting {
+		w.set(host.PullProgress{JobID: jobID, Done: true})
+		return w
+	}
+	if p, ok := s.pulls[jobID]; ok {
+		w.set(*p)
+	}
+	if _, ok := s.pullWatchers[jobID]; !ok {
+		s.pullWatchers[jobID] = make(map[*pullWatcher]struct{})
+	}
+	s.pullWatchers[jobID][w] = struct{}{}
+	return w
+}
+
+func (s *State) RemovePullWatcher(jobID string, w *pullWatcher) {
+	s.pullMtx.Lock()
+	defer s.pullMtx.Unlock()
+	delete(s.pullWatchers[jobID], w)
+	if len(s.pullWatchers[jobID]) == 0 {
+		delete(s.pullWatchers, jobID)
+	}
+}
+
+// SetPullLimit limits the number of job artifacts which are pulled at once,
+// zero being unlimited. Pulls which are already in progress are not affected.
+func (s *State) SetPullLimit(n int) {
+	s.pullMtx.Lock()
+	defer s.pullMtx.Unlock()
+	if n > 0 {
+		s.pullSlots = make(chan struct{}, n)
+	} else {
+		s.pullSlots = nil
+	}
+}
+
+// StartPull waits until the artifact of a job may be pulled without exceeding
+// the pull limit, reporting the pull as queued while it waits. The pull must
+// be finished with FinishPull.
+func (s *State) StartPull(jobID string) {
+	s.pullMtx.Lock()
+	slots := s.pullSlots
+	s.pullMtx.Unlock()
+	if slots == nil {
+		return
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		s.SetPullProgress(jobID, host.PullProgress{Status: host.PullStatusQueued})
+		slots <- struct{}{}
+		s.SetPullProgress(jobID, host.PullProgress{})
+	}
+	s.pullMtx.Lock()
+	s.pullHolders[jobID] = slots
+	s.pullMtx.Unlock()
+}
+
+// SetPullProgress records the progress of pulling the artifact of a job.
+func (s *State) SetPullProgress(jobID string, p host.PullProgress) {
+	s.pullMtx.Lock()
+	defer s.pullMtx.Unlock()
+	p.JobID = jobID
+	s.pulls[jobID] = &p
+	for w := range s.pullWatchers[jobID] {
+		w.set(p)
+	}
+}
+
+// FinishPull marks the pull of a job's artifact as done, notifying and
+// removing any watchers. It is safe to call for jobs which were not pulled.
+func (s *State) FinishPull(jobID string, err error) {
+	s.pullMtx.Lock()
+	defer s.pullMtx.Unlock()
+	p := host.PullProgress{JobID: jobID}
+	if prev, ok := s.pulls[jobID]; ok {
+		p = *prev
+		delete(s.pulls, jobID)
+	}
+	if slots, ok := s.pullHolders[jobID]; ok {
+		delete(s.pullHolders, jobID)
+		<-slots
+	}
+	p.Done = true
+	if err != nil {
+		p.Error = err.Error()
+	}
+	for w := range s.pullWatchers[jobID] {
+		w.set(p)
+	}
+	delete(s.pullWatchers, jobID)
+}
+
+func (s *State) SetDraining(draining bool) {
+	s.drainingMtx.Lock()
+	s.draining = draining
+	s.drainingMtx.Unlock()
+}
+
+func (s *State) Draining() bool {
+	s.drainingMtx.Lock()
+	defer s.drainingMtx.Unlock()
+	return s.draining
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+type eventStream struct {
+	events chan interface{}
+	stream rpcplus.Stream
+	done   chan struct{}
+}
+
+func streamEventsSince(h *Host, since uint64) *eventStream {
+	events := make(chan interface{})
+	s := &eventStream{
+		events: events,
+		stream: rpcplus.Stream{Send: events, Error: make(chan error)},
+		done:   make(chan struct{}),
+	}
+	go func() {
+		h.StreamEventsSince(&host.StreamEventsReq{JobID: "all", Since: since}, s.stream)
+		close(s.done)
+	}()
+	return s
+}
+
+func (s *eventStream) Close() {
+	close(s.stream.Error)
+	<-s.done
+}
+
+func (s *eventStream) next(t *testing.T) host.Event {
+	select {
+	case e := <-s.events:
+		return e.(host.Event)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return host.Event{}
+}
+
+func TestStreamEventsSince(t *testing.T) {
+	state := NewState()
+	h := &Host{state: state}
+
+	type expectedEvent struct {
+		event, jobID string
+	}
+	assertEvents := func(s *eventStream, last uint64, expected []expectedEvent) uint64 {
+		for _, exp := range expected {
+			e := s.next(t)
+			if e.Seq <= last {
+				t.Fatalf("expected sequence number greater than %d, got %d", last, e.Seq)
+			}
+			last = e.Seq
+			if e.Event != exp.event || e.JobID != exp.jobID {
+				t.Fatalf("expected %s event for %s, got %s event for %s", exp.event, exp.jobID, e.Event, e.JobID)
+			}
+		}
+		return last
+	}
+
+	stream := streamEventsSince(h, 0)
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	state.AddJob(&host.Job{ID: "b"})
+	last := assertEvents(stream, 0, []expectedEvent{{"create", "a"}, {"start", "a"}, {"create", "b"}})
+	stream.Close()
+
+	// generate events while disconnected
+	state.SetStatusRunning("b")
+	state.SetStatusDone("a", 0)
+
+	// reconnecting with the last seen sequence number should only replay
+	// the missed events, followed by new events
+	stream = streamEventsSince(h, last)
+	defer stream.Close()
+	last = assertEvents(stream, last, []expectedEvent{{"start", "b"}, {"stop", "a"}})
+	state.SetStatusDone("b", 1)
+	assertEvents(stream, last, []expectedEvent{{"stop", "b"}})
+
+	select {
+	case e := <-stream.events:
+		t.Fatalf("unexpected event: %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestInitFailedEvent(t *testing.T) {
+	state := NewState()
+	h := &Host{state: state}
+	stream := streamEventsSince(h, 0)
+	defer stream.Close()
+
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusInitFailed("a", errors.New("init command exited with status 1"))
+	state.AddJob(&host.Job{ID: "b"})
+	state.SetStatusFailed("b", errors.New("container failed to start"))
+
+	for _, exp := range []struct {
+		jobID      string
+		initFailed bool
+	}{{"a", true}, {"b", false}} {
+		if e := stream.next(t); e.Event != "create" || e.JobID != exp.jobID {
+			t.Fatalf("expected create event for %s, got %s event for %s", exp.jobID, e.Event, e.JobID)
+		}
+		e := stream.next(t)
+		if e.Event != "error" || e.JobID != exp.jobID {
+			t.Fatalf("expected error event for %s, got %s event for %s", exp.jobID, e.Event, e.JobID)
+		}
+		if e.Job.Status != host.StatusFailed || e.Job.InitFailed != exp.initFailed {
+			t.Fatalf("expected %s to be failed with init failed %t, got %s and %t", exp.jobID, exp.initFailed, e.Job.Status, e.Job.InitFailed)
+		}
+	}
+	if job := state.GetJob("a"); job.Error == nil || *job.Error != "init command exited with status 1" {
+		t.Fatalf("unexpected job error %v", job.Error)
+	}
+}
+
+func TestLastLogsJobsLimit(t *testing.T) {
+	state := NewState()
+	for i := 0; i < maxLastLogsJobs+10; i++ {
+		state.AddLastLog(&host.LogLine{JobID: fmt.Sprintf("job%d", i), Message: "output"})
+	}
+	state.RemoveJob("job20")
+
+	// the output of the jobs seen first is discarded
+	if n := len(state.lastLogs); n != maxLastLogsJobs-1 {
+		t.Fatalf("expected the output of %d jobs to be retained, got %d", maxLastLogsJobs-1, n)
+	}
+	if n := len(state.lastLogsJobs); n != maxLastLogsJobs-1 {
+		t.Fatalf("expected %d jobs to be tracked, got %d", maxLastLogsJobs-1, n)
+	}
+	for _, id := range []string{"job0", "job9", "job20"} {
+		if lines := state.LastLogs(id); len(lines) != 0 {
+			t.Errorf("expected the output of %s to be discarded, got %d lines", id, len(lines))
+		}
+	}
+	if lines := state.LastLogs("job10"); len(lines) != 1 {
+		t.Errorf("expected the output of job10 to be retained, got %d lines", len(lines))
+	}
+}
+
+func TestSlowListener(t *testing.T) {
+	state := NewState()
+	slow := state.AddListener("all")
+	defer state.RemoveListener("all", slow)
+	fast := state.AddListener("all")
+	defer state.RemoveListener("all", fast)
+
+	// a listener which isn't receiving doesn't hold up events for others
+	for i := 0; i < 10; i++ {
+		state.AddJob(&host.Job{ID: fmt.Sprintf("job%d", i)})
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case e := <-fast:
+			if id := fmt.Sprintf("job%d", i); e.JobID != id {
+				t.Fatalf("expected event for %s, got event for %s", id, e.JobID)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	// the slow listener still receives every event in order
+	for i := 0; i < 10; i++ {
+		if e := <-slow; e.JobID != fmt.Sprintf("job%d", i) {
+			t.Fatalf("expected event for job%d, got event for %s", i, e.JobID)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// statsDiskPath is the path on the filesystem whose usage is reported in host
+// stats.
+var statsDiskPath = "/"
+
+// statsSampler samples the resource usage of the host, keeping the previous
+// CPU times so that CPU usage is measured between samples.
+type statsSampler struct {
+	idle, total uint64
+}
+
+func newStatsSampler() (*statsSampler, error) {
+	s := &statsSampler{}
+	var err error
+	s.idle, s.total, err = readCPUTimes()
+	return s, err
+}
+
+func (s *statsSampler) Sample() (*host.HostStats, error) {
+	stats := &host.HostStats{Timestamp: time.Now().UTC()}
+
+	idle, total, err := readCPUTimes()
+	if err != nil {
+		return nil, err
+	}
+	if total > s.total {
+		stats.CPU = 1 - float64(idle-s.idle)/float64(total-s.total)
+	}
+	s.idle, s.total = idle, total
+
+	if stats.MemoryTotal, stats.MemoryUsed, err = readMemInfo(); err != nil {
+		return nil, err
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(statsDiskPath, &fs); err != nil {
+		return nil, err
+	}
+	stats.DiskTotal = fs.Blocks * uint64(fs.Bsize)
+	stats.DiskUsed = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+	return stats, nil
+}
+
+// readCPUTimes returns the idle and total CPU time of all cores from
+// /proc/stat, in clock ticks.
+func readCPUTimes() (idle, total uint64, err error) {
+	f, err := os.Open(filepath.Join(procPath, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return 0, 0, errors.New("host: empty /proc/stat")
+	}
+	fields := strings.Fields(s.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("host: unexpected /proc/stat line %q", s.Text())
+	}
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += n
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return idle, total, nil
+}
+
+// readMemInfo returns the total and used memory from /proc/meminfo in bytes,
+// not counting memory which the kernel can reclaim as used.
+func readMemInfo() (total, used uint64, err error) {
+	f, err := os.Open(filepath.Join(procPath, "meminfo"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = n * 1024
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	total = info["MemTotal"]
+	available, ok := info["MemAvailable"]
+	if !ok {
+		// kernels before 3.14 don't report available memory
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	if available > total {
+		available = total
+	}
+	return total, total - available, nil
+}
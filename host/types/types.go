@@ -13,6 +13,10 @@ type Job struct {
 	Resources JobResources
 
 	Config ContainerConfig
+
+	// LogRetention limits how much of the job's output the host keeps on
+	// disk, the zero value using the host defaults.
+	LogRetention LogRetention
 }
 
 func (j *Job) Dup() *Job {
@@ -37,8 +41,16 @@ func (j *Job) Dup() *Job {
 		return res
 	}
 	job.Metadata = dupMap(j.Metadata)
+	if j.Resources.Devices != nil {
+		job.Resources.Devices = make(map[string]int, len(j.Resources.Devices))
+		for k, v := range j.Resources.Devices {
+			job.Resources.Devices[k] = v
+		}
+	}
 	job.Config.Entrypoint = dupSlice(j.Config.Entrypoint)
 	job.Config.Cmd = dupSlice(j.Config.Cmd)
+	job.Config.InitCmd = dupSlice(j.Config.InitCmd)
+	job.Config.PreStop = dupSlice(j.Config.PreStop)
 	job.Config.Env = dupMap(j.Config.Env)
 	if j.Config.Ports != nil {
 		job.Config.Ports = make([]Port, len(j.Config.Ports))
@@ -58,6 +70,25 @@ func (j *Job) Dup() *Job {
 
 type JobResources struct {
 	Memory int // in KiB
+
+	// Devices are counts of countable devices such as "gpu". A host only has
+	// the devices it advertises, so jobs requesting devices are only placed
+	// on hosts with enough of them free.
+	Devices map[string]int
+}
+
+// MinLogRetentionBytes is the smallest MaxBytes a LogRetention may have, as
+// the log is rotated in two halves which must each fit a full log line.
+const MinLogRetentionBytes = 512 * 1024
+
+type LogRetention struct {
+	// MaxBytes is the maximum size of the log on disk, older output is
+	// removed as the log is rotated.
+	MaxBytes int64
+
+	// MaxAge is the age after which rotated log files are removed, it is
+	// rounded up to whole days.
+	MaxAge time.Duration
 }
 
 type ContainerConfig struct {
@@ -71,6 +102,38 @@ type ContainerConfig struct {
 	Ports      []Port
 	WorkingDir string
 	Uid        int
+
+	// User is the name or uid of the user the job runs as inside the
+	// container, overriding Uid. The image default is used if neither is
+	// set.
+	User string
+
+	// DNS are the nameservers written to the container's resolv.conf, the
+	// host's resolv.conf is used if empty. Hostname defaults to the job ID.
+	DNS      []string
+	Hostname string
+
+	// InitCmd is run to completion in the container before Cmd, the job
+	// fails without running Cmd if it does not exit zero.
+	InitCmd []string
+
+	// PreStop is run in the container before it is stopped, waiting up to
+	// ShutdownTimeout for it to exit before the stop signal is sent. The job
+	// is then killed if it has not exited after ShutdownTimeout, which
+	// defaults to DefaultShutdownTimeout.
+	PreStop         []string
+	ShutdownTimeout time.Duration
+}
+
+const DefaultShutdownTimeout = 10 * time.Second
+
+// StopTimeout returns how long to wait for the pre-stop command and for the
+// job to exit after being signalled.
+func (c ContainerConfig) StopTimeout() time.Duration {
+	if c.ShutdownTimeout > 0 {
+		return c.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
 }
 
 type Port struct {
@@ -83,6 +146,12 @@ type Mount struct {
 	Location  string
 	Target    string
 	Writeable bool
+
+	// Volume is the name of a host-local volume to mount, which is created
+	// when first used and kept when the job exits so that later jobs using
+	// the same name on the host see the same data. Target is ignored if it
+	// is set.
+	Volume string
 }
 
 type Artifact struct {
@@ -90,11 +159,21 @@ type Artifact struct {
 	Type string
 }
 
+// ZoneMetadataKey is the key of the host metadata naming the failure domain,
+// such as an availability zone or rack, which the host is in. It is set with
+// `flynn-host daemon --meta zone=<zone>`.
+const ZoneMetadataKey = "zone"
+
 type Host struct {
 	ID string
 
-	Jobs     []*Job
-	Metadata map[string]string
+	Jobs      []*Job
+	Metadata  map[string]string
+	Resources JobResources // resources available to jobs, zero memory is unlimited
+
+	// Volumes are the names of the named volumes held by the host, which
+	// exist whether or not a job using them is running.
+	Volumes []string
 }
 
 type AddJobsReq struct {
@@ -107,10 +186,88 @@ type AddJobsRes struct {
 	State map[string]Host
 }
 
+// Event is a job event emitted by a host.
+//
+// Seq is a per-host sequence number which increases monotonically with each
+// event. Events are delivered at least once and in order, so consumers which
+// reconnect may see an event again and should ignore events with a Seq lower
+// than or equal to the last one they processed.
 type Event struct {
 	Event string
 	JobID string
 	Job   *ActiveJob
+	Seq   uint64
+}
+
+type StreamEventsReq struct {
+	JobID string // "all" streams events for all jobs
+	Since uint64 // replay buffered events with a Seq greater than Since
+}
+
+type SetJobResourcesReq struct {
+	JobID     string
+	Resources JobResources
+}
+
+// PullProgress is the progress of pulling the artifact of a job which is
+// starting. The final progress of a pull has Done set, with Error set if the
+// pull failed.
+type PullProgress struct {
+	JobID       string
+	Status      string // the last status reported by the pull
+	LayersDone  int
+	LayersTotal int
+	Current     int64 // bytes downloaded of the current layer
+	Total       int64 // size in bytes of the current layer, zero if unknown
+	Done        bool
+	Error       string
+}
+
+// PullStatusQueued is the status of a pull which is waiting for other pulls
+// on the host to finish.
+const PullStatusQueued = "queued"
+
+// Percent returns the estimated percentage of the pull which is complete.
+func (p *PullProgress) Percent() int {
+	if p.Done {
+		return 100
+	}
+	if p.LayersTotal == 0 {
+		return 0
+	}
+	done := float64(p.LayersDone)
+	if p.Total > 0 && p.LayersDone < p.LayersTotal {
+		done += float64(p.Current) / float64(p.Total)
+	}
+	return int(100 * done / float64(p.LayersTotal))
+}
+
+// LogLine is a line of output from a job, as streamed by Host.StreamLogs.
+type LogLine struct {
+	JobID     string
+	Stream    string // "stdout" or "stderr"
+	Timestamp time.Time
+	Message   string // the line without the trailing newline
+}
+
+// Process is a process running in the container of a job, as seen by the
+// host. PID and PPID are host PIDs.
+type Process struct {
+	PID     int
+	PPID    int
+	Command string
+	State   string // the state from /proc/[pid]/stat, e.g. "S" for sleeping
+}
+
+// HostStats is a sample of the resource usage of a host, as streamed by
+// Host.StreamStats.
+type HostStats struct {
+	Timestamp   time.Time
+	CPU         float64 // the fraction of CPU time used across all cores since the previous sample, from 0 to 1
+	MemoryTotal uint64  // in bytes
+	MemoryUsed  uint64  // in bytes, excluding reclaimable caches
+	DiskTotal   uint64  // in bytes, of the filesystem jobs are stored on
+	DiskUsed    uint64  // in bytes
 }
 
 type HostEvent struct {
@@ -128,6 +285,15 @@ type ActiveJob struct {
 	ExitStatus  int
 	Error       *string
 	ManifestID  string
+
+	// InitFailed is set on a failed job whose init command failed, so that
+	// it is not restarted.
+	InitFailed bool `json:",omitempty"`
+
+	// LastLogs is the most recent output of the job, which is retained after
+	// the job stops so that a crash can be correlated with its final output.
+	// It is only set by Host.GetJob.
+	LastLogs []*LogLine `json:",omitempty"`
 }
 
 type AttachReq struct {
@@ -135,6 +301,14 @@ type AttachReq struct {
 	Flags  AttachFlag
 	Height uint16
 	Width  uint16
+
+	// StdoutOffset and StderrOffset are the number of bytes of each stream
+	// to skip when replaying the job's logs, so that a client which has
+	// already received some of the output can resume where it left off. If
+	// the logs no longer retain the output from an offset onwards the attach
+	// fails with AttachTruncated.
+	StdoutOffset int64 `json:",omitempty"`
+	StderrOffset int64 `json:",omitempty"`
 }
 
 type AttachFlag uint8
@@ -175,4 +349,5 @@ const (
 	AttachSignal
 	AttachExit
 	AttachResize
+	AttachTruncated
 )
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// volumeDir returns the directory of the named volume in volPath, creating it
+// if it does not exist. Volumes are never removed when jobs exit, so a job
+// which is restarted on the host sees the data of its predecessors.
+func volumeDir(volPath, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("host: invalid volume name %q", name)
+	}
+	dir := filepath.Join(volPath, "volumes", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// listVolumes returns the names of the volumes in volPath, so the host can
+// report the volumes it holds when registering.
+func listVolumes(volPath string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(volPath, "volumes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeDir(t *testing.T) {
+	volPath, err := ioutil.TempDir("", "flynn-host-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(volPath)
+
+	// the first job using the volume creates it and writes to it
+	dir, err := volumeDir(volPath, "app-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "data"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted job using the same volume sees the same data
+	restarted, err := volumeDir(volPath, "app-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted != dir {
+		t.Fatalf("expected volume dir %s, got %s", dir, restarted)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(restarted, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf(`expected data "foo", got %q`, data)
+	}
+
+	// other volumes are separate
+	other, err := volumeDir(volPath, "app-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(other, "data")); !os.IsNotExist(err) {
+		t.Fatalf("expected data to not exist in another volume, got %v", err)
+	}
+
+	for _, name := range []string{"", ".", "..", "../etc", "foo/bar"} {
+		if _, err := volumeDir(volPath, name); err == nil {
+			t.Errorf("expected an error for volume name %q", name)
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	volPath, err := ioutil.TempDir("", "flynn-host-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(volPath)
+
+	// a host which has never created a volume holds none
+	volumes, err := listVolumes(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 0 {
+		t.Fatalf("expected no volumes, got %v", volumes)
+	}
+
+	for _, name := range []string{"app-db", "app-cache"} {
+		if _, err := volumeDir(volPath, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	volumes, err = listVolumes(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || volumes[0] != "app-cache" || volumes[1] != "app-db" {
+		t.Fatalf("unexpected volumes %v", volumes)
+	}
+}
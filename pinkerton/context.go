@@ -90,3 +90,28 @@ func (c *Context) Cleanup(id string) {
 		log.Fatal(err)
 	}
 }
+
+func (c *Context) Prune(urls []string) {
+	keep := make([]string, 0, len(urls))
+	for _, url := range urls {
+		ref, err := registry.NewRef(url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		id := ref.ImageID()
+		if id == "" {
+			// the image ID of a tag can only be found from the registry
+			image, err := ref.Get()
+			if err != nil {
+				log.Fatal(err)
+			}
+			id = image.ID
+		}
+		keep = append(keep, id)
+	}
+	freed, err := c.Store.Prune(keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(freed)
+}
@@ -23,12 +23,14 @@ Usage:
   pinkerton pull [options] <image-url>
   pinkerton checkout [options] <id> <image-id>
   pinkerton cleanup [options] <id>
+  pinkerton prune [options] [<image-url>...]
   pinkerton -h | --help
 
 Commands:
   pull      Download a Docker image
   checkout  Create a working copy of an image
   cleanup   Destroy a working copy of an image
+  prune     Remove the images other than those given
 
 Examples:
   pinkerton pull https://registry.hub.docker.com/redis
@@ -36,6 +38,7 @@ Examples:
   pinkerton pull https://registry.hub.docker.com/flynn/slugrunner?id=1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton checkout slugrunner-test 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton cleanup slugrunner-test
+  pinkerton prune https://registry.hub.docker.com/flynn/slugrunner?id=1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
 
 Options:
   -h, --help       show this message and exit
@@ -65,5 +68,7 @@ Options:
 		ctx.Checkout(args.String["<id>"], args.String["<image-id>"])
 	case args.Bool["cleanup"]:
 		ctx.Cleanup(args.String["<id>"])
+	case args.Bool["prune"]:
+		ctx.Prune(args.All["<image-url>"].([]string))
 	}
 }
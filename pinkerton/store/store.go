@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -96,6 +97,80 @@ func (s *Store) Add(img *registry.Image) (err error) {
 	return os.Rename(tmp, s.root(img.ID))
 }
 
+// Prune removes the images other than those in keep and their ancestors,
+// returning the number of bytes freed.
+func (s *Store) Prune(keep []string) (int64, error) {
+	parents, err := s.parents()
+	if err != nil {
+		return 0, err
+	}
+	kept := make(map[string]struct{}, len(parents))
+	for _, id := range keep {
+		for id != "" {
+			if _, ok := kept[id]; ok {
+				break
+			}
+			kept[id] = struct{}{}
+			id = parents[id]
+		}
+	}
+
+	var freed int64
+	for id := range parents {
+		if _, ok := kept[id]; ok {
+			continue
+		}
+		size, err := s.remove(id)
+		if err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// parents returns the parent ID of each image in the store.
+func (s *Store) parents() (map[string]string, error) {
+	dirs, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[string]string, len(dirs))
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), "_") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(s.root(dir.Name()), "json"))
+		if err != nil {
+			return nil, err
+		}
+		var img registry.Image
+		err = json.NewDecoder(f).Decode(&img)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		parents[dir.Name()] = img.ParentID
+	}
+	return parents, nil
+}
+
+func (s *Store) remove(id string) (int64, error) {
+	if err := s.lock(id); err != nil {
+		return 0, err
+	}
+	defer s.unlock(id)
+
+	var size int64
+	if differ, ok := s.driver.(graphdriver.Differ); ok {
+		size, _ = differ.DiffSize(id)
+	}
+	if err := s.driver.Remove(id); err != nil {
+		return 0, err
+	}
+	return size, os.RemoveAll(s.root(id))
+}
+
 func (s *Store) Exists(id string) bool {
 	_, err := os.Stat(s.root(id))
 	return err == nil
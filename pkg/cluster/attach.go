@@ -18,6 +18,10 @@ import (
 
 var ErrWouldWait = errors.New("cluster: attach would wait")
 
+// ErrLogsTruncated is returned by Attach when the job's logs no longer retain
+// the output from the requested offsets onwards.
+var ErrLogsTruncated = errors.New("cluster: job logs truncated")
+
 func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error) {
 	data, err := json.Marshal(req)
 	if err != nil {
@@ -72,6 +76,9 @@ func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error
 				errBytes = errBytes[4:]
 			}
 			return errors.New(string(errBytes))
+		case host.AttachTruncated:
+			rwc.Close()
+			return ErrLogsTruncated
 		default:
 			rwc.Close()
 			return fmt.Errorf("cluster: unknown attach state: %d", attachState)
@@ -222,8 +222,45 @@ func (c *Client) RemoveJobs(jobIDs []string) error {
 	return client.Call("Cluster.RemoveJobs", jobIDs, &struct{}{})
 }
 
+// subscribeTimeout is how long StreamHostEvents waits for the leader to
+// confirm the subscription, leaders which predate the confirmation never send
+// it.
+var subscribeTimeout = 5 * time.Second
+
+// StreamHostEvents sends events for hosts joining and leaving the cluster to
+// ch, closing it when the stream ends. It returns once the subscription has
+// been established, so events which happen after it returns are not missed,
+// or after subscribeTimeout if the leader does not confirm it.
 func (c *Client) StreamHostEvents(ch chan<- *host.HostEvent) Stream {
-	return rpcStream{c.c.StreamGo("Cluster.StreamHostEvents", struct{}{}, ch)}
+	events := make(chan *host.HostEvent)
+	stream := rpcStream{c.c.StreamGo("Cluster.StreamHostEvents", struct{}{}, events)}
+	// the leader sends an empty event once it has added the listener
+	var first *host.HostEvent
+	select {
+	case event, ok := <-events:
+		if !ok {
+			close(ch)
+			return stream
+		}
+		if *event != (host.HostEvent{}) {
+			first = event
+		}
+	case <-time.After(subscribeTimeout):
+	}
+	go func() {
+		if first != nil {
+			ch <- first
+		}
+		for event := range events {
+			// skip a confirmation which arrives after the timeout
+			if *event == (host.HostEvent{}) {
+				continue
+			}
+			ch <- event
+		}
+		close(ch)
+	}()
+	return stream
 }
 
 func (c *Client) RPCClient() (RPCClient, error) {
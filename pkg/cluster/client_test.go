@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/sampi"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+func newSampiClient(t *testing.T) *Client {
+	server := rpcplus.NewServer()
+	if err := server.Register(sampi.NewCluster(sampi.NewState())); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{c: rpcplus.NewClient(conn)}
+}
+
+func TestStreamHostEventsSynchronous(t *testing.T) {
+	c := newSampiClient(t)
+	defer c.c.Close()
+
+	for i := 0; i < 20; i++ {
+		events := make(chan *host.HostEvent)
+		stream := c.StreamHostEvents(events)
+		if err := stream.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		// add a host as soon as the stream is returned, the add event must
+		// not be missed
+		hostID := fmt.Sprintf("host%d", i)
+		jobs := make(chan *host.Job)
+		hostStream := c.RegisterHost(&host.Host{ID: hostID}, jobs)
+
+	loop:
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					t.Fatalf("stream closed unexpectedly: %v", stream.Err())
+				}
+				// skip the remove event of the previous host
+				if event.HostID == hostID && event.Event == "add" {
+					break loop
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for add event for %s", hostID)
+			}
+		}
+		stream.Close()
+		hostStream.Close()
+	}
+}
+
+// legacyCluster streams host events like a leader which does not confirm the
+// subscription.
+type legacyCluster struct {
+	events chan host.HostEvent
+}
+
+func (c *legacyCluster) StreamHostEvents(arg struct{}, stream rpcplus.Stream) error {
+	for {
+		select {
+		case event := <-c.events:
+			select {
+			case stream.Send <- event:
+			case <-stream.Error:
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+func TestStreamHostEventsLegacyLeader(t *testing.T) {
+	defer func(d time.Duration) { subscribeTimeout = d }(subscribeTimeout)
+	subscribeTimeout = 100 * time.Millisecond
+
+	leader := &legacyCluster{events: make(chan host.HostEvent)}
+	server := rpcplus.NewServer()
+	if err := server.RegisterName("Cluster", leader); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{c: rpcplus.NewClient(conn)}
+	defer c.c.Close()
+
+	// the stream is returned without a confirmation from the leader
+	events := make(chan *host.HostEvent)
+	returned := make(chan Stream)
+	go func() { returned <- c.StreamHostEvents(events) }()
+	var stream Stream
+	select {
+	case stream = <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for StreamHostEvents to return")
+	}
+	defer stream.Close()
+
+	// and events are still sent
+	leader.events <- host.HostEvent{Event: "add", HostID: "host0"}
+	select {
+	case event := <-events:
+		if event.HostID != "host0" || event.Event != "add" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for add event")
+	}
+}
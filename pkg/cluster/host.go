@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"net"
+	"time"
 
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/rpcplus"
@@ -12,6 +13,33 @@ type Host interface {
 	GetJob(id string) (*host.ActiveJob, error)
 	StopJob(id string) error
 	StreamEvents(id string, ch chan<- *host.Event) Stream
+	// StreamEventsSince streams events with a sequence number greater than
+	// since, replaying those which the host has buffered.
+	StreamEventsSince(id string, since uint64, ch chan<- *host.Event) Stream
+	// PullProgress streams the progress of pulling the artifact of the given
+	// job, the stream ends once the pull is done or the job has started.
+	PullProgress(id string, ch chan<- *host.PullProgress) Stream
+	// StreamLogs streams the output of all jobs running on the host,
+	// including jobs which start after the stream begins.
+	StreamLogs(ch chan<- *host.LogLine) Stream
+	// JobProcessTree returns the processes running in the container of the
+	// given job, with host PIDs.
+	JobProcessTree(jobID string) ([]host.Process, error)
+	// SetJobResources changes the resource limits of a running job without
+	// restarting it. Only the memory limit can be changed, and it cannot be
+	// lowered below the memory the job is using.
+	SetJobResources(jobID string, r *host.JobResources) error
+	// StreamStats streams samples of the host's CPU, memory and disk usage
+	// at the given interval.
+	StreamStats(interval time.Duration, ch chan<- *host.HostStats) Stream
+	// PruneArtifacts removes the artifacts cached on the host other than
+	// those with the URIs in keep and those of the host's jobs, returning
+	// the number of bytes freed.
+	PruneArtifacts(keep []string) (int64, error)
+	// SetDraining registers the host as draining in discoverd, or
+	// unregisters it, so that routers stop or resume sending new
+	// connections to the jobs on it.
+	SetDraining(draining bool) error
 	Attach(req *host.AttachReq, wait bool) (AttachClient, error)
 	Close() error
 }
@@ -50,6 +78,42 @@ func (c *hostClient) StreamEvents(id string, ch chan<- *host.Event) Stream {
 	return rpcStream{c.c.StreamGo("Host.StreamEvents", id, ch)}
 }
 
+func (c *hostClient) StreamEventsSince(id string, since uint64, ch chan<- *host.Event) Stream {
+	return rpcStream{c.c.StreamGo("Host.StreamEventsSince", &host.StreamEventsReq{JobID: id, Since: since}, ch)}
+}
+
+func (c *hostClient) PullProgress(id string, ch chan<- *host.PullProgress) Stream {
+	return rpcStream{c.c.StreamGo("Host.PullProgress", id, ch)}
+}
+
+func (c *hostClient) StreamLogs(ch chan<- *host.LogLine) Stream {
+	return rpcStream{c.c.StreamGo("Host.StreamLogs", struct{}{}, ch)}
+}
+
+func (c *hostClient) JobProcessTree(jobID string) ([]host.Process, error) {
+	var procs []host.Process
+	err := c.c.Call("Host.JobProcessTree", jobID, &procs)
+	return procs, err
+}
+
+func (c *hostClient) SetJobResources(jobID string, r *host.JobResources) error {
+	return c.c.Call("Host.SetJobResources", &host.SetJobResourcesReq{JobID: jobID, Resources: *r}, &struct{}{})
+}
+
+func (c *hostClient) StreamStats(interval time.Duration, ch chan<- *host.HostStats) Stream {
+	return rpcStream{c.c.StreamGo("Host.StreamStats", interval, ch)}
+}
+
+func (c *hostClient) PruneArtifacts(keep []string) (int64, error) {
+	var freed int64
+	err := c.c.Call("Host.PruneArtifacts", keep, &freed)
+	return freed, err
+}
+
+func (c *hostClient) SetDraining(draining bool) error {
+	return c.c.Call("Host.SetDraining", draining, &struct{}{})
+}
+
 func (c *hostClient) Close() error {
 	return c.c.Close()
 }
@@ -0,0 +1,196 @@
+// Package cron parses cron-style schedule specifications and calculates when
+// they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes a recurring set of times.
+type Schedule interface {
+	// Next returns the first time after t that the schedule fires, or the
+	// zero time if it never fires.
+	Next(t time.Time) time.Time
+}
+
+// Parse parses a schedule spec, which is either a descriptor such as "@daily"
+// or "@every 5m", or a list of five (minute, hour, day of month, month, day
+// of week) or six (with a leading second) space separated fields.
+//
+// Each field is a comma separated list of "*", a value, or a range such as
+// "1-5", optionally followed by a step such as "*/15".
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid duration in %q: %s", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("cron: duration in %q must be at least one second", spec)
+		}
+		return every(d), nil
+	}
+	if s, ok := descriptors[spec]; ok {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron: expected 5 or 6 fields in %q, got %d", spec, len(fields))
+	}
+
+	s := &specSchedule{}
+	for i, b := range bounds {
+		bits, err := parseField(fields[i], b)
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid %s field in %q: %s", b.name, spec, err)
+		}
+		*s.field(i) = bits
+	}
+	s.domStar = fields[3] == "*"
+	s.dowStar = fields[5] == "*"
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type bound struct {
+	name     string
+	min, max int
+}
+
+var bounds = []bound{
+	{"second", 0, 59},
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseField(field string, b bound) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		var lo, hi int
+		switch {
+		case part == "*":
+			lo, hi = b.min, b.max
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(r[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", r[0])
+			}
+			if hi, err = strconv.Atoi(r[1]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", r[1])
+			}
+		default:
+			var err error
+			if lo, err = strconv.Atoi(part); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if step > 1 {
+				// "5/10" means every 10 starting at 5
+				hi = b.max
+			}
+		}
+		if lo < b.min || hi > b.max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, b.min, b.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	return t.Truncate(d).Add(d)
+}
+
+type specSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	domStar, dowStar                      bool
+}
+
+func (s *specSchedule) field(i int) *uint64 {
+	return []*uint64{&s.second, &s.minute, &s.hour, &s.dom, &s.month, &s.dow}[i]
+}
+
+// maxYears limits how far ahead Next searches for schedules which can never
+// fire, such as "0 0 30 2 *".
+const maxYears = 5
+
+func (s *specSchedule) Next(t time.Time) time.Time {
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	limit := t.Year() + maxYears
+
+	for t.Year() <= limit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows the cron convention that if both the day of month and
+// day of week are restricted, a day matching either of them fires.
+func (s *specSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
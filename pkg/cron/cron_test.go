@@ -0,0 +1,71 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/pkg/cron"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func mustParseTime(c *C, s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04:05", s)
+	c.Assert(err, IsNil)
+	return t
+}
+
+func (S) TestNext(c *C) {
+	for _, t := range []struct {
+		spec, from, next string
+	}{
+		{"* * * * *", "2014-10-16 09:15:30", "2014-10-16 09:16:00"},
+		{"*/5 * * * * *", "2014-10-16 09:15:31", "2014-10-16 09:15:35"},
+		{"30 2 * * *", "2014-10-16 09:15:00", "2014-10-17 02:30:00"},
+		{"0 0 1 */3 *", "2014-10-16 09:15:00", "2015-01-01 00:00:00"},
+		{"0 9 * * 1-5", "2014-10-17 09:15:00", "2014-10-20 09:00:00"},
+		{"0 0 * * 7", "2014-10-16 09:15:00", "2014-10-19 00:00:00"},
+		{"0 0 13 * 5", "2014-10-16 09:15:00", "2014-10-17 00:00:00"},
+		{"0 0 29 2 *", "2014-10-16 09:15:00", "2016-02-29 00:00:00"},
+		{"0,30 12 * * *", "2014-10-16 12:00:00", "2014-10-16 12:30:00"},
+		{"@daily", "2014-10-16 09:15:00", "2014-10-17 00:00:00"},
+		{"@every 10s", "2014-10-16 09:15:01", "2014-10-16 09:15:10"},
+	} {
+		s, err := cron.Parse(t.spec)
+		c.Assert(err, IsNil, Commentf("spec: %s", t.spec))
+		c.Assert(s.Next(mustParseTime(c, t.from)), Equals, mustParseTime(c, t.next), Commentf("spec: %s", t.spec))
+	}
+}
+
+func (S) TestNeverFires(c *C) {
+	s, err := cron.Parse("0 0 30 2 *")
+	c.Assert(err, IsNil)
+	c.Assert(s.Next(time.Now()).IsZero(), Equals, true)
+}
+
+func (S) TestParseErrors(c *C) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every",
+		"@every 10ms",
+		"@sometimes",
+	} {
+		_, err := cron.Parse(spec)
+		c.Assert(err, NotNil, Commentf("spec: %q", spec))
+	}
+}
@@ -106,7 +106,11 @@ func main() {
 			if proc.Env == nil {
 				proc.Env = make(map[string]string)
 			}
-			proc.Env["SD_NAME"] = app.Name + "-web"
+			// keep the service of the previous release, which a
+			// blue/green deploy may have switched the app's routes to
+			if proc.Env["SD_NAME"] == "" {
+				proc.Env["SD_NAME"] = app.Name + "-web"
+			}
 		}
 		procs[t] = proc
 	}
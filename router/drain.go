@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// NewDrainingDiscoverdClient wraps dc so that the service sets it creates
+// exclude the addresses of backends on hosts which are registered as draining,
+// so that they stop receiving new connections before their jobs are stopped.
+func NewDrainingDiscoverdClient(dc DiscoverdClient) DiscoverdClient {
+	return &drainingDiscoverdClient{DiscoverdClient: dc}
+}
+
+type drainingDiscoverdClient struct {
+	DiscoverdClient
+
+	mtx      sync.Mutex
+	draining discoverd.ServiceSet
+}
+
+func (d *drainingDiscoverdClient) NewServiceSet(name string) (discoverd.ServiceSet, error) {
+	ss, err := d.DiscoverdClient.NewServiceSet(name)
+	if err != nil {
+		return nil, err
+	}
+	draining, err := d.drainingSet()
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+	return &drainingServiceSet{ServiceSet: ss, draining: draining}, nil
+}
+
+// drainingSet returns the set of draining hosts, which is shared by all of the
+// service sets.
+func (d *drainingDiscoverdClient) drainingSet() (discoverd.ServiceSet, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.draining == nil {
+		ss, err := d.DiscoverdClient.NewServiceSet(discoverd.DrainingService)
+		if err != nil {
+			return nil, err
+		}
+		d.draining = ss
+	}
+	return d.draining, nil
+}
+
+type drainingServiceSet struct {
+	discoverd.ServiceSet
+	draining discoverd.ServiceSet
+}
+
+// Addrs returns the addresses of the services which are not on draining
+// hosts. If every service is on a draining host, all of the addresses are
+// returned, as sending connections to a draining host is better than dropping
+// them.
+func (s *drainingServiceSet) Addrs() []string {
+	addrs := s.ServiceSet.Addrs()
+	hosts := s.draining.Services()
+	if len(hosts) == 0 {
+		return addrs
+	}
+	draining := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		draining[h.Host] = struct{}{}
+	}
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		if _, ok := draining[host]; !ok {
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 {
+		return addrs
+	}
+	return res
+}
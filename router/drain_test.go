@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+func tcpConnPrefix(c *C, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	conn.(*net.TCPConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	conn.Close()
+	c.Assert(err, IsNil)
+	return string(res)
+}
+
+func (s *S) TestDrainingTCPBackend(c *C) {
+	const addr, port = "127.0.0.1:45000", 45000
+	srv1 := NewTCPTestServer("1")
+	srv2 := newTCPTestServerOnIP("127.0.0.2", "2")
+	defer srv1.Close()
+	defer srv2.Close()
+
+	dc, etcd, cleanup := setup(c, nil, nil)
+	l := &tcpListener{
+		NewTCPListener("127.0.0.1", firstTCPPort, lastTCPPort, NewEtcdDataStore(etcd, "/router/tcp/"), NewDrainingDiscoverdClient(dc)),
+		cleanup,
+	}
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addTCPRoute(c, l, port)
+	ss := l.services[port].ss
+	discoverdRegister(c, dc, ss, "test", srv1.Addr)
+	discoverdRegister(c, dc, ss, "test", srv2.Addr)
+	defer dc.UnregisterAll()
+
+	// Check both backends receive connections
+	seen := make(map[string]bool)
+	for i := 0; i < 50 && len(seen) < 2; i++ {
+		seen[tcpConnPrefix(c, addr)] = true
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	// Drain the host of the second backend and check it doesn't receive any
+	// new connections
+	draining := ss.(*drainingServiceSet).draining
+	discoverdRegister(c, dc, draining, discoverd.DrainingService, "127.0.0.2:1113")
+	for i := 0; i < 50; i++ {
+		c.Assert(tcpConnPrefix(c, addr), Equals, "1")
+	}
+
+	// Check the draining backend is used if it is the only one left
+	discoverdUnregister(c, dc, "test", srv1.Addr)
+	c.Assert(tcpConnPrefix(c, addr), Equals, "2")
+}
@@ -161,6 +161,8 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		TLSCert: route.TLSCert,
 		TLSKey:  route.TLSKey,
 		Sticky:  route.Sticky,
+
+		MaintenancePage: route.MaintenancePage,
 	}
 
 	if r.TLSCert != "" && r.TLSKey != "" {
@@ -282,6 +284,21 @@ func fail(sc *httputil.ServerConn, req *http.Request, code int, msg string) {
 	sc.Write(req, resp)
 }
 
+// maintenance responds with the route's maintenance page while its service
+// has no instances to proxy to.
+func maintenance(sc *httputil.ServerConn, req *http.Request, page string) {
+	resp := &http.Response{
+		StatusCode:    503,
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(page)),
+		ContentLength: int64(len(page)),
+	}
+	sc.Write(req, resp)
+}
+
 func (s *HTTPListener) handle(conn net.Conn, isTLS bool) {
 	defer conn.Close()
 
@@ -333,7 +350,7 @@ func (s *HTTPListener) handle(conn net.Conn, isTLS bool) {
 		}
 
 		req.RemoteAddr = conn.RemoteAddr().String()
-		if r.service.handle(req, sc, isTLS, r.Sticky) {
+		if r.service.handle(req, sc, isTLS, r) {
 			return
 		}
 	}
@@ -348,6 +365,8 @@ type httpRoute struct {
 	TLSKey  string
 	Sticky  bool
 
+	MaintenancePage string
+
 	keypair *tls.Certificate
 	service *httpService
 }
@@ -442,19 +461,23 @@ func (s *httpService) getBackendSticky(req *http.Request) (*httputil.ClientConn,
 	return httputil.NewClientConn(backend, nil), nil
 }
 
-func (s *httpService) handle(req *http.Request, sc *httputil.ServerConn, tls, sticky bool) (done bool) {
+func (s *httpService) handle(req *http.Request, sc *httputil.ServerConn, tls bool, r *httpRoute) (done bool) {
 	req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
 	req.Header.Set("X-Request-Id", random.UUID())
 
 	var backend *httputil.ClientConn
 	var stickyCookie *http.Cookie
-	if sticky {
+	if r.Sticky {
 		backend, stickyCookie = s.getBackendSticky(req)
 	} else {
 		backend = s.getBackend()
 	}
 	if backend == nil {
 		log.Println("no backend found")
+		if r.MaintenancePage != "" {
+			maintenance(sc, req, r.MaintenancePage)
+			return
+		}
 		fail(sc, req, 503, "Service Unavailable")
 		return
 	}
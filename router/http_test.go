@@ -145,6 +145,42 @@ func (s *S) TestAddHTTPRoute(c *C) {
 	res.Body.Close()
 }
 
+func (s *S) TestHTTPMaintenancePage(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, discoverd := newHTTPListener(c)
+	defer l.Close()
+
+	page := "<h1>Down for maintenance</h1>"
+	addRoute(c, l, (&router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		MaintenancePage: page,
+	}).ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	defer discoverd.UnregisterAll()
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	// scaling the service to zero serves the maintenance page
+	discoverdUnregister(c, discoverd, "test", srv.Listener.Addr().String())
+	httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(string(data), Equals, page)
+
+	// proxying resumes once the service has instances again
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+}
+
 func newReq(url, host string) *http.Request {
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Host = host
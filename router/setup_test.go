@@ -355,6 +355,8 @@ func (s *fakeServiceSet) Watch(bringCurrent bool) chan *agent.ServiceUpdate { re
 
 func (s *fakeServiceSet) Unwatch(chan *agent.ServiceUpdate) {}
 
+func (s *fakeServiceSet) Resync() error { return nil }
+
 func (s *fakeServiceSet) Close() error { return nil }
 
 // Hook gocheck up to the "go test" runner
@@ -12,9 +12,13 @@ import (
 )
 
 func NewTCPTestServer(prefix string) *TCPTestServer {
+	return newTCPTestServerOnIP("127.0.0.1", prefix)
+}
+
+func newTCPTestServerOnIP(ip, prefix string) *TCPTestServer {
 	s := &TCPTestServer{prefix: prefix}
 	var err error
-	s.l, err = net.Listen("tcp", "127.0.0.1:0")
+	s.l, err = net.Listen("tcp", ip+":0")
 	if err != nil {
 		panic(err)
 	}
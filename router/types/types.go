@@ -51,6 +51,10 @@ type HTTPRoute struct {
 	TLSCert string `json:"tls_cert,omitempty"`
 	TLSKey  string `json:"tls_key,omitempty"`
 	Sticky  bool   `json:"sticky,omitempty"`
+
+	// MaintenancePage is the HTML page served with a 503 status while the
+	// service has no instances, such as when it has been scaled to zero.
+	MaintenancePage string `json:"maintenance_page,omitempty"`
 }
 
 func (r *HTTPRoute) ToRoute() *Route {
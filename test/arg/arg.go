@@ -2,6 +2,7 @@ package arg
 
 import (
 	"flag"
+	"time"
 
 	"github.com/flynn/flynn/test/cluster"
 )
@@ -23,6 +24,8 @@ type Args struct {
 	TLSKey     string
 	AssetsDir  string
 	Run        string
+
+	ConvergenceBound time.Duration
 }
 
 func Parse() *Args {
@@ -43,6 +46,7 @@ func Parse() *Args {
 	flag.StringVar(&args.TLSKey, "tls-key", "", "TLS key")
 	flag.StringVar(&args.AssetsDir, "assets", "runner/assets", "path to the runner assets dir")
 	flag.StringVar(&args.Run, "run", "", "regular expression selecting which tests and/or suites to run")
+	flag.DurationVar(&args.ConvergenceBound, "convergence-bound", 30*time.Second, "the longest the scheduler may take to converge a formation")
 	flag.BoolVar(&args.Build, "build", true, "build Flynn")
 	flag.BoolVar(&args.Debug, "debug", false, "enable debug output")
 	flag.BoolVar(&args.Kill, "kill", true, "kill the cluster after running the tests")
@@ -192,7 +192,7 @@ func (c *Cluster) CLIConfig() (*config.Config, error) {
 func (c *Cluster) Shutdown() {
 	for i, inst := range c.instances {
 		c.log("killing instance", i)
-		if err := inst.Kill(); err != nil {
+		if err := inst.KillAndWait(); err != nil {
 			c.logf("error killing instance %d: %s\n", i, err)
 		}
 	}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -20,12 +22,15 @@ import (
 )
 
 func NewVMManager(bridge *Bridge) *VMManager {
-	return &VMManager{taps: &TapManager{bridge}}
+	return &VMManager{taps: &TapManager{bridge: bridge}}
 }
 
 type VMManager struct {
 	taps   *TapManager
 	nextID uint64
+
+	// userNet is set once an instance using NetworkUser has been created
+	userNet int32
 }
 
 type VMConfig struct {
@@ -38,9 +43,37 @@ type VMConfig struct {
 	Args   []string
 	Out    io.Writer
 
+	// Network is how the VM is networked, it defaults to NetworkTap.
+	Network NetworkMode
+
+	// HostFwd are guest TCP ports which are forwarded to ports on the
+	// host's loopback interface when using NetworkUser, in addition to ssh.
+	HostFwd []int
+
 	netFS string
 }
 
+// NetworkMode is a qemu networking model.
+type NetworkMode string
+
+const (
+	// NetworkTap connects the VM to the bridge using a tap device, so that
+	// it is reachable at its own IP by the host and other VMs.
+	NetworkTap NetworkMode = "tap"
+
+	// NetworkUser uses qemu's user-mode networking, which needs neither a
+	// bridge nor elevated privileges. The VM is only reachable through
+	// ports forwarded to the host's loopback interface, see HostFwd, so it
+	// can't reach or be reached by other VMs and must be the only VM of its
+	// VMManager.
+	NetworkUser NetworkMode = "user"
+)
+
+// ErrUserNetworkMultiVM is returned by NewInstance when a VM using
+// NetworkUser would not be the only VM of the VMManager, as such a VM can't
+// be part of a multi-host cluster.
+var ErrUserNetworkMultiVM = errors.New("cluster: a VM using user-mode networking must be the only VM")
+
 type VMDrive struct {
 	FS   string
 	COW  bool
@@ -48,6 +81,12 @@ type VMDrive struct {
 }
 
 func (v *VMManager) NewInstance(c *VMConfig) (Instance, error) {
+	if atomic.LoadInt32(&v.userNet) == 1 || c.Network == NetworkUser && atomic.LoadUint64(&v.nextID) > 0 {
+		return nil, ErrUserNetworkMultiVM
+	}
+	if c.Network == NetworkUser {
+		atomic.StoreInt32(&v.userNet, 1)
+	}
 	id := atomic.AddUint64(&v.nextID, 1) - 1
 	inst := &vm{
 		ID:       fmt.Sprintf("flynn%d", id),
@@ -63,18 +102,41 @@ func (v *VMManager) NewInstance(c *VMConfig) (Instance, error) {
 			return nil, err
 		}
 	}
+	if c.Network == NetworkUser {
+		inst.forwards = make(map[int]int, len(c.HostFwd)+1)
+		for _, port := range append([]int{22}, c.HostFwd...) {
+			hostPort, err := freePort()
+			if err != nil {
+				return nil, err
+			}
+			inst.forwards[port] = hostPort
+		}
+		return inst, nil
+	}
 	var err error
 	inst.tap, err = v.taps.NewTap(c.User, c.Group)
 	return inst, err
 }
 
+// freePort returns a free TCP port on the host's loopback interface.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
 type Instance interface {
 	DialSSH() (*ssh.Client, error)
 	Start() error
 	Wait(time.Duration) error
 	Shutdown() error
 	Kill() error
+	KillAndWait() error
 	IP() string
+	ForwardedAddr(int) string
 	Run(string, *Streams) error
 	Drive(string) *VMDrive
 }
@@ -85,6 +147,9 @@ type vm struct {
 	tap *Tap
 	cmd *exec.Cmd
 
+	// forwards maps guest ports to host ports when using NetworkUser
+	forwards map[int]int
+
 	tempFiles []string
 }
 
@@ -108,19 +173,56 @@ func (v *vm) writeInterfaceConfig() error {
 	}
 	defer f.Close()
 
+	if v.Network == NetworkUser {
+		// qemu's user-mode network stack serves DHCP
+		_, err := io.WriteString(f, "auto eth0\niface eth0 inet dhcp\n")
+		return err
+	}
 	return v.tap.WriteInterfaceConfig(f)
 }
 
-func (v *vm) cleanup() {
+// Allow mocking os.RemoveAll in tests
+var removeAll = os.RemoveAll
+
+// cleanupError aggregates the failures encountered while releasing the
+// resources held by a vm.
+type cleanupError []error
+
+func (e cleanupError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "cleanup failed: " + strings.Join(msgs, "; ")
+}
+
+// cleanup removes temp files and closes the tap device, returning a
+// cleanupError if any resource could not be released.
+func (v *vm) cleanup() error {
+	var errs cleanupError
 	for _, f := range v.tempFiles {
-		if err := os.RemoveAll(f); err != nil {
-			fmt.Printf("could not remove temp file %s: %s\n", f, err)
+		if err := removeAll(f); err != nil {
+			errs = append(errs, fmt.Errorf("could not remove temp file %s: %s", f, err))
 		}
 	}
-	if err := v.tap.Close(); err != nil {
-		fmt.Printf("could not close tap device %s: %s\n", v.tap.Name, err)
-	}
 	v.tempFiles = nil
+	if v.tap != nil {
+		if err := v.tap.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("could not close tap device %s: %s", v.tap.Name, err))
+		} else {
+			v.tap = nil
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (v *vm) printCleanup() {
+	if err := v.cleanup(); err != nil {
+		fmt.Println(err)
+	}
 }
 
 func (v *vm) Start() error {
@@ -134,7 +236,7 @@ func (v *vm) Start() error {
 		"-kernel", v.Kernel,
 		"-append", `"root=/dev/sda"`,
 		"-net", "nic,macaddr="+macaddr,
-		"-net", "tap,ifname="+v.tap.Name+",script=no,downscript=no",
+		"-net", v.netBackend(),
 		"-virtfs", "fsdriver=local,path="+v.netFS+",security_model=passthrough,readonly,mount_tag=netfs",
 		"-nographic",
 	)
@@ -149,7 +251,7 @@ func (v *vm) Start() error {
 		if d.COW {
 			fs, err := v.createCOW(d.FS, d.Temp)
 			if err != nil {
-				v.cleanup()
+				v.printCleanup()
 				return err
 			}
 			d.FS = fs
@@ -161,11 +263,29 @@ func (v *vm) Start() error {
 	v.cmd.Stdout = v.Out
 	v.cmd.Stderr = v.Out
 	if err = v.cmd.Start(); err != nil {
-		v.cleanup()
+		v.printCleanup()
 	}
 	return err
 }
 
+// netBackend returns the qemu -net option connecting the VM's NIC to the
+// host.
+func (v *vm) netBackend() string {
+	if v.Network != NetworkUser {
+		return "tap,ifname=" + v.tap.Name + ",script=no,downscript=no"
+	}
+	guestPorts := make([]int, 0, len(v.forwards))
+	for port := range v.forwards {
+		guestPorts = append(guestPorts, port)
+	}
+	sort.Ints(guestPorts)
+	opt := "user"
+	for _, port := range guestPorts {
+		opt += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:%d", v.forwards[port], port)
+	}
+	return opt
+}
+
 func (v *vm) createCOW(image string, temp bool) (string, error) {
 	name := strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
 	dir, err := ioutil.TempDir("", name+"-")
@@ -209,12 +329,12 @@ func (v *vm) Shutdown() error {
 	if err := v.Wait(5 * time.Second); err != nil {
 		return v.Kill()
 	}
-	v.cleanup()
+	v.printCleanup()
 	return nil
 }
 
 func (v *vm) Kill() error {
-	defer v.cleanup()
+	defer v.printCleanup()
 	if err := v.cmd.Process.Signal(syscall.SIGTERM); err != nil {
 		return err
 	}
@@ -224,17 +344,89 @@ func (v *vm) Kill() error {
 	return nil
 }
 
+// KillAndWait kills the vm, waits for the process to exit and then releases
+// its resources. Unlike Kill, it returns an error if any temp file or the tap
+// device could not be cleaned up, so callers can assert nothing leaked.
+func (v *vm) KillAndWait() error {
+	done := make(chan error, 1)
+	go func() {
+		done <- v.cmd.Wait()
+	}()
+
+	var errs cleanupError
+	if err := v.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		errs = append(errs, fmt.Errorf("could not signal vm %s: %s", v.ID, err))
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		if err := v.cmd.Process.Kill(); err != nil {
+			errs = append(errs, fmt.Errorf("could not kill vm %s: %s", v.ID, err))
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			errs = append(errs, fmt.Errorf("timed out waiting for vm %s to exit", v.ID))
+		}
+	}
+
+	if err := v.cleanup(); err != nil {
+		errs = append(errs, err.(cleanupError)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// sshDialTimeout limits how long a connection attempt can take, so that a tap
+// which goes down while dialing is noticed by the next attempt.
+const sshDialTimeout = 10 * time.Second
+
+// DialSSH connects to the VM, returning ErrTapDown without dialing if the tap
+// device of the VM is down. VMs using NetworkUser are dialed through the port
+// forwarded to their ssh port.
 func (v *vm) DialSSH() (*ssh.Client, error) {
-	return ssh.Dial("tcp", v.IP()+":22", &ssh.ClientConfig{
+	if v.tap != nil {
+		if err := v.tap.CheckUp(); err != nil {
+			return nil, err
+		}
+	}
+	addr := v.ForwardedAddr(22)
+	conn, err := net.DialTimeout("tcp", addr, sshDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
 		User: "ubuntu",
 		Auth: []ssh.AuthMethod{ssh.Password("ubuntu")},
 	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
+// IP returns the IP of the VM, which is the host's loopback address for VMs
+// using NetworkUser, on which only the ports given by ForwardedAddr reach the
+// VM.
 func (v *vm) IP() string {
+	if v.tap == nil {
+		return "127.0.0.1"
+	}
 	return v.tap.RemoteIP.String()
 }
 
+// ForwardedAddr returns the address on the host which connects to port on the
+// VM, which for VMs using NetworkUser is the port it is forwarded to.
+func (v *vm) ForwardedAddr(port int) string {
+	if hostPort, ok := v.forwards[port]; ok {
+		port = hostPort
+	}
+	return net.JoinHostPort(v.IP(), strconv.Itoa(port))
+}
+
 var sshAttempts = attempt.Strategy{
 	Min:   5,
 	Total: 5 * time.Minute,
@@ -246,13 +438,17 @@ func (v *vm) Run(command string, s *Streams) error {
 		s = &Streams{}
 	}
 	var sc *ssh.Client
-	err := sshAttempts.Run(func() (err error) {
+	var err error
+	for a := sshAttempts.Start(); a.Next(); {
 		if s.Stderr != nil {
-			fmt.Fprintf(s.Stderr, "Attempting to ssh to %s:22...\n", v.IP())
+			fmt.Fprintf(s.Stderr, "Attempting to ssh to %s...\n", v.ForwardedAddr(22))
 		}
 		sc, err = v.DialSSH()
-		return
-	})
+		// retrying is pointless if the tap is down, as the VM is unreachable
+		if err == nil || err == ErrTapDown {
+			break
+		}
+	}
 	if err != nil {
 		return err
 	}
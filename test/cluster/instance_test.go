@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/code.google.com/p/go.crypto/ssh"
+	"github.com/flynn/flynn/pkg/attempt"
+)
+
+func TestKillAndWaitCleanupError(t *testing.T) {
+	good, err := ioutil.TempDir("", "flynn-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(good)
+	bad, err := ioutil.TempDir("", "flynn-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bad)
+
+	removeAll = func(path string) error {
+		if path == bad {
+			return errors.New("device or resource busy")
+		}
+		return os.RemoveAll(path)
+	}
+	defer func() { removeAll = os.RemoveAll }()
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	v := &vm{ID: "flynn-test", cmd: cmd, tempFiles: []string{good, bad}}
+
+	err = v.KillAndWait()
+	if err == nil {
+		t.Fatal("expected KillAndWait to return a cleanup error")
+	}
+	errs, ok := err.(cleanupError)
+	if !ok {
+		t.Fatalf("expected cleanupError, got %T: %s", err, err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %d: %s", len(errs), err)
+	}
+	if !strings.Contains(err.Error(), bad) {
+		t.Errorf("expected error to mention %s, got %q", bad, err)
+	}
+	if _, err := os.Stat(good); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", good)
+	}
+	if cmd.ProcessState == nil {
+		t.Error("expected process to have exited")
+	}
+	if v.tempFiles != nil {
+		t.Error("expected temp files to be cleared")
+	}
+}
+
+func TestKillAndWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	v := &vm{ID: "flynn-test", cmd: cmd, tempFiles: []string{dir}}
+	if err := v.KillAndWait(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", dir)
+	}
+}
+
+func TestRunTapDown(t *testing.T) {
+	// the tap goes down after the first few ssh attempts have failed
+	var mtx sync.Mutex
+	checks := 0
+	tapUp = func(name string) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		checks++
+		return checks <= 3
+	}
+	defer func() { tapUp = linkUp }()
+	defer func(s attempt.Strategy) { sshAttempts = s }(sshAttempts)
+	sshAttempts.Delay = 10 * time.Millisecond
+
+	ip := net.ParseIP("127.0.0.1")
+	v := &vm{ID: "flynn-test", tap: &Tap{Name: "flynntap.test", RemoteIP: &ip}}
+
+	start := time.Now()
+	err := v.Run("true", nil)
+	if err != ErrTapDown {
+		t.Fatalf("expected ErrTapDown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected Run to fail fast, took %s", elapsed)
+	}
+	// no attempts are made after the tap is seen to be down
+	if checks != 4 {
+		t.Errorf("expected 4 link checks, got %d", checks)
+	}
+}
+
+// serveSSH runs an ssh server on addr which accepts any password and
+// succeeds every command, standing in for a VM's forwarded ssh port.
+func serveSSH(t *testing.T, addr string) (commands <-chan string, stop func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChan := range chans {
+				ch, reqs, err := newChan.Accept()
+				if err != nil {
+					continue
+				}
+				for req := range reqs {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					// the payload is the length prefixed command
+					cmds <- string(req.Payload[4:])
+					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					ch.Close()
+				}
+			}
+		}
+	}()
+	return cmds, func() { l.Close() }
+}
+
+func TestUserNetworkSSH(t *testing.T) {
+	// a manager without a bridge can't allocate taps
+	m := NewVMManager(nil)
+	inst, err := m.NewInstance(&VMConfig{Network: NetworkUser, HostFwd: []int{80}, Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := inst.(*vm)
+	if v.tap != nil {
+		t.Fatal("expected no tap device to be allocated")
+	}
+
+	backend := v.netBackend()
+	for _, port := range []int{22, 80} {
+		addr := v.ForwardedAddr(port)
+		if !strings.HasPrefix(addr, "127.0.0.1:") || addr == "127.0.0.1:22" || addr == "127.0.0.1:80" {
+			t.Fatalf("expected guest port %d to be forwarded to a free loopback port, got %s", port, addr)
+		}
+		if fwd := "hostfwd=tcp:" + addr + "-:"; !strings.Contains(backend, fwd) {
+			t.Errorf("expected %q to contain %q", backend, fwd)
+		}
+	}
+	if !strings.HasPrefix(backend, "user,") {
+		t.Errorf("expected user-mode networking, got %q", backend)
+	}
+
+	// ssh connects through the forwarded port
+	commands, stop := serveSSH(t, v.ForwardedAddr(22))
+	defer stop()
+	if err := v.Run("uptime", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cmd := <-commands:
+		if cmd != "uptime" {
+			t.Errorf("expected uptime to be run, got %q", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for command")
+	}
+}
+
+func TestUserNetworkSingleVM(t *testing.T) {
+	// a VM using user-mode networking can't be booted alongside others, as
+	// they can't reach each other
+	m := NewVMManager(nil)
+	if _, err := m.NewInstance(&VMConfig{Network: NetworkUser, Out: ioutil.Discard}); err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []NetworkMode{NetworkUser, NetworkTap} {
+		if _, err := m.NewInstance(&VMConfig{Network: network, Out: ioutil.Discard}); err != ErrUserNetworkMultiVM {
+			t.Errorf("expected ErrUserNetworkMultiVM creating a %s VM, got %v", network, err)
+		}
+	}
+
+	// nor alongside a VM which was created before it
+	m = NewVMManager(nil)
+	m.nextID = 1
+	if _, err := m.NewInstance(&VMConfig{Network: NetworkUser, Out: ioutil.Discard}); err != ErrUserNetworkMultiVM {
+		t.Errorf("expected ErrUserNetworkMultiVM, got %v", err)
+	}
+}
@@ -1,16 +1,18 @@
 package cluster
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 	"unsafe"
 
-	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/networkdriver/ipallocator"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
 	"github.com/flynn/flynn/pkg/iptables"
 	"github.com/flynn/flynn/pkg/random"
@@ -163,19 +165,51 @@ type Tap struct {
 	Name              string
 	LocalIP, RemoteIP *net.IP
 	bridge            *Bridge
+	manager           *TapManager
 }
 
-func (t *Tap) Close() error {
-	if err := deleteTap(t.Name); err != nil {
-		return err
+// ErrTapDown is returned when connecting to a VM whose tap device is down, as
+// the VM can't be reached until the device is brought back up.
+var ErrTapDown = errors.New("cluster: network unreachable: tap down")
+
+// Allow mocking the link state of tap devices in tests
+var tapUp = linkUp
+
+// linkUp returns whether the named network interface exists and is up, a
+// device which has been removed is treated as down.
+func linkUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
 	}
+	return iface.Flags&net.FlagUp != 0
+}
+
+// CheckUp returns ErrTapDown if the tap device is down.
+func (t *Tap) CheckUp() error {
+	if !tapUp(t.Name) {
+		return ErrTapDown
+	}
+	return nil
+}
+
+// Close deletes the tap device and returns its IPs to the manager. The IPs
+// are released even if the device cannot be deleted, as they are no longer
+// used by a VM.
+func (t *Tap) Close() error {
+	t.releaseIPs()
+	return deleteTap(t.Name)
+}
+
+func (t *Tap) releaseIPs() {
 	if t.LocalIP != nil {
-		ipallocator.ReleaseIP(t.bridge.ipNet, t.LocalIP)
+		t.manager.releaseIP(*t.LocalIP)
+		t.LocalIP = nil
 	}
 	if t.RemoteIP != nil {
-		ipallocator.ReleaseIP(t.bridge.ipNet, t.RemoteIP)
+		t.manager.releaseIP(*t.RemoteIP)
+		t.RemoteIP = nil
 	}
-	return nil
 }
 
 var ifaceConfig = template.Must(template.New("eth0").Parse(`
@@ -194,26 +228,27 @@ func (t *Tap) WriteInterfaceConfig(f io.Writer) error {
 	})
 }
 
+// ErrSubnetExhausted is returned by NewTap when every IP in the bridge subnet
+// is allocated to a tap.
+var ErrSubnetExhausted = errors.New("cluster: bridge subnet exhausted, no free IPs for tap")
+
+// TapManager creates the tap devices of VMs, allocating their IPs from the
+// bridge subnet.
 type TapManager struct {
 	bridge *Bridge
+
+	mtx       sync.Mutex
+	allocated map[uint32]struct{}
 }
 
 func (t *TapManager) NewTap(uid, gid int) (*Tap, error) {
-	tap := &Tap{Name: "flynntap." + random.String(5), bridge: t.bridge}
+	tap := &Tap{Name: "flynntap." + random.String(5), bridge: t.bridge, manager: t}
 
 	if err := createTap(tap.Name, uid, gid); err != nil {
 		return nil, err
 	}
 
-	var err error
-	tap.LocalIP, err = ipallocator.RequestIP(t.bridge.ipNet, nil)
-	if err != nil {
-		tap.Close()
-		return nil, err
-	}
-
-	tap.RemoteIP, err = ipallocator.RequestIP(t.bridge.ipNet, nil)
-	if err != nil {
+	if err := t.requestIPs(tap); err != nil {
 		tap.Close()
 		return nil, err
 	}
@@ -238,3 +273,79 @@ func (t *TapManager) NewTap(uid, gid int) (*Tap, error) {
 
 	return tap, nil
 }
+
+// requestIPs allocates the local and remote IPs of tap.
+func (t *TapManager) requestIPs(tap *Tap) error {
+	local, err := t.requestIP()
+	if err != nil {
+		return err
+	}
+	tap.LocalIP = &local
+	remote, err := t.requestIP()
+	if err != nil {
+		tap.releaseIPs()
+		return err
+	}
+	tap.RemoteIP = &remote
+	return nil
+}
+
+// requestIP allocates the lowest free IP in the bridge subnet, excluding the
+// network, broadcast and bridge addresses.
+func (t *TapManager) requestIP() (net.IP, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.allocated == nil {
+		t.allocated = make(map[uint32]struct{})
+	}
+	first, last := t.hostRange()
+	bridge := ipToUint(t.bridge.ipAddr)
+	for n := first; n <= last; n++ {
+		if _, ok := t.allocated[n]; ok || n == bridge {
+			continue
+		}
+		t.allocated[n] = struct{}{}
+		return uintToIP(n), nil
+	}
+	return nil, ErrSubnetExhausted
+}
+
+func (t *TapManager) releaseIP(ip net.IP) {
+	t.mtx.Lock()
+	delete(t.allocated, ipToUint(ip))
+	t.mtx.Unlock()
+}
+
+// UsedIPs returns the number of IPs allocated to taps.
+func (t *TapManager) UsedIPs() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return len(t.allocated)
+}
+
+// FreeIPs returns the number of IPs which can still be allocated to taps.
+func (t *TapManager) FreeIPs() int {
+	first, last := t.hostRange()
+	return int(last-first+1) - 1 - t.UsedIPs() // the bridge IP is never free
+}
+
+// hostRange returns the first and last host addresses of the bridge subnet.
+func (t *TapManager) hostRange() (first, last uint32) {
+	mask := t.bridge.ipNet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	network := ipToUint(t.bridge.ipNet.IP) & binary.BigEndian.Uint32(mask)
+	broadcast := network | ^binary.BigEndian.Uint32(mask)
+	return network + 1, broadcast - 1
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
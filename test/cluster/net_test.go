@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTapManagerIPReuse(t *testing.T) {
+	ipAddr, ipNet, err := net.ParseCIDR("10.52.0.1/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a /29 has 6 host addresses, one of which is the bridge
+	m := &TapManager{bridge: &Bridge{ipAddr: ipAddr, ipNet: ipNet}}
+	if free := m.FreeIPs(); free != 5 {
+		t.Fatalf("expected 5 free IPs, got %d", free)
+	}
+
+	// allocating and freeing many more taps than fit in the subnet reuses
+	// the released IPs
+	for i := 0; i < 20; i++ {
+		tap := &Tap{manager: m}
+		if err := m.requestIPs(tap); err != nil {
+			t.Fatalf("iteration %d: unexpected error: %s", i, err)
+		}
+		for _, ip := range []*net.IP{tap.LocalIP, tap.RemoteIP} {
+			if !ipNet.Contains(*ip) || ip.Equal(ipAddr) || ip.Equal(ipNet.IP) {
+				t.Fatalf("iteration %d: unexpected IP %s", i, ip)
+			}
+		}
+		if tap.LocalIP.Equal(*tap.RemoteIP) {
+			t.Fatalf("iteration %d: local and remote IPs are both %s", i, tap.LocalIP)
+		}
+		if used := m.UsedIPs(); used != 2 {
+			t.Fatalf("iteration %d: expected 2 used IPs, got %d", i, used)
+		}
+		tap.releaseIPs()
+		if used := m.UsedIPs(); used != 0 {
+			t.Fatalf("iteration %d: expected IPs to be released, got %d used", i, used)
+		}
+	}
+
+	// two taps use 4 IPs, leaving 1 which is not enough for a third
+	taps := []*Tap{{manager: m}, {manager: m}}
+	for _, tap := range taps {
+		if err := m.requestIPs(tap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.requestIPs(&Tap{manager: m}); err != ErrSubnetExhausted {
+		t.Fatalf("expected ErrSubnetExhausted, got %v", err)
+	}
+	if used, free := m.UsedIPs(), m.FreeIPs(); used != 4 || free != 1 {
+		t.Fatalf("expected the failed request to release its IP, got %d used and %d free", used, free)
+	}
+
+	// once a tap is released, its IPs can be allocated again
+	taps[0].releaseIPs()
+	tap := &Tap{manager: m}
+	if err := m.requestIPs(tap); err != nil {
+		t.Fatalf("expected released IPs to be reused, got %s", err)
+	}
+	if free := m.FreeIPs(); free != 1 {
+		t.Fatalf("expected 1 free IP, got %d", free)
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	c "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
 	"github.com/flynn/flynn/cli/config"
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
 )
 
 type SchedulerSuite struct {
@@ -58,6 +62,33 @@ func waitForJobEvents(t *c.C, events chan *ct.JobEvent, diff map[string]int) err
 	}
 }
 
+// waitForConvergence waits for the scheduler to report that the formation
+// has converged to the given processes, returning the time it took to do so
+// and failing if it took longer than bound. The duration is measured by the
+// scheduler so is not affected by clock skew between it and the test.
+func waitForConvergence(t *c.C, client *controller.Client, appID, releaseID string, procs map[string]int, bound time.Duration) time.Duration {
+	timeout := time.After(bound + 5*time.Second)
+	for {
+		metrics, err := client.SchedulerMetrics()
+		t.Assert(err, c.IsNil)
+		for _, f := range metrics.Formations {
+			if f.AppID != appID || f.ReleaseID != releaseID {
+				continue
+			}
+			if processesEqual(procs, f.Processes) && processesEqual(f.Processes, procs) {
+				t.Assert(f.Duration > 0, c.Equals, true)
+				t.Assert(f.Duration < bound, c.Equals, true, c.Commentf("took %s to converge", f.Duration))
+				return f.Duration
+			}
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for the formation to converge to %v", procs)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 var busyboxID = "184af8860f22e7a87f1416bb12a32b20d0d2c142f719653d87809a6122b04663"
 
 func (s *SchedulerSuite) TestScale(t *c.C) {
@@ -112,3 +143,91 @@ func (s *SchedulerSuite) TestScale(t *c.C) {
 		current = procs
 	}
 }
+
+func (s *SchedulerSuite) TestConvergence(t *c.C) {
+	app := &ct.App{}
+	t.Assert(s.client.CreateApp(app), c.IsNil)
+
+	artifact := &ct.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/flynn/busybox?id=" + busyboxID}
+	t.Assert(s.client.CreateArtifact(artifact), c.IsNil)
+
+	release := &ct.Release{
+		ArtifactID: artifact.ID,
+		Processes: map[string]ct.ProcessType{
+			"echoer": {Cmd: []string{"sh", "-c", "while true; do echo echoer; sleep 1; done"}},
+		},
+	}
+	t.Assert(s.client.CreateRelease(release), c.IsNil)
+	t.Assert(s.client.SetAppRelease(app.ID, release.ID), c.IsNil)
+
+	procs := map[string]int{"echoer": 5}
+	formation := &ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: procs,
+	}
+	t.Assert(s.client.PutFormation(formation), c.IsNil)
+
+	d := waitForConvergence(t, s.client, app.ID, release.ID, procs, args.ConvergenceBound)
+	t.Logf("scaled echoer to 5 in %s", d)
+}
+
+func (s *SchedulerSuite) TestRunJobLike(t *c.C) {
+	app := &ct.App{}
+	t.Assert(s.client.CreateApp(app), c.IsNil)
+
+	artifact := &ct.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/flynn/busybox?id=" + busyboxID}
+	t.Assert(s.client.CreateArtifact(artifact), c.IsNil)
+
+	release := &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"ECHOER_FOO": "foo", "ECHOER_BAR": "bar"},
+		Processes: map[string]ct.ProcessType{
+			"echoer": {Cmd: []string{"sh", "-c", "while true; do echo echoer; sleep 1; done"}},
+		},
+	}
+	t.Assert(s.client.CreateRelease(release), c.IsNil)
+	t.Assert(s.client.SetAppRelease(app.ID, release.ID), c.IsNil)
+
+	stream, err := s.client.StreamJobEvents(app.ID)
+	t.Assert(err, c.IsNil)
+	defer stream.Close()
+
+	formation := &ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"echoer": 1},
+	}
+	t.Assert(s.client.PutFormation(formation), c.IsNil)
+
+	var jobID string
+	for jobID == "" {
+		select {
+		case event := <-stream.Events:
+			if event.Type == "echoer" && event.State == "up" {
+				jobID = event.JobID
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("timed out waiting for the echoer job to start")
+		}
+	}
+
+	rwc, err := s.client.RunJobLike(app.ID, jobID, &ct.NewJob{Cmd: []string{"sh", "-c", "env"}})
+	t.Assert(err, c.IsNil)
+	defer rwc.Close()
+	rwc.CloseWrite()
+	stdout := &bytes.Buffer{}
+	status, err := cluster.NewAttachClient(rwc).Receive(stdout, ioutil.Discard)
+	t.Assert(err, c.IsNil)
+	t.Assert(status, c.Equals, 0)
+
+	env := make(map[string]string)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	for k, v := range release.Env {
+		t.Assert(env[k], c.Equals, v)
+	}
+}